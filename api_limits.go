@@ -0,0 +1,225 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"math"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// API requests are limited with token buckets per client IP and per
+// workspace, runs and force imports have a tighter limit of their own.
+// Rate of 0 disables the limit. Client IP is the address of the connection
+// unless it comes from a trusted proxy, see clientIP.
+
+const maxRequestLimiterBuckets = 10000
+
+var (
+	errTooManyRequests = errors.New("Too many requests, try again later")
+	errBodyTooLarge    = errors.New("Request body is too large")
+
+	ipRequestLimiter        = newRequestLimiter(rateLimit{})
+	workspaceRequestLimiter = newRequestLimiter(rateLimit{})
+	expensiveRequestLimiter = newRequestLimiter(rateLimit{})
+
+	// trustedProxyNets are networks of proxies in front of pipes,
+	// X-Forwarded-For of other clients is ignored
+	trustedProxyNets []*net.IPNet
+)
+
+type requestLimiter struct {
+	mu        sync.Mutex
+	limit     rateLimit
+	buckets   map[string]*TokenBucket
+	overflow  *TokenBucket // shared by keys that don't fit into buckets
+	evictedAt time.Time
+}
+
+func newRequestLimiter(limit rateLimit) *requestLimiter {
+	return &requestLimiter{limit: limit, buckets: make(map[string]*TokenBucket)}
+}
+
+// initRequestLimiters sets up API rate limits and trusted proxies from flags
+func initRequestLimiters() error {
+	nets, err := parseTrustedProxies(trustedProxies)
+	if err != nil {
+		return err
+	}
+	trustedProxyNets = nets
+	ipRequestLimiter = newRequestLimiter(rateLimit{rate: apiIPRateLimit, burst: apiIPRateBurst})
+	workspaceRequestLimiter = newRequestLimiter(rateLimit{rate: apiRateLimit, burst: apiRateBurst})
+	expensiveRequestLimiter = newRequestLimiter(rateLimit{rate: apiExpensiveRateLimit, burst: apiExpensiveRateBurst})
+	return nil
+}
+
+// parseTrustedProxies parses comma separated IPs and CIDR ranges
+func parseTrustedProxies(s string) ([]*net.IPNet, error) {
+	var nets []*net.IPNet
+	for _, value := range strings.Split(s, ",") {
+		value = strings.TrimSpace(value)
+		if value == "" {
+			continue
+		}
+		if !strings.Contains(value, "/") {
+			ip := net.ParseIP(value)
+			if ip == nil {
+				return nil, fmt.Errorf("invalid trusted proxy %q", value)
+			}
+			bits := 8 * net.IPv6len
+			if ip.To4() != nil {
+				ip, bits = ip.To4(), 8*net.IPv4len
+			}
+			nets = append(nets, &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)})
+			continue
+		}
+		_, ipNet, err := net.ParseCIDR(value)
+		if err != nil {
+			return nil, fmt.Errorf("invalid trusted proxy %q", value)
+		}
+		nets = append(nets, ipNet)
+	}
+	return nets, nil
+}
+
+// allow takes a token of key, if the request is rejected it returns
+// how long the client should wait before retrying
+func (l *requestLimiter) allow(key string, now time.Time) (bool, time.Duration) {
+	if l.limit.rate <= 0 {
+		return true, 0
+	}
+	l.mu.Lock()
+	bucket, found := l.buckets[key]
+	if !found {
+		if len(l.buckets) >= maxRequestLimiterBuckets && now.Sub(l.evictedAt) >= time.Second {
+			l.evict(now)
+		}
+		if len(l.buckets) < maxRequestLimiterBuckets {
+			bucket = NewTokenBucket(l.limit)
+			bucket.updatedAt = now
+			l.buckets[key] = bucket
+		} else {
+			// many clients at once get one bucket instead of growing memory
+			if l.overflow == nil {
+				l.overflow = NewTokenBucket(l.limit)
+				l.overflow.updatedAt = now
+			}
+			bucket = l.overflow
+		}
+	}
+	l.mu.Unlock()
+	return bucket.allow(now)
+}
+
+// evict drops refilled buckets, they behave the same as new ones
+func (l *requestLimiter) evict(now time.Time) {
+	for key, bucket := range l.buckets {
+		if bucket.full(now) {
+			delete(l.buckets, key)
+		}
+	}
+	l.evictedAt = now
+}
+
+// clientIP returns address of the client. Requests of trusted proxies
+// are from the right-most address of X-Forwarded-For that is not a trusted
+// proxy, other clients could send any X-Forwarded-For to avoid limits.
+func clientIP(r *http.Request) string {
+	ip, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		ip = r.RemoteAddr
+	}
+	if !trustedProxy(ip) {
+		return ip
+	}
+	hops := strings.Split(strings.Join(r.Header["X-Forwarded-For"], ","), ",")
+	for i := len(hops) - 1; i >= 0; i-- {
+		hop := strings.TrimSpace(hops[i])
+		if hop == "" {
+			continue
+		}
+		ip = hop
+		if !trustedProxy(hop) {
+			break
+		}
+	}
+	return ip
+}
+
+func trustedProxy(address string) bool {
+	ip := net.ParseIP(address)
+	if ip == nil {
+		return false
+	}
+	for _, ipNet := range trustedProxyNets {
+		if ipNet.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// expensiveRequest tells if request starts a pipe run or a force import
+func expensiveRequest(r *http.Request) bool {
+	if r.URL.Query().Get("force") == "true" {
+		return true
+	}
+	operation := apiSpec.operation(r)
+	return operation != nil && operation.OperationID == "postPipeRun"
+}
+
+func writeTooManyRequests(w http.ResponseWriter, r *http.Request, limit string, retryAfter time.Duration) {
+	rateLimitedRequests.WithLabelValues(limit).Inc()
+	requestLogger(r).Warn("request rate limited", Fields{
+		"limit":       limit,
+		"retry_after": retryAfter.String(),
+		"remote_addr": clientIP(r),
+	})
+	seconds := int(math.Ceil(retryAfter.Seconds()))
+	if seconds < 1 {
+		seconds = 1
+	}
+	w.Header().Set("Retry-After", strconv.Itoa(seconds))
+	writeError(w, r, http.StatusTooManyRequests, errTooManyRequests)
+}
+
+// withIPRateLimit limits requests of each client IP
+func withIPRateLimit(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if allowed, retryAfter := ipRequestLimiter.allow(clientIP(r), time.Now()); !allowed {
+			writeTooManyRequests(w, r, "ip", retryAfter)
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// allowWorkspaceRequest applies limits of the authenticated workspace
+func allowWorkspaceRequest(w http.ResponseWriter, r *http.Request, workspaceID int) bool {
+	key := strconv.Itoa(workspaceID)
+	now := time.Now()
+	if expensiveRequest(r) {
+		if allowed, retryAfter := expensiveRequestLimiter.allow(key, now); !allowed {
+			writeTooManyRequests(w, r, "expensive", retryAfter)
+			return false
+		}
+	}
+	if allowed, retryAfter := workspaceRequestLimiter.allow(key, now); !allowed {
+		writeTooManyRequests(w, r, "workspace", retryAfter)
+		return false
+	}
+	return true
+}
+
+// maxRequestBodySize returns body size limit of the matched route,
+// routes without x-max-body-size in the spec use the max_body_size flag
+func maxRequestBodySize(r *http.Request) int64 {
+	if operation := apiSpec.operation(r); operation != nil && operation.RequestBody != nil && operation.RequestBody.MaxSize > 0 {
+		return operation.RequestBody.MaxSize
+	}
+	return maxBodySize
+}
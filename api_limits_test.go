@@ -0,0 +1,175 @@
+package main
+
+import (
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+func TestRequestLimiter(t *testing.T) {
+	now := time.Now()
+	limiter := newRequestLimiter(rateLimit{rate: 2, burst: 2})
+
+	for i := 0; i < 2; i++ {
+		if allowed, _ := limiter.allow("1", now); !allowed {
+			t.Fatalf("expected request %d within burst to be allowed", i)
+		}
+	}
+	allowed, retryAfter := limiter.allow("1", now)
+	if allowed || retryAfter != 500*time.Millisecond {
+		t.Errorf("expected request to be rejected for 500ms, got %t %s", allowed, retryAfter)
+	}
+	if allowed, _ := limiter.allow("2", now); !allowed {
+		t.Error("expected other key to have its own bucket")
+	}
+	if allowed, _ := limiter.allow("1", now.Add(retryAfter)); !allowed {
+		t.Error("expected request to be allowed after waiting")
+	}
+
+	if allowed, _ := newRequestLimiter(rateLimit{}).allow("1", now); !allowed {
+		t.Error("expected zero rate to disable the limit")
+	}
+}
+
+func TestRequestLimiterEvictsRefilledBuckets(t *testing.T) {
+	now := time.Now()
+	limiter := newRequestLimiter(rateLimit{rate: 1, burst: 1})
+	for i := 0; i < maxRequestLimiterBuckets; i++ {
+		limiter.allow(string(rune(i)), now)
+	}
+	limiter.allow("new", now.Add(time.Second))
+	if len(limiter.buckets) != 1 {
+		t.Errorf("expected refilled buckets to be evicted, got %d buckets", len(limiter.buckets))
+	}
+}
+
+func TestRequestLimiterSharesBucketWhenFull(t *testing.T) {
+	now := time.Now()
+	limiter := newRequestLimiter(rateLimit{rate: 1, burst: 1})
+	for i := 0; i < maxRequestLimiterBuckets; i++ {
+		limiter.allow(string(rune(i)), now)
+	}
+	if allowed, _ := limiter.allow("new", now); !allowed {
+		t.Error("expected first key over the limit to be allowed")
+	}
+	if allowed, _ := limiter.allow("other", now); allowed {
+		t.Error("expected keys over the limit to share one bucket")
+	}
+	if len(limiter.buckets) != maxRequestLimiterBuckets {
+		t.Errorf("expected buckets not to grow over the limit, got %d", len(limiter.buckets))
+	}
+}
+
+func TestClientIP(t *testing.T) {
+	defer func(nets []*net.IPNet) { trustedProxyNets = nets }(trustedProxyNets)
+	trustedProxyNets = nil
+
+	r := httptest.NewRequest("GET", "/api/v1/status", nil)
+	if ip := clientIP(r); ip != "192.0.2.1" {
+		t.Errorf("expected host of remote address, got %q", ip)
+	}
+	r.Header.Set("X-Forwarded-For", "203.0.113.7, 10.0.0.1")
+	if ip := clientIP(r); ip != "192.0.2.1" {
+		t.Errorf("expected forwarded address of untrusted client to be ignored, got %q", ip)
+	}
+
+	nets, err := parseTrustedProxies("192.0.2.1, 10.0.0.0/8")
+	if err != nil {
+		t.Fatal(err)
+	}
+	trustedProxyNets = nets
+	r.Header.Set("X-Forwarded-For", "198.51.100.1, 203.0.113.7, 10.0.0.1")
+	if ip := clientIP(r); ip != "203.0.113.7" {
+		t.Errorf("expected right-most untrusted address, got %q", ip)
+	}
+	r.Header.Set("X-Forwarded-For", "10.0.0.2")
+	if ip := clientIP(r); ip != "10.0.0.2" {
+		t.Errorf("expected left-most address when all are proxies, got %q", ip)
+	}
+
+	if _, err := parseTrustedProxies("10.0.0.0/33"); err == nil {
+		t.Error("expected invalid range to be rejected")
+	}
+}
+
+func TestRateLimitedResponses(t *testing.T) {
+	defer func(limiter *requestLimiter) { ipRequestLimiter = limiter }(ipRequestLimiter)
+	ipRequestLimiter = newRequestLimiter(rateLimit{rate: 0.5, burst: 1})
+
+	get := func(path string) *httptest.ResponseRecorder {
+		w := httptest.NewRecorder()
+		routes.ServeHTTP(w, httptest.NewRequest("GET", path, nil))
+		return w
+	}
+	if w := get("/api/v1/status"); w.Code == http.StatusTooManyRequests {
+		t.Fatal("expected first request to be allowed")
+	}
+	w := get("/api/v2/status")
+	if w.Code != http.StatusTooManyRequests || w.Header().Get("Retry-After") != "2" {
+		t.Fatalf("expected 429 with Retry-After 2, got %d %q", w.Code, w.Header().Get("Retry-After"))
+	}
+	if apiErr := decodeErrorEnvelope(t, w); apiErr.Code != errorCodeRateLimited {
+		t.Errorf("expected %s, got %+v", errorCodeRateLimited, apiErr)
+	}
+}
+
+func TestExpensiveRequest(t *testing.T) {
+	router := mux.NewRouter()
+	var expensive bool
+	handler := func(w http.ResponseWriter, r *http.Request) { expensive = expensiveRequest(r) }
+	router.HandleFunc("/api/v1/integrations/{service}/pipes/{pipe}/run", handler).Methods("POST")
+	router.HandleFunc("/api/v1/integrations/{service}/accounts", handler).Methods("GET")
+
+	tests := []struct {
+		method, path string
+		expensive    bool
+	}{
+		{"POST", "/api/v1/integrations/asana/pipes/projects/run", true},
+		{"GET", "/api/v1/integrations/asana/accounts?force=true", true},
+		{"GET", "/api/v1/integrations/asana/accounts", false},
+	}
+	for _, tt := range tests {
+		router.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(tt.method, tt.path, nil))
+		if expensive != tt.expensive {
+			t.Errorf("%s %s: expected expensive %t", tt.method, tt.path, tt.expensive)
+		}
+	}
+}
+
+func TestRequestBodySizeLimit(t *testing.T) {
+	router := mux.NewRouter()
+	router.Use(withAPIVersion(2))
+	router.HandleFunc("/api/v2/integrations/{service}/authorizations", handleRequest(func(req Request) Response {
+		return ok(nil)
+	})).Methods("POST")
+	limit := apiSpec.Paths["/integrations/{service}/authorizations"]["post"].RequestBody.MaxSize
+
+	post := func(body string, chunked bool) *httptest.ResponseRecorder {
+		r := httptest.NewRequest("POST", "/api/v2/integrations/asana/authorizations", strings.NewReader(body))
+		if chunked {
+			r.ContentLength = -1
+		}
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, r)
+		return w
+	}
+	large := `{"code":"` + strings.Repeat("a", int(limit)) + `"}`
+	for _, chunked := range []bool{false, true} {
+		w := post(large, chunked)
+		if w.Code != http.StatusRequestEntityTooLarge {
+			t.Errorf("expected 413 for large body (chunked %t), got %d", chunked, w.Code)
+			continue
+		}
+		if apiErr := decodeErrorEnvelope(t, w); apiErr.Code != errorCodePayloadTooLarge {
+			t.Errorf("expected %s, got %+v", errorCodePayloadTooLarge, apiErr)
+		}
+	}
+	if w := post(`{"code":"abc"}`, false); w.Code != http.StatusOK {
+		t.Errorf("expected small body to be accepted, got %d %s", w.Code, w.Body.String())
+	}
+}
@@ -0,0 +1,139 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"strconv"
+
+	"github.com/gorilla/context"
+	"github.com/gorilla/mux"
+)
+
+// API v2 wraps response bodies in JSON envelopes, {"data": ...} for
+// successful responses and {"error": {...}} for errors. v1 responses
+// are written as they always were.
+
+type (
+	// APIError is the error of v2 responses
+	APIError struct {
+		Code    string      `json:"code"`
+		Message string      `json:"message"`
+		Details interface{} `json:"details,omitempty"`
+	}
+
+	// ValidationError tells which request field is invalid
+	ValidationError struct {
+		Field   string `json:"field"`
+		Message string `json:"message"`
+	}
+
+	errorEnvelope struct {
+		Error *APIError `json:"error"`
+	}
+
+	dataEnvelope struct {
+		Data interface{} `json:"data"`
+	}
+)
+
+const (
+	errorCodeInvalidRequest     = "invalid_request"
+	errorCodeUnauthorized       = "unauthorized"
+	errorCodeNotFound           = "not_found"
+	errorCodeConflict           = "conflict"
+	errorCodeServiceUnavailable = "service_unavailable"
+)
+
+var statusErrorCodes = map[int]string{
+	http.StatusBadRequest:            errorCodeInvalidRequest,
+	http.StatusUnauthorized:          errorCodeUnauthorized,
+	http.StatusNotFound:              errorCodeNotFound,
+	http.StatusConflict:              errorCodeConflict,
+	http.StatusRequestEntityTooLarge: errorCodePayloadTooLarge,
+	http.StatusTooManyRequests:       errorCodeRateLimited,
+	http.StatusInternalServerError:   errorCodeInternal,
+	http.StatusBadGateway:            errorCodeProviderUnavailable,
+	http.StatusServiceUnavailable:    errorCodeServiceUnavailable,
+}
+
+func (e *ValidationError) Error() string {
+	return e.Message
+}
+
+func invalidField(field, message string) Response {
+	return Response{http.StatusBadRequest, &ValidationError{Field: field, Message: message}, "application/json"}
+}
+
+func withAPIVersion(version int) mux.MiddlewareFunc {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			context.Set(r, apiVersionKey, version)
+			next.ServeHTTP(w, r)
+		})
+	}
+}
+
+func apiVersion(r *http.Request) int {
+	if v, ok := context.GetOk(r, apiVersionKey); ok {
+		return v.(int)
+	}
+	return 1
+}
+
+// newAPIError builds error of response with status and content,
+// content that is not an error or a message becomes error details
+func newAPIError(status int, content interface{}) *APIError {
+	apiErr := &APIError{Code: statusErrorCodes[status], Message: http.StatusText(status)}
+	if apiErr.Code == "" {
+		apiErr.Code = errorCodeInvalidRequest
+		if status >= 500 {
+			apiErr.Code = errorCodeInternal
+		}
+	}
+	switch c := content.(type) {
+	case *ValidationError:
+		apiErr.Message = c.Message
+		apiErr.Details = []*ValidationError{c}
+	case ValidationErrors:
+		apiErr.Message = "Invalid request body"
+		apiErr.Details = c
+	case *PipeError:
+		apiErr.Code = c.Code
+		apiErr.Message = c.Message
+		apiErr.Details = map[string]bool{"retryable": c.Retryable}
+	case error:
+		apiErr.Message = c.Error()
+	case string:
+		apiErr.Message = c
+	case nil:
+	default:
+		apiErr.Details = c
+	}
+	return apiErr
+}
+
+// writeError writes error in format of the requested API version
+func writeError(w http.ResponseWriter, r *http.Request, status int, err error) {
+	if apiVersion(r) < 2 {
+		message := err.Error()
+		if pipeErr, isPipeError := err.(*PipeError); isPipeError {
+			message = pipeErr.Message
+		}
+		http.Error(w, message, status)
+		return
+	}
+	writeErrorEnvelope(w, status, err)
+}
+
+func writeErrorEnvelope(w http.ResponseWriter, status int, content interface{}) {
+	b, err := json.Marshal(errorEnvelope{newAPIError(status, content)})
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Length", strconv.Itoa(len(b)))
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("X-Content-Type-Options", "nosniff")
+	w.WriteHeader(status)
+	w.Write(b)
+}
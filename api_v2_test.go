@@ -0,0 +1,179 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"code.google.com/p/goauth2/oauth"
+	"github.com/gorilla/context"
+)
+
+// serve calls handler with request of the given API version
+func serve(handler http.HandlerFunc, version int, method, path string) *httptest.ResponseRecorder {
+	r := httptest.NewRequest(method, path, nil)
+	defer context.Clear(r)
+	if version > 1 {
+		context.Set(r, apiVersionKey, version)
+	}
+	w := httptest.NewRecorder()
+	handler(w, r)
+	return w
+}
+
+func decodeErrorEnvelope(t *testing.T, w *httptest.ResponseRecorder) *APIError {
+	if ct := w.Header().Get("Content-Type"); ct != "application/json" {
+		t.Fatalf("expected JSON error, got content type %q", ct)
+	}
+	var body struct {
+		Error *APIError `json:"error"`
+	}
+	if err := json.Unmarshal(w.Body.Bytes(), &body); err != nil || body.Error == nil {
+		t.Fatalf("expected error envelope, got %s", w.Body.String())
+	}
+	return body.Error
+}
+
+func TestValidationErrorResponses(t *testing.T) {
+	handler := handleRequest(func(req Request) Response {
+		return invalidField("service", "Missing or invalid service")
+	})
+
+	w := serve(handler, 1, "GET", "/api/v1/integrations/foo/accounts")
+	if w.Code != http.StatusBadRequest || w.Body.String() != "Missing or invalid service\n" {
+		t.Errorf("expected v1 plain text error, got %d %q", w.Code, w.Body.String())
+	}
+
+	w = serve(handler, 2, "GET", "/api/v2/integrations/foo/accounts")
+	apiErr := decodeErrorEnvelope(t, w)
+	if w.Code != http.StatusBadRequest || apiErr.Code != errorCodeInvalidRequest || apiErr.Message != "Missing or invalid service" {
+		t.Errorf("unexpected v2 error %d %+v", w.Code, apiErr)
+	}
+	details, _ := apiErr.Details.([]interface{})
+	if len(details) != 1 || details[0].(map[string]interface{})["field"] != "service" {
+		t.Errorf("expected details of invalid field, got %v", apiErr.Details)
+	}
+}
+
+func TestPipeErrorResponses(t *testing.T) {
+	handler := handleRequest(func(req Request) Response {
+		return req.invalidServiceParams(errors.New("account_id must be present"))
+	})
+
+	w := serve(handler, 1, "GET", "/api/v1/integrations/asana/pipes/projects/users")
+	if w.Code != http.StatusBadRequest || w.Body.String() != "account_id must be present\n" {
+		t.Errorf("expected v1 plain text error, got %d %q", w.Code, w.Body.String())
+	}
+
+	w = serve(handler, 2, "GET", "/api/v2/integrations/asana/pipes/projects/users")
+	apiErr := decodeErrorEnvelope(t, w)
+	if apiErr.Code != errorCodeInvalidConfig {
+		t.Errorf("expected %s, got %+v", errorCodeInvalidConfig, apiErr)
+	}
+	if details, _ := apiErr.Details.(map[string]interface{}); details["retryable"] != false {
+		t.Errorf("expected retryable detail, got %v", apiErr.Details)
+	}
+}
+
+// TestV1ErrorBodies compares v1 error responses with bodies v1 always had
+func TestV1ErrorBodies(t *testing.T) {
+	setParams := func(serviceID string) error {
+		service, err := getService(serviceID, workspaceID)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return service.setParams([]byte(`{}`))
+	}
+	tests := []struct {
+		name    string
+		handler HandlerFunc
+		status  int
+		body    string
+		code    string
+	}{
+		{"refresh", func(req Request) Response {
+			return req.oAuthRefreshFailed(oauth.OAuthError{})
+		}, http.StatusBadRequest, "oAuth refresh failed!\n", errorCodeAuthRevoked},
+		{"asana params", func(req Request) Response {
+			return req.invalidServiceParams(setParams("asana"))
+		}, http.StatusBadRequest, "account_id must be present\n", errorCodeInvalidConfig},
+		{"basecamp params", func(req Request) Response {
+			return req.invalidServiceParams(setParams("basecamp"))
+		}, http.StatusBadRequest, "account_id must be present\n", errorCodeInvalidConfig},
+		{"teamweek params", func(req Request) Response {
+			return req.invalidServiceParams(setParams("teamweek"))
+		}, http.StatusBadRequest, "account_id must be present\n", errorCodeInvalidConfig},
+		{"service", func(req Request) Response {
+			return invalidField("service", "Missing or invalid service")
+		}, http.StatusBadRequest, "Missing or invalid service\n", errorCodeInvalidRequest},
+		{"pipe", func(req Request) Response {
+			return badRequest("Pipe is not configured")
+		}, http.StatusBadRequest, "Pipe is not configured\n", errorCodeInvalidRequest},
+	}
+	for _, tt := range tests {
+		w := serve(handleRequest(tt.handler), 1, "GET", "/api/v1/integrations/asana/users")
+		if w.Code != tt.status || w.Body.String() != tt.body {
+			t.Errorf("%s: expected v1 %d %q, got %d %q", tt.name, tt.status, tt.body, w.Code, w.Body.String())
+		}
+		w = serve(handleRequest(tt.handler), 2, "GET", "/api/v2/integrations/asana/users")
+		if apiErr := decodeErrorEnvelope(t, w); apiErr.Code != tt.code {
+			t.Errorf("%s: expected v2 %s, got %+v", tt.name, tt.code, apiErr)
+		}
+	}
+}
+
+func TestInternalErrorStringResponses(t *testing.T) {
+	handler := handleRequest(func(req Request) Response {
+		return internalServerError("Unable to get users from DB")
+	})
+
+	w := serve(handler, 1, "GET", "/api/v1/integrations/github/pipes/users/users")
+	if w.Body.String() != `"Unable to get users from DB"` {
+		t.Errorf("expected v1 JSON encoded string, got %q", w.Body.String())
+	}
+
+	w = serve(handler, 2, "GET", "/api/v2/integrations/github/pipes/users/users")
+	apiErr := decodeErrorEnvelope(t, w)
+	if w.Code != http.StatusInternalServerError || apiErr.Code != errorCodeInternal || apiErr.Message != "Unable to get users from DB" {
+		t.Errorf("unexpected v2 error %d %+v", w.Code, apiErr)
+	}
+}
+
+func TestSuccessResponseEnvelope(t *testing.T) {
+	handler := handleRequest(func(req Request) Response {
+		return ok(map[string]string{"status": "OK"})
+	})
+
+	w := serve(handler, 1, "GET", "/api/v1/status")
+	if w.Body.String() != `{"status":"OK"}` {
+		t.Errorf("expected v1 body without envelope, got %s", w.Body.String())
+	}
+	w = serve(handler, 2, "GET", "/api/v2/status")
+	if w.Body.String() != `{"data":{"status":"OK"}}` {
+		t.Errorf("expected v2 data envelope, got %s", w.Body.String())
+	}
+}
+
+func TestWithAuthErrorResponses(t *testing.T) {
+	handler := withAuth(handleRequest(func(req Request) Response { return ok(nil) }))
+
+	w := serve(handler, 1, "GET", "/api/v1/integrations")
+	if w.Code != http.StatusUnauthorized || w.Body.String() != "Unauthorized\n" {
+		t.Errorf("expected v1 plain text error, got %d %q", w.Code, w.Body.String())
+	}
+	w = serve(handler, 2, "GET", "/api/v2/integrations")
+	if apiErr := decodeErrorEnvelope(t, w); apiErr.Code != errorCodeUnauthorized {
+		t.Errorf("expected %s, got %+v", errorCodeUnauthorized, apiErr)
+	}
+}
+
+func TestV2RoutesAreRegistered(t *testing.T) {
+	r := httptest.NewRequest("GET", "/api/v2/jobs/123", nil)
+	w := httptest.NewRecorder()
+	routes.ServeHTTP(w, r)
+	if apiErr := decodeErrorEnvelope(t, w); w.Code != http.StatusUnauthorized || apiErr.Code != errorCodeUnauthorized {
+		t.Errorf("expected v2 unauthorized error, got %d %s", w.Code, w.Body.String())
+	}
+}
@@ -7,7 +7,6 @@ import (
 	"fmt"
 
 	"code.google.com/p/goauth2/oauth"
-	"github.com/bugsnag/bugsnag-go"
 	"github.com/range-labs/go-asana/asana"
 )
 
@@ -55,21 +54,20 @@ func (s *AsanaService) setAuthData(b []byte) error {
 
 func (s *AsanaService) client() *asana.Client {
 	t := &oauth.Transport{Token: &s.token}
-	return asana.NewClient(t.Client())
+	return asana.NewClient(rateLimitedClient(s, t))
 }
 
 // Map Asana accounts to local accounts
 func (s *AsanaService) Accounts() ([]*Account, error) {
 	foreignObjects, err := s.client().ListWorkspaces(context.Background())
 	if err != nil {
-		bugsnag.Notify(err, bugsnag.MetaData{
-			"asana_service": {
-				"method":           "Accounts()",
-				"remote_method":    "ListWorkspaces()",
-				"asana_account_id": s.AccountID,
-				"workspace_id":     s.WorkspaceID(),
-			},
-		})
+		metadata := serviceErrorMetadata(s)
+		metadata["asana"] = Fields{
+			"method":        "Accounts",
+			"remote_method": "ListWorkspaces",
+			"account_id":    s.AccountID,
+		}
+		reportError(err, metadata)
 		return nil, err
 	}
 	var accounts []*Account
@@ -91,15 +89,13 @@ func (s *AsanaService) Users() ([]*User, error) {
 	}
 	foreignObjects, err := s.client().ListUsers(context.Background(), opt)
 	if err != nil {
-		bugsnag.Notify(err, bugsnag.MetaData{
-			"asana_service": {
-				"method":           "Users()",
-				"remote_method":    "ListUsers()",
-				"filter_workspace": s.AccountID,
-				"asana_account_id": s.AccountID,
-				"workspace_id":     s.WorkspaceID(),
-			},
-		})
+		metadata := serviceErrorMetadata(s)
+		metadata["asana"] = Fields{
+			"method":        "Users",
+			"remote_method": "ListUsers",
+			"account_id":    s.AccountID,
+		}
+		reportError(err, metadata)
 		return nil, err
 	}
 	var users []*User
@@ -122,15 +118,13 @@ func (s *AsanaService) Projects() ([]*Project, error) {
 	}
 	foreignObjects, err := s.client().ListProjects(context.Background(), opt)
 	if err != nil {
-		bugsnag.Notify(err, bugsnag.MetaData{
-			"asana_service": {
-				"method":           "Projects()",
-				"remote_method":    "ListProjects()",
-				"filter_workspace": s.AccountID,
-				"asana_account_id": s.AccountID,
-				"workspace_id":     s.WorkspaceID(),
-			},
-		})
+		metadata := serviceErrorMetadata(s)
+		metadata["asana"] = Fields{
+			"method":        "Projects",
+			"remote_method": "ListProjects",
+			"account_id":    s.AccountID,
+		}
+		reportError(err, metadata)
 		return nil, err
 	}
 	var projects []*Project
@@ -153,39 +147,50 @@ func (s *AsanaService) Tasks() ([]*Task, error) {
 	}
 	foreignProjects, err := s.client().ListProjects(context.Background(), opt)
 	if err != nil {
-		bugsnag.Notify(err, bugsnag.MetaData{
-			"asana_service": {
-				"method":           "Tasks()",
-				"remote_method":    "ListProjects()",
-				"filter_workspace": s.AccountID,
-				"asana_account_id": s.AccountID,
-				"workspace_id":     s.WorkspaceID(),
-			},
-		})
+		metadata := serviceErrorMetadata(s)
+		metadata["asana"] = Fields{
+			"method":        "Tasks",
+			"remote_method": "ListProjects",
+			"account_id":    s.AccountID,
+		}
+		reportError(err, metadata)
 		return nil, err
 	}
 
-	var tasks []*Task
-	for _, project := range foreignProjects {
+	projectTasks := make([][]asana.Task, len(foreignProjects))
+	progress := newFetchProgress(s.context(), tasksPipeId, "projects", len(foreignProjects))
+	err = parallelFetch(s.context(), len(foreignProjects), func(ctx context.Context, i int) error {
+		project := foreignProjects[i]
 		// list task only accept project filter
 		opt := &asana.Filter{
 			Project: numberStrToInt64(project.GID),
 			Limit:   asanaPerPageLimit,
 		}
-		foreignObjects, err := s.client().ListTasks(context.Background(), opt)
+		foreignObjects, err := s.client().ListTasks(ctx, opt)
 		if err != nil {
-			bugsnag.Notify(err, bugsnag.MetaData{
-				"asana_service": {
-					"method":           "Tasks()",
-					"remote_method":    "ListTasks()",
-					"filter_project":   project.GID,
-					"asana_account_id": s.AccountID,
-					"workspace_id":     s.WorkspaceID(),
-				},
-			})
-			return nil, err
+			if ctx.Err() == nil {
+				metadata := serviceErrorMetadata(s)
+				metadata["asana"] = Fields{
+					"method":         "Tasks",
+					"remote_method":  "ListTasks",
+					"filter_project": project.GID,
+					"account_id":     s.AccountID,
+				}
+				reportError(err, metadata)
+			}
+			return err
 		}
-		for _, object := range foreignObjects {
+		projectTasks[i] = foreignObjects
+		progress.add()
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	var tasks []*Task
+	for i, project := range foreignProjects {
+		for _, object := range projectTasks[i] {
 			task := Task{
 				ForeignID:        object.GID,
 				Name:             object.Name,
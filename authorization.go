@@ -53,7 +53,7 @@ func NewAuthorization(workspaceID int, serviceID string) *Authorization {
 }
 
 func loadAuth(s Service) (*Authorization, error) {
-	rows, err := db.Query(selectAuthorizationSQL, s.WorkspaceID(), s.Name())
+	rows, err := db.QueryContext(s.context(), selectAuthorizationSQL, s.WorkspaceID(), s.Name())
 	if err != nil {
 		return nil, err
 	}
@@ -72,6 +72,11 @@ func loadAuth(s Service) (*Authorization, error) {
 }
 
 func (a *Authorization) refresh() error {
+	return a.refreshToken(false)
+}
+
+// refreshToken refreshes expired OAuth 2 token, or any OAuth 2 token when forced
+func (a *Authorization) refreshToken(force bool) error {
 	if availableAuthorizations[a.ServiceID] != "oauth2" {
 		return nil
 	}
@@ -79,7 +84,7 @@ func (a *Authorization) refresh() error {
 	if err := json.Unmarshal(a.Data, &token); err != nil {
 		return err
 	}
-	if !token.Expired() {
+	if !force && !token.Expired() {
 		return nil
 	}
 	config, res := oAuth2Configs[a.ServiceID+"_"+environment]
@@ -88,8 +93,10 @@ func (a *Authorization) refresh() error {
 	}
 	transport := &oauth.Transport{Config: config, Token: &token}
 	if err := transport.Refresh(); err != nil {
+		oAuthRefreshes.WithLabelValues(a.ServiceID, "failed").Inc()
 		return err
 	}
+	oAuthRefreshes.WithLabelValues(a.ServiceID, "succeeded").Inc()
 	b, err := json.Marshal(token)
 	if err != nil {
 		return err
@@ -1,41 +1,39 @@
 package main
 
 import (
-	"log"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
 	"math/rand"
+	"os"
+	"os/signal"
+	"path/filepath"
 	"strings"
-	"sync"
+	"syscall"
 	"time"
-
-	"github.com/bugsnag/bugsnag-go"
 )
 
-var wg sync.WaitGroup
-
 const (
-	workersCount = 15
-	sleepMin     = 60
-	sleepMax     = 300
+	sleepMin = 60
+	sleepMax = 300
 )
 
-// run background workers
-func runPipes() {
-	wg.Add(workersCount)
-	for i := 0; i < workersCount; i++ {
-		go pipeWorker(i)
-	}
-}
-
 // background worker function
-func pipeWorker(id int) {
-	defer func() {
-		log.Printf("[Workder %d] died\n", id)
-		wg.Done()
-	}()
+func pipeWorker(id int, stop <-chan struct{}) {
+	workerLog := logger.With(Fields{"worker": id})
 	for {
+		select {
+		case <-stop:
+			return
+		default:
+		}
+
 		pipes, err := getPipesFromQueue()
 		if err != nil {
-			bugsnag.Notify(err)
+			reportError(err, workerErrorMetadata("Worker", Fields{"id": id}))
+			if !sleepOrStop(time.Second, stop) {
+				return
+			}
 			continue
 		}
 
@@ -43,46 +41,95 @@ func pipeWorker(id int) {
 		if pipes == nil {
 			duration := time.Duration(30+rand.Int31n(30)) * time.Second
 
-			log.Printf("[Worker %d] did not receive works, sleeping for %d\n", id, duration)
-			time.Sleep(duration)
-
+			workerLog.Debug("no queued pipes, sleeping", Fields{"sleep_seconds": duration.Seconds()})
+			if !sleepOrStop(duration, stop) {
+				return
+			}
 			continue
 		}
 
-		log.Printf("[Worker %d] received %d pipes\n", id, len(pipes))
-		for _, pipe := range pipes {
-			log.Printf("[Worker %d] working on pipe [workspace_id: %d, key: %s] starting\n", id, pipe.workspaceID, pipe.key)
-			pipe.run()
-
-			err := setQueuedPipeSynced(pipe)
-			if err != nil {
-				BugsnagNotifyPipe(pipe, err)
-			}
-			log.Printf("[Worker %d] working on pipe [workspace_id: %d, key: %s] done, err: %t\n", id, pipe.workspaceID, pipe.key, (err != nil))
+		workerLog.Info("received queued pipes", Fields{"count": len(pipes)})
+		if !runQueuedPipes(id, pipes, stop) {
+			return
 		}
 	}
 }
 
-// run dummy background workers
-func runPipesStub() {
-	wg.Add(workersCount)
-	for i := 0; i < workersCount; i++ {
-		go pipeWorkerStub()
+// runQueuedPipes runs batch of queued pipes, when stop is closed the pipes
+// not started yet are put back to queue and false is returned
+func runQueuedPipes(id int, pipes []*Pipe, stop <-chan struct{}) bool {
+	for i, pipe := range pipes {
+		select {
+		case <-stop:
+			for _, queued := range pipes[i:] {
+				if err := unlockQueuedPipe(queued); err != nil {
+					reportPipeError(queued, err)
+				}
+			}
+			return false
+		default:
+		}
+
+		pipeLog := pipeLogger(pipe).With(Fields{"worker": id})
+		lock, err := tryLockWorkspace(pipe.workspaceID)
+		if err != nil {
+			if err != ErrWorkspaceLocked {
+				reportPipeError(pipe, err)
+			}
+			pipeLog.Info("workspace is locked, requeueing pipe")
+			if err := unlockQueuedPipe(pipe); err != nil {
+				reportPipeError(pipe, err)
+			}
+			continue
+		}
+
+		started, err := startQueuedPipe(pipe)
+		if err != nil {
+			reportPipeError(pipe, err)
+		}
+		if !started {
+			pipeLog.Info("pipe was not started, requeueing pipe")
+			if err := lock.unlock(); err != nil {
+				reportPipeError(pipe, err)
+			}
+			if err := unlockQueuedPipe(pipe); err != nil {
+				reportPipeError(pipe, err)
+			}
+			continue
+		}
+
+		pipeLog.Info("pipe run started")
+		pipe.run()
+		if err := lock.unlock(); err != nil {
+			reportPipeError(pipe, err)
+		}
+
+		err = setQueuedPipeSynced(pipe)
+		if err != nil {
+			reportPipeError(pipe, err)
+		}
+		pipeLog.Info("pipe run finished", Fields{"error": err})
 	}
+	return true
 }
 
 // dummy background worker function
-func pipeWorkerStub() {
+func pipeWorkerStub(id int, stop <-chan struct{}) {
 	ranCount := 0
 	gotCount := 0
 	defer func() {
-		log.Printf("Got %d pipes, ran %d pipes\n", gotCount, ranCount)
-		wg.Done()
+		logger.Info("stub worker stopped", Fields{"worker": id, "received": gotCount, "ran": ranCount})
 	}()
 	for {
+		select {
+		case <-stop:
+			return
+		default:
+		}
+
 		pipes, err := getPipesFromQueue()
 		if err != nil {
-			bugsnag.Notify(err)
+			reportError(err, workerErrorMetadata("WorkerStub", Fields{"id": id}))
 			continue
 		}
 		if pipes == nil {
@@ -93,39 +140,72 @@ func pipeWorkerStub() {
 			// NO PIPE RUN HERE
 			err := setQueuedPipeSynced(pipe)
 			if err != nil {
-				log.Printf("ERROR: %s\n", err.Error())
+				pipeLogger(pipe).Error("failed to mark queued pipe synced", Fields{"error": err})
 			}
 			ranCount++
 		}
 	}
 }
 
-func autoSyncRunner() {
-	for {
-		duration := time.Duration(rand.Intn(sleepMax-sleepMin)+sleepMin) * time.Second
-		log.Println("-- Autosync sleeping for ", duration)
-		time.Sleep(duration)
+// workersConfigSignals returns SIGHUP signals which reload the workers
+// config, signals are caught from the start so they do not stop the process
+func workersConfigSignals() <-chan os.Signal {
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGHUP)
+	return signals
+}
 
-		log.Println("-- Autosync started")
-		runPipes()
+func autoSyncRunner(pool *WorkerPool, signals <-chan os.Signal) {
+	duration := time.Duration(rand.Intn(sleepMax-sleepMin)+sleepMin) * time.Second
+	logger.Info("autosync sleeping", Fields{"sleep_seconds": duration.Seconds()})
+	time.Sleep(duration)
 
-		wg.Wait()
-		log.Println("-- Autosync finished")
-	}
+	logger.Info("autosync started")
+	pool.Resize(startWorkersCount())
+	watchWorkersConfig(pool, signals)
 }
 
-func autoSyncRunnerStub() {
-	for {
-		duration := time.Duration(rand.Intn(sleepMax-sleepMin)+sleepMin) * time.Second
-		log.Println("-- AutosyncStub sleeping for ", duration)
-		time.Sleep(duration)
+// startWorkersCount returns size of the pool from config/workers.json,
+// workers_count flag is used when the config is missing or invalid
+func startWorkersCount() int {
+	count, err := loadWorkersCount()
+	if err != nil {
+		if !os.IsNotExist(err) {
+			logger.Error("failed to load workers config", Fields{"error": err})
+		}
+		return workersCount
+	}
+	return count
+}
 
-		log.Println("-- AutosyncStub started")
-		runPipesStub()
+// watchWorkersConfig resizes the pool when SIGHUP is received,
+// size is read from config/workers.json
+func watchWorkersConfig(pool *WorkerPool, signals <-chan os.Signal) {
+	for range signals {
+		count, err := loadWorkersCount()
+		if err != nil {
+			logger.Error("failed to reload workers config", Fields{"error": err})
+			continue
+		}
+		pool.Resize(count)
+	}
+}
 
-		wg.Wait()
-		log.Println("-- AutosyncStub finished")
+func loadWorkersCount() (int, error) {
+	b, err := ioutil.ReadFile(filepath.Join(workdir, "config", "workers.json"))
+	if err != nil {
+		return 0, err
+	}
+	var config struct {
+		WorkersCount int `json:"workers_count"`
+	}
+	if err := json.Unmarshal(b, &config); err != nil {
+		return 0, err
+	}
+	if config.WorkersCount < 0 {
+		return 0, fmt.Errorf("invalid workers_count %d", config.WorkersCount)
 	}
+	return config.WorkersCount, nil
 }
 
 // schedule background job for each integration with auto sync enabled
@@ -134,16 +214,16 @@ func autoSyncQueuer() {
 		// making sleep longer to not trigger auto sync too fast
 		// between 600s until 3000s
 		duration := time.Duration(rand.Intn(sleepMax-sleepMin)+sleepMin) * time.Second * 10
-		log.Println("-- Queuer sleeping for ", duration)
+		logger.Info("queuer sleeping", Fields{"sleep_seconds": duration.Seconds()})
 		time.Sleep(duration)
 
-		log.Println("-- Queuer started")
+		logger.Info("queuer started")
 		_, err := db.Exec(queueAutomaticPipesSQL)
 		if err != nil {
 			if !strings.Contains(err.Error(), `duplicate key value violates unique constraint`) {
-				bugsnag.Notify(err)
+				reportError(err, workerErrorMetadata("Queuer", nil))
 			}
 		}
-		log.Println("-- Queuer finished")
+		logger.Info("queuer finished")
 	}
 }
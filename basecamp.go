@@ -1,9 +1,11 @@
 package main
 
 import (
+	"context"
 	"encoding/json"
 	"errors"
 	"fmt"
+	"net/http"
 	"strconv"
 	"time"
 
@@ -56,10 +58,16 @@ func (s *BasecampService) setSince(since *time.Time) {
 	s.modifiedSince = since
 }
 
-func (s *BasecampService) client() *basecamp.Client {
-	return &basecamp.Client{
-		ModifiedSince: s.modifiedSince,
-		AccessToken:   s.token.AccessToken,
+func (s *BasecampService) client() *basecampClient {
+	return s.clientContext(s.context())
+}
+
+// clientContext returns client whose requests are canceled with ctx
+func (s *BasecampService) clientContext(ctx context.Context) *basecampClient {
+	return &basecampClient{
+		modifiedSince: s.modifiedSince,
+		accessToken:   s.token.AccessToken,
+		httpClient:    rateLimitedClientContext(ctx, s, http.DefaultTransport),
 	}
 }
 
@@ -130,14 +138,26 @@ func (s *BasecampService) Tasks() ([]*Task, error) {
 	if len(foreignObjects) == 0 {
 		return tasks, nil
 	}
-	for _, object := range foreignObjects {
+	todoLists := make([]*basecamp.TodoList, len(foreignObjects))
+	progress := newFetchProgress(s.context(), tasksPipeId, "todo lists", len(foreignObjects))
+	err = parallelFetch(s.context(), len(foreignObjects), func(ctx context.Context, i int) error {
+		object := foreignObjects[i]
 		//if object.UpdatedAt.Before(*s.modifiedSince) {
-		//	continue
+		//	return nil
 		//}
-		todoList, err := c.GetTodoList(s.AccountID, object.ProjectId, object.Id)
+		todoList, err := s.clientContext(ctx).GetTodoList(s.AccountID, object.ProjectId, object.Id)
 		if err != nil {
-			return nil, err
+			return err
 		}
+		todoLists[i] = todoList
+		progress.add()
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	for i, object := range foreignObjects {
+		todoList := todoLists[i]
 		if todoList == nil {
 			continue
 		}
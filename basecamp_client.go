@@ -0,0 +1,121 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"time"
+
+	"github.com/toggl/go-basecamp"
+)
+
+// go-basecamp sends requests with its own HTTP client, basecampClient
+// makes the same requests through rate limited client of the pipe
+// and decodes them into types of go-basecamp.
+
+const (
+	basecampUserAgent = "go-basecamp"
+	basecampBaseURL   = "https://basecamp.com/%d/api/v1/%s"
+	basecampAuthURL   = "https://launchpad.37signals.com/authorization.json"
+)
+
+type basecampClient struct {
+	accessToken   string
+	modifiedSince *time.Time
+	httpClient    *http.Client
+}
+
+func (c *basecampClient) GetAccounts() ([]*basecamp.Account, error) {
+	var authorization struct {
+		Accounts []*basecamp.Account `json:"accounts"`
+	}
+	if err := c.get(basecampAuthURL, &authorization); err != nil {
+		return nil, err
+	}
+	if authorization.Accounts == nil {
+		return nil, errors.New("'accounts' not found in response JSON")
+	}
+	var result []*basecamp.Account
+	for _, account := range authorization.Accounts {
+		if account.Product == "bcx" {
+			result = append(result, account)
+		}
+	}
+	return result, nil
+}
+
+func (c *basecampClient) GetPeople(accountID int) ([]*basecamp.Person, error) {
+	var result []*basecamp.Person
+	err := c.get(fmt.Sprintf(basecampBaseURL, accountID, "people.json"), &result)
+	return result, err
+}
+
+func (c *basecampClient) GetProjects(accountID int) ([]*basecamp.Project, error) {
+	var result []*basecamp.Project
+	err := c.get(fmt.Sprintf(basecampBaseURL, accountID, "projects.json"), &result)
+	return result, err
+}
+
+// GetAllTodoLists returns remaining and completed todo lists
+func (c *basecampClient) GetAllTodoLists(accountID int) ([]*basecamp.TodoList, error) {
+	remaining, err := c.fetchTodoLists(accountID, "todolists.json")
+	if err != nil {
+		return nil, err
+	}
+	completed, err := c.fetchTodoLists(accountID, "todolists/completed.json")
+	if err != nil {
+		return nil, err
+	}
+	return append(remaining, completed...), nil
+}
+
+func (c *basecampClient) fetchTodoLists(accountID int, listURL string) ([]*basecamp.TodoList, error) {
+	var result []*basecamp.TodoList
+	if err := c.get(fmt.Sprintf(basecampBaseURL, accountID, listURL), &result); err != nil {
+		return nil, err
+	}
+	for _, todoList := range result {
+		if todoList.Bucket.Type == "Project" {
+			todoList.ProjectId = todoList.Bucket.Id
+		}
+	}
+	return result, nil
+}
+
+func (c *basecampClient) GetTodoList(accountID, projectID, listID int) (*basecamp.TodoList, error) {
+	var result *basecamp.TodoList
+	err := c.get(fmt.Sprintf(basecampBaseURL, accountID, fmt.Sprintf("projects/%d/todolists/%d.json", projectID, listID)), &result)
+	return result, err
+}
+
+// get decodes response of url into v, v is left as is when
+// nothing was modified since modifiedSince
+func (c *basecampClient) get(url string, v interface{}) error {
+	req, err := http.NewRequest("GET", url, nil)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("User-Agent", basecampUserAgent)
+	req.Header.Set("Authorization", "Bearer "+c.accessToken)
+	if c.modifiedSince != nil {
+		req.Header.Set("If-Modified-Since", c.modifiedSince.UTC().Format(http.TimeFormat))
+	}
+	resp, err := c.httpClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	b, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return err
+	}
+	if resp.StatusCode == http.StatusNotModified {
+		return nil
+	}
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("%s failed with status code %d", url, resp.StatusCode)
+	}
+	return json.Unmarshal(b, v)
+}
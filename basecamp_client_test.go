@@ -0,0 +1,68 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+	"time"
+)
+
+// testServerTransport sends requests to test server instead of their host
+type testServerTransport struct {
+	target *url.URL
+}
+
+func (t *testServerTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	req = req.Clone(req.Context())
+	req.URL.Scheme, req.URL.Host = t.target.Scheme, t.target.Host
+	return http.DefaultTransport.RoundTrip(req)
+}
+
+func newTestBasecampClient(handler http.HandlerFunc) (*basecampClient, *httptest.Server) {
+	ts := httptest.NewServer(handler)
+	target, _ := url.Parse(ts.URL)
+	client := &http.Client{Transport: &testServerTransport{target: target}}
+	return &basecampClient{accessToken: "token", httpClient: client}, ts
+}
+
+func TestBasecampClientAccounts(t *testing.T) {
+	c, ts := newTestBasecampClient(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Authorization") != "Bearer token" {
+			t.Errorf("expected access token, got %q", r.Header.Get("Authorization"))
+		}
+		w.Write([]byte(`{"accounts": [
+			{"id": 1, "name": "Classic", "href": "https://basecamp.com/1", "product": "bcx"},
+			{"id": 2, "name": "Basecamp 3", "href": "https://3.basecamp.com/2", "product": "bc3"}
+		]}`))
+	})
+	defer ts.Close()
+
+	accounts, err := c.GetAccounts()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(accounts) != 1 || accounts[0].Id != 1 || accounts[0].Name != "Classic" {
+		t.Errorf("expected only bcx account, got %+v", accounts)
+	}
+}
+
+func TestBasecampClientNotModified(t *testing.T) {
+	since := time.Now().Add(-time.Hour)
+	c, ts := newTestBasecampClient(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("If-Modified-Since") != since.UTC().Format(http.TimeFormat) {
+			t.Errorf("expected If-Modified-Since header, got %q", r.Header.Get("If-Modified-Since"))
+		}
+		w.WriteHeader(http.StatusNotModified)
+	})
+	defer ts.Close()
+	c.modifiedSince = &since
+
+	projects, err := c.GetProjects(1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(projects) != 0 {
+		t.Errorf("expected no projects, got %d", len(projects))
+	}
+}
@@ -0,0 +1,475 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"code.google.com/p/goauth2/oauth"
+	"github.com/namsral/flag"
+)
+
+// Subcommands let operators act on pipes without the API, global flags
+// go before the subcommand, e.g.
+//
+//	pipes-api -environment=production run --workspace 1 --service asana --pipe tasks
+type command struct {
+	name    string
+	args    string
+	summary string
+	db      bool // needs config and database
+	run     func(args []string) error
+}
+
+var (
+	commands []*command
+
+	cliOutput io.Writer = os.Stdout
+	cliErrors io.Writer = os.Stderr
+	cliInput  io.Reader = os.Stdin
+)
+
+func init() {
+	commands = []*command{
+		{name: "run", args: "--workspace N --service S --pipe P [--payload FILE]",
+			summary: "Run pipe synchronously and print its status", db: true, run: runPipeCommand},
+		{name: "queue list", args: "[--state S] [--workspace N] [--service S] [--older-than D] [--limit N] [--json]",
+			summary: "List queued, locked and synced pipes, newest first", db: true, run: queueListCommand},
+		{name: "queue requeue", args: "--id N | --workspace N --service S --pipe P",
+			summary: "Queue pipe as first, bumps priority of queued pipe", db: true, run: queueRequeueCommand},
+		{name: "connections dump", args: "--workspace N --service S --pipe P [--output FILE]",
+			summary: "Print which Toggl objects imported objects map to as JSON", db: true, run: connectionsDumpCommand},
+		{name: "connections import", args: "--workspace N --service S --pipe P [--input FILE] [--merge]",
+			summary: "Replace connections with JSON of connections dump, or merge with --merge", db: true, run: connectionsImportCommand},
+		{name: "auth refresh", args: "--workspace N --service S [--force]",
+			summary: "Refresh expired OAuth 2 token, any token with --force", db: true, run: authRefreshCommand},
+		{name: "config validate", args: "",
+			summary: "Check config files of the environment", run: configValidateCommand},
+	}
+}
+
+// runCommand runs subcommand of args and returns exit code of the process
+func runCommand(args []string) int {
+	cmd := findCommand(args)
+	if cmd == nil {
+		printUsage(cliErrors)
+		if args[0] == "help" {
+			return 0
+		}
+		return 2
+	}
+	if cmd.db {
+		if err := setupCommand(); err != nil {
+			fmt.Fprintf(cliErrors, "%s: %v\n", cmd.name, err)
+			return 1
+		}
+		defer db.Close()
+	}
+	if err := cmd.run(args[len(strings.Fields(cmd.name)):]); err != nil {
+		if err != flag.ErrHelp {
+			fmt.Fprintf(cliErrors, "%s: %v\n", cmd.name, err)
+		}
+		return 1
+	}
+	return 0
+}
+
+func findCommand(args []string) *command {
+	for _, cmd := range commands {
+		words := strings.Fields(cmd.name)
+		if len(args) >= len(words) && strings.Join(args[:len(words)], " ") == cmd.name {
+			return cmd
+		}
+	}
+	return nil
+}
+
+func printUsage(w io.Writer) {
+	fmt.Fprintln(w, "Usage: pipes-api [flags] [command]")
+	fmt.Fprintln(w, "\nWithout command the API server is started. Commands:")
+	tw := tabwriter.NewWriter(w, 0, 4, 2, ' ', 0)
+	for _, cmd := range commands {
+		fmt.Fprintf(tw, "  %s %s\t%s\n", cmd.name, cmd.args, cmd.summary)
+	}
+	tw.Flush()
+}
+
+func setupCommand() error {
+	reporter, err := newErrorReporter(errorReporterName)
+	if err != nil {
+		return err
+	}
+	errorReporter = reporter
+	if err := loadConfig(); err != nil {
+		return err
+	}
+	db = connectDB(dbConnString)
+	return nil
+}
+
+func newCommandFlags(name string) *flag.FlagSet {
+	fs := flag.NewFlagSet("pipes-api "+name, flag.ContinueOnError)
+	fs.SetOutput(cliErrors)
+	return fs
+}
+
+// pipeTarget is the pipe or service a command acts on
+type pipeTarget struct {
+	workspaceID int
+	serviceID   string
+	pipeID      string
+}
+
+func (t *pipeTarget) register(fs *flag.FlagSet, withPipe bool) {
+	fs.IntVar(&t.workspaceID, "workspace", 0, "Workspace ID")
+	fs.StringVar(&t.serviceID, "service", "", "Service, e.g. asana")
+	if withPipe {
+		fs.StringVar(&t.pipeID, "pipe", "", "Pipe, e.g. projects")
+	}
+}
+
+func (t *pipeTarget) service(withPipe bool) (Service, error) {
+	if t.workspaceID < 1 {
+		return nil, errors.New("--workspace is required")
+	}
+	if withPipe && t.pipeID == "" {
+		return nil, errors.New("--pipe is required")
+	}
+	return getService(t.serviceID, t.workspaceID)
+}
+
+func readInput(name string) ([]byte, error) {
+	if name == "-" {
+		return ioutil.ReadAll(cliInput)
+	}
+	return ioutil.ReadFile(name)
+}
+
+func printJSON(v interface{}) error {
+	b, err := json.MarshalIndent(v, "", "  ")
+	if err != nil {
+		return err
+	}
+	_, err = fmt.Fprintln(cliOutput, string(b))
+	return err
+}
+
+func runPipeCommand(args []string) error {
+	fs := newCommandFlags("run")
+	var target pipeTarget
+	target.register(fs, true)
+	payloadFile := fs.String("payload", "", "File with JSON payload of the run, users pipe needs selected users, - reads stdin")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	if _, err := target.service(true); err != nil {
+		return err
+	}
+
+	pipe, err := loadPipe(target.workspaceID, target.serviceID, target.pipeID)
+	if err != nil {
+		return err
+	}
+	if pipe == nil {
+		return fmt.Errorf("pipe %s is not configured in workspace %d", pipesKey(target.serviceID, target.pipeID), target.workspaceID)
+	}
+	var payload []byte
+	if *payloadFile != "" {
+		if payload, err = readInput(*payloadFile); err != nil {
+			return err
+		}
+	}
+	if msg := pipe.validatePayload(payload); msg != "" {
+		return errors.New(msg)
+	}
+
+	lock, err := tryLockWorkspace(target.workspaceID)
+	if err != nil {
+		return err
+	}
+	defer lock.unlock()
+
+	pipe.run()
+	if err := printJSON(pipe.PipeStatus); err != nil {
+		return err
+	}
+	if pipe.PipeStatus == nil || pipe.PipeStatus.Status == "error" {
+		return errors.New("pipe run failed")
+	}
+	return nil
+}
+
+func printQueueEntries(entries []*QueueEntry) error {
+	tw := tabwriter.NewWriter(cliOutput, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(tw, "ID\tWORKSPACE\tKEY\tSTATE\tPRIORITY\tMANUAL\tCREATED\tLOCKED\tSYNCED")
+	formatTime := func(t *time.Time) string {
+		if t == nil {
+			return "-"
+		}
+		return t.Format(time.RFC3339)
+	}
+	for _, e := range entries {
+		fmt.Fprintf(tw, "%d\t%d\t%s\t%s\t%d\t%t\t%s\t%s\t%s\n", e.ID, e.WorkspaceID, e.Key, e.State,
+			e.Priority, e.Manual, e.CreatedAt.Format(time.RFC3339), formatTime(e.LockedAt), formatTime(e.SyncedAt))
+	}
+	return tw.Flush()
+}
+
+func queueListCommand(args []string) error {
+	fs := newCommandFlags("queue list")
+	state := fs.String("state", "", "Entries in the state: queued, locked or synced")
+	workspace := fs.String("workspace", "", "Entries of the workspace")
+	service := fs.String("service", "", "Entries of the service")
+	olderThan := fs.String("older-than", "", "Entries in their state for at least the duration, e.g. 30m")
+	limit := fs.String("limit", "", "Max number of entries")
+	asJSON := fs.Bool("json", false, "Print entries as JSON")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+
+	query := url.Values{}
+	for param, value := range map[string]string{
+		"state":        *state,
+		"workspace_id": *workspace,
+		"service":      *service,
+		"older_than":   *olderThan,
+		"limit":        *limit,
+	} {
+		if value != "" {
+			query.Set(param, value)
+		}
+	}
+	filter, invalid := parseQueueFilter(query)
+	if invalid != nil {
+		return fmt.Errorf("%s: %s", invalid.Field, invalid.Message)
+	}
+	entries, err := listQueueEntries(filter)
+	if err != nil {
+		return err
+	}
+	if *asJSON {
+		return printJSON(entries)
+	}
+	return printQueueEntries(entries)
+}
+
+func queueRequeueCommand(args []string) error {
+	fs := newCommandFlags("queue requeue")
+	var target pipeTarget
+	target.register(fs, true)
+	id := fs.Int64("id", 0, "Queue entry ID")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+
+	var entry *QueueEntry
+	if *id > 0 {
+		loaded, err := loadQueueEntry(*id)
+		if err != nil {
+			return err
+		}
+		if loaded == nil {
+			return fmt.Errorf("queue entry %d not found", *id)
+		}
+		entry = loaded
+	} else {
+		if _, err := target.service(true); err != nil {
+			return errors.New("--id or --workspace, --service and --pipe are required")
+		}
+		pipe, err := loadPipe(target.workspaceID, target.serviceID, target.pipeID)
+		if err != nil {
+			return err
+		}
+		if pipe == nil {
+			return fmt.Errorf("pipe %s is not configured in workspace %d", pipesKey(target.serviceID, target.pipeID), target.workspaceID)
+		}
+		entry = &QueueEntry{WorkspaceID: pipe.workspaceID, Key: pipe.key}
+	}
+
+	pending, err := requeueQueueEntry(entry)
+	if err != nil {
+		return err
+	}
+	if pending == nil || pending.State == queueStateLocked {
+		return errors.New("pipe is running, unlock it with the admin API first if it is stuck")
+	}
+	return printQueueEntries([]*QueueEntry{pending})
+}
+
+func connectionsDumpCommand(args []string) error {
+	fs := newCommandFlags("connections dump")
+	var target pipeTarget
+	target.register(fs, true)
+	output := fs.String("output", "", "File to write connections to instead of stdout")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	service, err := target.service(true)
+	if err != nil {
+		return err
+	}
+
+	connection, err := loadConnection(service, target.pipeID)
+	if err != nil {
+		return err
+	}
+	if *output == "" {
+		return printJSON(connection.Data)
+	}
+	b, err := json.MarshalIndent(connection.Data, "", "  ")
+	if err != nil {
+		return err
+	}
+	if err := ioutil.WriteFile(*output, b, 0600); err != nil {
+		return err
+	}
+	fmt.Fprintf(cliOutput, "wrote %d connections to %s\n", len(connection.Data), *output)
+	return nil
+}
+
+func connectionsImportCommand(args []string) error {
+	fs := newCommandFlags("connections import")
+	var target pipeTarget
+	target.register(fs, true)
+	input := fs.String("input", "-", "File with connections of connections dump, - reads stdin")
+	merge := fs.Bool("merge", false, "Keep existing connections that are not in the input")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	service, err := target.service(true)
+	if err != nil {
+		return err
+	}
+
+	b, err := readInput(*input)
+	if err != nil {
+		return err
+	}
+	var data map[string]int
+	if err := json.Unmarshal(b, &data); err != nil {
+		return fmt.Errorf("input must map foreign IDs to Toggl IDs: %w", err)
+	}
+	connection := NewConnection(service, target.pipeID)
+	if *merge {
+		if connection, err = loadConnection(service, target.pipeID); err != nil {
+			return err
+		}
+	}
+	for foreignID, togglID := range data {
+		connection.Data[foreignID] = togglID
+	}
+	if err := connection.save(); err != nil {
+		return err
+	}
+	fmt.Fprintf(cliOutput, "saved %d connections of %s\n", len(connection.Data), connection.key)
+	return nil
+}
+
+func authRefreshCommand(args []string) error {
+	fs := newCommandFlags("auth refresh")
+	var target pipeTarget
+	target.register(fs, false)
+	force := fs.Bool("force", false, "Refresh token that is not expired yet")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	service, err := target.service(false)
+	if err != nil {
+		return err
+	}
+
+	auth, err := loadAuth(service)
+	if err != nil {
+		return err
+	}
+	if auth == nil {
+		return fmt.Errorf("workspace %d has not authorized %s", target.workspaceID, target.serviceID)
+	}
+	if availableAuthorizations[target.serviceID] != "oauth2" {
+		fmt.Fprintf(cliOutput, "%s uses %s, its tokens are not refreshed\n", target.serviceID, availableAuthorizations[target.serviceID])
+		return nil
+	}
+	if err := auth.refreshToken(*force); err != nil {
+		return classifyError(err)
+	}
+	var token oauth.Token
+	if err := json.Unmarshal(auth.Data, &token); err != nil {
+		return err
+	}
+	if token.Expiry.IsZero() {
+		fmt.Fprintf(cliOutput, "token of %s does not expire\n", target.serviceID)
+		return nil
+	}
+	fmt.Fprintf(cliOutput, "token of %s expires at %s\n", target.serviceID, token.Expiry.Format(time.RFC3339))
+	return nil
+}
+
+func configValidateCommand(args []string) error {
+	if err := newCommandFlags("config validate").Parse(args); err != nil {
+		return err
+	}
+	if err := loadConfig(); err != nil {
+		return err
+	}
+	problems := validateConfig()
+	for _, problem := range problems {
+		fmt.Fprintln(cliOutput, problem)
+	}
+	if len(problems) > 0 {
+		return fmt.Errorf("found %d problems in config of %s environment", len(problems), environment)
+	}
+	fmt.Fprintf(cliOutput, "config of %s environment is valid\n", environment)
+	return nil
+}
+
+// validateConfig lists problems of loaded config in current environment
+func validateConfig() []string {
+	var problems []string
+	for _, integration := range availableIntegrations {
+		if _, err := getService(integration.ID, 0); err != nil {
+			problems = append(problems, "integrations.json: unknown service "+integration.ID)
+		}
+		switch integration.AuthType {
+		case "oauth2":
+			if _, found := oAuth2Configs[integration.ID+"_"+environment]; !found {
+				problems = append(problems, "oauth2.json: missing "+integration.ID+"_"+environment)
+			}
+		case "oauth1":
+			if _, found := oAuth1Configs[integration.ID]; !found {
+				problems = append(problems, "oauth1.json: missing "+integration.ID)
+			}
+		default:
+			problems = append(problems, fmt.Sprintf("integrations.json: %s has invalid auth_type %q", integration.ID, integration.AuthType))
+		}
+	}
+	for _, hosts := range []struct {
+		name  string
+		value map[string]string
+	}{
+		{"return_url", urls.ReturnURL},
+		{"toggl_api_host", urls.TogglAPIHost},
+		{"pipes_api_host", urls.PipesAPIHost},
+	} {
+		if hosts.value[environment] == "" {
+			problems = append(problems, fmt.Sprintf("urls.json: missing %s of %s", hosts.name, environment))
+		}
+	}
+	if _, err := serviceLimits(); err != nil {
+		problems = append(problems, "service_concurrency flag: "+err.Error())
+	}
+	if _, err := queueWeights(); err != nil {
+		problems = append(problems, "service_weights flag: "+err.Error())
+	}
+	if workersCount < 1 {
+		problems = append(problems, "workers_count flag: must be positive, got "+strconv.Itoa(workersCount))
+	}
+	return problems
+}
@@ -0,0 +1,95 @@
+package main
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// captureCLI redirects command output to buffers until restore is called
+func captureCLI() (output, errors *bytes.Buffer, restore func()) {
+	output, errors = &bytes.Buffer{}, &bytes.Buffer{}
+	prevOutput, prevErrors := cliOutput, cliErrors
+	cliOutput, cliErrors = output, errors
+	return output, errors, func() { cliOutput, cliErrors = prevOutput, prevErrors }
+}
+
+func TestRunCommandUsage(t *testing.T) {
+	_, errors, restore := captureCLI()
+	defer restore()
+
+	if code := runCommand([]string{"queue", "purge"}); code != 2 {
+		t.Errorf("expected exit code 2 for unknown command, got %d", code)
+	}
+	for _, name := range []string{"run", "queue list", "queue requeue", "connections dump", "connections import", "auth refresh", "config validate"} {
+		if !strings.Contains(errors.String(), "  "+name+" ") {
+			t.Errorf("expected usage of %s in %q", name, errors.String())
+		}
+	}
+	if code := runCommand([]string{"help"}); code != 0 {
+		t.Errorf("expected help to succeed, got %d", code)
+	}
+}
+
+func TestFindCommand(t *testing.T) {
+	if cmd := findCommand([]string{"queue", "list", "--state", "locked"}); cmd == nil || cmd.name != "queue list" {
+		t.Errorf("expected queue list, got %+v", cmd)
+	}
+	if cmd := findCommand([]string{"queue"}); cmd != nil {
+		t.Errorf("expected no command without subcommand, got %s", cmd.name)
+	}
+}
+
+func TestConfigValidateCommand(t *testing.T) {
+	dir, err := ioutil.TempDir("", "pipes-config")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	if err := os.Mkdir(filepath.Join(dir, "config"), 0700); err != nil {
+		t.Fatal(err)
+	}
+	writeConfig := func(name, content string) {
+		if err := ioutil.WriteFile(filepath.Join(dir, "config", name), []byte(content), 0600); err != nil {
+			t.Fatal(err)
+		}
+	}
+	writeConfig("integrations.json", `[{"id":"asana","auth_type":"oauth2"},{"id":"freshbooks","auth_type":"oauth1"}]`)
+	writeConfig("oauth2.json", `{"asana_development":{}}`)
+	writeConfig("oauth1.json", `{"freshbooks":{}}`)
+	writeConfig("urls.json", `{"return_url":{"development":"http://localhost"},"toggl_api_host":{"development":"http://localhost"},"pipes_api_host":{"development":"http://localhost"}}`)
+
+	defer loadIntegrations()
+	defer func(dir, env string, workers int) {
+		workdir, environment, workersCount = dir, env, workers
+	}(workdir, environment, workersCount)
+	savedURLs := urls
+	defer func() { urls = savedURLs }()
+	workdir, environment, workersCount = dir, "development", 1
+
+	output, errors, restore := captureCLI()
+	defer restore()
+	if code := runCommand([]string{"config", "validate"}); code != 0 {
+		t.Fatalf("expected valid config, got %d %s %s", code, output, errors)
+	}
+
+	output.Reset()
+	environment = "production"
+	if code := runCommand([]string{"config", "validate"}); code != 1 {
+		t.Fatalf("expected invalid config, got %d", code)
+	}
+	for _, problem := range []string{"oauth2.json: missing asana_production", "urls.json: missing toggl_api_host of production"} {
+		if !strings.Contains(output.String(), problem) {
+			t.Errorf("expected %q in %q", problem, output.String())
+		}
+	}
+
+	writeConfig("oauth2.json", `{"asana_development":{},}`)
+	errors.Reset()
+	if code := runCommand([]string{"config", "validate"}); code != 1 || !strings.Contains(errors.String(), "parse oauth2.json") {
+		t.Errorf("expected parse error, got %d %q", code, errors.String())
+	}
+}
@@ -1,6 +1,7 @@
 package main
 
 import (
+	"context"
 	"database/sql"
 	"encoding/json"
 	"strconv"
@@ -39,6 +40,7 @@ type (
 		pipeID      string
 		key         string
 		Data        map[string]int
+		ctx         context.Context
 	}
 	ReversedConnection struct {
 		Data map[int]string
@@ -50,6 +52,7 @@ func NewConnection(s Service, pipeID string) *Connection {
 		workspaceID: s.WorkspaceID(),
 		key:         s.keyFor(pipeID),
 		Data:        make(map[string]int),
+		ctx:         s.context(),
 	}
 }
 
@@ -67,7 +70,7 @@ func (c *ReversedConnection) getKeys() []int {
 }
 
 func loadConnection(s Service, pipeID string) (*Connection, error) {
-	rows, err := db.Query(selectConnectionSQL, s.WorkspaceID(), s.keyFor(pipeID))
+	rows, err := db.QueryContext(s.context(), selectConnectionSQL, s.WorkspaceID(), s.keyFor(pipeID))
 	if err != nil {
 		return nil, err
 	}
@@ -98,7 +101,7 @@ func (c *Connection) save() error {
 	if err != nil {
 		return err
 	}
-	_, err = db.Exec(insertConnectionSQL, c.workspaceID, c.key, b)
+	_, err = db.ExecContext(c.ctx, insertConnectionSQL, c.workspaceID, c.key, b)
 	if err != nil {
 		return err
 	}
@@ -2,17 +2,14 @@ package main
 
 import (
 	"database/sql"
-	"log"
-
-	_ "github.com/lib/pq"
 )
 
 var db *sql.DB
 
 func connectDB(connString string) *sql.DB {
-	result, err := sql.Open("postgres", connString)
+	result, err := sql.Open(tracedDriverName, connString)
 	if err != nil {
-		log.Fatal(err)
+		logger.Fatal("failed to open database", Fields{"error": err})
 	}
 	return result
 }
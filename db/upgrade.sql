@@ -0,0 +1,210 @@
+-- upgrade.sql brings a database created with an earlier schema.sql up to
+-- date, fresh databases are created with schema.sql alone. It can be run
+-- more than once and must be run before the new version is deployed:
+--
+--   psql pipes_production < db/upgrade.sql
+--
+-- ADD COLUMN IF NOT EXISTS needs PostgreSQL 9.6 or later.
+
+BEGIN;
+
+ALTER TABLE pipes_status ADD COLUMN IF NOT EXISTS cancel_requested_at timestamp without time zone DEFAULT NULL;
+
+-- SERIAL would create its sequence even when the column exists
+DO $$
+BEGIN
+  IF NOT EXISTS (
+    SELECT 1 FROM information_schema.columns
+    WHERE table_name = 'queued_pipes' AND column_name = 'id'
+  ) THEN
+    ALTER TABLE queued_pipes ADD COLUMN id SERIAL PRIMARY KEY;
+  END IF;
+END;
+$$;
+ALTER TABLE queued_pipes ADD COLUMN IF NOT EXISTS manual BOOLEAN DEFAULT false;
+ALTER TABLE queued_pipes ADD COLUMN IF NOT EXISTS started_at timestamp without time zone DEFAULT NULL;
+
+CREATE TABLE IF NOT EXISTS jobs(
+  id VARCHAR(36) PRIMARY KEY,
+  workspace_id INTEGER,
+  kind VARCHAR(50),
+  key VARCHAR(50),
+  state VARCHAR(20),
+  progress INTEGER DEFAULT 0,
+  error TEXT,
+  error_code VARCHAR(50),
+  created_at timestamp without time zone DEFAULT now(),
+  updated_at timestamp without time zone DEFAULT now()
+);
+
+ALTER TABLE jobs ADD COLUMN IF NOT EXISTS error_code VARCHAR(50);
+
+CREATE INDEX IF NOT EXISTS jobs_workspace_key_state ON jobs USING btree (workspace_id, key, state);
+
+CREATE TABLE IF NOT EXISTS pipe_steps(
+  workspace_id INTEGER,
+  key VARCHAR(50),
+  synced_at timestamp without time zone DEFAULT now(),
+  PRIMARY KEY (workspace_id, key)
+);
+
+-- get_queued_pipes() without arguments is replaced by the one below
+DROP FUNCTION IF EXISTS get_queued_pipes();
+
+-- get_queued_pipes locks a batch of queued pipes for a worker.
+-- Manual runs are picked before automatic ones and workspaces that used less
+-- worker time in the last hour go first. Time used by workspaces of a service
+-- is divided by its weight in service_weights (e.g. {"asana": 2}), so they can
+-- use that many times more before others go first. Workspaces with a locked
+-- pipe are skipped and services listed in service_limits (e.g. {"asana": 3})
+-- get at most that many pipes besides their started runs, start_queued_pipe
+-- checks the limit again when the run starts. Locks older than stale_after
+-- are left to remove_locked_from_queue and block nothing. Calls are serialized,
+-- so that concurrent workers do not pick over the limits.
+CREATE OR REPLACE FUNCTION get_queued_pipes(service_limits JSON, service_weights JSON, batch_size INTEGER, stale_after INTERVAL) RETURNS TABLE(workspace_id INTEGER, key VARCHAR(50)) AS $$
+BEGIN
+  PERFORM pg_advisory_xact_lock(hashtext('queued_pipes'));
+
+  RETURN QUERY
+  WITH locked AS (
+    SELECT l.workspace_id, split_part(l.key, ':', 1) AS service, l.started_at
+    FROM queued_pipes l
+    WHERE l.locked_at > now() - stale_after AND l.synced_at IS NULL
+  ),
+  running AS (
+    SELECT locked.service, count(*) AS runs
+    FROM locked
+    WHERE locked.started_at IS NOT NULL
+    GROUP BY locked.service
+  ),
+  workspace_usage AS (
+    SELECT u.workspace_id, sum(extract(epoch FROM u.synced_at - coalesce(u.started_at, u.locked_at))) AS seconds
+    FROM queued_pipes u
+    WHERE u.synced_at > now() - interval '1 hour'
+    GROUP BY u.workspace_id
+  ),
+  pending_queue AS (
+    SELECT DISTINCT ON (t.workspace_id) t.workspace_id, t.key, t.manual, t.priority, t.created_at
+    FROM (
+      SELECT q.workspace_id, q.key, q.manual, q.priority, q.created_at
+      FROM queued_pipes q
+      WHERE q.locked_at IS NULL AND q.synced_at IS NULL
+      AND NOT EXISTS (SELECT 1 FROM locked WHERE locked.workspace_id = q.workspace_id)
+      FOR UPDATE
+    ) as t
+    ORDER BY t.workspace_id, t.manual DESC, t.priority DESC, t.created_at ASC
+  ),
+  ranked_queue AS (
+    SELECT p.workspace_id, p.key, p.manual, p.priority, p.created_at,
+      w.service,
+      coalesce(u.seconds, 0) / w.weight AS weighted_usage,
+      row_number() OVER (
+        PARTITION BY w.service
+        ORDER BY p.manual DESC, coalesce(u.seconds, 0) / w.weight ASC, p.priority DESC, p.created_at ASC
+      ) AS service_rank
+    FROM pending_queue p
+    CROSS JOIN LATERAL (
+      SELECT split_part(p.key, ':', 1) AS service,
+        coalesce((service_weights->>split_part(p.key, ':', 1))::float8, 1) AS weight
+    ) w
+    LEFT JOIN workspace_usage u ON u.workspace_id = p.workspace_id
+  )
+  UPDATE
+    queued_pipes
+  SET
+    locked_at = NOW()
+  FROM (
+    SELECT rq.workspace_id, rq.key
+    FROM ranked_queue rq
+    LEFT JOIN running r ON r.service = rq.service
+    WHERE (service_limits->>rq.service) IS NULL
+    OR rq.service_rank + coalesce(r.runs, 0) <= (service_limits->>rq.service)::integer
+    ORDER BY rq.manual DESC, rq.weighted_usage ASC, rq.priority DESC, rq.created_at ASC
+    LIMIT batch_size
+  ) as pipe
+  WHERE pipe.workspace_id = queued_pipes.workspace_id AND pipe.key = queued_pipes.key
+  AND queued_pipes.locked_at IS NULL AND queued_pipes.synced_at IS NULL
+  RETURNING pipe.workspace_id, pipe.key;
+END;
+$$
+LANGUAGE plpgsql;
+
+-- start_queued_pipe marks locked pipe as started unless its service already
+-- has as many started runs as service_limits allow, pipes that are not
+-- started are put back to queue by the worker.
+CREATE OR REPLACE FUNCTION start_queued_pipe(workspace_id_param INTEGER, key_param VARCHAR(50), service_limits JSON, stale_after INTERVAL) RETURNS BOOLEAN AS $$
+DECLARE
+  service_name TEXT := split_part(key_param, ':', 1);
+  service_limit INTEGER := (service_limits->>split_part(key_param, ':', 1))::integer;
+BEGIN
+  PERFORM pg_advisory_xact_lock(hashtext('queued_pipes'));
+
+  IF service_limit IS NOT NULL AND (
+    SELECT count(*) FROM queued_pipes r
+    WHERE split_part(r.key, ':', 1) = service_name
+    AND r.started_at > now() - stale_after
+    AND r.locked_at IS NOT NULL AND r.synced_at IS NULL
+  ) >= service_limit THEN
+    RETURN false;
+  END IF;
+
+  UPDATE queued_pipes
+  SET started_at = now()
+  WHERE queued_pipes.workspace_id = workspace_id_param
+  AND queued_pipes.key = key_param
+  AND queued_pipes.locked_at IS NOT NULL
+  AND queued_pipes.started_at IS NULL
+  AND queued_pipes.synced_at IS NULL;
+  RETURN FOUND;
+END;
+$$
+LANGUAGE plpgsql;
+
+CREATE OR REPLACE FUNCTION queue_pipe_as_first(workspace_id_param INTEGER, key_param VARCHAR(50)) RETURNS VOID AS $$
+BEGIN
+  WITH priority_cte AS (
+    SELECT max(priority)+1 as new_priority FROM queued_pipes WHERE locked_at IS NULL AND synced_at IS NULL
+  ),
+  existing_pipe AS
+  (
+    UPDATE queued_pipes
+    SET priority = new_priority, manual = true FROM priority_cte
+    WHERE workspace_id = workspace_id_param
+    AND key = key_param
+    AND locked_at IS NULL
+    AND synced_at IS NULL
+    RETURNING workspace_id
+  )
+  INSERT INTO queued_pipes (workspace_id, key, priority, manual)
+  SELECT workspace_id_param, key_param, new_priority, true FROM priority_cte
+  WHERE NOT EXISTS (SELECT 1 FROM existing_pipe)
+  AND NOT EXISTS
+  (
+    SELECT 1 FROM queued_pipes
+    WHERE workspace_id = workspace_id_param
+    AND key = key_param
+    AND synced_at IS NULL
+    FOR UPDATE
+  );
+END;
+$$
+LANGUAGE plpgsql;
+
+CREATE OR REPLACE FUNCTION remove_finished_jobs(age INTERVAL) RETURNS VOID AS $$
+BEGIN
+  DELETE FROM jobs
+  WHERE state IN ('succeeded', 'failed', 'canceled')
+  AND updated_at < (now() - age);
+END;
+$$
+LANGUAGE plpgsql;
+
+ALTER TABLE jobs OWNER TO pipes_user;
+ALTER TABLE pipe_steps OWNER TO pipes_user;
+
+ALTER FUNCTION get_queued_pipes(service_limits JSON, service_weights JSON, batch_size INTEGER, stale_after INTERVAL) OWNER TO pipes_user;
+ALTER FUNCTION start_queued_pipe(workspace_id_param INTEGER, key_param VARCHAR(50), service_limits JSON, stale_after INTERVAL) OWNER TO pipes_user;
+ALTER FUNCTION queue_pipe_as_first(workspace_id_param INTEGER, key_param VARCHAR(50)) OWNER TO pipes_user;
+ALTER FUNCTION remove_finished_jobs(age INTERVAL) OWNER TO pipes_user;
+
+COMMIT;
@@ -0,0 +1,70 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"database/sql/driver"
+	"errors"
+
+	"github.com/lib/pq"
+	"go.opentelemetry.io/otel/api/kv"
+)
+
+// tracedDriverName is postgres driver that creates spans for queries
+// made with a context of an ongoing trace, queries outside of traces
+// like the queue polling are not traced.
+const tracedDriverName = "postgres-traced"
+
+func init() {
+	sql.Register(tracedDriverName, &tracedDriver{&pq.Driver{}})
+}
+
+type tracedDriver struct {
+	driver.Driver
+}
+
+// tracedConnTarget is the part of pq connection the traced connection relies on
+type tracedConnTarget interface {
+	driver.Conn
+	driver.QueryerContext
+	driver.ExecerContext
+	driver.ConnBeginTx
+	driver.Pinger
+}
+
+func (d *tracedDriver) Open(name string) (driver.Conn, error) {
+	conn, err := d.Driver.Open(name)
+	if err != nil {
+		return nil, err
+	}
+	target, ok := conn.(tracedConnTarget)
+	if !ok {
+		conn.Close()
+		return nil, errors.New("postgres connection does not support contexts")
+	}
+	return &tracedConn{target}, nil
+}
+
+type tracedConn struct {
+	tracedConnTarget
+}
+
+func (c *tracedConn) QueryContext(ctx context.Context, query string, args []driver.NamedValue) (driver.Rows, error) {
+	if !hasSpan(ctx) {
+		return c.tracedConnTarget.QueryContext(ctx, query, args)
+	}
+	ctx, span := startSpan(ctx, "sql.query", kv.String("db.system", "postgresql"), kv.String("db.statement", query))
+	rows, err := c.tracedConnTarget.QueryContext(ctx, query, args)
+	endSpan(ctx, span, err)
+	return rows, err
+}
+
+func (c *tracedConn) ExecContext(ctx context.Context, query string, args []driver.NamedValue) (driver.Result, error) {
+	if !hasSpan(ctx) {
+		return c.tracedConnTarget.ExecContext(ctx, query, args)
+	}
+	ctx, span := startSpan(ctx, "sql.exec", kv.String("db.system", "postgresql"), kv.String("db.statement", query))
+	result, err := c.tracedConnTarget.ExecContext(ctx, query, args)
+	endSpan(ctx, span, err)
+	return result, err
+}
@@ -0,0 +1,313 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/bugsnag/bugsnag-go"
+	gouuid "github.com/nu7hatch/gouuid"
+	"go.opentelemetry.io/otel/api/trace"
+)
+
+// ErrorMetadata is extra data of reported error grouped in tabs,
+// e.g. "pipe", "workspace" or "run"
+type ErrorMetadata map[string]Fields
+
+// ErrorReporter sends errors to an error tracking service
+type ErrorReporter interface {
+	Report(err error, metadata ErrorMetadata)
+}
+
+var errorReporter ErrorReporter = &LogErrorReporter{}
+
+// newErrorReporter creates reporter selected by error_reporter flag
+func newErrorReporter(name string) (ErrorReporter, error) {
+	switch name {
+	case "bugsnag":
+		return NewBugsnagErrorReporter(bugsnagAPIKey, environment), nil
+	case "sentry":
+		return NewSentryErrorReporter(sentryDSN, environment)
+	case "log":
+		return &LogErrorReporter{}, nil
+	case "memory":
+		return &MemoryErrorReporter{}, nil
+	default:
+		return nil, fmt.Errorf("unknown error reporter %q, expected bugsnag, sentry, log or memory", name)
+	}
+}
+
+// reportError reports err unless it is caused by users or providers,
+// the error code is added to metadata, tokens, secrets and emails
+// are redacted before err and metadata reach the reporter
+func reportError(err error, metadata ErrorMetadata) {
+	if err == nil {
+		return
+	}
+	pipeErr := classifyError(err)
+	if !pipeErr.alert() {
+		return
+	}
+	if metadata == nil {
+		metadata = ErrorMetadata{}
+	}
+	metadata["error"] = Fields{"code": pipeErr.Code}
+	errorReporter.Report(redactError(err), redactMetadata(metadata))
+}
+
+// redactMetadata returns copy of metadata with redacted values
+func redactMetadata(metadata ErrorMetadata) ErrorMetadata {
+	redactedMetadata := ErrorMetadata{}
+	for tab, fields := range metadata {
+		redactedFields := Fields{}
+		for k, v := range fields {
+			redactedFields[k] = redactValue(v)
+		}
+		redactedMetadata[tab] = redactedFields
+	}
+	return redactedMetadata
+}
+
+// reportPipeError reports error with pipe, workspace and run metadata
+func reportPipeError(p *Pipe, err error) {
+	reportError(err, pipeErrorMetadata(p))
+}
+
+// reportJobError reports error with job and workspace metadata
+func reportJobError(job *Job, err error) {
+	reportError(err, ErrorMetadata{
+		"job": {
+			"id":   job.ID,
+			"kind": job.Kind,
+			"key":  job.key,
+		},
+		"workspace": {"id": job.workspaceID},
+	})
+}
+
+// serviceErrorMetadata is metadata of errors of the service, errors
+// during pipe runs get metadata of the pipe and run as well
+func serviceErrorMetadata(s Service) ErrorMetadata {
+	metadata := ErrorMetadata{}
+	if p := runPipe(s.context()); p != nil {
+		metadata = pipeErrorMetadata(p)
+	}
+	metadata["service"] = Fields{"name": s.Name()}
+	metadata["workspace"] = Fields{"id": s.WorkspaceID()}
+	return metadata
+}
+
+// workerErrorMetadata is metadata of errors of background workers
+// that happen outside of pipe runs, e.g. when reading the queue
+func workerErrorMetadata(pool string, fields Fields) ErrorMetadata {
+	metadata := Fields{"pool": pool}
+	for key, value := range fields {
+		metadata[key] = value
+	}
+	return ErrorMetadata{"worker": metadata}
+}
+
+func pipeErrorMetadata(p *Pipe) ErrorMetadata {
+	metadata := ErrorMetadata{
+		"pipe": {
+			"id":             p.ID,
+			"name":           p.Name,
+			"service":        p.serviceID,
+			"key":            p.key,
+			"service_params": string(p.ServiceParams),
+		},
+		"workspace": {"id": p.workspaceID},
+	}
+	run := Fields{}
+	if spanContext := trace.SpanFromContext(p.context()).SpanContext(); spanContext.IsValid() {
+		run["trace_id"] = spanContext.TraceID.String()
+	}
+	if p.PipeStatus != nil {
+		run["status"] = p.PipeStatus.Status
+		run["sync_date"] = p.PipeStatus.SyncDate
+		run["throttled_seconds"] = p.PipeStatus.ThrottledSeconds
+		if p.PipeStatus.StackTrace != "" {
+			run["stack_trace"] = p.PipeStatus.StackTrace
+		}
+	}
+	if len(run) > 0 {
+		metadata["run"] = run
+	}
+	return metadata
+}
+
+// BugsnagErrorReporter notifies Bugsnag in production and staging
+type BugsnagErrorReporter struct{}
+
+func NewBugsnagErrorReporter(apiKey, releaseStage string) *BugsnagErrorReporter {
+	bugsnag.Configure(bugsnag.Configuration{
+		APIKey:              apiKey,
+		ReleaseStage:        releaseStage,
+		NotifyReleaseStages: []string{"production", "staging"},
+	})
+	return &BugsnagErrorReporter{}
+}
+
+func (r *BugsnagErrorReporter) Report(err error, metadata ErrorMetadata) {
+	bugsnagMetadata := bugsnag.MetaData{}
+	for tab, fields := range metadata {
+		bugsnagMetadata[tab] = fields
+	}
+	bugsnag.Notify(err, bugsnagMetadata, bugsnag.ErrorClass{Name: errorType(err)})
+}
+
+// SentryErrorReporter sends events to store endpoint of Sentry
+// compatible services, metadata is sent as event extra data
+type SentryErrorReporter struct {
+	storeURL    string
+	key         string
+	environment string
+	client      *http.Client
+	wg          sync.WaitGroup
+}
+
+// NewSentryErrorReporter parses DSN of form https://<key>@<host>/<project>
+func NewSentryErrorReporter(dsn, environment string) (*SentryErrorReporter, error) {
+	u, err := url.Parse(dsn)
+	if err != nil {
+		return nil, fmt.Errorf("invalid sentry DSN: %v", err)
+	}
+	project := strings.Trim(u.Path, "/")
+	if u.User == nil || u.User.Username() == "" || project == "" {
+		return nil, fmt.Errorf("invalid sentry DSN, expected https://<key>@<host>/<project>")
+	}
+	storeURL := fmt.Sprintf("%s://%s/api/%s/store/", u.Scheme, u.Host, project)
+	return &SentryErrorReporter{
+		storeURL:    storeURL,
+		key:         u.User.Username(),
+		environment: environment,
+		client:      &http.Client{Timeout: 10 * time.Second},
+	}, nil
+}
+
+type sentryEvent struct {
+	EventID     string                       `json:"event_id"`
+	Timestamp   string                       `json:"timestamp"`
+	Level       string                       `json:"level"`
+	Platform    string                       `json:"platform"`
+	Environment string                       `json:"environment"`
+	Exception   map[string][]sentryException `json:"exception"`
+	Tags        map[string]string            `json:"tags,omitempty"`
+	Extra       map[string]interface{}       `json:"extra,omitempty"`
+}
+
+type sentryException struct {
+	Type  string `json:"type"`
+	Value string `json:"value"`
+}
+
+func (r *SentryErrorReporter) Report(err error, metadata ErrorMetadata) {
+	event := r.event(err, metadata)
+	r.wg.Add(1)
+	go func() {
+		defer r.wg.Done()
+		if sendErr := r.send(event); sendErr != nil {
+			logger.Error("failed to report error to sentry", Fields{"error": sendErr, "reported_error": err})
+		}
+	}()
+}
+
+// flush waits until reported events are sent
+func (r *SentryErrorReporter) flush() {
+	r.wg.Wait()
+}
+
+func (r *SentryErrorReporter) event(err error, metadata ErrorMetadata) *sentryEvent {
+	eventID := ""
+	if u4, uuidErr := gouuid.NewV4(); uuidErr == nil {
+		eventID = strings.Replace(u4.String(), "-", "", -1)
+	}
+	event := &sentryEvent{
+		EventID:     eventID,
+		Timestamp:   time.Now().UTC().Format(time.RFC3339),
+		Level:       "error",
+		Platform:    "go",
+		Environment: r.environment,
+		Exception: map[string][]sentryException{
+			"values": {{Type: errorType(err), Value: err.Error()}},
+		},
+		Tags:  map[string]string{},
+		Extra: map[string]interface{}{},
+	}
+	for tab, fields := range metadata {
+		event.Extra[tab] = fields
+		if id, ok := fields["id"]; ok && (tab == "pipe" || tab == "workspace") {
+			event.Tags[tab] = fmt.Sprintf("%v", id)
+		}
+	}
+	if service, ok := metadata["pipe"]["service"]; ok {
+		event.Tags["service"] = fmt.Sprintf("%v", service)
+	}
+	return event
+}
+
+func (r *SentryErrorReporter) send(event *sentryEvent) error {
+	b, err := json.Marshal(event)
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequest("POST", r.storeURL, bytes.NewReader(b))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("X-Sentry-Auth", fmt.Sprintf(
+		"Sentry sentry_version=7, sentry_client=pipes-api/1.0, sentry_key=%s", r.key))
+	resp, err := r.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode >= 300 {
+		return fmt.Errorf("sentry responded with status code %d", resp.StatusCode)
+	}
+	return nil
+}
+
+// LogErrorReporter writes reported errors to the log only
+type LogErrorReporter struct{}
+
+func (r *LogErrorReporter) Report(err error, metadata ErrorMetadata) {
+	fields := Fields{"error": err}
+	for tab, tabFields := range metadata {
+		for k, v := range tabFields {
+			fields[tab+"."+k] = v
+		}
+	}
+	logger.Error("error reported", fields)
+}
+
+// ReportedError is an error recorded by MemoryErrorReporter
+type ReportedError struct {
+	Err      error
+	Metadata ErrorMetadata
+}
+
+// MemoryErrorReporter keeps reported errors in memory, used in tests
+type MemoryErrorReporter struct {
+	mu     sync.Mutex
+	errors []ReportedError
+}
+
+func (r *MemoryErrorReporter) Report(err error, metadata ErrorMetadata) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.errors = append(r.errors, ReportedError{Err: err, Metadata: metadata})
+}
+
+// Errors returns copy of reported errors in the order they were reported
+func (r *MemoryErrorReporter) Errors() []ReportedError {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return append([]ReportedError(nil), r.errors...)
+}
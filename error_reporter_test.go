@@ -0,0 +1,175 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+// useMemoryErrorReporter installs in-memory reporter,
+// returned function restores the previous reporter
+func useMemoryErrorReporter() (*MemoryErrorReporter, func()) {
+	previous := errorReporter
+	reporter := &MemoryErrorReporter{}
+	errorReporter = reporter
+	return reporter, func() { errorReporter = previous }
+}
+
+func TestReportPipeErrorMetadata(t *testing.T) {
+	reporter, restore := useMemoryErrorReporter()
+	defer restore()
+	_, restoreTraces := recordTraces(t)
+	defer restoreTraces()
+
+	p := NewPipe(workspaceID, "asana", "projects")
+	p.PipeStatus = NewPipeStatus(workspaceID, "asana", "projects")
+	ctx, span := startSpan(context.Background(), "pipe.run")
+	defer span.End()
+	p.ctx = ctx
+
+	reportPipeError(p, errors.New("fetch failed"))
+
+	reported := reporter.Errors()
+	if len(reported) != 1 {
+		t.Fatalf("expected 1 reported error, got %d", len(reported))
+	}
+	metadata := reported[0].Metadata
+	if metadata["pipe"]["id"] != "projects" || metadata["pipe"]["service"] != "asana" {
+		t.Errorf("unexpected pipe metadata %v", metadata["pipe"])
+	}
+	if metadata["workspace"]["id"] != workspaceID {
+		t.Errorf("unexpected workspace metadata %v", metadata["workspace"])
+	}
+	if metadata["run"]["trace_id"] != span.SpanContext().TraceID.String() {
+		t.Errorf("expected run trace id %s, got %v", span.SpanContext().TraceID, metadata["run"])
+	}
+	if metadata["run"]["status"] != startStatus {
+		t.Errorf("expected run status %q, got %v", startStatus, metadata["run"]["status"])
+	}
+}
+
+func TestServiceErrorMetadata(t *testing.T) {
+	reporter, restore := useMemoryErrorReporter()
+	defer restore()
+
+	s := &TestService{workspaceID: workspaceID}
+	reportError(errors.New("list failed"), serviceErrorMetadata(s))
+
+	p := NewPipe(workspaceID, TestServiceName, timeEntriesPipeID)
+	p.PipeStatus = NewPipeStatus(workspaceID, TestServiceName, timeEntriesPipeID)
+	s.setContext(withProgress(context.Background(), p))
+	reportError(errors.New("list failed"), serviceErrorMetadata(s))
+	notifyTimeEntryError(p, &TimeEntry{ID: 3, ForeignID: "7"}, errors.New("export failed"))
+
+	reported := reporter.Errors()
+	if len(reported) != 3 {
+		t.Fatalf("expected 3 reported errors, got %d", len(reported))
+	}
+	outside := reported[0].Metadata
+	if outside["service"]["name"] != TestServiceName || outside["workspace"]["id"] != workspaceID || outside["pipe"] != nil {
+		t.Errorf("unexpected metadata outside of run %v", outside)
+	}
+	for _, r := range reported[1:] {
+		if r.Metadata["pipe"]["id"] != timeEntriesPipeID || r.Metadata["run"]["status"] != startStatus {
+			t.Errorf("expected pipe and run metadata, got %v", r.Metadata)
+		}
+	}
+	if entry := reported[2].Metadata["time_entry"]; entry["id"] != 3 || entry["foreign_id"] != "7" {
+		t.Errorf("unexpected time entry metadata %v", entry)
+	}
+}
+
+func TestReportErrorSkipsNil(t *testing.T) {
+	reporter, restore := useMemoryErrorReporter()
+	defer restore()
+
+	reportError(nil, nil)
+	if len(reporter.Errors()) != 0 {
+		t.Error("expected nil error not to be reported")
+	}
+}
+
+func TestReportErrorRedacts(t *testing.T) {
+	reporter, restore := useMemoryErrorReporter()
+	defer restore()
+
+	err := fmt.Errorf("request failed: %w", errors.New("token=abc123 is invalid"))
+	reportError(err, ErrorMetadata{
+		"request": {"url": "https://example.com/users?access_token=abc123", "email": "jane@example.com"},
+	})
+
+	reported := reporter.Errors()
+	if len(reported) != 1 {
+		t.Fatalf("expected 1 reported error, got %d", len(reported))
+	}
+	if !errors.Is(reported[0].Err, errors.Unwrap(err)) {
+		t.Error("expected redacted error to wrap the original error")
+	}
+	b, _ := json.Marshal(reported[0].Metadata)
+	for _, secret := range []string{"abc123", "jane@example.com"} {
+		if strings.Contains(reported[0].Err.Error(), secret) || strings.Contains(string(b), secret) {
+			t.Errorf("reported error leaks %q: %v %s", secret, reported[0].Err, b)
+		}
+	}
+}
+
+func TestSentryErrorReporter(t *testing.T) {
+	var auth string
+	var event map[string]interface{}
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/api/42/store/" {
+			t.Errorf("unexpected path %s", r.URL.Path)
+		}
+		auth = r.Header.Get("X-Sentry-Auth")
+		b, _ := ioutil.ReadAll(r.Body)
+		json.Unmarshal(b, &event)
+	}))
+	defer ts.Close()
+
+	dsn := strings.Replace(ts.URL, "http://", "http://public-key@", 1) + "/42"
+	reporter, err := NewSentryErrorReporter(dsn, "test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	previous := errorReporter
+	errorReporter = reporter
+	defer func() { errorReporter = previous }()
+	reportError(errors.New("request with token=abc123 failed"), ErrorMetadata{
+		"pipe":      {"id": "users", "service": "github"},
+		"workspace": {"id": 1},
+	})
+	reporter.flush()
+
+	if !strings.Contains(auth, "sentry_key=public-key") {
+		t.Errorf("unexpected auth header %q", auth)
+	}
+	tags, _ := event["tags"].(map[string]interface{})
+	if tags["pipe"] != "users" || tags["service"] != "github" || tags["workspace"] != "1" {
+		t.Errorf("unexpected event tags %v", tags)
+	}
+	b, _ := json.Marshal(event)
+	if strings.Contains(string(b), "abc123") {
+		t.Errorf("event leaks token: %s", b)
+	}
+}
+
+func TestNewErrorReporter(t *testing.T) {
+	if _, err := newErrorReporter("log"); err != nil {
+		t.Error(err)
+	}
+	if _, err := newErrorReporter("rollbar"); err == nil {
+		t.Error("expected error for unknown reporter")
+	}
+	previous := sentryDSN
+	defer func() { sentryDSN = previous }()
+	sentryDSN = "https://sentry.example.com"
+	if _, err := newErrorReporter("sentry"); err == nil {
+		t.Error("expected error for DSN without key and project")
+	}
+}
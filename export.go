@@ -1,20 +1,133 @@
 package main
 
 import (
+	"encoding/json"
+	"errors"
+	"fmt"
 	"strconv"
 	"time"
-
-	"github.com/bugsnag/bugsnag-go"
 )
 
 func fetchTimeEntries(p *Pipe) error {
+	if !p.imports() {
+		return nil
+	}
+
+	response := TimeEntriesResponse{}
+	defer func() { saveObject(p, timeEntriesObjectKey, response) }()
+
+	service, err := p.Service()
+	if err != nil {
+		return err
+	}
+	service.setSince(p.lastSync)
+	timeEntries, err := service.TimeEntries()
+	if err != nil {
+		response.Error = err.Error()
+		return err
+	}
+	p.reportStep(stageFetch, timeEntriesObjectKey, len(timeEntries), len(timeEntries),
+		fmt.Sprintf("Fetched %d time entries", len(timeEntries)))
+
+	var usersCon, projectsCon, tasksCon, importedCon *Connection
+	var exportedCon *ReversedConnection
+	if usersCon, err = loadConnection(service, usersPipeID); err != nil {
+		response.Error = err.Error()
+		return err
+	}
+	if projectsCon, err = loadConnection(service, projectsPipeID); err != nil {
+		response.Error = err.Error()
+		return err
+	}
+	if tasksCon, err = loadConnection(service, tasksPipeId); err != nil {
+		response.Error = err.Error()
+		return err
+	}
+	if importedCon, err = loadConnection(service, importedTimeEntriesPipeID); err != nil {
+		response.Error = err.Error()
+		return err
+	}
+	if exportedCon, err = loadConnectionRev(service, timeEntriesObjectKey); err != nil {
+		response.Error = err.Error()
+		return err
+	}
+
+	response.TimeEntries = make([]*TimeEntry, 0)
+	for _, entry := range timeEntries {
+		// entries exported from Toggl must not come back as duplicates
+		if _, exported := exportedCon.Data[numberStrToInt(entry.ForeignID)]; exported {
+			continue
+		}
+		entry.UserID = usersCon.Data[entry.foreignUserID]
+		if entry.UserID == 0 {
+			continue
+		}
+		entry.ID = importedCon.Data[entry.ForeignID]
+		entry.ProjectID = projectsCon.Data[entry.foreignProjectID]
+		entry.TaskID = tasksCon.Data[entry.foreignTaskID]
+		response.TimeEntries = append(response.TimeEntries, entry)
+	}
 	return nil
 }
 
 func postTimeEntries(p *Pipe) error {
+	if p.imports() {
+		if err := importTimeEntries(p); err != nil {
+			return err
+		}
+	}
+	if p.exports() {
+		return exportTimeEntries(p)
+	}
+	return nil
+}
+
+func importTimeEntries(p *Pipe) error {
+	service, err := p.Service()
+	if err != nil {
+		return err
+	}
+	timeEntriesResponse, err := getTimeEntries(service)
+	if err != nil {
+		return errors.New("unable to get time entries from DB")
+	}
+	if timeEntriesResponse == nil {
+		return errors.New("service time entries not found")
+	}
+	if len(timeEntriesResponse.TimeEntries) == 0 {
+		p.PipeStatus.complete("imported timeentries", []string{}, 0)
+		return nil
+	}
+
+	b, err := togglClient.PostPipesAPI(p.context(), p.authorization.WorkspaceToken, timeEntriesObjectKey,
+		timeEntryRequest{TimeEntries: timeEntriesResponse.TimeEntries})
+	if err != nil {
+		return err
+	}
+	var timeEntriesImport TimeEntriesImport
+	if err := json.Unmarshal(b, &timeEntriesImport); err != nil {
+		return err
+	}
+	connection, err := loadConnection(service, importedTimeEntriesPipeID)
+	if err != nil {
+		return err
+	}
+	for _, entry := range timeEntriesImport.TimeEntries {
+		connection.Data[entry.ForeignID] = entry.ID
+	}
+	if err := connection.save(); err != nil {
+		return err
+	}
+	count := len(timeEntriesResponse.TimeEntries)
+	p.reportStep(stagePost, timeEntriesObjectKey, count, count, fmt.Sprintf("Imported %d time entries", count))
+	p.PipeStatus.complete("imported timeentries", timeEntriesImport.Notifications, timeEntriesImport.Count())
+	return nil
+}
+
+func exportTimeEntries(p *Pipe) error {
 	var err error
 	var entriesCon *Connection
-	var usersCon, tasksCon, projectsCon *ReversedConnection
+	var usersCon, tasksCon, projectsCon, importedCon *ReversedConnection
 	service, err := p.Service()
 	if err != nil {
 		return err
@@ -28,7 +141,10 @@ func postTimeEntries(p *Pipe) error {
 	if projectsCon, err = loadConnectionRev(service, "projects"); err != nil {
 		return err
 	}
-	if entriesCon, err = loadConnection(service, "time_entries"); err != nil {
+	if entriesCon, err = loadConnection(service, timeEntriesObjectKey); err != nil {
+		return err
+	}
+	if importedCon, err = loadConnectionRev(service, importedTimeEntriesPipeID); err != nil {
 		return err
 	}
 
@@ -37,7 +153,13 @@ func postTimeEntries(p *Pipe) error {
 		p.lastSync = &currentTime
 	}
 
-	timeEntries, err := getTogglTimeEntries(
+	// collect entries exported in previous runs before new ones are added
+	exportedIDs := make([]int, 0, len(entriesCon.Data))
+	for id := range entriesCon.Data {
+		exportedIDs = append(exportedIDs, numberStrToInt(id))
+	}
+
+	timeEntries, err := togglClient.GetTimeEntries(p.context(),
 		p.authorization.WorkspaceToken, *p.lastSync,
 		usersCon.getKeys(), projectsCon.getKeys(),
 	)
@@ -45,39 +167,142 @@ func postTimeEntries(p *Pipe) error {
 		return err
 	}
 
+	// entries imported from foreign service must not be sent back
+	pending := make([]TimeEntry, 0, len(timeEntries))
 	for _, entry := range timeEntries {
-		entry.foreignID = strconv.Itoa(entriesCon.Data[strconv.Itoa(entry.ID)])
-		entry.foreignTaskID = strconv.Itoa(tasksCon.getInt(entry.TaskID))
-		entry.foreignUserID = strconv.Itoa(usersCon.getInt(entry.UserID))
-		entry.foreignProjectID = strconv.Itoa(projectsCon.getInt(entry.ProjectID))
+		if _, imported := importedCon.Data[entry.ID]; !imported {
+			pending = append(pending, entry)
+		}
+	}
+	// exports stop at safe points of canceled runs, entries exported
+	// before it are saved so that the next run does not export them again
+	exported := make(map[int]bool)
+	for i, entry := range pending {
+		if err := p.checkCanceled(); err != nil {
+			return saveExported(p, entriesCon, err)
+		}
+		exported[entry.ID] = true
+		if err := exportTimeEntry(p, service, entriesCon, usersCon, tasksCon, projectsCon, entry); err != nil {
+			return saveExported(p, entriesCon, err)
+		}
+		p.reportStep(stageExport, timeEntriesObjectKey, i+1, len(pending),
+			fmt.Sprintf("Exported %d of %d time entries", i+1, len(pending)))
+	}
+	if err := p.checkCanceled(); err != nil {
+		return saveExported(p, entriesCon, err)
+	}
 
-		entryID, err := service.ExportTimeEntry(&entry)
+	var deletedCount int
+	if len(exportedIDs) > 0 {
+		changes, err := togglClient.GetTimeEntryChanges(p.context(), p.authorization.WorkspaceToken, *p.lastSync, exportedIDs)
 		if err != nil {
-			bugsnag.Notify(err, bugsnag.MetaData{
-				"Workspace": {
-					"ID": service.WorkspaceID(),
-				},
-				"Entry": {
-					"ID":        entry.ID,
-					"TaskID":    entry.TaskID,
-					"UserID":    entry.UserID,
-					"ProjectID": entry.ProjectID,
-				},
-				"Foreign Entry": {
-					"foreignID":        entry.foreignID,
-					"foreignTaskID":    entry.foreignTaskID,
-					"foreignUserID":    entry.foreignUserID,
-					"foreignProjectID": entry.foreignProjectID,
-				},
-			})
-			p.PipeStatus.addError(err)
-		} else {
-			entriesCon.Data[strconv.Itoa(entry.ID)] = entryID
+			return saveExported(p, entriesCon, err)
+		}
+		for _, id := range changes.Deleted {
+			deleted, err := deleteTimeEntry(p, service, entriesCon, TimeEntry{ID: id})
+			if err != nil {
+				return saveExported(p, entriesCon, err)
+			}
+			if deleted {
+				deletedCount++
+			}
+		}
+		for _, entry := range changes.Moved {
+			if exported[entry.ID] {
+				continue
+			}
+			// entries moved to a project outside of this integration
+			// can no longer be kept in the foreign service
+			if _, found := projectsCon.Data[entry.ProjectID]; !found {
+				deleted, err := deleteTimeEntry(p, service, entriesCon, entry)
+				if err != nil {
+					return saveExported(p, entriesCon, err)
+				}
+				if deleted {
+					deletedCount++
+				}
+				continue
+			}
+			if err := exportTimeEntry(p, service, entriesCon, usersCon, tasksCon, projectsCon, entry); err != nil {
+				return saveExported(p, entriesCon, err)
+			}
 		}
 	}
+
 	if err := entriesCon.save(); err != nil {
 		return err
 	}
-	p.PipeStatus.complete("timeentries", []string{}, len(timeEntries))
+	p.PipeStatus.complete(timeEntriesPipeID, []string{}, len(exported))
+	p.PipeStatus.complete("deleted timeentries", []string{}, deletedCount)
+	return nil
+}
+
+// saveExported saves connections of entries exported before err stopped
+// the export and returns err
+func saveExported(p *Pipe, entriesCon *Connection, err error) error {
+	if saveErr := entriesCon.save(); saveErr != nil {
+		reportPipeError(p, saveErr)
+	}
+	return err
+}
+
+// exportTimeEntry exports entry to foreign service, errors of the entry
+// are added to pipe status and only cancel of the run is returned
+func exportTimeEntry(p *Pipe, service Service, entriesCon *Connection, usersCon, tasksCon, projectsCon *ReversedConnection, entry TimeEntry) error {
+	entry.ForeignID = strconv.Itoa(entriesCon.Data[strconv.Itoa(entry.ID)])
+	entry.foreignTaskID = strconv.Itoa(tasksCon.getInt(entry.TaskID))
+	entry.foreignUserID = strconv.Itoa(usersCon.getInt(entry.UserID))
+	entry.foreignProjectID = strconv.Itoa(projectsCon.getInt(entry.ProjectID))
+
+	entryID, err := service.ExportTimeEntry(&entry)
+	if errors.Is(err, ErrPipeCanceled) {
+		return err
+	}
+	if err != nil {
+		notifyTimeEntryError(p, &entry, err)
+		p.PipeStatus.addError(err)
+		return nil
+	}
+	entriesCon.Data[strconv.Itoa(entry.ID)] = entryID
 	return nil
 }
+
+// deleteTimeEntry removes exported entry from foreign service and
+// drops it from connections, returns true if entry was deleted.
+// Like exportTimeEntry, only cancel of the run is returned.
+func deleteTimeEntry(p *Pipe, service Service, entriesCon *Connection, entry TimeEntry) (bool, error) {
+	key := strconv.Itoa(entry.ID)
+	foreignID, found := entriesCon.Data[key]
+	if !found {
+		return false, nil
+	}
+	entry.ForeignID = strconv.Itoa(foreignID)
+
+	err := service.DeleteTimeEntry(&entry)
+	if errors.Is(err, ErrPipeCanceled) {
+		return false, err
+	}
+	if err != nil {
+		notifyTimeEntryError(p, &entry, err)
+		p.PipeStatus.addError(err)
+		return false, nil
+	}
+	delete(entriesCon.Data, key)
+	return true, nil
+}
+
+// notifyTimeEntryError reports error of the entry with pipe metadata
+func notifyTimeEntryError(p *Pipe, entry *TimeEntry, err error) {
+	metadata := pipeErrorMetadata(p)
+	metadata["time_entry"] = Fields{
+		"id":                 entry.ID,
+		"task_id":            entry.TaskID,
+		"user_id":            entry.UserID,
+		"project_id":         entry.ProjectID,
+		"foreign_id":         entry.ForeignID,
+		"foreign_task_id":    entry.foreignTaskID,
+		"foreign_user_id":    entry.foreignUserID,
+		"foreign_project_id": entry.foreignProjectID,
+	}
+	reportError(err, metadata)
+}
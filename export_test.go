@@ -0,0 +1,228 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"reflect"
+	"strconv"
+	"testing"
+	"time"
+)
+
+func newTestExportPipe(ctx context.Context) *Pipe {
+	p := NewPipe(workspaceID, TestServiceName, timeEntriesPipeID)
+	p.authorization = &Authorization{WorkspaceToken: "token"}
+	p.PipeStatus = NewPipeStatus(workspaceID, TestServiceName, timeEntriesPipeID)
+	p.ctx = ctx
+	return p
+}
+
+// saveTestConnection replaces connection of the test service
+func saveTestConnection(t *testing.T, pipeID string, data map[string]int) {
+	connection := NewConnection(&TestService{workspaceID: workspaceID}, pipeID)
+	for key, value := range data {
+		connection.Data[key] = value
+	}
+	if err := connection.save(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestExportTimeEntryReturnsCancel(t *testing.T) {
+	testTimeEntries.reset()
+	defer testTimeEntries.reset()
+
+	p := newTestExportPipe(context.Background())
+	service := &TestService{workspaceID: workspaceID}
+	entriesCon := NewConnection(service, timeEntriesObjectKey)
+	noConnection := &ReversedConnection{make(map[int]string)}
+
+	testTimeEntries.exportErr = func(*TimeEntry) error { return fmt.Errorf("export: %w", ErrPipeCanceled) }
+	err := exportTimeEntry(p, service, entriesCon, noConnection, noConnection, noConnection, TimeEntry{ID: 1})
+	if !errors.Is(err, ErrPipeCanceled) {
+		t.Errorf("expected cancel to stop the export, got %v", err)
+	}
+	if p.PipeStatus.Status != startStatus {
+		t.Errorf("expected cancel to be left to the run, got status %q", p.PipeStatus.Status)
+	}
+
+	testTimeEntries.exportErr = func(*TimeEntry) error { return errors.New("entry is locked") }
+	if err := exportTimeEntry(p, service, entriesCon, noConnection, noConnection, noConnection, TimeEntry{ID: 2}); err != nil {
+		t.Errorf("expected failed entry not to stop the export, got %v", err)
+	}
+	if p.PipeStatus.Status != "error" || p.PipeStatus.Message != "entry is locked" || len(entriesCon.Data) != 0 {
+		t.Errorf("expected failed entry on status, got %q and connections %v", p.PipeStatus.Message, entriesCon.Data)
+	}
+}
+
+func TestExportTimeEntriesStopsWhenCanceled(t *testing.T) {
+	db = connectDB(testDBConnString)
+	api := newFakeTogglAPI(workspaceID)
+	defer api.Close()
+	defer api.use()()
+	testTimeEntries.reset()
+	defer testTimeEntries.reset()
+
+	saveTestConnection(t, usersPipeID, map[string]int{"1": 10})
+	saveTestConnection(t, projectsPipeID, nil)
+	saveTestConnection(t, tasksPipeId, nil)
+	saveTestConnection(t, timeEntriesObjectKey, nil)
+	saveTestConnection(t, importedTimeEntriesPipeID, nil)
+	for i := 0; i < 3; i++ {
+		api.addTimeEntry(TimeEntry{UserID: 10})
+	}
+
+	c := &runCancel{workspaceID: workspaceID, key: pipesKey(TestServiceName, timeEntriesPipeID), checkedAt: time.Now()}
+	p := newTestExportPipe(withRunCancel(context.Background(), c))
+	var exports int
+	testTimeEntries.exportErr = func(*TimeEntry) error {
+		// canceled while the second entry is exported
+		if exports++; exports == 2 {
+			c.cancel()
+		}
+		return nil
+	}
+
+	if err := exportTimeEntries(p); err != ErrPipeCanceled {
+		t.Fatalf("expected export to stop when canceled, got %v", err)
+	}
+	if n := testTimeEntries.count(); n != 2 {
+		t.Errorf("expected 2 exported entries, got %d", n)
+	}
+	connection, err := loadConnection(&TestService{workspaceID: workspaceID}, timeEntriesObjectKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(connection.Data) != 2 {
+		t.Errorf("expected entries exported before cancel to be saved, got %v", connection.Data)
+	}
+}
+
+func TestExportTimeEntriesDeletesAndMoves(t *testing.T) {
+	db = connectDB(testDBConnString)
+	api := newFakeTogglAPI(workspaceID)
+	defer api.Close()
+	defer api.use()()
+	testTimeEntries.reset()
+	defer testTimeEntries.reset()
+
+	integrated := api.addProject("Website")
+	moved := api.addProject("Mobile")
+	other := api.addProject("Internal")
+	deletedEntry := api.addTimeEntry(TimeEntry{UserID: 10, ProjectID: integrated.ID})
+	movedOut := api.addTimeEntry(TimeEntry{UserID: 10, ProjectID: integrated.ID})
+	movedIn := api.addTimeEntry(TimeEntry{UserID: 10, ProjectID: integrated.ID})
+
+	saveTestConnection(t, usersPipeID, map[string]int{"1": 10})
+	saveTestConnection(t, projectsPipeID, map[string]int{"100": integrated.ID, "200": moved.ID})
+	saveTestConnection(t, tasksPipeId, nil)
+	saveTestConnection(t, importedTimeEntriesPipeID, nil)
+	// entries exported by an earlier run
+	saveTestConnection(t, timeEntriesObjectKey, map[string]int{
+		strconv.Itoa(deletedEntry.ID): 1,
+		strconv.Itoa(movedOut.ID):     2,
+		strconv.Itoa(movedIn.ID):      3,
+	})
+	for i, entry := range []*TimeEntry{deletedEntry, movedOut, movedIn} {
+		foreignID := strconv.Itoa(i + 1)
+		testTimeEntries.entries[foreignID] = &TimeEntry{ID: entry.ID, ForeignID: foreignID}
+	}
+	testTimeEntries.lastID = 3
+
+	api.deleteTimeEntry(deletedEntry.ID)
+	api.moveTimeEntry(movedOut.ID, other.ID)
+	api.moveTimeEntry(movedIn.ID, moved.ID)
+
+	p := newTestExportPipe(context.Background())
+	if err := postTimeEntries(p); err != nil {
+		t.Fatal(err)
+	}
+	if testTimeEntries.get("1") != nil || testTimeEntries.get("2") != nil {
+		t.Error("expected deleted entry and entry moved out of the integration to be deleted")
+	}
+	if entry := testTimeEntries.get("3"); entry == nil || entry.foreignProjectID != "200" {
+		t.Errorf("expected moved entry to be exported again to project 200, got %+v", entry)
+	}
+	if n := testTimeEntries.count(); n != 1 {
+		t.Errorf("expected 1 entry in the service, got %d", n)
+	}
+
+	connection, err := loadConnection(&TestService{workspaceID: workspaceID}, timeEntriesObjectKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := map[string]int{strconv.Itoa(movedIn.ID): 3}
+	if !reflect.DeepEqual(connection.Data, expected) {
+		t.Errorf("expected connections of deleted entries to be removed, got %v", connection.Data)
+	}
+}
+
+func TestImportTimeEntriesWithoutLoops(t *testing.T) {
+	db = connectDB(testDBConnString)
+	api := newFakeTogglAPI(workspaceID)
+	defer api.Close()
+	defer api.use()()
+	testTimeEntries.reset()
+	defer testTimeEntries.reset()
+
+	project := api.addProject("Website")
+	imported := api.addTimeEntry(TimeEntry{UserID: 10, ForeignID: "502"})
+	exported := api.addTimeEntry(TimeEntry{UserID: 10})
+
+	saveTestConnection(t, usersPipeID, map[string]int{"1": 10})
+	saveTestConnection(t, projectsPipeID, map[string]int{"100": project.ID})
+	saveTestConnection(t, tasksPipeId, nil)
+	saveTestConnection(t, importedTimeEntriesPipeID, map[string]int{"502": imported.ID})
+	saveTestConnection(t, timeEntriesObjectKey, map[string]int{strconv.Itoa(exported.ID): 7})
+	testTimeEntries.entries["7"] = &TimeEntry{ID: exported.ID, ForeignID: "7"}
+	testTimeEntries.lastID = 7
+	testTimeEntries.imported = []*TimeEntry{
+		{ForeignID: "501", foreignUserID: "1", foreignProjectID: "100"},
+		{ForeignID: "502", foreignUserID: "1", Description: "changed"},
+		{ForeignID: "7", foreignUserID: "1"},    // exported from Toggl
+		{ForeignID: "503", foreignUserID: "99"}, // user is not imported
+	}
+
+	p := newTestExportPipe(context.Background())
+	p.Direction = directionImport
+	if err := fetchTimeEntries(p); err != nil {
+		t.Fatal(err)
+	}
+	if err := postTimeEntries(p); err != nil {
+		t.Fatal(err)
+	}
+
+	connection, err := loadConnection(&TestService{workspaceID: workspaceID}, importedTimeEntriesPipeID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(connection.Data) != 2 || connection.Data["502"] != imported.ID || connection.Data["501"] == 0 {
+		t.Fatalf("expected new entry to be connected and changed entry to keep its ID, got %v", connection.Data)
+	}
+	created := connection.Data["501"]
+	api.mu.Lock()
+	var count int
+	for _, entry := range api.timeEntries {
+		count++
+		if entry.ID == created && (entry.UserID != 10 || entry.ProjectID != project.ID) {
+			t.Errorf("expected imported entry with user and project, got %+v", entry)
+		}
+		if entry.ID == imported.ID && entry.Description != "changed" {
+			t.Errorf("expected imported entry to be updated, got %+v", entry)
+		}
+	}
+	api.mu.Unlock()
+	if count != 3 {
+		t.Errorf("expected entries exported from Toggl not to be imported back, got %d entries", count)
+	}
+
+	// entries imported from the service must not be exported back to it
+	p.Direction = directionExport
+	if err := postTimeEntries(p); err != nil {
+		t.Fatal(err)
+	}
+	if n := testTimeEntries.count(); n != 1 || testTimeEntries.get("7") == nil {
+		t.Errorf("expected only the exported entry in the service, got %d entries", n)
+	}
+}
@@ -0,0 +1,355 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// FakeTogglAPI is an in-memory implementation of Toggl pipes API.
+// Objects are matched by name like Toggl does, so importing the same
+// foreign objects twice does not create duplicates.
+type FakeTogglAPI struct {
+	*httptest.Server
+
+	mu          sync.Mutex
+	workspaceID int
+	lastID      int
+	requests    map[string]int
+	users       []*User
+	clients     []*Client
+	projects    []*Project
+	tasks       []*Task
+	timeEntries []*TimeEntry
+	deleted     map[int]bool
+	moved       map[int]bool
+}
+
+// newFakeTogglAPI starts fake Toggl API for the workspace, Close must be called when done
+func newFakeTogglAPI(workspaceID int) *FakeTogglAPI {
+	api := &FakeTogglAPI{
+		workspaceID: workspaceID,
+		requests:    make(map[string]int),
+		deleted:     make(map[int]bool),
+		moved:       make(map[int]bool),
+	}
+	mux := http.NewServeMux()
+	mux.HandleFunc("/api/pipes/workspace", api.handle(api.workspace))
+	mux.HandleFunc("/api/pipes/users", api.handle(api.postUsers))
+	mux.HandleFunc("/api/pipes/clients", api.handle(api.postClients))
+	mux.HandleFunc("/api/pipes/projects", api.handle(api.postProjects))
+	mux.HandleFunc("/api/pipes/tasks", api.handle(api.postTasks))
+	mux.HandleFunc("/api/pipes/time_entries", api.handle(api.timeEntriesHandler))
+	mux.HandleFunc("/api/pipes/time_entries/changes", api.handle(api.timeEntryChanges))
+	api.Server = httptest.NewServer(mux)
+	return api
+}
+
+// use replaces Toggl API client with one talking to the fake,
+// returned function restores the previous client
+func (api *FakeTogglAPI) use() func() {
+	previous := togglClient
+	togglClient = NewTogglClientWithHost(api.URL)
+	return func() { togglClient = previous }
+}
+
+// requestCount returns number of requests made to path
+func (api *FakeTogglAPI) requestCount(path string) int {
+	api.mu.Lock()
+	defer api.mu.Unlock()
+	return api.requests[path]
+}
+
+func (api *FakeTogglAPI) addProject(name string) *Project {
+	api.mu.Lock()
+	defer api.mu.Unlock()
+	project := &Project{ID: api.nextID(), Name: name, Active: true}
+	api.projects = append(api.projects, project)
+	return project
+}
+
+func (api *FakeTogglAPI) addTimeEntry(entry TimeEntry) *TimeEntry {
+	api.mu.Lock()
+	defer api.mu.Unlock()
+	entry.ID = api.nextID()
+	api.timeEntries = append(api.timeEntries, &entry)
+	return &entry
+}
+
+func (api *FakeTogglAPI) deleteTimeEntry(id int) {
+	api.mu.Lock()
+	defer api.mu.Unlock()
+	api.deleted[id] = true
+}
+
+// moveTimeEntry moves time entry to another project
+func (api *FakeTogglAPI) moveTimeEntry(id, projectID int) {
+	api.mu.Lock()
+	defer api.mu.Unlock()
+	for _, entry := range api.timeEntries {
+		if entry.ID == id {
+			entry.ProjectID = projectID
+			api.moved[id] = true
+		}
+	}
+}
+
+func (api *FakeTogglAPI) nextID() int {
+	api.lastID++
+	return api.lastID
+}
+
+type fakeHandler func(r *http.Request) (interface{}, int)
+
+func (api *FakeTogglAPI) handle(handler fakeHandler) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		api.mu.Lock()
+		defer api.mu.Unlock()
+		api.requests[r.URL.Path]++
+
+		if token, _, ok := r.BasicAuth(); !ok || token == "" {
+			http.Error(w, "Unauthorized", http.StatusForbidden)
+			return
+		}
+		response, status := handler(r)
+		if status != http.StatusOK {
+			http.Error(w, fmt.Sprint(response), status)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(response)
+	}
+}
+
+func decodeFakeRequest(r *http.Request, v interface{}) (interface{}, int) {
+	if r.Method != "POST" {
+		return "method not allowed", http.StatusMethodNotAllowed
+	}
+	if err := json.NewDecoder(r.Body).Decode(v); err != nil {
+		return err.Error(), http.StatusBadRequest
+	}
+	return nil, http.StatusOK
+}
+
+func sameName(a, b string) bool {
+	return strings.EqualFold(strings.TrimSpace(a), strings.TrimSpace(b))
+}
+
+func (api *FakeTogglAPI) workspace(r *http.Request) (interface{}, int) {
+	return workspaceResponse{Workspace: &Workspace{ID: api.workspaceID, Name: "Test workspace"}}, http.StatusOK
+}
+
+func (api *FakeTogglAPI) postUsers(r *http.Request) (interface{}, int) {
+	var request usersRequest
+	if msg, status := decodeFakeRequest(r, &request); status != http.StatusOK {
+		return msg, status
+	}
+	response := UsersImport{WorkspaceUsers: make([]*User, 0), Notifications: make([]string, 0)}
+	for _, user := range request.Users {
+		if user.Email == "" {
+			response.Notifications = append(response.Notifications,
+				fmt.Sprintf("User %s has no email and was not imported", user.Name))
+			continue
+		}
+		var existing *User
+		for _, u := range api.users {
+			if strings.EqualFold(u.Email, user.Email) {
+				existing = u
+				break
+			}
+		}
+		if existing == nil {
+			existing = &User{ID: api.nextID(), Email: user.Email, Name: user.Name}
+			api.users = append(api.users, existing)
+		}
+		response.WorkspaceUsers = append(response.WorkspaceUsers, &User{
+			ID: existing.ID, Email: existing.Email, Name: existing.Name, ForeignID: user.ForeignID,
+		})
+	}
+	return response, http.StatusOK
+}
+
+func (api *FakeTogglAPI) postClients(r *http.Request) (interface{}, int) {
+	var request clientRequest
+	if msg, status := decodeFakeRequest(r, &request); status != http.StatusOK {
+		return msg, status
+	}
+	response := ClientsImport{Clients: make([]*Client, 0), Notifications: make([]string, 0)}
+	for _, client := range request.Clients {
+		if strings.TrimSpace(client.Name) == "" {
+			response.Notifications = append(response.Notifications, "Client name can't be blank")
+			continue
+		}
+		var existing *Client
+		for _, c := range api.clients {
+			if sameName(c.Name, client.Name) {
+				existing = c
+				break
+			}
+		}
+		if existing == nil {
+			existing = &Client{ID: api.nextID(), Name: strings.TrimSpace(client.Name)}
+			api.clients = append(api.clients, existing)
+		}
+		response.Clients = append(response.Clients, &Client{
+			ID: existing.ID, Name: existing.Name, ForeignID: client.ForeignID,
+		})
+	}
+	return response, http.StatusOK
+}
+
+func (api *FakeTogglAPI) postProjects(r *http.Request) (interface{}, int) {
+	var request projectRequest
+	if msg, status := decodeFakeRequest(r, &request); status != http.StatusOK {
+		return msg, status
+	}
+	response := ProjectsImport{Projects: make([]*Project, 0), Notifications: make([]string, 0)}
+	for _, project := range request.Projects {
+		if strings.TrimSpace(project.Name) == "" {
+			response.Notifications = append(response.Notifications, "Project name can't be blank")
+			continue
+		}
+		var existing *Project
+		for _, p := range api.projects {
+			if sameName(p.Name, project.Name) {
+				existing = p
+				break
+			}
+		}
+		if existing == nil {
+			existing = &Project{ID: api.nextID(), Name: strings.TrimSpace(project.Name)}
+			api.projects = append(api.projects, existing)
+		}
+		existing.Active = project.Active
+		existing.Billable = project.Billable
+		if request.SupportsClient {
+			existing.ClientID = project.ClientID
+		}
+		response.Projects = append(response.Projects, &Project{
+			ID: existing.ID, Name: existing.Name, Active: existing.Active,
+			Billable: existing.Billable, ClientID: existing.ClientID, ForeignID: project.ForeignID,
+		})
+	}
+	return response, http.StatusOK
+}
+
+func (api *FakeTogglAPI) postTasks(r *http.Request) (interface{}, int) {
+	var request taskRequest
+	if msg, status := decodeFakeRequest(r, &request); status != http.StatusOK {
+		return msg, status
+	}
+	response := TasksImport{Tasks: make([]*Task, 0), Notifications: make([]string, 0)}
+	for _, task := range request.Tasks {
+		if !api.hasProject(task.ProjectID) {
+			response.Notifications = append(response.Notifications,
+				fmt.Sprintf("Task %s has no project and was not imported", task.Name))
+			continue
+		}
+		var existing *Task
+		for _, t := range api.tasks {
+			if t.ProjectID == task.ProjectID && sameName(t.Name, task.Name) {
+				existing = t
+				break
+			}
+		}
+		if existing == nil {
+			existing = &Task{ID: api.nextID(), Name: strings.TrimSpace(task.Name), ProjectID: task.ProjectID}
+			api.tasks = append(api.tasks, existing)
+		}
+		existing.Active = task.Active
+		response.Tasks = append(response.Tasks, &Task{
+			ID: existing.ID, Name: existing.Name, Active: existing.Active,
+			ProjectID: existing.ProjectID, ForeignID: task.ForeignID,
+		})
+	}
+	return response, http.StatusOK
+}
+
+func (api *FakeTogglAPI) hasProject(id int) bool {
+	for _, p := range api.projects {
+		if p.ID == id {
+			return true
+		}
+	}
+	return false
+}
+
+func (api *FakeTogglAPI) timeEntriesHandler(r *http.Request) (interface{}, int) {
+	if r.Method == "GET" {
+		return api.getTimeEntries(r)
+	}
+	var request timeEntryRequest
+	if msg, status := decodeFakeRequest(r, &request); status != http.StatusOK {
+		return msg, status
+	}
+	response := TimeEntriesImport{TimeEntries: make([]*TimeEntry, 0), Notifications: make([]string, 0)}
+	for _, entry := range request.TimeEntries {
+		if entry.UserID == 0 {
+			response.Notifications = append(response.Notifications,
+				fmt.Sprintf("Time entry %s has no user and was not imported", entry.ForeignID))
+			continue
+		}
+		saved := *entry
+		if entry.ID == 0 {
+			saved.ID = api.nextID()
+			api.timeEntries = append(api.timeEntries, &saved)
+		} else {
+			for i, te := range api.timeEntries {
+				if te.ID == entry.ID {
+					api.timeEntries[i] = &saved
+				}
+			}
+		}
+		response.TimeEntries = append(response.TimeEntries, &saved)
+	}
+	return response, http.StatusOK
+}
+
+func (api *FakeTogglAPI) getTimeEntries(r *http.Request) (interface{}, int) {
+	userIDs := parseFakeIDs(r.URL.Query().Get("user_ids"))
+	projectIDs := parseFakeIDs(r.URL.Query().Get("project_ids"))
+	timeEntries := make([]TimeEntry, 0)
+	for _, entry := range api.timeEntries {
+		if api.deleted[entry.ID] || !userIDs[entry.UserID] {
+			continue
+		}
+		if entry.ProjectID != 0 && !projectIDs[entry.ProjectID] {
+			continue
+		}
+		timeEntries = append(timeEntries, *entry)
+	}
+	return timeEntries, http.StatusOK
+}
+
+func (api *FakeTogglAPI) timeEntryChanges(r *http.Request) (interface{}, int) {
+	ids := parseFakeIDs(r.URL.Query().Get("ids"))
+	if len(ids) > togglAPIMaxIDsPerRequest {
+		return "too many ids", http.StatusRequestURITooLong
+	}
+	changes := timeEntryChanges{Deleted: make([]int, 0), Moved: make([]TimeEntry, 0)}
+	for id := range ids {
+		if api.deleted[id] {
+			changes.Deleted = append(changes.Deleted, id)
+		}
+	}
+	for _, entry := range api.timeEntries {
+		if ids[entry.ID] && api.moved[entry.ID] && !api.deleted[entry.ID] {
+			changes.Moved = append(changes.Moved, *entry)
+		}
+	}
+	return changes, http.StatusOK
+}
+
+func parseFakeIDs(s string) map[int]bool {
+	ids := make(map[int]bool)
+	for _, id := range strings.Split(s, ",") {
+		if n, err := strconv.Atoi(id); err == nil {
+			ids[n] = true
+		}
+	}
+	return ids
+}
@@ -2,6 +2,7 @@ package main
 
 import (
 	"os"
+	"time"
 
 	"github.com/namsral/flag"
 )
@@ -10,20 +11,82 @@ var (
 	port             int
 	workdir          string
 	bugsnagAPIKey    string
+	sentryDSN        string
 	environment      string
 	dbConnString     string
 	testDBConnString string
+	workersCount     int
+
+	queueBatchSize      int
+	serviceConcurrency  string
+	serviceWeights      string
+	queueStaleAfter     time.Duration
+	dependencyFreshness time.Duration
+	fetchConcurrency    int
+
+	workspaceCacheSize     int
+	workspaceCacheTTL      time.Duration
+	workspaceCacheStaleTTL time.Duration
+
+	traceExporter    string
+	traceFile        string
+	traceOTLPAddress string
+	traceSampleRatio float64
+
+	logLevelName string
+
+	errorReporterName string
+
+	adminToken string
+
+	maxBodySize           int64
+	apiRateLimit          float64
+	apiRateBurst          int
+	apiIPRateLimit        float64
+	apiIPRateBurst        int
+	apiExpensiveRateLimit float64
+	apiExpensiveRateBurst int
+	trustedProxies        string
 )
 
-func InitFlags() {
+// InitFlags parses flags and returns the arguments after them,
+// the subcommand and its flags if any
+func InitFlags() []string {
 	fs := flag.NewFlagSetWithEnvPrefix(os.Args[0], "PIPES_API", flag.ExitOnError)
 
 	fs.IntVar(&port, "port", 8100, "port")
 	fs.StringVar(&workdir, "workdir", ".", "Workdir of server")
 	fs.StringVar(&bugsnagAPIKey, "bugsnag_key", "", "Bugsnag API Key")
+	fs.StringVar(&errorReporterName, "error_reporter", "bugsnag", "Where errors are reported: bugsnag, sentry, log or memory")
+	fs.StringVar(&sentryDSN, "sentry_dsn", "", "DSN of Sentry compatible service for the sentry error reporter")
 	fs.StringVar(&environment, "environment", "development", "Environment")
 	fs.StringVar(&dbConnString, "db_conn_string", "dbname=pipes_development user=pipes_user host=localhost sslmode=disable port=5432", "DB Connection String")
+	fs.IntVar(&workersCount, "workers_count", 15, "Number of background workers, can be changed at runtime with config/workers.json and SIGHUP")
+	fs.IntVar(&queueBatchSize, "queue_batch_size", 10, "Number of queued pipes a worker locks at once")
+	fs.StringVar(&serviceConcurrency, "service_concurrency", "", "Max concurrent runs per service, e.g. asana=3,github=5")
+	fs.StringVar(&serviceWeights, "service_weights", "", "Worker time share of workspaces per service, e.g. asana=2 lets asana workspaces use twice the time of others, default is 1")
+	fs.DurationVar(&queueStaleAfter, "queue_stale_after", time.Hour, "How long locked queued pipe keeps its workspace and service busy, older locks are of crashed workers")
+	fs.IntVar(&fetchConcurrency, "fetch_concurrency", 4, "Max parallel provider requests of one fetch, e.g. tasks of projects, the service rate limit still applies")
+	fs.DurationVar(&dependencyFreshness, "dependency_freshness", 15*time.Minute, "How long synced clients, projects and tasks are not synced again before pipes depending on them, 0 always syncs them")
+	fs.IntVar(&workspaceCacheSize, "workspace_cache_size", 10000, "Max number of API tokens with cached workspace")
+	fs.DurationVar(&workspaceCacheTTL, "workspace_cache_ttl", 5*time.Minute, "How long workspace of API token is cached")
+	fs.DurationVar(&workspaceCacheStaleTTL, "workspace_cache_stale_ttl", 0, "How long expired workspace is served while refreshed, 0 disables it")
+	fs.StringVar(&traceExporter, "trace_exporter", "none", "OpenTelemetry trace exporter: none, stdout, file or otlp")
+	fs.StringVar(&traceFile, "trace_file", "traces.json", "File the file trace exporter appends spans to")
+	fs.StringVar(&traceOTLPAddress, "trace_otlp_address", "localhost:55680", "Address of OTLP collector for the otlp trace exporter")
+	fs.Float64Var(&traceSampleRatio, "trace_sample_ratio", 1, "Fraction of traces that are recorded")
+	fs.StringVar(&logLevelName, "log_level", "info", "Minimum level of logged entries: debug, info, warn or error")
+	fs.Int64Var(&maxBodySize, "max_body_size", 1<<20, "Max size of API request bodies in bytes, routes may have lower limits, 0 disables it")
+	fs.Float64Var(&apiRateLimit, "api_rate_limit", 10, "API requests per second allowed for each workspace, 0 disables it")
+	fs.IntVar(&apiRateBurst, "api_rate_burst", 50, "API requests a workspace can make at once")
+	fs.Float64Var(&apiIPRateLimit, "api_ip_rate_limit", 20, "API requests per second allowed for each client IP, 0 disables it")
+	fs.IntVar(&apiIPRateBurst, "api_ip_rate_burst", 100, "API requests a client IP can make at once")
+	fs.Float64Var(&apiExpensiveRateLimit, "api_expensive_rate_limit", 0.1, "Pipe runs and force imports per second allowed for each workspace, 0 disables it")
+	fs.IntVar(&apiExpensiveRateBurst, "api_expensive_rate_burst", 5, "Pipe runs and force imports a workspace can start at once")
+	fs.StringVar(&trustedProxies, "trusted_proxies", "", "Comma separated IPs or CIDR ranges of proxies whose X-Forwarded-For tells client IP, e.g. 10.0.0.0/8")
+	fs.StringVar(&adminToken, "admin_token", "", "Bearer token of the admin API, empty disables it")
 	fs.StringVar(&testDBConnString, "test_db_conn_string", "dbname=pipes_test user=pipes_user host=localhost sslmode=disable port=5432", "test DB Connection String")
 
 	fs.Parse(os.Args[1:])
+	return fs.Args()
 }
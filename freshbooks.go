@@ -1,8 +1,14 @@
 package main
 
 import (
+	"bytes"
 	"encoding/json"
+	"encoding/xml"
+	"errors"
 	"fmt"
+	"io/ioutil"
+	"math"
+	"net/http"
 	"strconv"
 	"time"
 
@@ -12,9 +18,10 @@ import (
 
 type FreshbooksService struct {
 	emptyService
-	workspaceID int
-	accountName string
-	token       oauthplain.Token
+	workspaceID   int
+	accountName   string
+	token         oauthplain.Token
+	modifiedSince *time.Time
 }
 
 func (s *FreshbooksService) Name() string {
@@ -33,6 +40,10 @@ func (s *FreshbooksService) setParams(b []byte) error {
 	return nil
 }
 
+func (s *FreshbooksService) setSince(since *time.Time) {
+	s.modifiedSince = since
+}
+
 func (s *FreshbooksService) setAuthData(b []byte) error {
 	if err := json.Unmarshal(b, &s.token); err != nil {
 		return err
@@ -137,7 +148,7 @@ func (s *FreshbooksService) ExportTimeEntry(t *TimeEntry) (int, error) {
 		return 0, err
 	}
 	entry := &freshbooks.TimeEntry{
-		TimeEntryId: numberStrToInt(t.foreignID),
+		TimeEntryId: numberStrToInt(t.ForeignID),
 		ProjectId:   numberStrToInt(t.foreignProjectID),
 		TaskId:      numberStrToInt(t.foreignTaskID),
 		UserId:      numberStrToInt(t.foreignUserID),
@@ -150,3 +161,143 @@ func (s *FreshbooksService) ExportTimeEntry(t *TimeEntry) (int, error) {
 	}
 	return s.Api().SaveTimeEntry(entry)
 }
+
+type (
+	freshbooksDeleteTimeEntryRequest struct {
+		XMLName     xml.Name `xml:"request"`
+		Method      string   `xml:"method,attr"`
+		TimeEntryID int      `xml:"time_entry_id"`
+	}
+
+	freshbooksTimeEntriesRequest struct {
+		XMLName xml.Name `xml:"request"`
+		Method  string   `xml:"method,attr"`
+		PerPage int      `xml:"per_page"`
+		Page    int      `xml:"page"`
+		// UpdatedFrom filters by modification time, date_from would
+		// filter by the day entry was logged for
+		UpdatedFrom string `xml:"updated_from,omitempty"`
+	}
+
+	freshbooksTimeEntriesResponse struct {
+		Status      string `xml:"status,attr"`
+		Error       string `xml:"error"`
+		TimeEntries struct {
+			Page        int                    `xml:"page,attr"`
+			Pages       int                    `xml:"pages,attr"`
+			TimeEntries []freshbooks.TimeEntry `xml:"time_entry"`
+		} `xml:"time_entries"`
+	}
+)
+
+// freshbooksModifiedSinceWindow is subtracted from the last sync, because
+// Freshbooks compares updated_from in time zone of the account. Entries
+// changed within the window are fetched again and updated in Toggl, as
+// they are found in connection of imported time entries.
+const freshbooksModifiedSinceWindow = 24 * time.Hour
+
+// timeEntriesRequest lists entries modified since the last sync. Entries
+// deleted in Freshbooks are not listed, so they are not deleted in Toggl.
+func (s *FreshbooksService) timeEntriesRequest() freshbooksTimeEntriesRequest {
+	request := freshbooksTimeEntriesRequest{
+		Method:  "time_entry.list",
+		PerPage: 100,
+	}
+	if s.modifiedSince != nil {
+		request.UpdatedFrom = s.modifiedSince.Add(-freshbooksModifiedSinceWindow).UTC().Format("2006-01-02 15:04:05")
+	}
+	return request
+}
+
+// TimeEntries returns entries modified since the last sync. Freshbooks
+// entries have only a date and hours, so imported entries start at midnight
+// UTC of the date, and they are all billable as Freshbooks has no such flag.
+func (s *FreshbooksService) TimeEntries() ([]*TimeEntry, error) {
+	request := s.timeEntriesRequest()
+
+	var timeEntries []*TimeEntry
+	for page := 1; ; page++ {
+		request.Page = page
+		var response freshbooksTimeEntriesResponse
+		if err := s.request(&request, &response); err != nil {
+			return nil, err
+		}
+		if response.Status != "ok" {
+			return nil, errors.New(response.Error)
+		}
+		for _, object := range response.TimeEntries.TimeEntries {
+			entry, err := freshbooksTimeEntry(object)
+			if err != nil {
+				return nil, err
+			}
+			timeEntries = append(timeEntries, entry)
+		}
+		if page >= response.TimeEntries.Pages {
+			break
+		}
+	}
+	return timeEntries, nil
+}
+
+func freshbooksTimeEntry(object freshbooks.TimeEntry) (*TimeEntry, error) {
+	date, err := time.Parse("2006-01-02", object.Date)
+	if err != nil {
+		return nil, err
+	}
+	return &TimeEntry{
+		Start:             date.Format(time.RFC3339),
+		DurationInSeconds: int(math.Round(object.Hours * 3600)),
+		Description:       object.Notes,
+		Billable:          true,
+		ForeignID:         strconv.Itoa(object.TimeEntryId),
+		foreignUserID:     strconv.Itoa(object.UserId),
+		foreignProjectID:  strconv.Itoa(object.ProjectId),
+		foreignTaskID:     fmt.Sprintf("%d-%d", object.TaskId, object.ProjectId),
+	}, nil
+}
+
+func (s *FreshbooksService) DeleteTimeEntry(t *TimeEntry) error {
+	timeEntryID := numberStrToInt(t.ForeignID)
+	if timeEntryID == 0 {
+		return nil
+	}
+	request := freshbooksDeleteTimeEntryRequest{
+		Method:      "time_entry.delete",
+		TimeEntryID: timeEntryID,
+	}
+	var response freshbooks.TimeEntryResponse
+	if err := s.request(&request, &response); err != nil {
+		return err
+	}
+	if response.Status != "ok" {
+		return errors.New(response.Error)
+	}
+	return nil
+}
+
+// request calls Freshbooks API methods not covered by go-freshbooks
+func (s *FreshbooksService) request(request, response interface{}) error {
+	b, err := xml.Marshal(request)
+	if err != nil {
+		return err
+	}
+	url := fmt.Sprintf("https://%s.freshbooks.com/api/2.1/xml-in", s.accountName)
+	req, err := http.NewRequest("POST", url, bytes.NewBuffer(b))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Authorization", s.token.AuthHeader())
+	resp, err := rateLimitedClient(s, http.DefaultTransport).Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return errors.New(resp.Status)
+	}
+	b, err = ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return err
+	}
+	return xml.Unmarshal(b, response)
+}
@@ -0,0 +1,56 @@
+package main
+
+import (
+	"encoding/xml"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/toggl/go-freshbooks"
+)
+
+func TestFreshbooksTimeEntriesRequest(t *testing.T) {
+	s := &FreshbooksService{}
+	b, err := xml.Marshal(s.timeEntriesRequest())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if strings.Contains(string(b), "updated_from") || strings.Contains(string(b), "date_from") {
+		t.Errorf("expected first sync to list all entries, got %s", b)
+	}
+
+	since := time.Date(2020, 3, 10, 12, 30, 0, 0, time.UTC)
+	s.setSince(&since)
+	b, err = xml.Marshal(s.timeEntriesRequest())
+	if err != nil {
+		t.Fatal(err)
+	}
+	// entries of earlier days modified since the last sync are listed too
+	if !strings.Contains(string(b), "<updated_from>2020-03-09 12:30:00</updated_from>") || strings.Contains(string(b), "date_from") {
+		t.Errorf("expected entries to be filtered by modification time, got %s", b)
+	}
+}
+
+func TestFreshbooksTimeEntry(t *testing.T) {
+	hours, err := strconv.ParseFloat("4.35", 64)
+	if err != nil {
+		t.Fatal(err)
+	}
+	entry, err := freshbooksTimeEntry(freshbooks.TimeEntry{
+		TimeEntryId: 7, ProjectId: 2, TaskId: 3, UserId: 4, Date: "2020-03-10", Hours: hours,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if entry.DurationInSeconds != 15660 {
+		t.Errorf("expected 4.35 hours to be 15660 seconds, got %d", entry.DurationInSeconds)
+	}
+	if entry.Start != "2020-03-10T00:00:00Z" || entry.ForeignID != "7" || entry.foreignTaskID != "3-2" {
+		t.Errorf("unexpected entry %+v", entry)
+	}
+
+	if _, err := freshbooksTimeEntry(freshbooks.TimeEntry{Date: "10.03.2020"}); err == nil {
+		t.Error("expected invalid date to fail")
+	}
+}
@@ -62,5 +62,5 @@ func (s *GithubService) Projects() ([]*Project, error) {
 
 func (s *GithubService) client() *github.Client {
 	t := &oauth.Transport{Token: &s.token}
-	return github.NewClient(t.Client())
+	return github.NewClient(rateLimitedClient(s, t))
 }
@@ -26,10 +26,14 @@ require (
 	github.com/lib/pq v1.3.0
 	github.com/namsral/flag v1.7.4-pre
 	github.com/nu7hatch/gouuid v0.0.0-20131221200532-179d4d0c4d8d
+	github.com/prometheus/client_golang v1.7.1
 	github.com/range-labs/go-asana v0.0.0-20200127233601-f09b5bdfed8d
 	github.com/tambet/oauthplain v0.0.0-20140905172838-bbbd263fa701
 	github.com/toggl/go-freshbooks v0.0.0-20140904111550-aacdf55e408d
 	github.com/toggl/go-teamweek v0.0.0-20190812140547-f3996a352cd2
+	go.opentelemetry.io/otel v0.8.0
+	go.opentelemetry.io/otel/exporters/otlp v0.8.0
+	google.golang.org/grpc v1.30.0
 )
 
 go 1.13
@@ -3,24 +3,48 @@ package main
 import (
 	"encoding/json"
 	"fmt"
-	"log"
 	"net/http"
-	"sync"
+	"net/url"
+	"regexp"
+	"strconv"
 	"time"
 
 	"github.com/gorilla/mux"
 	"github.com/tambet/oauthplain"
 )
 
-// mutex to prevent multiple of postPipeRun on same workspace run at same time
-var postPipeRunWorkspaceLock = map[int]*sync.Mutex{}
-var postPipeRunLock sync.Mutex
-
 type Selector struct {
 	IDs         []int `json:"ids"`
 	SendInvites bool  `json:"send_invites"`
 }
 
+// ProjectSelector limits projects pipe and tasks under it to selected
+// projects. Projects not listed in KnownIDs when selection was saved are
+// considered new and get selected if AutoSelect is set.
+type ProjectSelector struct {
+	IDs        []int `json:"ids"`
+	KnownIDs   []int `json:"known_ids"`
+	AutoSelect bool  `json:"auto_select"`
+}
+
+func (s *ProjectSelector) selected(foreignID string) bool {
+	id := numberStrToInt(foreignID)
+	for _, selectedID := range s.IDs {
+		if selectedID == id {
+			return true
+		}
+	}
+	if !s.AutoSelect {
+		return false
+	}
+	for _, knownID := range s.KnownIDs {
+		if knownID == id {
+			return false
+		}
+	}
+	return true
+}
+
 func getIntegrations(req Request) Response {
 	workspaceID := currentWorkspaceID(req.r)
 	integrations, err := workspaceIntegrations(workspaceID)
@@ -34,11 +58,11 @@ func getIntegrationPipe(req Request) Response {
 	workspaceID := currentWorkspaceID(req.r)
 	serviceID := mux.Vars(req.r)["service"]
 	if !serviceType.MatchString(serviceID) {
-		return badRequest("Missing or invalid service")
+		return invalidField("service", "Missing or invalid service")
 	}
 	pipeID := mux.Vars(req.r)["pipe"]
 	if !pipeType.MatchString(pipeID) {
-		return badRequest("Missing or invalid pipe")
+		return invalidField("pipe", "Missing or invalid pipe")
 	}
 
 	pipe, err := loadPipe(workspaceID, serviceID, pipeID)
@@ -61,17 +85,17 @@ func postPipeSetup(req Request) Response {
 	workspaceID := currentWorkspaceID(req.r)
 	serviceID := mux.Vars(req.r)["service"]
 	if !serviceType.MatchString(serviceID) {
-		return badRequest("Missing or invalid service")
+		return invalidField("service", "Missing or invalid service")
 	}
 	pipeID := mux.Vars(req.r)["pipe"]
 	if !pipeType.MatchString(pipeID) {
-		return badRequest("Missing or invalid pipe")
+		return invalidField("pipe", "Missing or invalid pipe")
 	}
 
 	pipe := NewPipe(workspaceID, serviceID, pipeID)
 	errorMsg := pipe.validateServiceConfig(req.body)
 	if errorMsg != "" {
-		return badRequest(errorMsg)
+		return invalidField("body", errorMsg)
 	}
 
 	if err := pipe.save(); err != nil {
@@ -84,14 +108,14 @@ func putPipeSetup(req Request) Response {
 	workspaceID := currentWorkspaceID(req.r)
 	serviceID := mux.Vars(req.r)["service"]
 	if !serviceType.MatchString(serviceID) {
-		return badRequest("Missing or invalid service")
+		return invalidField("service", "Missing or invalid service")
 	}
 	pipeID := mux.Vars(req.r)["pipe"]
 	if !pipeType.MatchString(pipeID) {
-		return badRequest("Missing or invalid pipe")
+		return invalidField("pipe", "Missing or invalid pipe")
 	}
 	if len(req.body) == 0 {
-		return badRequest("Missing payload")
+		return invalidField("body", "Missing payload")
 	}
 	pipe, err := loadPipe(workspaceID, serviceID, pipeID)
 	if err != nil {
@@ -103,6 +127,9 @@ func putPipeSetup(req Request) Response {
 	if err := json.Unmarshal(req.body, &pipe); err != nil {
 		return internalServerError(err.Error())
 	}
+	if errorMsg := pipe.validateDirection(); errorMsg != "" {
+		return invalidField("direction", errorMsg)
+	}
 	if err := pipe.save(); err != nil {
 		return internalServerError(err.Error())
 	}
@@ -113,11 +140,11 @@ func deletePipeSetup(req Request) Response {
 	workspaceID := currentWorkspaceID(req.r)
 	serviceID := mux.Vars(req.r)["service"]
 	if !serviceType.MatchString(serviceID) {
-		return badRequest("Missing or invalid service")
+		return invalidField("service", "Missing or invalid service")
 	}
 	pipeID := mux.Vars(req.r)["pipe"]
 	if !pipeType.MatchString(pipeID) {
-		return badRequest("Missing or invalid pipe")
+		return invalidField("pipe", "Missing or invalid pipe")
 	}
 	pipe, err := loadPipe(workspaceID, serviceID, pipeID)
 	if err != nil {
@@ -138,13 +165,13 @@ func getAuthURL(req Request) Response {
 	callbackURL := req.r.FormValue("callback_url")
 
 	if !serviceType.MatchString(serviceID) {
-		return badRequest("Missing or invalid service")
+		return invalidField("service", "Missing or invalid service")
 	}
 	if accountName == "" {
-		return badRequest("Missing or invalid account_name")
+		return invalidField("account_name", "Missing or invalid account_name")
 	}
 	if callbackURL == "" {
-		return badRequest("Missing or invalid callback_url")
+		return invalidField("callback_url", "Missing or invalid callback_url")
 	}
 
 	config, found := oAuth1Configs[serviceID]
@@ -169,10 +196,10 @@ func postAuthorization(req Request) Response {
 	workspaceID := currentWorkspaceID(req.r)
 	serviceID := mux.Vars(req.r)["service"]
 	if !serviceType.MatchString(serviceID) {
-		return badRequest("Missing or invalid service")
+		return invalidField("service", "Missing or invalid service")
 	}
 	if len(req.body) == 0 {
-		return badRequest("Missing payload")
+		return invalidField("body", "Missing payload")
 	}
 
 	var payload map[string]interface{}
@@ -210,9 +237,12 @@ func deleteAuthorization(req Request) Response {
 	workspaceID := currentWorkspaceID(req.r)
 	serviceID := mux.Vars(req.r)["service"]
 	if !serviceType.MatchString(serviceID) {
-		return badRequest("Missing or invalid service")
+		return invalidField("service", "Missing or invalid service")
+	}
+	service, err := getService(serviceID, workspaceID)
+	if err != nil {
+		return badRequest(err.Error())
 	}
-	service := getService(serviceID, workspaceID)
 	authorization, err := loadAuth(service)
 	if err != nil {
 		return internalServerError(err.Error())
@@ -231,15 +261,18 @@ func getServiceAccounts(req Request) Response {
 	workspaceID := currentWorkspaceID(req.r)
 	serviceID := mux.Vars(req.r)["service"]
 	if !serviceType.MatchString(serviceID) {
-		return badRequest("Missing or invalid service")
+		return invalidField("service", "Missing or invalid service")
+	}
+	service, err := getService(serviceID, workspaceID)
+	if err != nil {
+		return badRequest(err.Error())
 	}
-	service := getService(serviceID, workspaceID)
 	auth, err := loadAuth(service)
 	if err != nil {
 		return badRequest("No authorizations for " + serviceID)
 	}
 	if err := auth.refresh(); err != nil {
-		return badRequest("oAuth refresh failed!")
+		return req.oAuthRefreshFailed(err)
 	}
 	forceImport := req.r.FormValue("force")
 	if forceImport == "true" {
@@ -252,12 +285,13 @@ func getServiceAccounts(req Request) Response {
 		return internalServerError("Unable to get accounts from DB")
 	}
 	if accountsResponse == nil {
-		go func() {
-			if err := fetchAccounts(service); err != nil {
-				log.Print(err.Error())
-			}
-		}()
-		return noContent()
+		job, err := startJob(workspaceID, jobKindAccounts, service.keyFor("accounts"), func() error {
+			return fetchAccounts(service)
+		})
+		if err != nil {
+			return internalServerError(err.Error())
+		}
+		return accepted(job)
 	}
 	return ok(accountsResponse)
 }
@@ -267,9 +301,12 @@ func getServiceUsers(req Request) Response {
 
 	serviceID := mux.Vars(req.r)["service"]
 	if !serviceType.MatchString(serviceID) {
-		return badRequest("Missing or invalid service")
+		return invalidField("service", "Missing or invalid service")
+	}
+	service, err := getService(serviceID, workspaceID)
+	if err != nil {
+		return badRequest(err.Error())
 	}
-	service := getService(serviceID, workspaceID)
 	if _, err := loadAuth(service); err != nil {
 		return badRequest("No authorizations for " + serviceID)
 	}
@@ -282,7 +319,7 @@ func getServiceUsers(req Request) Response {
 		return badRequest("Pipe is not configured")
 	}
 	if err := service.setParams(pipe.ServiceParams); err != nil {
-		return badRequest(err.Error())
+		return req.invalidServiceParams(err)
 	}
 
 	forceImport := req.r.FormValue("force")
@@ -298,17 +335,130 @@ func getServiceUsers(req Request) Response {
 	}
 	if usersResponse == nil {
 		if forceImport == "true" {
-			go func() {
-				if err := pipe.fetchObjects(false); err != nil {
-					log.Print(err.Error())
-				}
-			}()
+			job, err := startJob(workspaceID, jobKindUsers, service.keyFor(pipeID), func() error {
+				return pipe.fetchObjects(false)
+			})
+			if err != nil {
+				return internalServerError(err.Error())
+			}
+			return accepted(job)
 		}
 		return noContent()
 	}
 	return ok(usersResponse)
 }
 
+func getServiceProjects(req Request) Response {
+	workspaceID := currentWorkspaceID(req.r)
+	serviceID, pipeID := currentServicePipeID(req.r)
+	if pipeID != projectsPipeID {
+		return badRequest("Project selection is only available for projects pipe")
+	}
+
+	service, err := getService(serviceID, workspaceID)
+	if err != nil {
+		return badRequest(err.Error())
+	}
+	if _, err := loadAuth(service); err != nil {
+		return badRequest("No authorizations for " + serviceID)
+	}
+	pipe, err := loadPipe(workspaceID, serviceID, pipeID)
+	if err != nil {
+		return internalServerError(err.Error())
+	}
+	if pipe == nil {
+		return badRequest("Pipe is not configured")
+	}
+	if err := service.setParams(pipe.ServiceParams); err != nil {
+		return req.invalidServiceParams(err)
+	}
+
+	forceImport := req.r.FormValue("force")
+	if forceImport == "true" {
+		if err := clearImportFor(service, pipeID); err != nil {
+			return internalServerError(err.Error())
+		}
+	}
+
+	projectsResponse, err := getProjects(service)
+	if err != nil {
+		return internalServerError("Unable to get projects from DB")
+	}
+	if projectsResponse == nil {
+		if forceImport == "true" {
+			job, err := startJob(workspaceID, jobKindProjects, service.keyFor(pipeID), func() error {
+				return fetchProjectsList(pipe)
+			})
+			if err != nil {
+				return internalServerError(err.Error())
+			}
+			return accepted(job)
+		}
+		return noContent()
+	}
+	return ok(struct {
+		*ProjectsResponse
+		Selector *ProjectSelector `json:"selector,omitempty"`
+	}{projectsResponse, pipe.ProjectSelector})
+}
+
+func postServiceProjects(req Request) Response {
+	workspaceID := currentWorkspaceID(req.r)
+	serviceID, pipeID := currentServicePipeID(req.r)
+	if pipeID != projectsPipeID {
+		return badRequest("Project selection is only available for projects pipe")
+	}
+	if len(req.body) == 0 {
+		return invalidField("body", "Missing payload")
+	}
+
+	var selector ProjectSelector
+	if err := json.Unmarshal(req.body, &selector); err != nil {
+		return badRequest(err.Error())
+	}
+
+	pipe, err := loadPipe(workspaceID, serviceID, pipeID)
+	if err != nil {
+		return internalServerError(err.Error())
+	}
+	if pipe == nil {
+		return badRequest("Pipe is not configured")
+	}
+	service, err := pipe.Service()
+	if err != nil {
+		return badRequest(err.Error())
+	}
+	projectsResponse, err := getProjects(service)
+	if err != nil {
+		return internalServerError("Unable to get projects from DB")
+	}
+	if projectsResponse == nil {
+		return badRequest("Projects have not been fetched yet")
+	}
+
+	selector.KnownIDs = make([]int, 0, len(projectsResponse.Projects))
+	known := make(map[int]bool, len(projectsResponse.Projects))
+	for _, project := range projectsResponse.Projects {
+		id := numberStrToInt(project.ForeignID)
+		selector.KnownIDs = append(selector.KnownIDs, id)
+		known[id] = true
+	}
+	for _, id := range selector.IDs {
+		if !known[id] {
+			return invalidField("ids", fmt.Sprintf("Unknown project ID %d", id))
+		}
+	}
+	pipe.ProjectSelector = &selector
+	if err := pipe.save(); err != nil {
+		return internalServerError(err.Error())
+	}
+	// newly selected projects must be imported before their tasks
+	if err := resetPipeSteps(workspaceID, serviceID); err != nil {
+		return internalServerError(err.Error())
+	}
+	return ok(nil)
+}
+
 func getServicePipeLog(req Request) Response {
 	workspaceID := currentWorkspaceID(req.r)
 	serviceID, pipeID := currentServicePipeID(req.r)
@@ -339,21 +489,14 @@ func postServicePipeClearConnections(req Request) Response {
 	if err != nil {
 		return internalServerError("Unable to get clear connections")
 	}
+	if err := resetPipeSteps(workspaceID, serviceID); err != nil {
+		return internalServerError(err.Error())
+	}
 	return noContent()
 }
 
 func postPipeRun(req Request) Response {
 	workspaceID := currentWorkspaceID(req.r)
-
-	// make sure no race condition on fetching workspace lock
-	postPipeRunLock.Lock()
-	workspaceLock, exists := postPipeRunWorkspaceLock[workspaceID]
-	if !exists {
-		workspaceLock = &sync.Mutex{}
-		postPipeRunWorkspaceLock[workspaceID] = workspaceLock
-	}
-	postPipeRunLock.Unlock()
-
 	serviceID, pipeID := currentServicePipeID(req.r)
 
 	pipe, err := loadPipe(workspaceID, serviceID, pipeID)
@@ -364,22 +507,79 @@ func postPipeRun(req Request) Response {
 		return badRequest("Pipe is not configured")
 	}
 	if msg := pipe.validatePayload(req.body); msg != "" {
-		return badRequest(msg)
+		return invalidField("body", msg)
+	}
+
+	lock, err := tryLockWorkspace(workspaceID)
+	if err == ErrWorkspaceLocked {
+		return conflict(err.Error())
+	}
+	if err != nil {
+		return internalServerError(err.Error())
+	}
+
+	job, err := NewJob(workspaceID, jobKindPipe, pipe.key)
+	if err != nil {
+		lock.unlock()
+		return internalServerError(err.Error())
 	}
 	if pipe.ID == "users" {
+		pipe.ctx = detachedContext(req.r.Context())
 		go func() {
-			workspaceLock.Lock()
+			defer lock.unlock()
 			pipe.run()
-			workspaceLock.Unlock()
 		}()
-		time.Sleep(500 * time.Millisecond)
-	} else {
-		_, err = db.Exec(queuePipeAsFirstSQL, pipe.workspaceID, pipe.key)
-		if err != nil {
-			return internalServerError(err.Error())
-		}
+		return accepted(job)
 	}
-	return ok(nil)
+
+	// other pipes are run by background workers which lock the workspace
+	// themselves, lock is only taken here to reject concurrent runs
+	defer lock.unlock()
+	_, err = db.Exec(queuePipeAsFirstSQL, pipe.workspaceID, pipe.key)
+	if err != nil {
+		return internalServerError(err.Error())
+	}
+	return accepted(job)
+}
+
+// postPipeCancel removes queued run of the pipe and stops the running
+// one at the next safe point
+func postPipeCancel(req Request) Response {
+	workspaceID := currentWorkspaceID(req.r)
+	serviceID, pipeID := currentServicePipeID(req.r)
+
+	pipe, err := loadPipe(workspaceID, serviceID, pipeID)
+	if err != nil {
+		return internalServerError(err.Error())
+	}
+	if pipe == nil {
+		return badRequest("Pipe is not configured")
+	}
+	dequeued, stopping, err := cancelPipe(pipe)
+	if err != nil {
+		return internalServerError(err.Error())
+	}
+	if !dequeued && !stopping {
+		return conflict("Pipe is not queued or running")
+	}
+	return accepted(struct {
+		Dequeued bool `json:"dequeued"`
+		Stopping bool `json:"stopping"`
+	}{dequeued, stopping})
+}
+
+func getJob(req Request) Response {
+	workspaceID := currentWorkspaceID(req.r)
+	jobID := mux.Vars(req.r)["id"]
+
+	job, err := loadJob(workspaceID, jobID)
+	if err != nil {
+		return internalServerError(err.Error())
+	}
+	if job == nil {
+		return notFound("Job not found")
+	}
+	return ok(job)
 }
 
 func getStatus(req Request) Response {
@@ -400,3 +600,165 @@ func getStatus(req Request) Response {
 	}
 	return ok(map[string]string{"status": "OK"})
 }
+
+var queueServicePattern = regexp.MustCompile(`^\w+$`)
+
+// parseQueueFilter reads filters of admin queue listing from query
+func parseQueueFilter(query url.Values) (queueFilter, *ValidationError) {
+	var filter queueFilter
+
+	switch state := query.Get("state"); state {
+	case "", queueStateQueued, queueStateLocked, queueStateSynced:
+		filter.state = state
+	default:
+		return filter, &ValidationError{Field: "state", Message: "Must be queued, locked or synced"}
+	}
+	if v := query.Get("workspace_id"); v != "" {
+		id, err := strconv.Atoi(v)
+		if err != nil || id < 1 {
+			return filter, &ValidationError{Field: "workspace_id", Message: "Must be a positive integer"}
+		}
+		filter.workspaceID = id
+	}
+	if v := query.Get("service"); v != "" {
+		if !queueServicePattern.MatchString(v) {
+			return filter, &ValidationError{Field: "service", Message: "Invalid service"}
+		}
+		filter.service = v
+	}
+	if v := query.Get("older_than"); v != "" {
+		d, err := time.ParseDuration(v)
+		if err != nil || d < 0 {
+			return filter, &ValidationError{Field: "older_than", Message: "Must be a duration, e.g. 30m"}
+		}
+		filter.olderThan = d
+	}
+	filter.limit = defaultQueueListLimit
+	if v := query.Get("limit"); v != "" {
+		limit, err := strconv.Atoi(v)
+		if err != nil || limit < 1 || limit > maxQueueListLimit {
+			return filter, &ValidationError{Field: "limit", Message: fmt.Sprintf("Must be between 1 and %d", maxQueueListLimit)}
+		}
+		filter.limit = limit
+	}
+	return filter, nil
+}
+
+func queueEntryID(req Request) (int64, *ValidationError) {
+	id, err := strconv.ParseInt(mux.Vars(req.r)["entry_id"], 10, 64)
+	if err != nil || id < 1 {
+		return 0, &ValidationError{Field: "entry_id", Message: "Missing or invalid queue entry ID"}
+	}
+	return id, nil
+}
+
+func getAdminQueue(req Request) Response {
+	filter, invalid := parseQueueFilter(req.r.URL.Query())
+	if invalid != nil {
+		return invalidField(invalid.Field, invalid.Message)
+	}
+	entries, err := listQueueEntries(filter)
+	if err != nil {
+		return internalServerError(err.Error())
+	}
+	return ok(entries)
+}
+
+func getAdminWorkspaceQueue(req Request) Response {
+	workspaceID, err := strconv.Atoi(mux.Vars(req.r)["workspace_id"])
+	if err != nil || workspaceID < 1 {
+		return invalidField("workspace_id", "Missing or invalid workspace ID")
+	}
+	filter, invalid := parseQueueFilter(req.r.URL.Query())
+	if invalid != nil {
+		return invalidField(invalid.Field, invalid.Message)
+	}
+	filter.workspaceID = workspaceID
+	entries, err := listQueueEntries(filter)
+	if err != nil {
+		return internalServerError(err.Error())
+	}
+	return ok(entries)
+}
+
+func postAdminQueueEntryRequeue(req Request) Response {
+	id, invalid := queueEntryID(req)
+	if invalid != nil {
+		return invalidField(invalid.Field, invalid.Message)
+	}
+	entry, err := loadQueueEntry(id)
+	if err != nil {
+		return internalServerError(err.Error())
+	}
+	if entry == nil {
+		return notFound("Queue entry not found")
+	}
+	pending, err := requeueQueueEntry(entry)
+	if err != nil {
+		return internalServerError(err.Error())
+	}
+	if pending == nil || pending.State == queueStateLocked {
+		return conflict("Pipe is running, unlock it first if it is stuck")
+	}
+	requestLogger(req.r).Info("admin requeued pipe", Fields{"queue_entry_id": id, "workspace_id": entry.WorkspaceID, "key": entry.Key})
+	return ok(pending)
+}
+
+func deleteAdminQueueEntry(req Request) Response {
+	id, invalid := queueEntryID(req)
+	if invalid != nil {
+		return invalidField(invalid.Field, invalid.Message)
+	}
+	canceled, err := cancelQueueEntry(id)
+	if err != nil {
+		return internalServerError(err.Error())
+	}
+	if !canceled {
+		entry, err := loadQueueEntry(id)
+		if err != nil {
+			return internalServerError(err.Error())
+		}
+		if entry == nil {
+			return notFound("Queue entry not found")
+		}
+		return conflict(fmt.Sprintf("Only queued entries can be canceled, entry is %s", entry.State))
+	}
+	requestLogger(req.r).Info("admin canceled queue entry", Fields{"queue_entry_id": id})
+	return noContent()
+}
+
+func postAdminQueueEntryUnlock(req Request) Response {
+	id, invalid := queueEntryID(req)
+	if invalid != nil {
+		return invalidField(invalid.Field, invalid.Message)
+	}
+	ids, err := unlockQueueEntries(id, 0)
+	if err != nil {
+		return internalServerError(err.Error())
+	}
+	if len(ids) == 0 {
+		entry, err := loadQueueEntry(id)
+		if err != nil {
+			return internalServerError(err.Error())
+		}
+		if entry == nil {
+			return notFound("Queue entry not found")
+		}
+		return conflict(fmt.Sprintf("Only locked entries can be unlocked, entry is %s", entry.State))
+	}
+	requestLogger(req.r).Warn("admin unlocked queue entry", Fields{"queue_entry_id": id})
+	return ok(map[string][]int64{"unlocked": ids})
+}
+
+func postAdminQueueUnlockStale(req Request) Response {
+	lockedFor, err := time.ParseDuration(req.r.URL.Query().Get("older_than"))
+	if err != nil || lockedFor < time.Minute {
+		return invalidField("older_than", "Must be a duration of at least 1m, e.g. 2h")
+	}
+	ids, err := unlockQueueEntries(0, lockedFor)
+	if err != nil {
+		return internalServerError(err.Error())
+	}
+	requestLogger(req.r).Warn("admin unlocked stale queue entries", Fields{"older_than": lockedFor.String(), "count": len(ids)})
+	return ok(map[string][]int64{"unlocked": ids})
+}
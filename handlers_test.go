@@ -0,0 +1,98 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/gorilla/context"
+)
+
+func TestProjectSelectorSelected(t *testing.T) {
+	selector := ProjectSelector{
+		IDs:      []int{1, 2},
+		KnownIDs: []int{1, 2, 3},
+	}
+
+	for foreignID, want := range map[string]bool{"1": true, "2": true, "3": false, "4": false} {
+		if got := selector.selected(foreignID); got != want {
+			t.Errorf("selected(%s) = %t, want %t", foreignID, got, want)
+		}
+	}
+
+	selector.AutoSelect = true
+	for foreignID, want := range map[string]bool{"1": true, "3": false, "4": true} {
+		if got := selector.selected(foreignID); got != want {
+			t.Errorf("selected(%s) with auto select = %t, want %t", foreignID, got, want)
+		}
+	}
+}
+
+// postProjectSelection calls postServiceProjects for projects pipe of the test service
+func postProjectSelection(body string) Response {
+	r := httptest.NewRequest("POST", "/", nil)
+	defer context.Clear(r)
+	context.Set(r, workspaceIDKey, workspaceID)
+	context.Set(r, serviceIDKey, TestServiceName)
+	context.Set(r, pipeIDKey, projectsPipeID)
+	return postServiceProjects(Request{r: r, body: []byte(body)})
+}
+
+func TestProjectSelectionSyncsSelectedProjects(t *testing.T) {
+	db = connectDB(testDBConnString)
+	api := newFakeTogglAPI(workspaceID)
+	defer api.Close()
+	defer api.use()()
+	defer func(tasks []*Task) { testTasks = tasks }(testTasks)
+	testTasks = []*Task{
+		{Name: "Design", Active: true, ForeignID: "11", foreignProjectID: "1"},
+		{Name: "Review", Active: true, ForeignID: "12", foreignProjectID: "2"},
+	}
+	saveTestConnection(t, projectsPipeID, nil)
+	saveTestConnection(t, tasksPipeId, nil)
+
+	projects := NewPipe(workspaceID, TestServiceName, projectsPipeID)
+	projects.PipeStatus = NewPipeStatus(workspaceID, TestServiceName, projectsPipeID)
+	if err := projects.save(); err != nil {
+		t.Fatal(err)
+	}
+	if err := projects.fetchObjects(false); err != nil {
+		t.Fatal(err)
+	}
+
+	if resp := postProjectSelection(`{"ids": [1, 42]}`); resp.status != http.StatusBadRequest {
+		t.Errorf("expected unknown project ID to be rejected, got %d", resp.status)
+	} else if err, ok := resp.content.(*ValidationError); !ok || err.Field != "ids" {
+		t.Errorf("expected invalid ids field, got %v", resp.content)
+	}
+	if resp := postProjectSelection(`{"ids": [1]}`); resp.status != http.StatusOK {
+		t.Fatalf("expected selection to be saved, got %d %v", resp.status, resp.content)
+	}
+
+	for _, pipeID := range []string{projectsPipeID, tasksPipeId} {
+		p, err := loadPipe(workspaceID, TestServiceName, pipeID)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if p == nil {
+			p = NewPipe(workspaceID, TestServiceName, pipeID)
+		}
+		p.authorization = &Authorization{WorkspaceToken: "token"}
+		p.PipeStatus = NewPipeStatus(workspaceID, TestServiceName, pipeID)
+		if err := p.fetchObjects(false); err != nil {
+			t.Fatal(err)
+		}
+		if err := p.postObjects(false); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	api.mu.Lock()
+	defer api.mu.Unlock()
+	if len(api.projects) != 1 || api.projects[0].Name != p1Name {
+		t.Errorf("expected only selected project to be synced, got %d projects", len(api.projects))
+	}
+	if len(api.tasks) != 1 || api.tasks[0].Name != "Design" {
+		t.Errorf("expected only tasks of selected project to be synced, got %d tasks", len(api.tasks))
+	}
+}
@@ -3,10 +3,10 @@ package main
 import (
 	"encoding/json"
 	"errors"
+	"fmt"
 	"strconv"
 	"strings"
 
-	"github.com/bugsnag/bugsnag-go"
 )
 
 const maxPayloadSizeBytes = 800 * 1000
@@ -15,12 +15,18 @@ const clientsPipeID = "clients"
 const projectsPipeID = "projects"
 const tasksPipeId = "tasks"
 const todoPipeId = "todolists"
+const timeEntriesPipeID = "timeentries"
+
+// timeEntriesObjectKey is the Toggl endpoint of time entries,
+// their imports and connections are saved with it
+const timeEntriesObjectKey = "time_entries"
+const importedTimeEntriesPipeID = "imported_time_entries"
 
 var ErrNotSupported = errors.New("service does not support")
 
 func getAccounts(s Service) (*AccountsResponse, error) {
 	var result []byte
-	rows, err := db.Query(`
+	rows, err := db.QueryContext(s.context(), `
 		SELECT data FROM imports
 		WHERE workspace_id = $1 AND key = $2
 		ORDER by created_at DESC
@@ -47,30 +53,30 @@ func getAccounts(s Service) (*AccountsResponse, error) {
 
 func fetchAccounts(s Service) error {
 	var response AccountsResponse
-	accounts, err := s.Accounts()
+	accounts, accountsErr := s.Accounts()
 	response.Accounts = accounts
-	if err != nil {
-		response.Error = err.Error()
+	if accountsErr != nil {
+		response.Error = accountsErr.Error()
 	}
 
 	b, err := json.Marshal(response)
 	if err != nil {
-		bugsnag.Notify(err)
+		reportError(err, serviceErrorMetadata(s))
 		return err
 	}
-	_, err = db.Exec(`
+	_, err = db.ExecContext(s.context(), `
     INSERT INTO imports(workspace_id, key, data, created_at)
     VALUES($1, $2, $3, NOW())
   	`, s.WorkspaceID(), s.keyFor("accounts"), b)
 	if err != nil {
-		bugsnag.Notify(err)
+		reportError(err, serviceErrorMetadata(s))
 		return err
 	}
-	return nil
+	return accountsErr
 }
 
 func clearImportFor(s Service, pipeID string) error {
-	_, err := db.Exec(`
+	_, err := db.ExecContext(s.context(), `
 	    DELETE FROM imports
 	    WHERE workspace_id = $1 AND key = $2
 	`, s.WorkspaceID(), s.keyFor(pipeID))
@@ -79,7 +85,7 @@ func clearImportFor(s Service, pipeID string) error {
 
 func getObject(s Service, pipeID string) ([]byte, error) {
 	var result []byte
-	rows, err := db.Query(`
+	rows, err := db.QueryContext(s.context(), `
 		SELECT data FROM imports
 		WHERE workspace_id = $1 AND key = $2
 		ORDER by created_at DESC
@@ -155,6 +161,20 @@ func getTasks(s Service, objType string) (*TasksResponse, error) {
 	return &tasksResponse, nil
 }
 
+func getTimeEntries(s Service) (*TimeEntriesResponse, error) {
+	b, err := getObject(s, timeEntriesObjectKey)
+	if err != nil || b == nil {
+		return nil, err
+	}
+
+	var timeEntriesResponse TimeEntriesResponse
+	err = json.Unmarshal(b, &timeEntriesResponse)
+	if err != nil {
+		return nil, err
+	}
+	return &timeEntriesResponse, nil
+}
+
 func postUsers(p *Pipe) error {
 	s, err := p.Service()
 	if err != nil {
@@ -183,7 +203,7 @@ func postUsers(p *Pipe) error {
 		}
 	}
 
-	b, err := postPipesAPI(p.authorization.WorkspaceToken, usersPipeID, usersRequest{Users: users})
+	b, err := togglClient.PostPipesAPI(p.context(), p.authorization.WorkspaceToken, usersPipeID, usersRequest{Users: users})
 	if err != nil {
 		return err
 	}
@@ -204,6 +224,7 @@ func postUsers(p *Pipe) error {
 		return err
 	}
 
+	p.reportStep(stagePost, usersPipeID, len(users), len(users), fmt.Sprintf("Posted %d users", len(users)))
 	p.PipeStatus.complete(usersPipeID, usersImport.Notifications, usersImport.Count())
 	return nil
 }
@@ -226,7 +247,7 @@ func postClients(p *Pipe) error {
 	if len(clientsResponse.Clients) == 0 {
 		return nil
 	}
-	b, err := postPipesAPI(p.authorization.WorkspaceToken, clientsPipeID, clients)
+	b, err := togglClient.PostPipesAPI(p.context(), p.authorization.WorkspaceToken, clientsPipeID, clients)
 	if err != nil {
 		return err
 	}
@@ -244,6 +265,8 @@ func postClients(p *Pipe) error {
 	if err := connection.save(); err != nil {
 		return err
 	}
+	p.reportStep(stagePost, clientsPipeID, len(clients.Clients), len(clients.Clients),
+		fmt.Sprintf("Posted %d clients", len(clients.Clients)))
 	p.PipeStatus.complete(clientsPipeID, clientsImport.Notifications, clientsImport.Count())
 	return nil
 }
@@ -260,12 +283,24 @@ func postProjects(p *Pipe) error {
 	if projectsResponse == nil {
 		return errors.New("service projects not found")
 	}
+	selector, err := p.projectSelector()
+	if err != nil {
+		return err
+	}
 	projects := projectRequest{
 		Projects: projectsResponse.Projects,
 		SupportsClient: projectsResponse.SupportsClient,
 	}
+	if selector != nil {
+		projects.Projects = make([]*Project, 0)
+		for _, project := range projectsResponse.Projects {
+			if selector.selected(project.ForeignID) {
+				projects.Projects = append(projects.Projects, project)
+			}
+		}
+	}
 
-	b, err := postPipesAPI(p.authorization.WorkspaceToken, projectsPipeID, projects)
+	b, err := togglClient.PostPipesAPI(p.context(), p.authorization.WorkspaceToken, projectsPipeID, projects)
 	if err != nil {
 		return err
 	}
@@ -283,6 +318,8 @@ func postProjects(p *Pipe) error {
 	if err := connection.save(); err != nil {
 		return err
 	}
+	p.reportStep(stagePost, projectsPipeID, len(projects.Projects), len(projectsResponse.Projects),
+		fmt.Sprintf("Posted %d of %d projects", len(projects.Projects), len(projectsResponse.Projects)))
 	p.PipeStatus.complete(projectsPipeID, projectsImport.Notifications, projectsImport.Count())
 	return nil
 }
@@ -305,8 +342,14 @@ func postTodoLists(p *Pipe) error {
 	}
 	var notifications []string
 	var count int
-	for _, tr := range trs {
-		b, err := postPipesAPI(p.authorization.WorkspaceToken, tasksPipeId, tr)
+	for i, tr := range trs {
+		// stop canceled run between batches, connections of
+		// the posted batches are saved already
+		if err := p.checkCanceled(); err != nil {
+			p.PipeStatus.complete(todoPipeId, notifications, count)
+			return err
+		}
+		b, err := togglClient.PostPipesAPI(p.context(), p.authorization.WorkspaceToken, tasksPipeId, tr)
 		if err != nil {
 			return err
 		}
@@ -326,6 +369,7 @@ func postTodoLists(p *Pipe) error {
 		}
 		notifications = append(notifications, tasksImport.Notifications...)
 		count += tasksImport.Count()
+		p.reportStep(stagePost, todoPipeId, i+1, len(trs), fmt.Sprintf("Posted batch %d of %d", i+1, len(trs)))
 	}
 	p.PipeStatus.complete(todoPipeId, notifications, count)
 	return nil
@@ -349,8 +393,14 @@ func postTasks(p *Pipe) error {
 	}
 	var notifications []string
 	var count int
-	for _, tr := range trs {
-		b, err := postPipesAPI(p.authorization.WorkspaceToken, tasksPipeId, tr)
+	for i, tr := range trs {
+		// stop canceled run between batches, connections of
+		// the posted batches are saved already
+		if err := p.checkCanceled(); err != nil {
+			p.PipeStatus.complete(p.ID, notifications, count)
+			return err
+		}
+		b, err := togglClient.PostPipesAPI(p.context(), p.authorization.WorkspaceToken, tasksPipeId, tr)
 		if err != nil {
 			return err
 		}
@@ -371,6 +421,7 @@ func postTasks(p *Pipe) error {
 		}
 		notifications = append(notifications, tasksImport.Notifications...)
 		count += tasksImport.Count()
+		p.reportStep(stagePost, p.ID, i+1, len(trs), fmt.Sprintf("Posted batch %d of %d", i+1, len(trs)))
 	}
 	p.PipeStatus.complete(p.ID, notifications, count)
 	return nil
@@ -379,19 +430,19 @@ func postTasks(p *Pipe) error {
 func saveObject(p *Pipe, pipeID string, obj interface{}) error {
 	b, err := json.Marshal(obj)
 	if err != nil {
-		bugsnag.Notify(err)
+		reportPipeError(p, err)
 		return err
 	}
 	s, err := p.Service()
 	if err != nil {
 		return err
 	}
-	_, err = db.Exec(`
+	_, err = db.ExecContext(p.context(), `
 	  INSERT INTO imports(workspace_id, key, data, created_at)
     VALUES($1, $2, $3, NOW())
 	`, p.workspaceID, s.keyFor(pipeID), b)
 	if err != nil {
-		bugsnag.Notify(err)
+		reportPipeError(p, err)
 		return err
 	}
 	return nil
@@ -409,6 +460,7 @@ func fetchUsers(p *Pipe) error {
 		response.Error = err.Error()
 		return err
 	}
+	p.reportStep(stageFetch, usersPipeID, len(users), len(users), fmt.Sprintf("Fetched %d users", len(users)))
 	return nil
 }
 
@@ -436,68 +488,85 @@ func fetchClients(p *Pipe) error {
 	for _, client := range response.Clients {
 		client.ID = connections.Data[client.ForeignID]
 	}
+	p.reportStep(stageFetch, clientsPipeID, len(clients), len(clients), fmt.Sprintf("Fetched %d clients", len(clients)))
 	return nil
 }
 
+// fetchProjects saves foreign projects, clients step runs before
+// it and saves clients if the service supports them
 func fetchProjects(p *Pipe) error {
 	response := ProjectsResponse{}
 	defer func() { saveObject(p, projectsPipeID, response) }()
 
-	if err := fetchClients(p); err != nil && !errors.Is(err, ErrNotSupported) {
+	service, err := p.Service()
+	if err != nil {
 		response.Error = err.Error()
 		return err
-	} else if err == nil {
-		response.SupportsClient = true
-		if err := postClients(p); err != nil {
-			response.Error = err.Error()
-			return err
-		}
 	}
+	clients, err := getClients(service)
+	if err != nil {
+		response.Error = err.Error()
+		return err
+	}
+	response.SupportsClient = clients != nil
 
-	service, err := p.Service()
+	projects, err := loadServiceProjects(p)
 	if err != nil {
+		response.Error = err.Error()
 		return err
 	}
-	service.setSince(p.lastSync)
-	projects, err := service.Projects()
+	response.Projects = projects
+	return nil
+}
+
+// fetchProjectsList saves foreign projects for selection
+// without importing clients to Toggl
+func fetchProjectsList(p *Pipe) error {
+	response := ProjectsResponse{}
+	defer func() { saveObject(p, projectsPipeID, response) }()
+
+	projects, err := loadServiceProjects(p)
 	if err != nil {
 		response.Error = err.Error()
 		return err
 	}
+	response.Projects = projects
+	return nil
+}
 
-	response.Projects = trimSpacesFromName(projects)
+func loadServiceProjects(p *Pipe) ([]*Project, error) {
+	service, err := p.Service()
+	if err != nil {
+		return nil, err
+	}
+	service.setSince(p.lastSync)
+	projects, err := service.Projects()
+	if err != nil {
+		return nil, err
+	}
+
+	projects = trimSpacesFromName(projects)
+	p.reportStep(stageFetch, projectsPipeID, len(projects), len(projects), fmt.Sprintf("Fetched %d projects", len(projects)))
 
 	var clientConnections, projectConnections *Connection
 	if clientConnections, err = loadConnection(service, clientsPipeID); err != nil {
-		response.Error = err.Error()
-		return err
+		return nil, err
 	}
 	if projectConnections, err = loadConnection(service, projectsPipeID); err != nil {
-		response.Error = err.Error()
-		return err
+		return nil, err
 	}
 
-	for _, project := range response.Projects {
+	for _, project := range projects {
 		project.ID = projectConnections.Data[project.ForeignID]
 		project.ClientID = clientConnections.Data[project.foreignClientID]
 	}
-
-	return nil
+	return projects, nil
 }
 
 func fetchTodoLists(p *Pipe) error {
 	response := TasksResponse{}
 	defer func() { saveObject(p, todoPipeId, response) }()
 
-	if err := fetchProjects(p); err != nil {
-		response.Error = err.Error()
-		return err
-	}
-	if err := postProjects(p); err != nil {
-		response.Error = err.Error()
-		return err
-	}
-
 	service, err := p.Service()
 	if err != nil {
 		return err
@@ -508,6 +577,7 @@ func fetchTodoLists(p *Pipe) error {
 		response.Error = err.Error()
 		return err
 	}
+	p.reportStep(stageFetch, todoPipeId, len(tasks), len(tasks), fmt.Sprintf("Fetched %d todo lists", len(tasks)))
 
 	var projectConnections, taskConnections *Connection
 
@@ -520,8 +590,17 @@ func fetchTodoLists(p *Pipe) error {
 		return err
 	}
 
+	selector, err := p.projectSelector()
+	if err != nil {
+		response.Error = err.Error()
+		return err
+	}
+
 	response.Tasks = make([]*Task, 0)
 	for _, task := range tasks {
+		if selector != nil && !selector.selected(task.foreignProjectID) {
+			continue
+		}
 		id := taskConnections.Data[task.ForeignID]
 		if (id > 0) || task.Active {
 			task.ID = id
@@ -536,15 +615,6 @@ func fetchTasks(p *Pipe) error {
 	response := TasksResponse{}
 	defer func() { saveObject(p, tasksPipeId, response) }()
 
-	if err := fetchProjects(p); err != nil {
-		response.Error = err.Error()
-		return err
-	}
-	if err := postProjects(p); err != nil {
-		response.Error = err.Error()
-		return err
-	}
-
 	service, err := p.Service()
 	if err != nil {
 		return err
@@ -555,6 +625,7 @@ func fetchTasks(p *Pipe) error {
 		response.Error = err.Error()
 		return err
 	}
+	p.reportStep(stageFetch, tasksPipeId, len(tasks), len(tasks), fmt.Sprintf("Fetched %d tasks", len(tasks)))
 	var projectConnections, taskConnections *Connection
 
 	if projectConnections, err = loadConnection(service, projectsPipeID); err != nil {
@@ -566,8 +637,17 @@ func fetchTasks(p *Pipe) error {
 		return err
 	}
 
+	selector, err := p.projectSelector()
+	if err != nil {
+		response.Error = err.Error()
+		return err
+	}
+
 	response.Tasks = make([]*Task, 0)
 	for _, task := range tasks {
+		if selector != nil && !selector.selected(task.foreignProjectID) {
+			continue
+		}
 		id := taskConnections.Data[task.ForeignID]
 		if (id > 0) || task.Active {
 			task.ID = id
@@ -618,20 +698,6 @@ func trimSpacesFromName(ps []*Project) []*Project {
 	return trimmedPs
 }
 
-// BugsnagNotifyPipe notifies bugsnag with metadata for the given pipe
-func BugsnagNotifyPipe(pipe *Pipe, err error) {
-	bugsnag.Notify(err, bugsnag.MetaData{
-		"pipe": {
-			"ID":            pipe.ID,
-			"Name":          pipe.Name,
-			"ServiceParams": string(pipe.ServiceParams),
-			"workspaceID":   pipe.workspaceID,
-			"serviceID":     pipe.serviceID,
-		},
-	})
-	return
-}
-
 func numberStrToInt(s string) int {
 	if s == "" {
 		return 0
@@ -44,6 +44,7 @@ func workspaceIntegrations(workspaceID int) ([]Integration, error) {
 				pipesAreInUseForThisWS = true
 				pipe.Automatic = existingPipe.Automatic
 				pipe.Configured = existingPipe.Configured
+				pipe.Direction = existingPipe.Direction
 			}
 
 			pipe.PipeStatus = pipeStatuses[key]
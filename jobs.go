@@ -0,0 +1,230 @@
+package main
+
+import (
+	"database/sql"
+	"fmt"
+	"time"
+
+	gouuid "github.com/nu7hatch/gouuid"
+)
+
+// Job tracks asynchronous work started by API requests,
+// pipe jobs are keyed by pipe key so that whichever worker
+// runs the pipe can report back to them.
+type Job struct {
+	ID        string    `json:"id"`
+	Kind      string    `json:"kind"`
+	State     string    `json:"state"`
+	Progress  int       `json:"progress"`
+	Error     string    `json:"error,omitempty"`
+	ErrorCode string    `json:"error_code,omitempty"`
+	CreatedAt time.Time `json:"created_at"`
+	UpdatedAt time.Time `json:"updated_at"`
+
+	workspaceID int
+	key         string
+}
+
+const (
+	jobKindAccounts = "accounts"
+	jobKindUsers    = "users"
+	jobKindProjects = "projects"
+	jobKindPipe     = "pipe"
+
+	jobQueued    = "queued"
+	jobRunning   = "running"
+	jobSucceeded = "succeeded"
+	jobFailed    = "failed"
+	jobCanceled  = "canceled"
+
+	insertJobSQL = `INSERT INTO jobs(id, workspace_id, kind, key, state, progress, error, error_code, created_at, updated_at)
+    VALUES($1, $2, $3, $4, $5, $6, $7, $8, $9, $10)
+  `
+	updateJobSQL = `UPDATE jobs
+    SET state = $2, progress = $3, error = $4, error_code = $5, updated_at = now()
+    WHERE id = $1
+  `
+	singleJobSQL = `SELECT id, kind, key, state, progress, error, error_code, created_at, updated_at
+    FROM jobs
+    WHERE workspace_id = $1
+    AND id = $2 LIMIT 1
+  `
+	claimPipeJobsSQL = `UPDATE jobs
+    SET state = 'running', updated_at = now()
+    WHERE workspace_id = $1
+    AND key = $2
+    AND state = 'queued'
+  `
+	updatePipeJobsSQL = `UPDATE jobs
+    SET state = $3, progress = $4, error = $5, error_code = $6, updated_at = now()
+    WHERE workspace_id = $1
+    AND key = $2
+    AND state = 'running'
+  `
+	// lockJobKeySQL serializes starting jobs of the same key
+	// until the transaction ends
+	lockJobKeySQL = `SELECT pg_advisory_xact_lock(hashtext($1))`
+	activeJobSQL  = `SELECT id, kind, key, state, progress, error, error_code, created_at, updated_at
+    FROM jobs
+    WHERE workspace_id = $1
+    AND kind = $2
+    AND key = $3
+    AND state IN ('queued', 'running')
+    AND updated_at > now() - $4::float8 * interval '1 second'
+    ORDER BY created_at DESC LIMIT 1
+  `
+	removeFinishedJobsSQL = `SELECT remove_finished_jobs($1::float8 * interval '1 second')`
+
+	// activeJobTimeout is how long queued or running job without updates
+	// is returned to polling clients, jobs of crashed processes are
+	// never finished and are started again after it
+	activeJobTimeout = 30 * time.Minute
+	// finishedJobsMaxAge is how long finished jobs can be polled
+	finishedJobsMaxAge = 24 * time.Hour
+	// finishedJobsCleanupInterval is how often finished jobs are removed
+	finishedJobsCleanupInterval = time.Hour
+)
+
+func NewJob(workspaceID int, kind, key string) (*Job, error) {
+	return insertJob(db, workspaceID, kind, key)
+}
+
+type execer interface {
+	Exec(query string, args ...interface{}) (sql.Result, error)
+}
+
+func insertJob(e execer, workspaceID int, kind, key string) (*Job, error) {
+	u4, err := gouuid.NewV4()
+	if err != nil {
+		return nil, err
+	}
+	now := time.Now()
+	job := &Job{
+		ID:          u4.String(),
+		Kind:        kind,
+		State:       jobQueued,
+		CreatedAt:   now,
+		UpdatedAt:   now,
+		workspaceID: workspaceID,
+		key:         key,
+	}
+	_, err = e.Exec(insertJobSQL, job.ID, workspaceID, kind, key,
+		job.State, job.Progress, job.Error, job.ErrorCode, job.CreatedAt, job.UpdatedAt)
+	if err != nil {
+		return nil, err
+	}
+	return job, nil
+}
+
+func (j *Job) save() error {
+	j.UpdatedAt = time.Now()
+	_, err := db.Exec(updateJobSQL, j.ID, j.State, j.Progress, j.Error, j.ErrorCode)
+	return err
+}
+
+func (j *Job) finish(err error) error {
+	j.Progress = 100
+	j.State = jobSucceeded
+	if err != nil {
+		pipeErr := classifyError(err)
+		j.State = jobFailed
+		j.Error = pipeErr.Message
+		j.ErrorCode = pipeErr.Code
+	}
+	return j.save()
+}
+
+// runJob runs fn in background and records its outcome on the job
+func runJob(job *Job, fn func() error) {
+	go func() {
+		var err error
+		defer func() {
+			if r := recover(); r != nil {
+				err = fmt.Errorf("job panicked: %v", r)
+			}
+			if saveErr := job.finish(err); saveErr != nil {
+				reportJobError(job, saveErr)
+			}
+		}()
+
+		job.State = jobRunning
+		if err = job.save(); err != nil {
+			reportJobError(job, err)
+			return
+		}
+		err = fn()
+	}()
+}
+
+// startJob returns queued or running job of the key, e.g. when clients
+// poll for accounts that are still fetched, or runs fn in a new job
+func startJob(workspaceID int, kind, key string, fn func() error) (*Job, error) {
+	tx, err := db.Begin()
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+
+	if _, err := tx.Exec(lockJobKeySQL, fmt.Sprintf("%d:%s:%s", workspaceID, kind, key)); err != nil {
+		return nil, err
+	}
+	job, err := scanJob(workspaceID, tx.QueryRow(activeJobSQL, workspaceID, kind, key, activeJobTimeout.Seconds()))
+	if err != nil || job != nil {
+		return job, err
+	}
+	if job, err = insertJob(tx, workspaceID, kind, key); err != nil {
+		return nil, err
+	}
+	if err := tx.Commit(); err != nil {
+		return nil, err
+	}
+	runJob(job, fn)
+	return job, nil
+}
+
+func loadJob(workspaceID int, id string) (*Job, error) {
+	return scanJob(workspaceID, db.QueryRow(singleJobSQL, workspaceID, id))
+}
+
+func scanJob(workspaceID int, row *sql.Row) (*Job, error) {
+	var job Job
+	var key, jobError, errorCode sql.NullString
+	err := row.Scan(
+		&job.ID, &job.Kind, &key, &job.State, &job.Progress,
+		&jobError, &errorCode, &job.CreatedAt, &job.UpdatedAt,
+	)
+	if err == sql.ErrNoRows {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	job.workspaceID = workspaceID
+	job.key = key.String
+	job.Error = jobError.String
+	job.ErrorCode = errorCode.String
+	return &job, nil
+}
+
+// claimPipeJobs marks queued jobs of the pipe as running
+func claimPipeJobs(p *Pipe) error {
+	_, err := db.ExecContext(p.context(), claimPipeJobsSQL, p.workspaceID, p.key)
+	return err
+}
+
+// updatePipeJobs reports progress of running jobs of the pipe
+func updatePipeJobs(p *Pipe, state string, progress int, jobError, errorCode string) error {
+	_, err := db.ExecContext(p.context(), updatePipeJobsSQL, p.workspaceID, p.key, state, progress, jobError, errorCode)
+	return err
+}
+
+// removeFinishedJobs removes jobs finished more than finishedJobsMaxAge
+// ago every finishedJobsCleanupInterval
+func removeFinishedJobs() {
+	for {
+		time.Sleep(finishedJobsCleanupInterval)
+		if _, err := db.Exec(removeFinishedJobsSQL, finishedJobsMaxAge.Seconds()); err != nil {
+			reportError(err, workerErrorMetadata("JobsCleaner", nil))
+		}
+	}
+}
@@ -0,0 +1,72 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestStartJobReturnsActiveJob(t *testing.T) {
+	db = connectDB(testDBConnString)
+	key := pipesKey(TestServiceName, "accounts")
+	if _, err := db.Exec(`DELETE FROM jobs WHERE workspace_id = $1 AND key = $2`, workspaceID, key); err != nil {
+		t.Fatal(err)
+	}
+
+	release := make(chan struct{})
+	started := make(chan string, 3)
+	fetch := func() error {
+		started <- "fetch"
+		<-release
+		return nil
+	}
+	job, err := startJob(workspaceID, jobKindAccounts, key, fetch)
+	if err != nil {
+		t.Fatal(err)
+	}
+	polled, err := startJob(workspaceID, jobKindAccounts, key, fetch)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if polled.ID != job.ID {
+		t.Errorf("expected polling to return job %s, got %s", job.ID, polled.ID)
+	}
+	other, err := startJob(workspaceID, jobKindUsers, key, func() error { return nil })
+	if err != nil {
+		t.Fatal(err)
+	}
+	if other.ID == job.ID {
+		t.Error("expected job of another kind to be started")
+	}
+
+	<-started
+	close(release)
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		finished, err := loadJob(workspaceID, job.ID)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if finished.State == jobSucceeded {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("expected job to finish, got %s", finished.State)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	next, err := startJob(workspaceID, jobKindAccounts, key, fetch)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if next.ID == job.ID {
+		t.Error("expected finished job to be started again")
+	}
+	select {
+	case <-started:
+	case <-time.After(5 * time.Second):
+		t.Error("expected fetch of the new job to run")
+	}
+	if len(started) != 0 {
+		t.Error("expected polled job not to fetch again")
+	}
+}
@@ -0,0 +1,130 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+type logLevel int
+
+const (
+	levelDebug logLevel = iota
+	levelInfo
+	levelWarn
+	levelError
+)
+
+var logLevelNames = map[logLevel]string{
+	levelDebug: "debug",
+	levelInfo:  "info",
+	levelWarn:  "warn",
+	levelError: "error",
+}
+
+// Fields are structured fields of a log entry, string and error
+// values are redacted before they are written out
+type Fields map[string]interface{}
+
+// Logger writes JSON log entries, one per line
+type Logger struct {
+	fields Fields
+}
+
+var (
+	logger = &Logger{}
+
+	logMu       sync.Mutex
+	logOutput   io.Writer = os.Stderr
+	minLogLevel           = levelInfo
+)
+
+func init() {
+	// route logs of standard library and dependencies through the logger
+	log.SetFlags(0)
+	log.SetOutput(stdLogWriter{})
+}
+
+func setLogLevel(name string) error {
+	for level, levelName := range logLevelNames {
+		if levelName == strings.ToLower(name) {
+			minLogLevel = level
+			return nil
+		}
+	}
+	return fmt.Errorf("unknown log level %q, expected debug, info, warn or error", name)
+}
+
+// With returns logger that adds fields to every entry
+func (l *Logger) With(fields Fields) *Logger {
+	merged := make(Fields, len(l.fields)+len(fields))
+	for k, v := range l.fields {
+		merged[k] = v
+	}
+	for k, v := range fields {
+		merged[k] = v
+	}
+	return &Logger{fields: merged}
+}
+
+func (l *Logger) Debug(msg string, fields ...Fields) { l.log(levelDebug, msg, fields) }
+func (l *Logger) Info(msg string, fields ...Fields)  { l.log(levelInfo, msg, fields) }
+func (l *Logger) Warn(msg string, fields ...Fields)  { l.log(levelWarn, msg, fields) }
+func (l *Logger) Error(msg string, fields ...Fields) { l.log(levelError, msg, fields) }
+
+// Fatal logs error and exits the process
+func (l *Logger) Fatal(msg string, fields ...Fields) {
+	l.log(levelError, msg, fields)
+	os.Exit(1)
+}
+
+func (l *Logger) log(level logLevel, msg string, fields []Fields) {
+	if level < minLogLevel {
+		return
+	}
+	entry := make(map[string]interface{}, len(l.fields)+4)
+	for k, v := range l.fields {
+		entry[k] = redactValue(v)
+	}
+	for _, f := range fields {
+		for k, v := range f {
+			entry[k] = redactValue(v)
+		}
+	}
+	entry["time"] = time.Now().UTC().Format(time.RFC3339Nano)
+	entry["level"] = logLevelNames[level]
+	entry["msg"] = redact(msg)
+
+	b, err := json.Marshal(entry)
+	if err != nil {
+		b, _ = json.Marshal(map[string]string{
+			"time":  entry["time"].(string),
+			"level": "error",
+			"msg":   "failed to encode log entry: " + err.Error(),
+		})
+	}
+	logMu.Lock()
+	defer logMu.Unlock()
+	logOutput.Write(append(b, '\n'))
+}
+
+type stdLogWriter struct{}
+
+func (stdLogWriter) Write(p []byte) (int, error) {
+	logger.Info(strings.TrimSpace(string(p)), Fields{"source": "log"})
+	return len(p), nil
+}
+
+// pipeLogger returns logger with fields identifying the pipe
+func pipeLogger(p *Pipe) *Logger {
+	return logger.With(Fields{
+		"workspace_id": p.workspaceID,
+		"service":      p.serviceID,
+		"pipe":         p.ID,
+	})
+}
@@ -0,0 +1,128 @@
+package main
+
+import (
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+const (
+	queueDepthSQL = `SELECT
+		count(*) FILTER (WHERE locked_at IS NULL),
+		count(*) FILTER (WHERE locked_at IS NOT NULL),
+		COALESCE(EXTRACT(EPOCH FROM now() - min(created_at) FILTER (WHERE locked_at IS NULL)), 0)
+		FROM queued_pipes
+		WHERE synced_at IS NULL
+	`
+)
+
+var (
+	pipeRunsStarted = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "pipes_runs_started_total",
+		Help: "Number of started pipe runs.",
+	}, []string{"service", "pipe"})
+
+	pipeRunsFinished = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "pipes_runs_finished_total",
+		Help: "Number of finished pipe runs by result, succeeded, failed or canceled.",
+	}, []string{"service", "pipe", "result"})
+
+	pipeRunDuration = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "pipes_run_duration_seconds",
+		Help:    "Duration of pipe runs.",
+		Buckets: []float64{1, 5, 15, 30, 60, 120, 300, 600, 1800, 3600},
+	}, []string{"service", "pipe"})
+
+	importedObjects = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "pipes_imported_objects_total",
+		Help: "Number of objects imported or exported by pipes.",
+	}, []string{"service", "type"})
+
+	togglAPIRequestDuration = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "pipes_toggl_api_request_duration_seconds",
+		Help:    "Latency of Toggl API requests by status code, code is 0 on network errors.",
+		Buckets: prometheus.DefBuckets,
+	}, []string{"method", "path", "code"})
+
+	providerRequestDuration = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "pipes_provider_request_duration_seconds",
+		Help:    "Latency of third party service requests by status code, code is 0 on network errors.",
+		Buckets: prometheus.DefBuckets,
+	}, []string{"service", "code"})
+
+	oAuthRefreshes = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "pipes_oauth_refreshes_total",
+		Help: "Number of OAuth token refreshes by result, succeeded or failed.",
+	}, []string{"service", "result"})
+
+	rateLimitedRequests = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "pipes_api_rate_limited_requests_total",
+		Help: "Number of API requests rejected by rate limits, by limit: ip, workspace or expensive.",
+	}, []string{"limit"})
+)
+
+func init() {
+	prometheus.MustRegister(
+		pipeRunsStarted,
+		pipeRunsFinished,
+		pipeRunDuration,
+		importedObjects,
+		togglAPIRequestDuration,
+		providerRequestDuration,
+		oAuthRefreshes,
+		rateLimitedRequests,
+		&queueCollector{},
+		workspaceCacheHits,
+		workspaceCacheStaleHits,
+		workspaceCacheMisses,
+		workspaceCacheEvictions,
+	)
+}
+
+func runResult(failed bool) string {
+	if failed {
+		return "failed"
+	}
+	return "succeeded"
+}
+
+// observeRun records finished pipe run
+func observeRun(p *Pipe, start time.Time, failed bool) {
+	result := runResult(failed)
+	if p.PipeStatus != nil && p.PipeStatus.Status == canceledStatus {
+		result = canceledStatus
+	}
+	pipeRunsFinished.WithLabelValues(p.serviceID, p.ID, result).Inc()
+	pipeRunDuration.WithLabelValues(p.serviceID, p.ID).Observe(time.Since(start).Seconds())
+}
+
+// queueCollector reports state of queued_pipes when metrics are scraped
+type queueCollector struct{}
+
+var (
+	queueDepthDesc = prometheus.NewDesc("pipes_queue_depth",
+		"Number of queued pipes by state, waiting or running.", []string{"state"}, nil)
+	queueAgeDesc = prometheus.NewDesc("pipes_queue_oldest_age_seconds",
+		"Age of the oldest waiting queued pipe.", nil, nil)
+)
+
+func (c *queueCollector) Describe(ch chan<- *prometheus.Desc) {
+	ch <- queueDepthDesc
+	ch <- queueAgeDesc
+}
+
+func (c *queueCollector) Collect(ch chan<- prometheus.Metric) {
+	if db == nil {
+		return
+	}
+	var waiting, running int
+	var age float64
+	// queue metrics are skipped when DB is down so that other metrics are still served
+	if err := db.QueryRow(queueDepthSQL).Scan(&waiting, &running, &age); err != nil {
+		logger.Error("failed to collect queue metrics", Fields{"error": err})
+		return
+	}
+	ch <- prometheus.MustNewConstMetric(queueDepthDesc, prometheus.GaugeValue, float64(waiting), "waiting")
+	ch <- prometheus.MustNewConstMetric(queueDepthDesc, prometheus.GaugeValue, float64(running), "running")
+	ch <- prometheus.MustNewConstMetric(queueAgeDesc, prometheus.GaugeValue, age)
+}
@@ -0,0 +1,57 @@
+package main
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+func TestObserveRun(t *testing.T) {
+	p := NewPipe(workspaceID, TestServiceName, projectsPipeID)
+	failed := pipeRunsFinished.WithLabelValues(TestServiceName, projectsPipeID, "failed")
+	before := testutil.ToFloat64(failed)
+
+	observeRun(p, time.Now().Add(-time.Second), true)
+
+	if got := testutil.ToFloat64(failed) - before; got != 1 {
+		t.Fatalf("expected one failed run, got %v", got)
+	}
+}
+
+func TestPipeStatusCompleteCountsObjects(t *testing.T) {
+	status := NewPipeStatus(workspaceID, TestServiceName, projectsPipeID)
+	counter := importedObjects.WithLabelValues(TestServiceName, projectsPipeID)
+	before := testutil.ToFloat64(counter)
+
+	status.complete(projectsPipeID, nil, 3)
+
+	if got := testutil.ToFloat64(counter) - before; got != 3 {
+		t.Fatalf("expected 3 imported projects, got %v", got)
+	}
+}
+
+func TestMetricsHandler(t *testing.T) {
+	pipeRunsStarted.WithLabelValues(TestServiceName, projectsPipeID).Inc()
+
+	w := httptest.NewRecorder()
+	serveMux.ServeHTTP(w, httptest.NewRequest("GET", "/metrics", nil))
+	b, _ := ioutil.ReadAll(w.Body)
+	for _, name := range []string{"pipes_runs_started_total", "pipes_workspace_cache_hits_total"} {
+		if !strings.Contains(string(b), name) {
+			t.Errorf("expected %s in metrics", name)
+		}
+	}
+}
+
+func TestDebugVarsNotServed(t *testing.T) {
+	w := httptest.NewRecorder()
+	serveMux.ServeHTTP(w, httptest.NewRequest("GET", "/debug/vars", nil))
+	if w.Code == http.StatusOK || strings.Contains(w.Body.String(), "cmdline") {
+		t.Errorf("expected command line not to be served, got %d", w.Code)
+	}
+}
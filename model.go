@@ -59,7 +59,7 @@ type (
 		DurationInSeconds int    `json:"duration"`
 		Description       string `json:"description,omitempty"`
 
-		foreignID        string
+		ForeignID        string `json:"foreign_id,omitempty"`
 		foreignTaskID    string
 		foreignUserID    string
 		foreignProjectID string
@@ -90,4 +90,9 @@ type (
 		Error string  `json:"error"`
 		Tasks []*Task `json:"tasks"`
 	}
+
+	TimeEntriesResponse struct {
+		Error       string       `json:"error"`
+		TimeEntries []*TimeEntry `json:"time_entries"`
+	}
 )
@@ -0,0 +1,631 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"math"
+	"net/http"
+	"regexp"
+	"sort"
+	"strings"
+
+	"github.com/gorilla/mux"
+)
+
+// OpenAPI 3 document of the REST API. Paths are relative to the
+// API version prefix, every route in routes.go must have an entry,
+// which is checked by tests. Request bodies are validated against it.
+
+type (
+	OpenAPISpec struct {
+		OpenAPI    string                                  `json:"openapi"`
+		Info       map[string]string                       `json:"info"`
+		Servers    []map[string]string                     `json:"servers"`
+		Security   []map[string][]string                   `json:"security"`
+		Paths      map[string]map[string]*OpenAPIOperation `json:"paths"`
+		Components OpenAPIComponents                       `json:"components"`
+	}
+
+	OpenAPIComponents struct {
+		Schemas         map[string]*OpenAPISchema         `json:"schemas"`
+		SecuritySchemes map[string]map[string]interface{} `json:"securitySchemes"`
+	}
+
+	OpenAPIOperation struct {
+		Summary     string                      `json:"summary"`
+		OperationID string                      `json:"operationId"`
+		Tags        []string                    `json:"tags,omitempty"`
+		Security    []map[string][]string       `json:"security,omitempty"`
+		Parameters  []*OpenAPIParameter         `json:"parameters,omitempty"`
+		RequestBody *OpenAPIRequestBody         `json:"requestBody,omitempty"`
+		Responses   map[string]*OpenAPIResponse `json:"responses"`
+	}
+
+	OpenAPIParameter struct {
+		Name        string         `json:"name"`
+		In          string         `json:"in"`
+		Description string         `json:"description,omitempty"`
+		Required    bool           `json:"required,omitempty"`
+		Schema      *OpenAPISchema `json:"schema"`
+	}
+
+	OpenAPIRequestBody struct {
+		Required bool                         `json:"required,omitempty"`
+		Content  map[string]*OpenAPIMediaType `json:"content"`
+		MaxSize  int64                        `json:"x-max-body-size,omitempty"` // bytes, larger bodies get 413
+	}
+
+	OpenAPIResponse struct {
+		Description string                       `json:"description"`
+		Content     map[string]*OpenAPIMediaType `json:"content,omitempty"`
+	}
+
+	OpenAPIMediaType struct {
+		Schema *OpenAPISchema `json:"schema"`
+	}
+
+	OpenAPISchema struct {
+		Ref         string                    `json:"$ref,omitempty"`
+		Type        string                    `json:"type,omitempty"`
+		Format      string                    `json:"format,omitempty"`
+		Description string                    `json:"description,omitempty"`
+		Enum        []interface{}             `json:"enum,omitempty"`
+		Properties  map[string]*OpenAPISchema `json:"properties,omitempty"`
+		Required    []string                  `json:"required,omitempty"`
+		Items       *OpenAPISchema            `json:"items,omitempty"`
+		ReadOnly    bool                      `json:"readOnly,omitempty"`
+	}
+
+	// ValidationErrors are all invalid fields of request body
+	ValidationErrors []*ValidationError
+)
+
+func (e ValidationErrors) Error() string {
+	messages := make([]string, len(e))
+	for i, err := range e {
+		messages[i] = err.Field + ": " + err.Message
+	}
+	return strings.Join(messages, ", ")
+}
+
+var apiSpec = newOpenAPISpec()
+
+var (
+	stringSchema  = &OpenAPISchema{Type: "string"}
+	integerSchema = &OpenAPISchema{Type: "integer"}
+	booleanSchema = &OpenAPISchema{Type: "boolean"}
+)
+
+func ref(name string) *OpenAPISchema {
+	return &OpenAPISchema{Ref: "#/components/schemas/" + name}
+}
+
+func arrayOf(items *OpenAPISchema) *OpenAPISchema {
+	return &OpenAPISchema{Type: "array", Items: items}
+}
+
+func object(properties map[string]*OpenAPISchema, required ...string) *OpenAPISchema {
+	return &OpenAPISchema{Type: "object", Properties: properties, Required: required}
+}
+
+func jsonBody(schema *OpenAPISchema, maxSize int64) *OpenAPIRequestBody {
+	return &OpenAPIRequestBody{
+		Required: true,
+		Content:  map[string]*OpenAPIMediaType{"application/json": {Schema: schema}},
+		MaxSize:  maxSize,
+	}
+}
+
+// responses documents successful response with schema and error responses
+func responses(status int, schema *OpenAPISchema, description string) map[string]*OpenAPIResponse {
+	success := &OpenAPIResponse{Description: description}
+	if schema != nil {
+		success.Content = map[string]*OpenAPIMediaType{"application/json": {Schema: schema}}
+	}
+	errorResponse := func(description string) *OpenAPIResponse {
+		return &OpenAPIResponse{
+			Description: description + ", v1 responds with plain text, v2 with error envelope",
+			Content:     map[string]*OpenAPIMediaType{"application/json": {Schema: ref("ErrorEnvelope")}},
+		}
+	}
+	return map[string]*OpenAPIResponse{
+		fmt.Sprint(status): success,
+		"400":              errorResponse("Invalid request"),
+		"401":              errorResponse("Missing or invalid API token"),
+		"429":              errorResponse("Rate limit exceeded, Retry-After header tells when to retry"),
+		"500":              errorResponse("Internal error"),
+	}
+}
+
+func queryParameter(name, description string, schema *OpenAPISchema) *OpenAPIParameter {
+	return &OpenAPIParameter{Name: name, In: "query", Description: description, Schema: schema}
+}
+
+var forceParameter = queryParameter("force", "Discard imported objects and fetch them again",
+	&OpenAPISchema{Type: "string", Enum: []interface{}{"true", "false"}})
+
+func newOpenAPISpec() *OpenAPISpec {
+	spec := &OpenAPISpec{
+		OpenAPI: "3.0.3",
+		Info: map[string]string{
+			"title":       "Toggl Pipes API",
+			"version":     "1",
+			"description": "Imports users, projects, tasks and time entries from third party services to Toggl workspaces",
+		},
+		Servers: []map[string]string{
+			{"url": "/api/v1"},
+			{"url": "/api/v2", "description": "Responses are wrapped in {\"data\": ...} and errors in {\"error\": ...} envelopes"},
+		},
+		Security: []map[string][]string{{"apiToken": {}}},
+		Components: OpenAPIComponents{
+			SecuritySchemes: map[string]map[string]interface{}{
+				"apiToken": {
+					"type":        "http",
+					"scheme":      "basic",
+					"description": "Toggl API token as user name and api_token as password",
+				},
+				"adminToken": {
+					"type":        "http",
+					"scheme":      "bearer",
+					"description": "Token set with the admin_token flag",
+				},
+			},
+			Schemas: map[string]*OpenAPISchema{
+				"Status": object(map[string]*OpenAPISchema{"status": stringSchema}),
+				"Integration": object(map[string]*OpenAPISchema{
+					"id":         stringSchema,
+					"name":       stringSchema,
+					"link":       stringSchema,
+					"image":      stringSchema,
+					"pipes":      arrayOf(ref("Pipe")),
+					"auth_url":   stringSchema,
+					"auth_type":  &OpenAPISchema{Type: "string", Enum: []interface{}{"oauth1", "oauth2"}},
+					"authorized": booleanSchema,
+					"deprecated": booleanSchema,
+				}),
+				"Pipe": object(map[string]*OpenAPISchema{
+					"id":               stringSchema,
+					"name":             stringSchema,
+					"description":      stringSchema,
+					"automatic":        &OpenAPISchema{Type: "boolean", Description: "Run the pipe periodically by background workers"},
+					"automatic_option": booleanSchema,
+					"configured":       booleanSchema,
+					"premium":          booleanSchema,
+					"pipe_status":      ref("PipeStatus"),
+					"service_params":   &OpenAPISchema{Type: "string", Format: "byte", Description: "Base64 encoded ServiceParams"},
+					"direction": &OpenAPISchema{
+						Type:        "string",
+						Enum:        []interface{}{"", directionImport, directionExport, directionBoth},
+						Description: "Sync direction, empty means import",
+					},
+					"project_selector": ref("ProjectSelector"),
+				}),
+				"PipeStatus": object(map[string]*OpenAPISchema{
+					"status":            &OpenAPISchema{Type: "string", Enum: []interface{}{startStatus, "success", "error", canceledStatus}},
+					"message":           stringSchema,
+					"sync_log":          stringSchema,
+					"sync_date":         &OpenAPISchema{Type: "string", Format: "date-time"},
+					"object_counts":     arrayOf(stringSchema),
+					"notifications":     arrayOf(stringSchema),
+					"stack_trace":       stringSchema,
+					"throttled_seconds": integerSchema,
+					"error_code":        ref("ErrorCode"),
+					"retryable":         booleanSchema,
+					"progress":          ref("RunProgress"),
+					"steps":             arrayOf(ref("StepResult")),
+				}),
+				"StepResult": object(map[string]*OpenAPISchema{
+					"step":             stringSchema,
+					"result":           &OpenAPISchema{Type: "string", Enum: []interface{}{stepRan, stepSkipped, stepUnsupported, stepFailed}},
+					"duration_seconds": &OpenAPISchema{Type: "number"},
+					"synced_at":        &OpenAPISchema{Type: "string", Format: "date-time", Description: "When skipped step was synced"},
+					"error":            stringSchema,
+					"error_code":       ref("ErrorCode"),
+				}),
+				"RunProgress": object(map[string]*OpenAPISchema{
+					"seq":        &OpenAPISchema{Type: "integer", Description: "Number of the step within the run"},
+					"stage":      &OpenAPISchema{Type: "string", Enum: []interface{}{stageFetch, stagePost, stageExport}},
+					"object":     stringSchema,
+					"done":       integerSchema,
+					"total":      integerSchema,
+					"message":    stringSchema,
+					"updated_at": &OpenAPISchema{Type: "string", Format: "date-time"},
+				}),
+				"ServiceParams": object(map[string]*OpenAPISchema{
+					"account_id": &OpenAPISchema{Type: "integer", Description: "Account of the service to import from, required by asana, basecamp and teamweek"},
+				}),
+				"Selector": object(map[string]*OpenAPISchema{
+					"ids":          &OpenAPISchema{Type: "array", Items: integerSchema, Description: "Foreign IDs of users to import"},
+					"send_invites": booleanSchema,
+				}),
+				"ProjectSelector": object(map[string]*OpenAPISchema{
+					"ids":         &OpenAPISchema{Type: "array", Items: integerSchema, Description: "Foreign IDs of projects to import"},
+					"known_ids":   &OpenAPISchema{Type: "array", Items: integerSchema, ReadOnly: true, Description: "Projects available when the selection was saved"},
+					"auto_select": &OpenAPISchema{Type: "boolean", Description: "Import projects that are not known yet too"},
+				}),
+				"AuthorizationRequest": &OpenAPISchema{
+					Type:        "object",
+					Description: "OAuth 2 services need code, OAuth 1 services account_name, oauth_token and oauth_verifier",
+					Properties: map[string]*OpenAPISchema{
+						"code":           stringSchema,
+						"account_name":   stringSchema,
+						"oauth_token":    stringSchema,
+						"oauth_verifier": stringSchema,
+					},
+				},
+				"Account": object(map[string]*OpenAPISchema{"id": integerSchema, "name": stringSchema}),
+				"AccountsResponse": object(map[string]*OpenAPISchema{
+					"error":    stringSchema,
+					"accounts": arrayOf(ref("Account")),
+				}),
+				"User": object(map[string]*OpenAPISchema{
+					"id":              integerSchema,
+					"email":           stringSchema,
+					"name":            stringSchema,
+					"send_invitation": booleanSchema,
+					"foreign_id":      stringSchema,
+				}),
+				"UsersResponse": object(map[string]*OpenAPISchema{
+					"error": stringSchema,
+					"users": arrayOf(ref("User")),
+				}),
+				"Project": object(map[string]*OpenAPISchema{
+					"id":         integerSchema,
+					"name":       stringSchema,
+					"active":     booleanSchema,
+					"billable":   booleanSchema,
+					"cid":        integerSchema,
+					"foreign_id": stringSchema,
+				}),
+				"ProjectsResponse": object(map[string]*OpenAPISchema{
+					"error":           stringSchema,
+					"supports_client": booleanSchema,
+					"projects":        arrayOf(ref("Project")),
+					"selector":        ref("ProjectSelector"),
+				}),
+				"Job": object(map[string]*OpenAPISchema{
+					"id":         stringSchema,
+					"kind":       &OpenAPISchema{Type: "string", Enum: []interface{}{jobKindAccounts, jobKindUsers, jobKindProjects, jobKindPipe}},
+					"state":      &OpenAPISchema{Type: "string", Enum: []interface{}{jobQueued, jobRunning, jobSucceeded, jobFailed, jobCanceled}},
+					"progress":   integerSchema,
+					"error":      stringSchema,
+					"error_code": ref("ErrorCode"),
+					"created_at": &OpenAPISchema{Type: "string", Format: "date-time"},
+					"updated_at": &OpenAPISchema{Type: "string", Format: "date-time"},
+				}),
+				"PipeCancel": object(map[string]*OpenAPISchema{
+					"dequeued": &OpenAPISchema{Type: "boolean", Description: "Queued run was removed"},
+					"stopping": &OpenAPISchema{Type: "boolean", Description: "Running run stops at the next safe point, its status becomes canceled"},
+				}),
+				"QueueEntry": object(map[string]*OpenAPISchema{
+					"id":           integerSchema,
+					"workspace_id": integerSchema,
+					"key":          stringSchema,
+					"service":      stringSchema,
+					"pipe":         stringSchema,
+					"state":        &OpenAPISchema{Type: "string", Enum: []interface{}{queueStateQueued, queueStateLocked, queueStateSynced}},
+					"priority":     integerSchema,
+					"manual":       &OpenAPISchema{Type: "boolean", Description: "Queued by a run request, picked before automatic runs"},
+					"created_at":   &OpenAPISchema{Type: "string", Format: "date-time"},
+					"locked_at":    &OpenAPISchema{Type: "string", Format: "date-time", Description: "When a worker picked the entry"},
+					"synced_at":    &OpenAPISchema{Type: "string", Format: "date-time"},
+				}),
+				"UnlockedQueueEntries": object(map[string]*OpenAPISchema{
+					"unlocked": &OpenAPISchema{Type: "array", Items: integerSchema, Description: "IDs of unlocked entries, entries queued again already are removed"},
+				}),
+				"ErrorCode": &OpenAPISchema{Type: "string", Enum: []interface{}{
+					errorCodeAuthRevoked, errorCodeRateLimited, errorCodeProviderUnavailable,
+					errorCodeTogglRejected, errorCodeInvalidConfig, errorCodePayloadTooLarge, errorCodeInternal,
+					errorCodeInvalidRequest, errorCodeUnauthorized, errorCodeNotFound, errorCodeConflict,
+					errorCodeServiceUnavailable, errorCodeCanceled,
+				}},
+				"ErrorEnvelope": object(map[string]*OpenAPISchema{
+					"error": object(map[string]*OpenAPISchema{
+						"code":    ref("ErrorCode"),
+						"message": stringSchema,
+						"details": &OpenAPISchema{Description: "Invalid fields of validation errors, retryable flag of pipe errors"},
+					}, "code", "message"),
+				}),
+			},
+		},
+	}
+
+	noAuth := []map[string][]string{{}}
+	adminAuth := []map[string][]string{{"adminToken": {}}}
+	queueFilterParameters := []*OpenAPIParameter{
+		queryParameter("workspace_id", "Entries of the workspace", integerSchema),
+		queryParameter("state", "Entries in the state", &OpenAPISchema{Type: "string", Enum: []interface{}{queueStateQueued, queueStateLocked, queueStateSynced}}),
+		queryParameter("service", "Entries of the service", stringSchema),
+		queryParameter("older_than", "Entries in their state for at least the duration, e.g. 30m", stringSchema),
+		queryParameter("limit", fmt.Sprintf("Max number of entries, %d by default", defaultQueueListLimit), integerSchema),
+	}
+	spec.Paths = map[string]map[string]*OpenAPIOperation{
+		"/openapi.json": {
+			"get": {Summary: "This document", OperationID: "getOpenAPISpec", Security: noAuth,
+				Responses: responses(http.StatusOK, &OpenAPISchema{Type: "object"}, "OpenAPI document")},
+		},
+		"/status": {
+			"get": {Summary: "Health of the database and Toggl API", OperationID: "getStatus", Security: noAuth,
+				Responses: responses(http.StatusOK, ref("Status"), "Service is healthy")},
+		},
+		"/integrations": {
+			"get": {Summary: "Integrations with pipes and their statuses", OperationID: "getIntegrations",
+				Responses: responses(http.StatusOK, arrayOf(ref("Integration")), "Integrations of the workspace")},
+		},
+		"/integrations/{service}/pipes/{pipe}": {
+			"get": {Summary: "Pipe with its status", OperationID: "getIntegrationPipe",
+				Responses: responses(http.StatusOK, ref("Pipe"), "Pipe")},
+		},
+		"/integrations/{service}/pipes/{pipe}/setup": {
+			"post": {Summary: "Configure pipe with service params", OperationID: "postPipeSetup",
+				RequestBody: jsonBody(ref("ServiceParams"), 64<<10),
+				Responses:   responses(http.StatusOK, nil, "Pipe is configured")},
+			"put": {Summary: "Update pipe settings", OperationID: "putPipeSetup",
+				RequestBody: jsonBody(ref("Pipe"), 64<<10),
+				Responses:   responses(http.StatusOK, nil, "Pipe is updated")},
+			"delete": {Summary: "Remove pipe configuration", OperationID: "deletePipeSetup",
+				Responses: responses(http.StatusOK, nil, "Pipe is removed")},
+		},
+		"/integrations/{service}/pipes/{pipe}/log": {
+			"get": {Summary: "Log of the last pipe run", OperationID: "getServicePipeLog",
+				Responses: map[string]*OpenAPIResponse{
+					"200": {Description: "Log", Content: map[string]*OpenAPIMediaType{"text/plain": {Schema: stringSchema}}},
+					"204": {Description: "Pipe has not run yet"},
+				}},
+		},
+		"/integrations/{service}/pipes/{pipe}/events": {
+			"get": {Summary: "Stream status and progress of pipe runs as Server-Sent Events", OperationID: "getPipeEvents",
+				Responses: map[string]*OpenAPIResponse{
+					"200": {Description: "Current status, then status events with PipeStatus data when runs start or end and progress events with RunProgress data",
+						Content: map[string]*OpenAPIMediaType{"text/event-stream": {Schema: stringSchema}}},
+					"400": {Description: "Pipe is not configured"},
+				}},
+		},
+		"/integrations/{service}/pipes/{pipe}/clear_connections": {
+			"post": {Summary: "Forget which Toggl objects imported objects map to", OperationID: "postServicePipeClearConnections",
+				Responses: responses(http.StatusNoContent, nil, "Connections are cleared")},
+		},
+		"/integrations/{service}/accounts": {
+			"get": {Summary: "Accounts of the service", OperationID: "getServiceAccounts",
+				Parameters: []*OpenAPIParameter{forceParameter},
+				Responses:  withAccepted(responses(http.StatusOK, ref("AccountsResponse"), "Imported accounts"))},
+		},
+		"/integrations/{service}/auth_url": {
+			"get": {Summary: "OAuth 1 authorization URL", OperationID: "getAuthURL",
+				Parameters: []*OpenAPIParameter{
+					queryParameter("account_name", "Account of the service", stringSchema),
+					queryParameter("callback_url", "Where the service redirects to", stringSchema),
+				},
+				Responses: responses(http.StatusOK, object(map[string]*OpenAPISchema{"auth_url": stringSchema}), "Authorization URL")},
+		},
+		"/integrations/{service}/authorizations": {
+			"post": {Summary: "Authorize the service", OperationID: "postAuthorization",
+				RequestBody: jsonBody(ref("AuthorizationRequest"), 16<<10),
+				Responses:   responses(http.StatusOK, nil, "Service is authorized")},
+			"delete": {Summary: "Remove authorization and pipes of the service", OperationID: "deleteAuthorization",
+				Responses: responses(http.StatusOK, nil, "Authorization is removed")},
+		},
+		"/integrations/{service}/pipes/{pipe}/users": {
+			"get": {Summary: "Users of the service to select for import", OperationID: "getServiceUsers",
+				Parameters: []*OpenAPIParameter{forceParameter},
+				Responses:  withAccepted(responses(http.StatusOK, ref("UsersResponse"), "Imported users"))},
+		},
+		"/integrations/{service}/pipes/{pipe}/projects": {
+			"get": {Summary: "Projects of the service with the saved selection", OperationID: "getServiceProjects",
+				Parameters: []*OpenAPIParameter{forceParameter},
+				Responses:  withAccepted(responses(http.StatusOK, ref("ProjectsResponse"), "Imported projects"))},
+			"post": {Summary: "Select projects to import", OperationID: "postServiceProjects",
+				RequestBody: jsonBody(ref("ProjectSelector"), 256<<10),
+				Responses:   responses(http.StatusOK, nil, "Selection is saved")},
+		},
+		"/integrations/{service}/pipes/{pipe}/run": {
+			"post": {Summary: "Run the pipe, users pipe needs the selected users", OperationID: "postPipeRun",
+				RequestBody: &OpenAPIRequestBody{
+					Content: map[string]*OpenAPIMediaType{"application/json": {Schema: ref("Selector")}},
+				},
+				Responses: responses(http.StatusAccepted, ref("Job"), "Run is queued")},
+		},
+		"/integrations/{service}/pipes/{pipe}/cancel": {
+			"post": {Summary: "Cancel queued run and stop running one between provider requests or Toggl batches", OperationID: "postPipeCancel",
+				Responses: responses(http.StatusAccepted, ref("PipeCancel"), "Run is canceled or stopping")},
+		},
+		"/jobs/{id}": {
+			"get": {Summary: "State of asynchronous operation", OperationID: "getJob",
+				Responses: responses(http.StatusOK, ref("Job"), "Job")},
+		},
+		"/admin/queue": {
+			"get": {Summary: "Queue entries, newest first", OperationID: "getAdminQueue", Security: adminAuth,
+				Parameters: queueFilterParameters,
+				Responses:  responses(http.StatusOK, arrayOf(ref("QueueEntry")), "Queue entries")},
+		},
+		"/admin/queue/unlock_stale": {
+			"post": {Summary: "Put entries locked for too long back to queue", OperationID: "postAdminQueueUnlockStale", Security: adminAuth,
+				Parameters: []*OpenAPIParameter{{Name: "older_than", In: "query", Required: true,
+					Description: "How long entries have been locked, at least 1m", Schema: stringSchema}},
+				Responses: responses(http.StatusOK, ref("UnlockedQueueEntries"), "Entries are unlocked")},
+		},
+		"/admin/queue/{entry_id}": {
+			"delete": {Summary: "Cancel entry that is not picked by a worker yet", OperationID: "deleteAdminQueueEntry", Security: adminAuth,
+				Responses: responses(http.StatusNoContent, nil, "Entry is canceled")},
+		},
+		"/admin/queue/{entry_id}/requeue": {
+			"post": {Summary: "Queue pipe of the entry as first, bumps priority of queued entries", OperationID: "postAdminQueueEntryRequeue", Security: adminAuth,
+				Responses: responses(http.StatusOK, ref("QueueEntry"), "Queued entry")},
+		},
+		"/admin/queue/{entry_id}/unlock": {
+			"post": {Summary: "Put locked entry back to queue, the worker may still be running it", OperationID: "postAdminQueueEntryUnlock", Security: adminAuth,
+				Responses: responses(http.StatusOK, ref("UnlockedQueueEntries"), "Entry is unlocked")},
+		},
+		"/admin/workspaces/{workspace_id}/queue": {
+			"get": {Summary: "Queue history of the workspace, newest first", OperationID: "getAdminWorkspaceQueue", Security: adminAuth,
+				Parameters: queueFilterParameters[1:],
+				Responses:  responses(http.StatusOK, arrayOf(ref("QueueEntry")), "Queue entries")},
+		},
+	}
+	for path, operations := range spec.Paths {
+		for _, operation := range operations {
+			operation.Parameters = append(pathParameters(path), operation.Parameters...)
+		}
+	}
+	return spec
+}
+
+func withAccepted(r map[string]*OpenAPIResponse) map[string]*OpenAPIResponse {
+	r["202"] = &OpenAPIResponse{
+		Description: "Objects are being fetched",
+		Content:     map[string]*OpenAPIMediaType{"application/json": {Schema: ref("Job")}},
+	}
+	return r
+}
+
+var pathParameterPattern = regexp.MustCompile(`\{(\w+)\}`)
+
+func pathParameters(path string) []*OpenAPIParameter {
+	var parameters []*OpenAPIParameter
+	for _, match := range pathParameterPattern.FindAllStringSubmatch(path, -1) {
+		parameter := &OpenAPIParameter{Name: match[1], In: "path", Required: true, Schema: stringSchema}
+		switch match[1] {
+		case "service":
+			parameter.Description = "Integration ID, e.g. asana, basecamp, github"
+		case "pipe":
+			parameter.Schema = &OpenAPISchema{Type: "string", Enum: []interface{}{
+				"users", "projects", "todolists", "todos", "tasks", "timeentries"}}
+		case "id":
+			parameter.Description = "Job ID"
+		case "entry_id":
+			parameter.Schema = integerSchema
+			parameter.Description = "Queue entry ID"
+		case "workspace_id":
+			parameter.Schema = integerSchema
+		}
+		parameters = append(parameters, parameter)
+	}
+	return parameters
+}
+
+var apiVersionPrefix = regexp.MustCompile(`^/api/v\d+`)
+
+// operation returns spec entry of route matched for r
+func (spec *OpenAPISpec) operation(r *http.Request) *OpenAPIOperation {
+	route := mux.CurrentRoute(r)
+	if route == nil {
+		return nil
+	}
+	template, err := route.GetPathTemplate()
+	if err != nil {
+		return nil
+	}
+	path := apiVersionPrefix.ReplaceAllString(template, "")
+	return spec.Paths[path][strings.ToLower(r.Method)]
+}
+
+// validateRequestBody checks body against schema of the matched route,
+// empty bodies are left for handlers to check
+func (spec *OpenAPISpec) validateRequestBody(r *http.Request, body []byte) ValidationErrors {
+	if len(body) == 0 {
+		return nil
+	}
+	operation := spec.operation(r)
+	if operation == nil || operation.RequestBody == nil {
+		return nil
+	}
+	mediaType, ok := operation.RequestBody.Content["application/json"]
+	if !ok {
+		return nil
+	}
+	var value interface{}
+	if err := json.Unmarshal(body, &value); err != nil {
+		return ValidationErrors{{Field: "body", Message: "invalid JSON: " + err.Error()}}
+	}
+	return spec.validate(mediaType.Schema, value, "body")
+}
+
+func (spec *OpenAPISpec) resolve(schema *OpenAPISchema) *OpenAPISchema {
+	for schema.Ref != "" {
+		schema = spec.Components.Schemas[strings.TrimPrefix(schema.Ref, "#/components/schemas/")]
+	}
+	return schema
+}
+
+// validate checks types, enums and required properties of value,
+// null values are accepted like json.Unmarshal does
+func (spec *OpenAPISpec) validate(schema *OpenAPISchema, value interface{}, field string) ValidationErrors {
+	schema = spec.resolve(schema)
+	if value == nil {
+		return nil
+	}
+	invalid := func(message string) ValidationErrors {
+		return ValidationErrors{{Field: field, Message: message}}
+	}
+
+	switch schema.Type {
+	case "object":
+		object, ok := value.(map[string]interface{})
+		if !ok {
+			return invalid("must be an object")
+		}
+		var errs ValidationErrors
+		for _, name := range schema.Required {
+			if _, ok := object[name]; !ok {
+				errs = append(errs, &ValidationError{Field: childField(field, name), Message: "is required"})
+			}
+		}
+		names := make([]string, 0, len(schema.Properties))
+		for name := range schema.Properties {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+		for _, name := range names {
+			if v, ok := object[name]; ok {
+				errs = append(errs, spec.validate(schema.Properties[name], v, childField(field, name))...)
+			}
+		}
+		return errs
+	case "array":
+		items, ok := value.([]interface{})
+		if !ok {
+			return invalid("must be an array")
+		}
+		var errs ValidationErrors
+		for i, item := range items {
+			errs = append(errs, spec.validate(schema.Items, item, fmt.Sprintf("%s[%d]", field, i))...)
+		}
+		return errs
+	case "string":
+		if _, ok := value.(string); !ok {
+			return invalid("must be a string")
+		}
+	case "integer":
+		if n, ok := value.(float64); !ok || n != math.Trunc(n) {
+			return invalid("must be an integer")
+		}
+	case "number":
+		if _, ok := value.(float64); !ok {
+			return invalid("must be a number")
+		}
+	case "boolean":
+		if _, ok := value.(bool); !ok {
+			return invalid("must be a boolean")
+		}
+	}
+	if len(schema.Enum) > 0 {
+		for _, allowed := range schema.Enum {
+			if allowed == value {
+				return nil
+			}
+		}
+		return invalid(fmt.Sprintf("must be one of %v", schema.Enum))
+	}
+	return nil
+}
+
+func childField(parent, name string) string {
+	if parent == "body" {
+		return name
+	}
+	return parent + "." + name
+}
+
+func getOpenAPISpec(req Request) Response {
+	return ok(apiSpec)
+}
@@ -0,0 +1,125 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/gorilla/mux"
+)
+
+func TestEveryRouteHasSpecEntry(t *testing.T) {
+	routed := make(map[string]bool)
+	err := routes.Routes.Walk(func(route *mux.Route, router *mux.Router, ancestors []*mux.Route) error {
+		template, err := route.GetPathTemplate()
+		if err != nil {
+			return err
+		}
+		methods, err := route.GetMethods()
+		if err != nil {
+			// version prefixes of subrouters have no methods
+			return nil
+		}
+		path := apiVersionPrefix.ReplaceAllString(template, "")
+		for _, method := range methods {
+			method = strings.ToLower(method)
+			routed[method+" "+path] = true
+			if apiSpec.Paths[path][method] == nil {
+				t.Errorf("route %s %s has no entry in OpenAPI spec", method, template)
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for path, operations := range apiSpec.Paths {
+		for method := range operations {
+			if !routed[method+" "+path] {
+				t.Errorf("OpenAPI spec has %s %s which is not routed", method, path)
+			}
+		}
+	}
+}
+
+func TestSpecReferencesResolve(t *testing.T) {
+	b, err := json.Marshal(apiSpec)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, match := range strings.Split(string(b), `"$ref":"#/components/schemas/`)[1:] {
+		name := match[:strings.Index(match, `"`)]
+		if apiSpec.Components.Schemas[name] == nil {
+			t.Errorf("schema %s is referenced but not defined", name)
+		}
+	}
+}
+
+func TestSpecIsServed(t *testing.T) {
+	w := httptest.NewRecorder()
+	routes.ServeHTTP(w, httptest.NewRequest("GET", "/api/v1/openapi.json", nil))
+	if w.Code != http.StatusOK {
+		t.Fatalf("expected 200, got %d", w.Code)
+	}
+	var spec map[string]interface{}
+	if err := json.Unmarshal(w.Body.Bytes(), &spec); err != nil {
+		t.Fatal(err)
+	}
+	if spec["openapi"] != "3.0.3" {
+		t.Errorf("unexpected openapi version %v", spec["openapi"])
+	}
+}
+
+func TestRequestBodyValidation(t *testing.T) {
+	var handled bool
+	router := mux.NewRouter()
+	router.HandleFunc("/api/v1/integrations/{service}/pipes/{pipe}/projects", handleRequest(func(req Request) Response {
+		handled = true
+		return ok(nil)
+	})).Methods("POST")
+
+	post := func(body string) *httptest.ResponseRecorder {
+		handled = false
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, httptest.NewRequest("POST", "/api/v1/integrations/asana/pipes/projects/projects", strings.NewReader(body)))
+		return w
+	}
+
+	w := post(`{"ids":[1,"2"],"auto_select":"yes"}`)
+	if handled || w.Code != http.StatusBadRequest {
+		t.Fatalf("expected invalid body to be rejected, got %d", w.Code)
+	}
+	for _, expected := range []string{"ids[1]: must be an integer", "auto_select: must be a boolean"} {
+		if !strings.Contains(w.Body.String(), expected) {
+			t.Errorf("expected %q in %q", expected, w.Body.String())
+		}
+	}
+
+	if w = post(`{"ids":[1,2],"auto_select":true}`); !handled || w.Code != http.StatusOK {
+		t.Errorf("expected valid body to be handled, got %d %s", w.Code, w.Body.String())
+	}
+	if w = post(`{"ids":`); handled || !strings.Contains(w.Body.String(), "invalid JSON") {
+		t.Errorf("expected malformed body to be rejected, got %d %s", w.Code, w.Body.String())
+	}
+}
+
+func TestValidateSchema(t *testing.T) {
+	schema := object(map[string]*OpenAPISchema{
+		"direction": {Type: "string", Enum: []interface{}{directionImport, directionExport}},
+		"selector":  ref("Selector"),
+	}, "direction")
+
+	var value interface{}
+	json.Unmarshal([]byte(`{"selector":{"ids":[1.5],"send_invites":null}}`), &value)
+	errs := apiSpec.validate(schema, value, "body")
+	if errs.Error() != "direction: is required, selector.ids[0]: must be an integer" {
+		t.Errorf("unexpected validation errors %q", errs.Error())
+	}
+
+	json.Unmarshal([]byte(`{"direction":"sideways"}`), &value)
+	if errs := apiSpec.validate(schema, value, "body"); len(errs) != 1 || errs[0].Field != "direction" {
+		t.Errorf("expected enum violation, got %v", errs)
+	}
+}
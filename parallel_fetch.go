@@ -0,0 +1,108 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"runtime/debug"
+	"sync"
+)
+
+// parallelFetch calls fetch for indexes 0 to n-1 in up to fetchConcurrency
+// goroutines, requests are still paced by the rate limiter of the service.
+// Callers keep results by index, so their order does not depend on timing.
+// The first error cancels ctx of the other calls, which also ends their
+// waits for the rate limiter, and skips calls not started yet. Fetch
+// returns nil for errors that must not stop the others.
+func parallelFetch(ctx context.Context, n int, fetch func(ctx context.Context, i int) error) error {
+	if ctx == nil {
+		ctx = context.Background()
+	}
+	parent := ctx
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	workers := fetchConcurrency
+	if workers < 1 {
+		workers = 1
+	}
+	if workers > n {
+		workers = n
+	}
+
+	var (
+		wg       sync.WaitGroup
+		once     sync.Once
+		firstErr error
+	)
+	indexes := make(chan int)
+	for w := 0; w < workers; w++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := range indexes {
+				if ctx.Err() != nil {
+					continue
+				}
+				if err := fetchIndex(ctx, i, fetch); err != nil {
+					once.Do(func() {
+						firstErr = err
+						cancel()
+					})
+				}
+			}
+		}()
+	}
+
+feed:
+	for i := 0; i < n; i++ {
+		select {
+		case indexes <- i:
+		case <-ctx.Done():
+			break feed
+		}
+	}
+	close(indexes)
+	wg.Wait()
+
+	if panicErr, ok := firstErr.(*fetchPanic); ok {
+		recordFetchPanic(parent, panicErr)
+	}
+	if firstErr != nil {
+		return firstErr
+	}
+	return parent.Err()
+}
+
+// fetchPanic is error of a panicked fetch, the stack is kept
+// apart so it does not reach pipe status message
+type fetchPanic struct {
+	index int
+	value interface{}
+	stack string
+}
+
+func (e *fetchPanic) Error() string {
+	return fmt.Sprintf("fetch %d panicked: %v", e.index, e.value)
+}
+
+// recordFetchPanic adds stack of the panic to status of the pipe run,
+// which reports it with the failed run, panics outside of runs are
+// reported here
+func recordFetchPanic(ctx context.Context, err *fetchPanic) {
+	if p := runPipe(ctx); p != nil && p.PipeStatus != nil {
+		p.PipeStatus.StackTrace = err.stack
+		return
+	}
+	reportError(err, ErrorMetadata{"panic": {"stack": err.stack}})
+}
+
+// fetchIndex turns panic of fetch into error, panics of goroutines
+// are not recovered by the pipe run
+func fetchIndex(ctx context.Context, i int, fetch func(ctx context.Context, i int) error) (err error) {
+	defer func() {
+		if r := recover(); r != nil {
+			err = &fetchPanic{index: i, value: r, stack: string(debug.Stack())}
+		}
+	}()
+	return fetch(ctx, i)
+}
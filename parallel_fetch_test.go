@@ -0,0 +1,186 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestParallelFetchKeepsOrder(t *testing.T) {
+	defer func(concurrency int) { fetchConcurrency = concurrency }(fetchConcurrency)
+	fetchConcurrency = 3
+
+	var mu sync.Mutex
+	var running, maxRunning int
+	results := make([]int, 20)
+	err := parallelFetch(context.Background(), len(results), func(ctx context.Context, i int) error {
+		mu.Lock()
+		running++
+		if running > maxRunning {
+			maxRunning = running
+		}
+		mu.Unlock()
+
+		// later indexes finish first
+		time.Sleep(time.Duration(len(results)-i) * time.Millisecond)
+		results[i] = i * i
+
+		mu.Lock()
+		running--
+		mu.Unlock()
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i, result := range results {
+		if result != i*i {
+			t.Fatalf("expected results in index order, got %v", results)
+		}
+	}
+	if maxRunning > fetchConcurrency {
+		t.Errorf("expected at most %d calls at once, got %d", fetchConcurrency, maxRunning)
+	}
+}
+
+func TestParallelFetchCancelsSiblings(t *testing.T) {
+	defer func(concurrency int) { fetchConcurrency = concurrency }(fetchConcurrency)
+	fetchConcurrency = 4
+
+	failing := errors.New("project is gone")
+	var mu sync.Mutex
+	var started int
+	err := parallelFetch(context.Background(), 100, func(ctx context.Context, i int) error {
+		mu.Lock()
+		started++
+		mu.Unlock()
+		if i == 2 {
+			return failing
+		}
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-time.After(5 * time.Second):
+			return nil
+		}
+	})
+	if err != failing {
+		t.Errorf("expected the first error, got %v", err)
+	}
+	if started > fetchConcurrency+1 {
+		t.Errorf("expected calls after the error to be skipped, %d started", started)
+	}
+}
+
+func TestParallelFetchRecoversPanic(t *testing.T) {
+	reporter, restore := useMemoryErrorReporter()
+	defer restore()
+
+	fetch := func(ctx context.Context, i int) error {
+		if i == 1 {
+			var tasks []*Task
+			_ = tasks[i]
+		}
+		return nil
+	}
+	err := parallelFetch(context.Background(), 3, fetch)
+	if err == nil {
+		t.Fatal("expected panic to fail the fetch")
+	}
+	if strings.Contains(err.Error(), "\n") {
+		t.Errorf("expected short error without stack, got %q", err)
+	}
+	reported := reporter.Errors()
+	if len(reported) != 1 || reported[0].Metadata["panic"]["stack"] == "" {
+		t.Errorf("expected panic to be reported with stack, got %v", reported)
+	}
+
+	p := NewPipe(workspaceID, "asana", "tasks")
+	p.PipeStatus = NewPipeStatus(workspaceID, "asana", "tasks")
+	if err := parallelFetch(withProgress(context.Background(), p), 3, fetch); err == nil {
+		t.Fatal("expected panic to fail the fetch")
+	}
+	if !strings.Contains(p.PipeStatus.StackTrace, "parallelFetch") {
+		t.Errorf("expected stack trace in pipe status, got %q", p.PipeStatus.StackTrace)
+	}
+	if len(reporter.Errors()) != 1 {
+		t.Error("expected panic of pipe run to be reported with the run")
+	}
+	if err := parallelFetch(context.Background(), 0, nil); err != nil {
+		t.Errorf("expected nothing to fetch, got %v", err)
+	}
+}
+
+func TestParallelFetchStopsLimiterWaits(t *testing.T) {
+	defer func(concurrency int) { fetchConcurrency = concurrency }(fetchConcurrency)
+	fetchConcurrency = 4
+
+	var requests int32
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&requests, 1)
+	}))
+	defer ts.Close()
+
+	// provider asked to wait, so requests queue up in the limiter
+	limiter := &RateLimiter{authorization: NewTokenBucket(rateLimit{rate: 100, burst: 10})}
+	limiter.authorization.pause(time.Now().Add(time.Hour))
+
+	failing := errors.New("project is gone")
+	start := time.Now()
+	err := parallelFetch(context.Background(), 4, func(ctx context.Context, i int) error {
+		if i == 0 {
+			time.Sleep(10 * time.Millisecond)
+			return failing
+		}
+		client := &http.Client{Transport: &rateLimitedTransport{limiter: limiter, next: http.DefaultTransport, parent: ctx}}
+		req, err := http.NewRequest("GET", ts.URL, nil)
+		if err != nil {
+			return err
+		}
+		resp, err := client.Do(req)
+		if err != nil {
+			return err
+		}
+		return resp.Body.Close()
+	})
+	if err != failing {
+		t.Errorf("expected the first error, got %v", err)
+	}
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Errorf("expected waiting fetches to stop with the error, took %s", elapsed)
+	}
+	if n := atomic.LoadInt32(&requests); n != 0 {
+		t.Errorf("expected no request to be sent, got %d", n)
+	}
+}
+
+func TestRateLimitedTransportCancelsRequestsWithoutContext(t *testing.T) {
+	var requests int
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests++
+	}))
+	defer ts.Close()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	limiter := &RateLimiter{authorization: NewTokenBucket(rateLimit{rate: 100, burst: 10})}
+	client := &http.Client{Transport: &rateLimitedTransport{limiter: limiter, next: http.DefaultTransport, parent: ctx}}
+
+	// like client libraries, the request has no context of its own
+	req, err := http.NewRequest("GET", ts.URL, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := client.Do(req); !errors.Is(err, context.Canceled) {
+		t.Errorf("expected request to be canceled with the fetch, got %v", err)
+	}
+	if requests != 0 {
+		t.Errorf("expected no request to be sent, got %d", requests)
+	}
+}
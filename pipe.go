@@ -1,10 +1,13 @@
 package main
 
 import (
+	"context"
 	"database/sql"
 	"encoding/json"
 	"errors"
 	"fmt"
+	"runtime/debug"
+	"strconv"
 	"strings"
 	"time"
 )
@@ -19,6 +22,9 @@ type Pipe struct {
 	Premium         bool        `json:"premium"`
 	PipeStatus      *PipeStatus `json:"pipe_status,omitempty"`
 	ServiceParams   []byte      `json:"service_params,omitempty"`
+	Direction       string      `json:"direction,omitempty"`
+
+	ProjectSelector *ProjectSelector `json:"project_selector,omitempty"`
 
 	authorization *Authorization
 	workspaceID   int
@@ -26,6 +32,7 @@ type Pipe struct {
 	key           string
 	payload       []byte
 	lastSync      *time.Time
+	ctx           context.Context
 }
 
 const (
@@ -61,12 +68,21 @@ const (
     AND key = $2
   `
 	selectPipesFromQueueSQL = `SELECT workspace_id, key
-	FROM get_queued_pipes()`
+	FROM get_queued_pipes($1, $2, $3, $4::float8 * interval '1 second')`
+
+	startQueuedPipeSQL = `SELECT start_queued_pipe($1, $2, $3, $4::float8 * interval '1 second')`
 
 	queueAutomaticPipesSQL = `SELECT queue_automatic_pipes()`
 
 	queuePipeAsFirstSQL = `SELECT queue_pipe_as_first($1, $2)`
 
+	unlockQueuedPipeSQL = `UPDATE queued_pipes
+	SET locked_at = NULL, started_at = NULL
+	WHERE workspace_id = $1
+	AND key = $2
+	AND locked_at IS NOT NULL
+	AND synced_at IS NULL`
+
 	setQueuedPipeSyncedSQL = `UPDATE queued_pipes
 	SET synced_at = now()
 	WHERE workspace_id = $1
@@ -75,6 +91,12 @@ const (
 	AND synced_at IS NULL`
 )
 
+const (
+	directionImport = "import"
+	directionExport = "export"
+	directionBoth   = "both"
+)
+
 func NewPipe(workspaceID int, serviceID, pipeID string) *Pipe {
 	return &Pipe{
 		ID:          pipeID,
@@ -102,11 +124,13 @@ func (p *Pipe) save() error {
 }
 
 func (p *Pipe) validateServiceConfig(payload []byte) string {
-	service := getService(p.serviceID, p.workspaceID)
-	err := service.setParams(payload)
+	service, err := getService(p.serviceID, p.workspaceID)
 	if err != nil {
 		return err.Error()
 	}
+	if err := service.setParams(payload); err != nil {
+		return err.Error()
+	}
 	p.ServiceParams = payload
 	return ""
 }
@@ -119,6 +143,45 @@ func (p *Pipe) validatePayload(payload []byte) string {
 	return ""
 }
 
+func (p *Pipe) validateDirection() string {
+	switch p.Direction {
+	case "", directionImport, directionExport, directionBoth:
+		return ""
+	}
+	return "Invalid direction, must be one of import, export or both"
+}
+
+// imports reports if pipe should bring foreign objects into Toggl,
+// only time entries pipe supports other directions than import
+func (p *Pipe) imports() bool {
+	if p.ID != timeEntriesPipeID {
+		return true
+	}
+	return p.Direction == directionImport || p.Direction == directionBoth
+}
+
+// exports reports if pipe should send Toggl objects to foreign service,
+// time entries pipe without direction set exports for backward compatibility
+func (p *Pipe) exports() bool {
+	if p.ID != timeEntriesPipeID {
+		return false
+	}
+	return p.Direction == "" || p.Direction == directionExport || p.Direction == directionBoth
+}
+
+// projectSelector returns project selection saved on projects pipe,
+// nil selector means all projects are synced
+func (p *Pipe) projectSelector() (*ProjectSelector, error) {
+	if p.ID == projectsPipeID {
+		return p.ProjectSelector, nil
+	}
+	projectsPipe, err := loadPipe(p.workspaceID, p.serviceID, projectsPipeID)
+	if err != nil || projectsPipe == nil {
+		return nil, err
+	}
+	return projectsPipe.ProjectSelector, nil
+}
+
 func (p *Pipe) load(rows *sql.Rows) error {
 	var wid int
 	var b []byte
@@ -142,10 +205,22 @@ func (p *Pipe) NewStatus() error {
 	return p.PipeStatus.save()
 }
 
+// context returns context of the pipe run, spans of the run are kept in it
+func (p *Pipe) context() context.Context {
+	if p.ctx == nil {
+		return context.Background()
+	}
+	return p.ctx
+}
+
 func (p *Pipe) Service() (Service, error) {
-	service := getService(p.serviceID, p.workspaceID)
+	service, err := getService(p.serviceID, p.workspaceID)
+	if err != nil {
+		return nil, err
+	}
+	service.setContext(p.context())
 	if err := service.setParams(p.ServiceParams); err != nil {
-		return service, err
+		return service, asInvalidConfig(err)
 	}
 	if _, err := loadAuth(service); err != nil {
 		return service, err
@@ -154,7 +229,10 @@ func (p *Pipe) Service() (Service, error) {
 }
 
 func (p *Pipe) loadAuth() error {
-	service := getService(p.serviceID, p.workspaceID)
+	service, err := getService(p.serviceID, p.workspaceID)
+	if err != nil {
+		return err
+	}
 	auth, err := loadAuth(service)
 	if err != nil {
 		return err
@@ -168,30 +246,124 @@ func (p *Pipe) loadAuth() error {
 
 func (p *Pipe) run() {
 	var err error
+	if err = claimPipeJobs(p); err != nil {
+		reportPipeError(p, err)
+	}
+	start := time.Now()
+	pipeRunsStarted.WithLabelValues(p.serviceID, p.ID).Inc()
+	ctx, span := startSpan(p.context(), "pipe.run", pipeAttributes(p)...)
+	canceler, cancelErr := startRunCancel(p)
+	if cancelErr != nil {
+		reportPipeError(p, cancelErr)
+	}
+	defer canceler.stop()
+	p.ctx = withProgress(withRunCancel(ctx, canceler), p)
+	limiter := rateLimiterFor(p.serviceID, p.workspaceID)
+	throttledBefore := limiter.throttledTime()
 	defer func() {
+		if r := recover(); r != nil {
+			err = p.recoverPanic(r)
+		}
+		// client libraries may not keep the cause of failed requests
+		if err != nil && canceler.wasCanceled() {
+			err = ErrPipeCanceled
+		}
+		if p.PipeStatus != nil {
+			throttled := limiter.throttledTime() - throttledBefore
+			p.PipeStatus.ThrottledSeconds = int(throttled.Seconds())
+		}
 		p.endSync(true, err)
+		p.publishStatus()
+		p.finishJobs(err)
+		observeRun(p, start, err != nil || (p.PipeStatus != nil && p.PipeStatus.Status == "error"))
+		endSpan(ctx, span, err)
 	}()
 
 	if err = p.NewStatus(); err != nil {
-		BugsnagNotifyPipe(p, err)
+		reportPipeError(p, err)
+		return
+	}
+	p.publishStatus()
+	if err = p.runPhase("pipe.loadAuth", p.loadAuth); err != nil {
+		reportPipeError(p, err)
+		return
+	}
+	p.reportProgress(10)
+	if err = p.runDependencies(); err != nil {
+		reportPipeError(p, err)
 		return
 	}
-	if err = p.loadAuth(); err != nil {
-		BugsnagNotifyPipe(p, err)
+	p.reportProgress(30)
+	if err = p.checkCanceled(); err != nil {
 		return
 	}
-	if err = p.fetchObjects(false); err != nil {
-		BugsnagNotifyPipe(p, err)
+	stepStart := time.Now()
+	err = p.runPhase("pipe.fetch", func() error { return p.fetchObjects(false) })
+	if err != nil {
+		p.finishStep(stepID(p.ID), stepStart, err)
+		reportPipeError(p, err)
+		return
+	}
+	p.reportProgress(60)
+	if err = p.checkCanceled(); err != nil {
 		return
 	}
-	if err = p.postObjects(false); err != nil {
-		BugsnagNotifyPipe(p, err)
+	err = p.runPhase("pipe.post", func() error { return p.postObjects(false) })
+	if err = p.finishStep(stepID(p.ID), stepStart, err); err != nil {
+		reportPipeError(p, err)
 		return
 	}
 }
 
+// runPhase runs fn in a child span of the pipe run
+func (p *Pipe) runPhase(name string, fn func() error) error {
+	parent := p.ctx
+	ctx, span := startSpan(p.context(), name)
+	p.ctx = ctx
+	err := fn()
+	p.ctx = parent
+	endSpan(ctx, span, err)
+	return err
+}
+
+// recoverPanic turns panic during run into failed pipe status
+// with the stack trace, so it does not take down the worker
+func (p *Pipe) recoverPanic(r interface{}) error {
+	err := fmt.Errorf("pipe run panicked: %v", r)
+	if p.PipeStatus == nil {
+		p.PipeStatus = NewPipeStatus(p.workspaceID, p.serviceID, p.ID)
+	}
+	p.PipeStatus.StackTrace = string(debug.Stack())
+	reportPipeError(p, err)
+	return err
+}
+
+func (p *Pipe) reportProgress(progress int) {
+	if err := updatePipeJobs(p, jobRunning, progress, "", ""); err != nil {
+		reportPipeError(p, err)
+	}
+}
+
+// finishJobs records run outcome on pipe jobs, errors collected
+// in pipe status without failing the run also fail the jobs
+func (p *Pipe) finishJobs(err error) {
+	state, message, code := jobSucceeded, "", ""
+	if err != nil {
+		pipeErr := classifyError(err)
+		state, message, code = jobFailed, pipeErr.Message, pipeErr.Code
+		if code == errorCodeCanceled {
+			state = jobCanceled
+		}
+	} else if p.PipeStatus != nil && p.PipeStatus.Status == "error" {
+		state, message, code = jobFailed, p.PipeStatus.Message, p.PipeStatus.ErrorCode
+	}
+	if saveErr := updatePipeJobs(p, state, 100, message, code); saveErr != nil {
+		reportPipeError(p, saveErr)
+	}
+}
+
 func (p *Pipe) loadLastSync() {
-	err := db.QueryRow(lastSyncSQL, p.workspaceID, p.key).Scan(&p.lastSync)
+	err := db.QueryRowContext(p.context(), lastSyncSQL, p.workspaceID, p.key).Scan(&p.lastSync)
 	if err != nil {
 		var err error
 		t := time.Now()
@@ -220,10 +392,10 @@ func (p *Pipe) fetchObjects(saveStatus bool) (err error) {
 		err = fetchTodoLists(p)
 	case "todos", "tasks":
 		err = fetchTasks(p)
-	case "timeentries":
+	case timeEntriesPipeID:
 		err = fetchTimeEntries(p)
 	default:
-		panic(fmt.Sprintf("fetchObjects: Unrecognized pipeID - %s", p.ID))
+		err = fmt.Errorf("fetchObjects: Unrecognized pipeID - %s", p.ID)
 	}
 	return p.endSync(saveStatus, err)
 }
@@ -238,10 +410,10 @@ func (p *Pipe) postObjects(saveStatus bool) (err error) {
 		err = postTodoLists(p)
 	case "todos", "tasks":
 		err = postTasks(p)
-	case "timeentries":
+	case timeEntriesPipeID:
 		err = postTimeEntries(p)
 	default:
-		panic(fmt.Sprintf("postObjects: Unrecognized pipeID - %s", p.ID))
+		err = fmt.Errorf("postObjects: Unrecognized pipeID - %s", p.ID)
 	}
 	return p.endSync(saveStatus, err)
 }
@@ -252,14 +424,10 @@ func (p *Pipe) endSync(saveStatus bool, err error) error {
 	}
 
 	if err != nil {
-		// If it is JSON marshalling error suppress it for status
-		if _, ok := err.(*json.UnmarshalTypeError); ok {
-			err = ErrJSONParsing
-		}
 		p.PipeStatus.addError(err)
 	}
 	if err = p.PipeStatus.save(); err != nil {
-		BugsnagNotifyPipe(p, err)
+		reportPipeError(p, err)
 		return err
 	}
 
@@ -364,9 +532,50 @@ func (p *Pipe) clearPipeConnections() (err error) {
 	return
 }
 
+// serviceLimits parses service_concurrency flag into JSON
+// object accepted by get_queued_pipes, e.g. {"asana":3}
+func serviceLimits() ([]byte, error) {
+	return parseServiceValues(serviceConcurrency, "service concurrency")
+}
+
+// queueWeights parses service_weights flag into JSON
+// object accepted by get_queued_pipes, e.g. {"asana":2}
+func queueWeights() ([]byte, error) {
+	return parseServiceValues(serviceWeights, "service weight")
+}
+
+// parseServiceValues parses positive numbers of services,
+// e.g. "asana=3,github=5"
+func parseServiceValues(value, name string) ([]byte, error) {
+	values := make(map[string]int)
+	for _, pair := range strings.Split(value, ",") {
+		if strings.TrimSpace(pair) == "" {
+			continue
+		}
+		parts := strings.SplitN(pair, "=", 2)
+		if len(parts) != 2 {
+			return nil, fmt.Errorf("invalid %s %q", name, pair)
+		}
+		n, err := strconv.Atoi(strings.TrimSpace(parts[1]))
+		if err != nil || n < 1 {
+			return nil, fmt.Errorf("invalid %s %q", name, pair)
+		}
+		values[strings.TrimSpace(parts[0])] = n
+	}
+	return json.Marshal(values)
+}
+
 func getPipesFromQueue() ([]*Pipe, error) {
 	var pipes []*Pipe
-	rows, err := db.Query(selectPipesFromQueueSQL)
+	limits, err := serviceLimits()
+	if err != nil {
+		return nil, err
+	}
+	weights, err := queueWeights()
+	if err != nil {
+		return nil, err
+	}
+	rows, err := db.Query(selectPipesFromQueueSQL, limits, weights, queueBatchSize, queueStaleAfter.Seconds())
 	if err != nil {
 		if err == sql.ErrNoRows {
 			return nil, nil
@@ -394,7 +603,25 @@ func getPipesFromQueue() ([]*Pipe, error) {
 	return pipes, nil
 }
 
+// startQueuedPipe marks locked pipe as started, false is returned when
+// its service runs as many pipes as service_concurrency allows
+func startQueuedPipe(pipe *Pipe) (bool, error) {
+	limits, err := serviceLimits()
+	if err != nil {
+		return false, err
+	}
+	var started bool
+	err = db.QueryRow(startQueuedPipeSQL, pipe.workspaceID, pipe.key, limits, queueStaleAfter.Seconds()).Scan(&started)
+	return started, err
+}
+
 func setQueuedPipeSynced(pipe *Pipe) error {
 	_, err := db.Exec(setQueuedPipeSyncedSQL, pipe.workspaceID, pipe.key)
 	return err
 }
+
+// unlockQueuedPipe puts pipe back to queue to be picked up by next batch
+func unlockQueuedPipe(pipe *Pipe) error {
+	_, err := db.Exec(unlockQueuedPipeSQL, pipe.workspaceID, pipe.key)
+	return err
+}
@@ -0,0 +1,189 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+)
+
+// Running pipes are canceled by flagging their status, the run checks
+// the flag at safe points: before provider requests and before Toggl
+// batches, when connections of the previous batch are saved. Runs of
+// this process are signaled directly as well.
+
+// ErrPipeCanceled stops run of a pipe canceled by the user
+var ErrPipeCanceled = errors.New("pipe run was canceled")
+
+const (
+	canceledStatus = "canceled"
+
+	// cancelCheckInterval limits how often a run queries the cancel flag
+	cancelCheckInterval = 2 * time.Second
+
+	requestPipeCancelSQL = `UPDATE pipes_status
+	SET cancel_requested_at = now()
+	WHERE workspace_id = $1
+	AND key = $2
+	AND data->>'status' = 'running'`
+
+	clearPipeCancelSQL = `UPDATE pipes_status
+	SET cancel_requested_at = NULL
+	WHERE workspace_id = $1
+	AND key = $2`
+
+	pipeCancelRequestedSQL = `SELECT cancel_requested_at IS NOT NULL
+	FROM pipes_status
+	WHERE workspace_id = $1
+	AND key = $2`
+
+	dequeuePipeSQL = `DELETE FROM queued_pipes
+	WHERE workspace_id = $1
+	AND key = $2
+	AND locked_at IS NULL
+	AND synced_at IS NULL`
+
+	cancelQueuedPipeJobsSQL = `UPDATE jobs
+	SET state = 'canceled', progress = 100, error = $3, error_code = $4, updated_at = now()
+	WHERE workspace_id = $1
+	AND key = $2
+	AND state = 'queued'`
+)
+
+// runCancel tells a run whether it has been canceled
+type runCancel struct {
+	workspaceID int
+	key         string
+
+	mu        sync.Mutex
+	canceled  bool
+	checkedAt time.Time
+}
+
+type cancelContextKey struct{}
+
+var runningPipes = struct {
+	sync.Mutex
+	runs map[string]*runCancel
+}{runs: make(map[string]*runCancel)}
+
+func runKey(workspaceID int, key string) string {
+	return fmt.Sprintf("%d:%s", workspaceID, key)
+}
+
+// startRunCancel clears cancel requests of earlier runs of the pipe
+// and registers the run, so it can be signaled from this process
+func startRunCancel(p *Pipe) (*runCancel, error) {
+	c := &runCancel{workspaceID: p.workspaceID, key: p.key, checkedAt: time.Now()}
+	if _, err := db.ExecContext(p.context(), clearPipeCancelSQL, p.workspaceID, p.key); err != nil {
+		return c, err
+	}
+	runningPipes.Lock()
+	runningPipes.runs[runKey(p.workspaceID, p.key)] = c
+	runningPipes.Unlock()
+	return c, nil
+}
+
+func (c *runCancel) stop() {
+	runningPipes.Lock()
+	defer runningPipes.Unlock()
+	if runningPipes.runs[runKey(c.workspaceID, c.key)] == c {
+		delete(runningPipes.runs, runKey(c.workspaceID, c.key))
+	}
+}
+
+func (c *runCancel) cancel() {
+	c.mu.Lock()
+	c.canceled = true
+	c.mu.Unlock()
+}
+
+func (c *runCancel) wasCanceled() bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.canceled
+}
+
+// check returns ErrPipeCanceled once the run is canceled, the flag in
+// database is queried at most once per cancelCheckInterval
+func (c *runCancel) check(ctx context.Context) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.canceled {
+		return ErrPipeCanceled
+	}
+	if time.Since(c.checkedAt) < cancelCheckInterval {
+		return nil
+	}
+	c.checkedAt = time.Now()
+
+	var requested bool
+	err := db.QueryRowContext(ctx, pipeCancelRequestedSQL, c.workspaceID, c.key).Scan(&requested)
+	if err != nil && err != sql.ErrNoRows {
+		// keep running, the next check may get through
+		logger.Warn("failed to check if pipe is canceled", Fields{"workspace_id": c.workspaceID, "key": c.key, "error": err})
+		return nil
+	}
+	if requested {
+		c.canceled = true
+		return ErrPipeCanceled
+	}
+	return nil
+}
+
+func withRunCancel(ctx context.Context, c *runCancel) context.Context {
+	return context.WithValue(ctx, cancelContextKey{}, c)
+}
+
+// checkCanceled returns ErrPipeCanceled if the run of ctx is canceled,
+// callers must stop before sending anything more
+func checkCanceled(ctx context.Context) error {
+	if ctx == nil {
+		return nil
+	}
+	if c, ok := ctx.Value(cancelContextKey{}).(*runCancel); ok {
+		return c.check(ctx)
+	}
+	return nil
+}
+
+func (p *Pipe) checkCanceled() error {
+	return checkCanceled(p.context())
+}
+
+// cancelPipe removes queued run of the pipe and asks the running one to
+// stop, it returns false for both if the pipe has nothing to cancel
+func cancelPipe(p *Pipe) (dequeued bool, stopping bool, err error) {
+	res, err := db.Exec(dequeuePipeSQL, p.workspaceID, p.key)
+	if err != nil {
+		return false, false, err
+	}
+	n, err := res.RowsAffected()
+	if err != nil {
+		return false, false, err
+	}
+	if dequeued = n > 0; dequeued {
+		pipeErr := classifyError(ErrPipeCanceled)
+		if _, err := db.Exec(cancelQueuedPipeJobsSQL, p.workspaceID, p.key, pipeErr.Message, pipeErr.Code); err != nil {
+			return dequeued, false, err
+		}
+	}
+
+	if res, err = db.Exec(requestPipeCancelSQL, p.workspaceID, p.key); err != nil {
+		return dequeued, false, err
+	}
+	if n, err = res.RowsAffected(); err != nil {
+		return dequeued, false, err
+	}
+	stopping = n > 0
+
+	runningPipes.Lock()
+	if c, found := runningPipes.runs[runKey(p.workspaceID, p.key)]; found {
+		c.cancel()
+		stopping = true
+	}
+	runningPipes.Unlock()
+	return dequeued, stopping, nil
+}
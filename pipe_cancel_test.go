@@ -0,0 +1,68 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestCheckCanceled(t *testing.T) {
+	c := &runCancel{workspaceID: 1, key: "asana:tasks"}
+	c.cancel()
+	ctx := withRunCancel(context.Background(), c)
+	if err := checkCanceled(ctx); err != ErrPipeCanceled {
+		t.Errorf("expected canceled run to stop, got %v", err)
+	}
+	if err := checkCanceled(context.Background()); err != nil {
+		t.Errorf("expected run without cancel to continue, got %v", err)
+	}
+}
+
+func TestRateLimitedTransportStopsCanceledRun(t *testing.T) {
+	var requests int
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests++
+	}))
+	defer ts.Close()
+
+	c := &runCancel{workspaceID: 1, key: "asana:tasks"}
+	c.cancel()
+	limiter := &RateLimiter{authorization: NewTokenBucket(rateLimit{rate: 100, burst: 10})}
+	client := &http.Client{Transport: &rateLimitedTransport{
+		limiter: limiter,
+		next:    http.DefaultTransport,
+		parent:  withRunCancel(context.Background(), c),
+	}}
+
+	if _, err := client.Get(ts.URL); !errors.Is(err, ErrPipeCanceled) {
+		t.Errorf("expected canceled error, got %v", err)
+	}
+	if requests != 0 {
+		t.Errorf("expected no request to be sent, got %d", requests)
+	}
+}
+
+func TestPipeStatusCanceled(t *testing.T) {
+	status := NewPipeStatus(1, "asana", "tasks")
+	status.addError(ErrPipeCanceled)
+	if status.Status != canceledStatus {
+		t.Errorf("expected status %s, got %s", canceledStatus, status.Status)
+	}
+}
+
+func TestRunCancelRegistry(t *testing.T) {
+	c := &runCancel{workspaceID: 1, key: "asana:tasks"}
+	runningPipes.Lock()
+	runningPipes.runs[runKey(c.workspaceID, c.key)] = c
+	runningPipes.Unlock()
+
+	c.stop()
+	runningPipes.Lock()
+	_, found := runningPipes.runs[runKey(c.workspaceID, c.key)]
+	runningPipes.Unlock()
+	if found {
+		t.Error("expected stopped run to be unregistered")
+	}
+}
@@ -0,0 +1,224 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"strings"
+
+	"code.google.com/p/goauth2/oauth"
+)
+
+// Error codes are stable identifiers of error classes,
+// they are stored in pipe statuses and jobs and returned by the API
+const (
+	errorCodeAuthRevoked         = "auth_revoked"
+	errorCodeRateLimited         = "rate_limited"
+	errorCodeProviderUnavailable = "provider_unavailable"
+	errorCodeTogglRejected       = "toggl_rejected"
+	errorCodeInvalidConfig       = "invalid_config"
+	errorCodePayloadTooLarge     = "payload_too_large"
+	errorCodeInternal            = "internal"
+	errorCodeCanceled            = "canceled"
+)
+
+type errorClass struct {
+	message   string
+	retryable bool
+	// alert tells if errors are reported to error tracking,
+	// errors caused by users or providers are not actionable
+	alert  bool
+	status int
+}
+
+var errorClasses = map[string]errorClass{
+	errorCodeAuthRevoked: {
+		message: "Authorization with the service was revoked or has expired, please reconnect the integration",
+		status:  http.StatusForbidden,
+	},
+	errorCodeRateLimited: {
+		message:   "The service rate limit was reached, please try again later",
+		retryable: true,
+		status:    http.StatusTooManyRequests,
+	},
+	errorCodeProviderUnavailable: {
+		message:   "The service is not available at the moment, please try again later",
+		retryable: true,
+		status:    http.StatusBadGateway,
+	},
+	errorCodeTogglRejected: {
+		message: "Toggl rejected the synced data",
+		alert:   true,
+		status:  http.StatusUnprocessableEntity,
+	},
+	errorCodeInvalidConfig: {
+		message: "The integration is not configured correctly",
+		status:  http.StatusBadRequest,
+	},
+	errorCodePayloadTooLarge: {
+		message: "Too much data to sync at once, please select fewer objects",
+		status:  http.StatusRequestEntityTooLarge,
+	},
+	errorCodeCanceled: {
+		message: "The run was canceled, objects synced before it are kept",
+		status:  http.StatusConflict,
+	},
+	errorCodeInternal: {
+		message: "Something went wrong, please contact support",
+		alert:   true,
+		status:  http.StatusInternalServerError,
+	},
+}
+
+// PipeError is an error classified by its code, Message is shown to users
+type PipeError struct {
+	Code      string `json:"code"`
+	Message   string `json:"message"`
+	Retryable bool   `json:"retryable"`
+
+	err error
+}
+
+// newPipeError wraps err into error of class code with the class message
+func newPipeError(code string, err error) *PipeError {
+	class := errorClasses[code]
+	return &PipeError{
+		Code:      code,
+		Message:   class.message,
+		Retryable: class.retryable,
+		err:       err,
+	}
+}
+
+// withDetail appends detail useful to users to the message
+func (e *PipeError) withDetail(detail string) *PipeError {
+	if detail != "" {
+		e.Message = e.Message + ": " + detail
+	}
+	return e
+}
+
+func (e *PipeError) Error() string {
+	// details already in message are not repeated
+	if e.err == nil || strings.HasSuffix(e.Message, e.err.Error()) {
+		return e.Message
+	}
+	return e.Message + ": " + e.err.Error()
+}
+
+func (e *PipeError) Unwrap() error {
+	return e.err
+}
+
+func (e *PipeError) alert() bool {
+	return errorClasses[e.Code].alert
+}
+
+func (e *PipeError) status() int {
+	return errorClasses[e.Code].status
+}
+
+// asInvalidConfig classifies errors of parsing integration settings
+func asInvalidConfig(err error) error {
+	var pipeErr *PipeError
+	if err == nil || errors.As(err, &pipeErr) {
+		return err
+	}
+	return newPipeError(errorCodeInvalidConfig, err).withDetail(err.Error())
+}
+
+// classifyError maps err to one of the error codes, errors which are
+// not recognised are internal and keep their message for users
+func classifyError(err error) *PipeError {
+	var pipeErr *PipeError
+	if errors.As(err, &pipeErr) {
+		return pipeErr
+	}
+	if errors.Is(err, ErrPipeCanceled) {
+		return newPipeError(errorCodeCanceled, err)
+	}
+
+	var togglErr *TogglAPIError
+	if errors.As(err, &togglErr) {
+		switch {
+		case togglErr.StatusCode == http.StatusRequestEntityTooLarge:
+			return newPipeError(errorCodePayloadTooLarge, err)
+		case togglErr.StatusCode == http.StatusTooManyRequests:
+			return newPipeError(errorCodeRateLimited, err)
+		case togglErr.StatusCode >= 500:
+			return newPipeError(errorCodeProviderUnavailable, err)
+		default:
+			return newPipeError(errorCodeTogglRejected, err).withDetail(togglErr.message())
+		}
+	}
+
+	var unmarshalTypeErr *json.UnmarshalTypeError
+	var syntaxErr *json.SyntaxError
+	if errors.As(err, &unmarshalTypeErr) || errors.As(err, &syntaxErr) {
+		// hide json marshalling errors from users
+		pipeErr := newPipeError(errorCodeInternal, err)
+		pipeErr.Message = ErrJSONParsing.Error()
+		return pipeErr
+	}
+
+	var oauthErr oauth.OAuthError
+	if errors.As(err, &oauthErr) {
+		return newPipeError(errorCodeAuthRevoked, err)
+	}
+
+	// url.Error of canceled requests is a net.Error too
+	var netErr net.Error
+	canceled := errors.Is(err, context.Canceled)
+	if !canceled && (errors.Is(err, context.DeadlineExceeded) || errors.As(err, &netErr)) {
+		return newPipeError(errorCodeProviderUnavailable, err)
+	}
+
+	if errors.Is(err, ErrNotSupported) {
+		return newPipeError(errorCodeInvalidConfig, err).withDetail(err.Error())
+	}
+
+	pipeErr = newPipeError(errorCodeInternal, err)
+	pipeErr.Message = err.Error()
+	return pipeErr
+}
+
+// providerResponseError classifies failed responses of providers,
+// nil is returned for responses that client libraries should handle
+func providerResponseError(service string, resp *http.Response, rateLimited bool) *PipeError {
+	cause := fmt.Errorf("%s responded with status code %d", service, resp.StatusCode)
+	switch {
+	case rateLimited:
+		return newPipeError(errorCodeRateLimited, cause)
+	case resp.StatusCode == http.StatusUnauthorized:
+		return newPipeError(errorCodeAuthRevoked, cause)
+	case resp.StatusCode == http.StatusBadGateway,
+		resp.StatusCode == http.StatusServiceUnavailable,
+		resp.StatusCode == http.StatusGatewayTimeout:
+		return newPipeError(errorCodeProviderUnavailable, cause)
+	}
+	return nil
+}
+
+// message returns error message from Toggl API response body
+func (e *TogglAPIError) message() string {
+	var body struct {
+		Error   string `json:"error"`
+		Message string `json:"message"`
+	}
+	if err := json.Unmarshal(e.Body, &body); err == nil {
+		if body.Message != "" {
+			return body.Message
+		}
+		if body.Error != "" {
+			return body.Error
+		}
+	}
+	message := strings.TrimSpace(string(e.Body))
+	if len(message) > maxErrorBodyLength {
+		message = message[:maxErrorBodyLength] + "..."
+	}
+	return message
+}
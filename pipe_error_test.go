@@ -0,0 +1,119 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"code.google.com/p/goauth2/oauth"
+)
+
+func TestClassifyError(t *testing.T) {
+	tests := []struct {
+		err       error
+		code      string
+		retryable bool
+	}{
+		{&TogglAPIError{StatusCode: http.StatusBadRequest, Body: []byte(`{"message":"Name has already been taken"}`)}, errorCodeTogglRejected, false},
+		{&TogglAPIError{StatusCode: http.StatusRequestEntityTooLarge}, errorCodePayloadTooLarge, false},
+		{&TogglAPIError{StatusCode: http.StatusTooManyRequests}, errorCodeRateLimited, true},
+		{fmt.Errorf("post projects: %w", &TogglAPIError{StatusCode: http.StatusServiceUnavailable}), errorCodeProviderUnavailable, true},
+		{oauth.OAuthError{}, errorCodeAuthRevoked, false},
+		{context.DeadlineExceeded, errorCodeProviderUnavailable, true},
+		{context.Canceled, errorCodeInternal, false},
+		{json.Unmarshal([]byte(`{"id":"1"}`), &struct{ ID int }{}), errorCodeInternal, false},
+		{fmt.Errorf("%w clients", ErrNotSupported), errorCodeInvalidConfig, false},
+		{asInvalidConfig(errors.New("account_id must be present")), errorCodeInvalidConfig, false},
+		{errors.New("unable to get users from DB"), errorCodeInternal, false},
+		{fmt.Errorf("get tasks: %w", ErrPipeCanceled), errorCodeCanceled, false},
+	}
+	for i, tt := range tests {
+		pipeErr := classifyError(tt.err)
+		if pipeErr.Code != tt.code || pipeErr.Retryable != tt.retryable {
+			t.Errorf("case %d: expected %s (retryable %t), got %s (retryable %t)",
+				i, tt.code, tt.retryable, pipeErr.Code, pipeErr.Retryable)
+		}
+	}
+}
+
+func TestClassifyErrorMessages(t *testing.T) {
+	togglErr := &TogglAPIError{StatusCode: http.StatusBadRequest, Body: []byte(`{"message":"Name has already been taken"}`)}
+	if msg := classifyError(togglErr).Message; msg != "Toggl rejected the synced data: Name has already been taken" {
+		t.Errorf("unexpected toggl_rejected message %q", msg)
+	}
+	jsonErr := json.Unmarshal([]byte(`{"id":"1"}`), &struct{ ID int }{})
+	if msg := classifyError(jsonErr).Message; msg != ErrJSONParsing.Error() {
+		t.Errorf("expected JSON errors to be hidden, got %q", msg)
+	}
+	configErr := asInvalidConfig(errors.New("account_id must be present"))
+	if configErr.Error() != "The integration is not configured correctly: account_id must be present" {
+		t.Errorf("unexpected invalid_config error %q", configErr.Error())
+	}
+}
+
+func TestPipeStatusAddErrorStoresCode(t *testing.T) {
+	status := NewPipeStatus(workspaceID, "github", "projects")
+	status.addError(&TogglAPIError{StatusCode: http.StatusBadGateway})
+
+	if status.Status != "error" || status.ErrorCode != errorCodeProviderUnavailable || !status.Retryable {
+		t.Errorf("unexpected status %+v", status)
+	}
+	if status.Message != errorClasses[errorCodeProviderUnavailable].message {
+		t.Errorf("unexpected message %q", status.Message)
+	}
+}
+
+func TestProviderResponsesAreClassified(t *testing.T) {
+	status := http.StatusUnauthorized
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(status)
+	}))
+	defer ts.Close()
+	client := rateLimitedClient(&TestService{workspaceID: workspaceID}, http.DefaultTransport)
+
+	_, err := client.Get(ts.URL)
+	if code := classifyError(err).Code; code != errorCodeAuthRevoked {
+		t.Errorf("expected %s for 401 response, got %s (%v)", errorCodeAuthRevoked, code, err)
+	}
+
+	status = http.StatusNotFound
+	resp, err := client.Get(ts.URL)
+	if err != nil {
+		t.Fatalf("expected 404 response to be handled by client library, got %v", err)
+	}
+	resp.Body.Close()
+}
+
+func TestTogglClientRetriesRateLimitedRequests(t *testing.T) {
+	var requests int
+	c, ts := newTestTogglClient(func(w http.ResponseWriter, r *http.Request) {
+		requests++
+		w.WriteHeader(http.StatusTooManyRequests)
+	})
+	defer ts.Close()
+
+	_, err := c.GetWorkspaceID(context.Background(), "token")
+	if code := classifyError(err).Code; code != errorCodeRateLimited {
+		t.Errorf("expected %s, got %s", errorCodeRateLimited, code)
+	}
+	if requests != c.maxRetries+1 {
+		t.Errorf("expected rate limited request to be retried %d times, got %d requests", c.maxRetries, requests)
+	}
+}
+
+func TestReportErrorSkipsUserErrors(t *testing.T) {
+	reporter, restore := useMemoryErrorReporter()
+	defer restore()
+
+	reportError(newPipeError(errorCodeAuthRevoked, errors.New("invalid_grant")), nil)
+	reportError(errors.New("unable to save status"), nil)
+
+	reported := reporter.Errors()
+	if len(reported) != 1 || reported[0].Metadata["error"]["code"] != errorCodeInternal {
+		t.Errorf("expected only internal error to be reported, got %+v", reported)
+	}
+}
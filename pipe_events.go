@@ -0,0 +1,330 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// Running pipes report steps such as fetched objects or posted batches.
+// The last step is kept on the pipe status for polling and every step is
+// streamed to subscribers of the pipe as Server-Sent Events. Streams poll
+// the status as well, so runs of other processes are followed too.
+
+const (
+	stageFetch  = "fetch"
+	stagePost   = "post"
+	stageExport = "export"
+
+	// progressSaveInterval limits how often steps are written to database,
+	// subscribers of this process get all of them
+	progressSaveInterval = time.Second
+
+	eventsPollInterval      = 2 * time.Second
+	eventsHeartbeatInterval = 15 * time.Second
+	maxEventStreamDuration  = time.Hour
+	eventsBufferSize        = 16
+
+	savePipeProgressSQL = `UPDATE pipes_status
+	SET data = (data::jsonb || jsonb_build_object('progress', $3::jsonb))::json
+	WHERE workspace_id = $1
+	AND key = $2
+	AND data->>'status' = 'running'`
+)
+
+// RunProgress is the last step reported by pipe run
+type RunProgress struct {
+	Seq       int       `json:"seq"`
+	Stage     string    `json:"stage"`
+	Object    string    `json:"object"`
+	Done      int       `json:"done"`
+	Total     int       `json:"total"`
+	Message   string    `json:"message"`
+	UpdatedAt time.Time `json:"updated_at"`
+}
+
+// reportStep records progress of the run, done of total objects of the
+// stage are processed. Steps the pipe depends on report to its status.
+func (p *Pipe) reportStep(stage, object string, done, total int, message string) {
+	status := p.PipeStatus
+	if status == nil {
+		return
+	}
+	now := time.Now()
+	seq := 1
+	if status.Progress != nil {
+		seq = status.Progress.Seq + 1
+	}
+	status.Progress = &RunProgress{
+		Seq:       seq,
+		Stage:     stage,
+		Object:    object,
+		Done:      done,
+		Total:     total,
+		Message:   message,
+		UpdatedAt: now.UTC(),
+	}
+
+	// objects completed earlier in the run must not look like finished run
+	running := status.snapshot()
+	running.Status = startStatus
+	pipeEvents.publish(status.workspaceID, status.key, running)
+
+	if done < total && now.Sub(status.progressSavedAt) < progressSaveInterval {
+		return
+	}
+	status.progressSavedAt = now
+	b, err := json.Marshal(status.Progress)
+	if err != nil {
+		reportPipeError(p, err)
+		return
+	}
+	if _, err := db.ExecContext(p.context(), savePipeProgressSQL, status.workspaceID, status.key, b); err != nil {
+		pipeLogger(p).Warn("failed to save pipe progress", Fields{"error": err})
+	}
+}
+
+type progressKey struct{}
+
+// withProgress keeps pipe in ctx of its run, so that services can report
+// progress of fetches that take long
+func withProgress(ctx context.Context, p *Pipe) context.Context {
+	return context.WithValue(ctx, progressKey{}, p)
+}
+
+// runPipe returns pipe of the run ctx belongs to, or nil outside runs
+func runPipe(ctx context.Context) *Pipe {
+	pipe, _ := ctx.Value(progressKey{}).(*Pipe)
+	return pipe
+}
+
+// fetchProgress reports parts of a fetch done in parallel, e.g. tasks
+// of each project, to the pipe run of ctx
+type fetchProgress struct {
+	mu     sync.Mutex
+	pipe   *Pipe
+	object string
+	parts  string
+	done   int
+	total  int
+}
+
+// newFetchProgress returns progress of fetching object in total parts,
+// fetches outside pipe runs report nothing
+func newFetchProgress(ctx context.Context, object, parts string, total int) *fetchProgress {
+	return &fetchProgress{pipe: runPipe(ctx), object: object, parts: parts, total: total}
+}
+
+// add reports one more part fetched, it is safe for parallel fetches
+func (f *fetchProgress) add() {
+	if f.pipe == nil {
+		return
+	}
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.done++
+	f.pipe.reportStep(stageFetch, f.object, f.done, f.total,
+		fmt.Sprintf("Fetched %s of %d of %d %s", f.object, f.done, f.total, f.parts))
+}
+
+// publishStatus tells subscribers that the run started or ended,
+// status must be saved before so polling streams agree with it
+func (p *Pipe) publishStatus() {
+	if p.PipeStatus != nil {
+		pipeEvents.publish(p.workspaceID, p.key, p.PipeStatus.snapshot())
+	}
+}
+
+// snapshot copies status, so subscribers can read it while run goes on
+func (p *PipeStatus) snapshot() *PipeStatus {
+	s := *p
+	if p.Progress != nil {
+		progress := *p.Progress
+		s.Progress = &progress
+	}
+	return &s
+}
+
+type eventHub struct {
+	sync.Mutex
+	subscribers map[string]map[chan *PipeStatus]bool
+}
+
+var pipeEvents = &eventHub{subscribers: make(map[string]map[chan *PipeStatus]bool)}
+
+func (h *eventHub) subscribe(workspaceID int, key string) (<-chan *PipeStatus, func()) {
+	k := runKey(workspaceID, key)
+	ch := make(chan *PipeStatus, eventsBufferSize)
+	h.Lock()
+	if h.subscribers[k] == nil {
+		h.subscribers[k] = make(map[chan *PipeStatus]bool)
+	}
+	h.subscribers[k][ch] = true
+	h.Unlock()
+
+	return ch, func() {
+		h.Lock()
+		delete(h.subscribers[k], ch)
+		if len(h.subscribers[k]) == 0 {
+			delete(h.subscribers, k)
+		}
+		h.Unlock()
+	}
+}
+
+// publish does not wait for slow subscribers, they miss steps
+// but get the latest one when they poll the status
+func (h *eventHub) publish(workspaceID int, key string, status *PipeStatus) {
+	h.Lock()
+	defer h.Unlock()
+	for ch := range h.subscribers[runKey(workspaceID, key)] {
+		select {
+		case ch <- status:
+		default:
+		}
+	}
+}
+
+type flusherKey struct{}
+
+// withFlusher keeps flusher of the connection in request context,
+// the tracing handler wraps response writer without it
+func withFlusher(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if f, ok := w.(http.Flusher); ok {
+			r = r.WithContext(context.WithValue(r.Context(), flusherKey{}, f))
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+func flusherFor(w http.ResponseWriter, r *http.Request) (http.Flusher, bool) {
+	if f, ok := w.(http.Flusher); ok {
+		return f, true
+	}
+	f, ok := r.Context().Value(flusherKey{}).(http.Flusher)
+	return f, ok
+}
+
+// eventStream writes status and progress events, events the client
+// got already are skipped
+type eventStream struct {
+	w       io.Writer
+	flusher http.Flusher
+
+	status      string
+	syncDate    string
+	progressRun string
+	progressSeq int
+}
+
+func (s *eventStream) write(event string, data interface{}) error {
+	b, err := json.Marshal(data)
+	if err != nil {
+		return err
+	}
+	if _, err := fmt.Fprintf(s.w, "event: %s\ndata: %s\n\n", event, b); err != nil {
+		return err
+	}
+	s.flusher.Flush()
+	return nil
+}
+
+func (s *eventStream) comment(text string) error {
+	if _, err := fmt.Fprintf(s.w, ": %s\n\n", text); err != nil {
+		return err
+	}
+	s.flusher.Flush()
+	return nil
+}
+
+func (s *eventStream) send(status *PipeStatus) error {
+	if status == nil {
+		return nil
+	}
+	if status.Status != s.status || status.SyncDate != s.syncDate {
+		s.status, s.syncDate = status.Status, status.SyncDate
+		if err := s.write("status", status); err != nil {
+			return err
+		}
+	}
+	progress := status.Progress
+	if progress == nil || (status.SyncDate == s.progressRun && progress.Seq <= s.progressSeq) {
+		return nil
+	}
+	s.progressRun, s.progressSeq = status.SyncDate, progress.Seq
+	return s.write("progress", progress)
+}
+
+// getPipeEvents streams status and progress of pipe runs until
+// the client disconnects
+func getPipeEvents(w http.ResponseWriter, r *http.Request) {
+	flusher, ok := flusherFor(w, r)
+	if !ok {
+		writeError(w, r, http.StatusInternalServerError, errors.New("Streaming is not supported"))
+		return
+	}
+	workspaceID := currentWorkspaceID(r)
+	serviceID, pipeID := currentServicePipeID(r)
+	pipe, err := loadPipe(workspaceID, serviceID, pipeID)
+	if err != nil {
+		writeError(w, r, http.StatusInternalServerError, err)
+		return
+	}
+	if pipe == nil {
+		writeError(w, r, http.StatusBadRequest, errors.New("Pipe is not configured"))
+		return
+	}
+
+	events, unsubscribe := pipeEvents.subscribe(workspaceID, pipe.key)
+	defer unsubscribe()
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.Header().Set("X-Accel-Buffering", "no")
+	w.WriteHeader(http.StatusOK)
+	stream := &eventStream{w: w, flusher: flusher}
+
+	poll := func() error {
+		status, err := loadPipeStatus(workspaceID, serviceID, pipeID)
+		if err != nil {
+			// keep streaming, the next poll may get through
+			requestLogger(r).Warn("failed to poll pipe status", Fields{"error": err})
+			return nil
+		}
+		return stream.send(status)
+	}
+	if err := poll(); err != nil {
+		return
+	}
+
+	pollTicker := time.NewTicker(eventsPollInterval)
+	defer pollTicker.Stop()
+	heartbeat := time.NewTicker(eventsHeartbeatInterval)
+	defer heartbeat.Stop()
+	deadline := time.NewTimer(maxEventStreamDuration)
+	defer deadline.Stop()
+
+	for {
+		select {
+		case <-r.Context().Done():
+			return
+		case <-deadline.C:
+			return
+		case status := <-events:
+			err = stream.send(status)
+		case <-pollTicker.C:
+			err = poll()
+		case <-heartbeat.C:
+			err = stream.comment("heartbeat")
+		}
+		if err != nil {
+			return
+		}
+	}
+}
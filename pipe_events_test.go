@@ -0,0 +1,117 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestEventStreamSkipsSentEvents(t *testing.T) {
+	w := httptest.NewRecorder()
+	stream := &eventStream{w: w, flusher: w}
+	events := func() []string {
+		var names []string
+		for _, line := range strings.Split(w.Body.String(), "\n") {
+			if strings.HasPrefix(line, "event: ") {
+				names = append(names, strings.TrimPrefix(line, "event: "))
+			}
+		}
+		w.Body.Reset()
+		return names
+	}
+
+	status := &PipeStatus{Status: startStatus, SyncDate: "2020-05-01T10:00:00Z"}
+	stream.send(status)
+	status.Progress = &RunProgress{Seq: 1, Stage: stageFetch, Done: 5, Total: 5}
+	stream.send(status)
+	if got := strings.Join(events(), ","); got != "status,progress" {
+		t.Errorf("expected status and progress, got %s", got)
+	}
+
+	// polled status may be older than published steps
+	stream.send(&PipeStatus{Status: startStatus, SyncDate: "2020-05-01T10:00:00Z", Progress: &RunProgress{Seq: 1}})
+	if got := events(); len(got) != 0 {
+		t.Errorf("expected sent events to be skipped, got %v", got)
+	}
+
+	stream.send(&PipeStatus{Status: "success", SyncDate: "2020-05-01T10:00:00Z", Progress: &RunProgress{Seq: 1}})
+	stream.send(&PipeStatus{Status: startStatus, SyncDate: "2020-05-01T11:00:00Z", Progress: &RunProgress{Seq: 1}})
+	if got := strings.Join(events(), ","); got != "status,status,progress" {
+		t.Errorf("expected status of ended run and progress of the next one, got %s", got)
+	}
+}
+
+func TestReportStepPublishesRunningStatus(t *testing.T) {
+	pipe := NewPipe(1, "asana", tasksPipeId)
+	pipe.PipeStatus = NewPipeStatus(1, "asana", tasksPipeId)
+	pipe.PipeStatus.Status = "success" // projects of the run are completed
+	pipe.PipeStatus.progressSavedAt = time.Now()
+
+	events, unsubscribe := pipeEvents.subscribe(1, pipe.key)
+	defer unsubscribe()
+
+	pipe.reportStep(stagePost, tasksPipeId, 1, 3, "Posted batch 1 of 3")
+	pipe.reportStep(stagePost, tasksPipeId, 2, 3, "Posted batch 2 of 3")
+	for seq := 1; seq <= 2; seq++ {
+		status := <-events
+		if status.Status != startStatus || status.Progress.Seq != seq || status.Progress.Done != seq {
+			t.Errorf("expected running status with step %d, got %s %+v", seq, status.Status, status.Progress)
+		}
+	}
+	if pipe.PipeStatus.Status != "success" || pipe.PipeStatus.Progress.Seq != 2 {
+		t.Errorf("expected status of the run to keep the last step, got %+v", pipe.PipeStatus)
+	}
+}
+
+func TestFetchProgressReportsParts(t *testing.T) {
+	pipe := NewPipe(1, "asana", tasksPipeId)
+	pipe.PipeStatus = NewPipeStatus(1, "asana", tasksPipeId)
+	pipe.PipeStatus.progressSavedAt = time.Now()
+	ctx := withProgress(context.Background(), pipe)
+
+	// the last project is left, so that progress is not saved to DB
+	progress := newFetchProgress(ctx, tasksPipeId, "projects", 4)
+	err := parallelFetch(ctx, 3, func(ctx context.Context, i int) error {
+		progress.add()
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if p := pipe.PipeStatus.Progress; p == nil || p.Seq != 3 || p.Done != 3 || p.Total != 4 || p.Message != "Fetched tasks of 3 of 4 projects" {
+		t.Errorf("expected progress of 3 projects, got %+v", p)
+	}
+
+	// fetches outside pipe runs report nothing
+	newFetchProgress(context.Background(), tasksPipeId, "projects", 1).add()
+}
+
+func TestEventHubUnsubscribe(t *testing.T) {
+	events, unsubscribe := pipeEvents.subscribe(2, "asana:projects")
+	unsubscribe()
+	pipeEvents.publish(2, "asana:projects", &PipeStatus{Status: startStatus})
+	select {
+	case status := <-events:
+		t.Errorf("expected no events after unsubscribe, got %+v", status)
+	default:
+	}
+	if _, found := pipeEvents.subscribers[runKey(2, "asana:projects")]; found {
+		t.Error("expected subscribers of the pipe to be removed")
+	}
+}
+
+func TestFlusherForWrappedWriter(t *testing.T) {
+	var found bool
+	handler := withFlusher(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		// like the tracing handler, the wrapper hides optional interfaces
+		wrapped := struct{ http.ResponseWriter }{w}
+		_, found = flusherFor(wrapped, r)
+	}))
+	handler.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", "/api/v1/integrations/asana/pipes/projects/events", nil))
+	if !found {
+		t.Error("expected flusher of the connection to be found")
+	}
+}
@@ -15,11 +15,27 @@ type PipeStatus struct {
 	SyncDate      string   `json:"sync_date,omitempty"`
 	ObjectCounts  []string `json:"object_counts,omitempty"`
 	Notifications []string `json:"notifications,omitempty"`
+	StackTrace    string   `json:"stack_trace,omitempty"`
+
+	// ErrorCode and Retryable classify the error of failed run
+	ErrorCode string `json:"error_code,omitempty"`
+	Retryable bool   `json:"retryable,omitempty"`
+
+	// ThrottledSeconds is time the run was paused by provider rate limits
+	ThrottledSeconds int `json:"throttled_seconds,omitempty"`
+
+	// Progress is the last step of running pipe, kept after the run ends
+	Progress *RunProgress `json:"progress,omitempty"`
+
+	// Steps are results of the pipe and the steps it depends on
+	Steps []*StepResult `json:"steps,omitempty"`
 
 	workspaceID int
 	serviceID   string
 	pipeID      string
 	key         string
+
+	progressSavedAt time.Time // when the last step was written to database
 }
 
 const (
@@ -105,8 +121,14 @@ func (p *PipeStatus) load(rows *sql.Rows) error {
 }
 
 func (p *PipeStatus) addError(err error) {
+	pipeErr := classifyError(err)
 	p.Status = "error"
-	p.Message = err.Error()
+	if pipeErr.Code == errorCodeCanceled {
+		p.Status = canceledStatus
+	}
+	p.Message = pipeErr.Message
+	p.ErrorCode = pipeErr.Code
+	p.Retryable = pipeErr.Retryable
 }
 
 func (p *PipeStatus) complete(objType string, notifications []string, objCount int) {
@@ -117,6 +139,7 @@ func (p *PipeStatus) complete(objType string, notifications []string, objCount i
 	p.Notifications = notifications
 	if objCount > 0 {
 		p.ObjectCounts = append(p.ObjectCounts, fmt.Sprintf("%d %s", objCount, objType))
+		importedObjects.WithLabelValues(p.serviceID, objType).Add(float64(objCount))
 	}
 	p.SyncLog = fmt.Sprintf("%s/api/v1/integrations/%s/pipes/%s/log",
 		urls.PipesAPIHost[environment], p.serviceID, p.pipeID)
@@ -0,0 +1,256 @@
+package main
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"time"
+)
+
+// Pipes declare steps they depend on: clients, then projects, then tasks
+// and todo lists, then time entries. Before a pipe runs its dependencies
+// run in order, steps synced within dependency_freshness are skipped and
+// results of all steps are kept on the pipe status.
+
+const (
+	stepRan         = "ran"
+	stepSkipped     = "skipped"
+	stepUnsupported = "unsupported"
+	stepFailed      = "failed"
+
+	stepSyncSQL = `SELECT synced_at, synced_at > now() - $3::float8 * interval '1 second'
+	FROM pipe_steps
+	WHERE workspace_id = $1
+	AND key = $2`
+
+	setStepSyncedSQL = `INSERT INTO pipe_steps(workspace_id, key, synced_at)
+	VALUES($1, $2, now())
+	ON CONFLICT (workspace_id, key) DO UPDATE SET synced_at = now()`
+
+	resetPipeStepsSQL = `DELETE FROM pipe_steps
+	WHERE workspace_id = $1
+	AND split_part(key, ':', 1) = $2`
+)
+
+// pipeStep syncs objects other pipes depend on, steps in whenConfigured
+// run only if the workspace has set up their pipes
+type pipeStep struct {
+	dependsOn      []string
+	whenConfigured []string
+	fetch          func(*Pipe) error
+	post           func(*Pipe) error
+}
+
+var pipeSteps = map[string]*pipeStep{
+	clientsPipeID:     {fetch: fetchClients, post: postClients},
+	projectsPipeID:    {dependsOn: []string{clientsPipeID}, fetch: fetchProjects, post: postProjects},
+	todoPipeId:        {dependsOn: []string{projectsPipeID}, fetch: fetchTodoLists, post: postTodoLists},
+	tasksPipeId:       {dependsOn: []string{projectsPipeID}, fetch: fetchTasks, post: postTasks},
+	timeEntriesPipeID: {whenConfigured: []string{projectsPipeID, tasksPipeId}, fetch: fetchTimeEntries, post: postTimeEntries},
+}
+
+// StepResult tells what a step of pipe run did
+type StepResult struct {
+	Step            string     `json:"step"`
+	Result          string     `json:"result"`
+	DurationSeconds float64    `json:"duration_seconds"`
+	SyncedAt        *time.Time `json:"synced_at,omitempty"` // when skipped step was synced
+	Error           string     `json:"error,omitempty"`
+	ErrorCode       string     `json:"error_code,omitempty"`
+}
+
+// stepID returns step of the pipe, basecamp todos are tasks
+func stepID(pipeID string) string {
+	if pipeID == "todos" {
+		return tasksPipeId
+	}
+	return pipeID
+}
+
+// stepOrder returns dependencies of the pipe in the order they run,
+// configured tells whether the workspace has set up pipe of a step
+func stepOrder(pipeID string, configured func(string) (bool, error)) ([]string, error) {
+	var order []string
+	state := make(map[string]int) // 1 while dependencies are visited, 2 when done
+	var visit func(id string) error
+	visit = func(id string) error {
+		switch state[id] {
+		case 1:
+			return fmt.Errorf("pipe steps depend on each other at %s", id)
+		case 2:
+			return nil
+		}
+		step, found := pipeSteps[id]
+		if !found {
+			return nil
+		}
+		state[id] = 1
+		dependencies := append([]string{}, step.dependsOn...)
+		for _, dependency := range step.whenConfigured {
+			ok, err := configured(dependency)
+			if err != nil {
+				return err
+			}
+			if ok {
+				dependencies = append(dependencies, dependency)
+			}
+		}
+		for _, dependency := range dependencies {
+			if err := visit(dependency); err != nil {
+				return err
+			}
+		}
+		state[id] = 2
+		order = append(order, id)
+		return nil
+	}
+
+	target := stepID(pipeID)
+	if err := visit(target); err != nil {
+		return nil, err
+	}
+	if len(order) > 0 && order[len(order)-1] == target {
+		order = order[:len(order)-1]
+	}
+	return order, nil
+}
+
+func (p *Pipe) stepConfigured(id string) (bool, error) {
+	pipe, err := loadPipe(p.workspaceID, p.serviceID, id)
+	if err != nil {
+		return false, err
+	}
+	return pipe != nil && pipe.Configured, nil
+}
+
+// runDependencies runs steps the pipe depends on, failed step fails the run
+func (p *Pipe) runDependencies() error {
+	order, err := stepOrder(p.ID, p.stepConfigured)
+	if err != nil {
+		return err
+	}
+	for _, id := range order {
+		if err := p.checkCanceled(); err != nil {
+			return err
+		}
+		id := id
+		if err := p.runPhase("pipe.step."+id, func() error { return p.runStep(id) }); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// runStep syncs objects of the step unless they are fresh
+func (p *Pipe) runStep(id string) error {
+	step, err := p.stepPipe(id)
+	if err != nil {
+		return err
+	}
+	service, err := step.Service()
+	if err != nil {
+		return err
+	}
+	syncedAt, fresh, err := stepSync(p.workspaceID, service.keyFor(id), dependencyFreshness)
+	if err != nil {
+		return err
+	}
+	if fresh {
+		p.addStepResult(&StepResult{Step: id, Result: stepSkipped, SyncedAt: syncedAt})
+		return nil
+	}
+	if syncedAt != nil {
+		// fetch what changed since the step was synced
+		step.lastSync = syncedAt
+	}
+
+	start := time.Now()
+	err = pipeSteps[id].fetch(step)
+	if err == nil {
+		err = pipeSteps[id].post(step)
+	}
+	if errors.Is(err, ErrNotSupported) {
+		p.addStepResult(&StepResult{Step: id, Result: stepUnsupported, DurationSeconds: time.Since(start).Seconds()})
+		return nil
+	}
+	return step.finishStep(id, start, err)
+}
+
+// stepPipe returns pipe that runs the step with service params and
+// status of p, projects are synced with the saved project selection
+func (p *Pipe) stepPipe(id string) (*Pipe, error) {
+	step := *p
+	step.ID = id
+	step.key = pipesKey(p.serviceID, id)
+	step.ProjectSelector = nil
+	if id == projectsPipeID {
+		projectsPipe, err := loadPipe(p.workspaceID, p.serviceID, projectsPipeID)
+		if err != nil {
+			return nil, err
+		}
+		if projectsPipe != nil {
+			step.ProjectSelector = projectsPipe.ProjectSelector
+		}
+	}
+	return &step, nil
+}
+
+// finishStep records result of the step, successful steps
+// are fresh for dependency_freshness
+func (p *Pipe) finishStep(id string, start time.Time, err error) error {
+	result := &StepResult{Step: id, Result: stepRan, DurationSeconds: time.Since(start).Seconds()}
+	if err != nil {
+		pipeErr := classifyError(err)
+		result.Result, result.Error, result.ErrorCode = stepFailed, pipeErr.Message, pipeErr.Code
+	}
+	p.addStepResult(result)
+	if err != nil || pipeSteps[id] == nil {
+		return err
+	}
+	if p.PipeStatus != nil && p.PipeStatus.Status == "error" {
+		// objects that failed are synced again by the next run
+		return nil
+	}
+
+	service, serviceErr := p.Service()
+	if serviceErr == nil {
+		_, serviceErr = db.ExecContext(p.context(), setStepSyncedSQL, p.workspaceID, service.keyFor(id))
+	}
+	if serviceErr != nil {
+		// the step runs again next time, which is only slower
+		pipeLogger(p).Warn("failed to save pipe step", Fields{"step": id, "error": serviceErr})
+	}
+	return nil
+}
+
+func (p *Pipe) addStepResult(result *StepResult) {
+	if p.PipeStatus != nil {
+		p.PipeStatus.Steps = append(p.PipeStatus.Steps, result)
+	}
+}
+
+// stepSync returns when the step was synced and whether it was within
+// freshness, steps are never fresh with 0 freshness
+func stepSync(workspaceID int, key string, freshness time.Duration) (*time.Time, bool, error) {
+	seconds := freshness.Seconds()
+	if freshness <= 0 {
+		seconds = -1
+	}
+	var syncedAt time.Time
+	var fresh bool
+	err := db.QueryRow(stepSyncSQL, workspaceID, key, seconds).Scan(&syncedAt, &fresh)
+	if err == sql.ErrNoRows {
+		return nil, false, nil
+	}
+	if err != nil {
+		return nil, false, err
+	}
+	return &syncedAt, fresh, nil
+}
+
+// resetPipeSteps makes steps of the service run again, e.g. after
+// project selection changes
+func resetPipeSteps(workspaceID int, serviceID string) error {
+	_, err := db.Exec(resetPipeStepsSQL, workspaceID, serviceID)
+	return err
+}
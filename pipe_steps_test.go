@@ -0,0 +1,80 @@
+package main
+
+import (
+	"errors"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestStepOrder(t *testing.T) {
+	configured := func(ids ...string) func(string) (bool, error) {
+		return func(id string) (bool, error) {
+			for _, configuredID := range ids {
+				if id == configuredID {
+					return true, nil
+				}
+			}
+			return false, nil
+		}
+	}
+	tests := []struct {
+		pipeID     string
+		configured []string
+		order      []string
+	}{
+		{usersPipeID, nil, nil},
+		{projectsPipeID, nil, []string{clientsPipeID}},
+		{tasksPipeId, nil, []string{clientsPipeID, projectsPipeID}},
+		{"todos", nil, []string{clientsPipeID, projectsPipeID}},
+		{todoPipeId, nil, []string{clientsPipeID, projectsPipeID}},
+		{timeEntriesPipeID, nil, nil},
+		{timeEntriesPipeID, []string{tasksPipeId}, []string{clientsPipeID, projectsPipeID, tasksPipeId}},
+		{timeEntriesPipeID, []string{projectsPipeID, tasksPipeId}, []string{clientsPipeID, projectsPipeID, tasksPipeId}},
+	}
+	for _, tt := range tests {
+		order, err := stepOrder(tt.pipeID, configured(tt.configured...))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(order) != len(tt.order) || (len(order) > 0 && !reflect.DeepEqual(order, tt.order)) {
+			t.Errorf("%s with %v configured: expected %v, got %v", tt.pipeID, tt.configured, tt.order, order)
+		}
+	}
+
+	failing := errors.New("unable to load pipe")
+	if _, err := stepOrder(timeEntriesPipeID, func(string) (bool, error) { return false, failing }); err != failing {
+		t.Errorf("expected error of configured check, got %v", err)
+	}
+}
+
+func TestStepOrderRejectsCycles(t *testing.T) {
+	defer func(steps map[string]*pipeStep) { pipeSteps = steps }(pipeSteps)
+	pipeSteps = map[string]*pipeStep{
+		clientsPipeID:  {dependsOn: []string{projectsPipeID}},
+		projectsPipeID: {dependsOn: []string{clientsPipeID}},
+		tasksPipeId:    {dependsOn: []string{projectsPipeID}},
+	}
+	if _, err := stepOrder(tasksPipeId, nil); err == nil {
+		t.Error("expected steps depending on each other to be rejected")
+	}
+}
+
+func TestFinishStepResults(t *testing.T) {
+	p := NewPipe(1, "asana", usersPipeID)
+	p.PipeStatus = NewPipeStatus(1, "asana", usersPipeID)
+
+	if err := p.finishStep(usersPipeID, time.Now(), nil); err != nil {
+		t.Fatal(err)
+	}
+	if err := p.finishStep(usersPipeID, time.Now(), ErrPipeCanceled); err != ErrPipeCanceled {
+		t.Errorf("expected step error to be returned, got %v", err)
+	}
+	steps := p.PipeStatus.Steps
+	if len(steps) != 2 {
+		t.Fatalf("expected 2 step results, got %d", len(steps))
+	}
+	if steps[0].Result != stepRan || steps[1].Result != stepFailed || steps[1].ErrorCode != errorCodeCanceled {
+		t.Errorf("expected ran and failed steps, got %+v %+v", steps[0], steps[1])
+	}
+}
@@ -3,7 +3,9 @@ package main
 import (
 	"encoding/json"
 	"reflect"
+	"strings"
 	"testing"
+	"time"
 )
 
 var (
@@ -46,6 +48,27 @@ func TestPipeEndSyncJSONParsingFail(t *testing.T) {
 	}
 }
 
+func TestPipeDirection(t *testing.T) {
+	tests := []struct {
+		pipeID, direction string
+		imports, exports  bool
+	}{
+		{projectsPipeID, "", true, false},
+		{timeEntriesPipeID, "", false, true},
+		{timeEntriesPipeID, directionImport, true, false},
+		{timeEntriesPipeID, directionExport, false, true},
+		{timeEntriesPipeID, directionBoth, true, true},
+	}
+	for _, tt := range tests {
+		p := NewPipe(workspaceID, TestServiceName, tt.pipeID)
+		p.Direction = tt.direction
+		if p.imports() != tt.imports || p.exports() != tt.exports {
+			t.Errorf("%s with direction %q: expected imports %v and exports %v, got %v and %v",
+				tt.pipeID, tt.direction, tt.imports, tt.exports, p.imports(), p.exports())
+		}
+	}
+}
+
 func TestGetPipesFromQueue_DoesNotReturnMultipleSameWorkspace(t *testing.T) {
 	db = connectDB(testDBConnString)
 	createAndEnqueuePipeFn := func(workspaceID int, serviceID, pipeID string, priority int) *Pipe {
@@ -119,3 +142,206 @@ func TestGetPipesFromQueue_DoesNotReturnMultipleSameWorkspace(t *testing.T) {
 		t.Error("should return pipe with workspace from retrievedWorkspace")
 	}
 }
+
+func TestServiceLimits(t *testing.T) {
+	defer func(v string) { serviceConcurrency = v }(serviceConcurrency)
+
+	serviceConcurrency = "asana=3, github=5"
+	b, err := serviceLimits()
+	if err != nil {
+		t.Fatalf("Unexpected error %v", err)
+	}
+	if string(b) != `{"asana":3,"github":5}` {
+		t.Errorf("serviceLimits() = %s", b)
+	}
+
+	for _, invalid := range []string{"asana", "asana=0", "asana=x"} {
+		serviceConcurrency = invalid
+		if _, err := serviceLimits(); err == nil {
+			t.Errorf("expected error for %q", invalid)
+		}
+	}
+}
+
+func TestQueueWeights(t *testing.T) {
+	defer func(v string) { serviceWeights = v }(serviceWeights)
+
+	serviceWeights = ""
+	if b, err := queueWeights(); err != nil || string(b) != `{}` {
+		t.Errorf("expected no weights, got %s %v", b, err)
+	}
+	serviceWeights = "asana=2"
+	if b, err := queueWeights(); err != nil || string(b) != `{"asana":2}` {
+		t.Errorf("queueWeights() = %s %v", b, err)
+	}
+	serviceWeights = "asana=-1"
+	if _, err := queueWeights(); err == nil || !strings.Contains(err.Error(), "service weight") {
+		t.Errorf("expected invalid weight error, got %v", err)
+	}
+}
+
+func TestGetPipesFromQueue_RespectsServiceConcurrency(t *testing.T) {
+	db = connectDB(testDBConnString)
+	defer func(v string) { serviceConcurrency = v }(serviceConcurrency)
+	serviceConcurrency = TestServiceName + "=2"
+
+	for _, wid := range []int{101, 102, 103} {
+		pipe := NewPipe(wid, TestServiceName, projectsPipeID)
+		pipe.Configured = true
+		data, err := json.Marshal(pipe)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err := db.Exec(insertPipesSQL, pipe.workspaceID, pipe.key, data); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := db.Exec(queuePipeAsFirstSQL, pipe.workspaceID, pipe.key); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	pipes, err := getPipesFromQueue()
+	if err != nil {
+		t.Fatal(err)
+	}
+	var count int
+	for _, pipe := range pipes {
+		if pipe.serviceID == TestServiceName {
+			count++
+		}
+	}
+	if count != 2 {
+		t.Errorf("should return 2 %s pipes, got %d", TestServiceName, count)
+	}
+}
+
+// queueTestPipes configures and queues pipes of the test service
+func queueTestPipes(t *testing.T, pipeID string, workspaceIDs ...int) {
+	for _, wid := range workspaceIDs {
+		pipe := NewPipe(wid, TestServiceName, pipeID)
+		pipe.Configured = true
+		data, err := json.Marshal(pipe)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err := db.Exec(insertPipesSQL, pipe.workspaceID, pipe.key, data); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := db.Exec(queuePipeAsFirstSQL, pipe.workspaceID, pipe.key); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func TestStartQueuedPipe_RespectsServiceConcurrency(t *testing.T) {
+	db = connectDB(testDBConnString)
+	defer func(v string) { serviceConcurrency = v }(serviceConcurrency)
+	serviceConcurrency = TestServiceName + "=1"
+	queueTestPipes(t, projectsPipeID, 201, 202)
+
+	// pipes locked in batches do not count until they are started
+	first, err := getPipesFromQueue()
+	if err != nil {
+		t.Fatal(err)
+	}
+	second, err := getPipesFromQueue()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(first) != 1 || len(second) != 1 {
+		t.Fatalf("expected a pipe for each batch, got %d and %d", len(first), len(second))
+	}
+
+	started, err := startQueuedPipe(first[0])
+	if err != nil || !started {
+		t.Fatalf("expected first pipe to start, got %v %v", started, err)
+	}
+	started, err = startQueuedPipe(second[0])
+	if err != nil || started {
+		t.Fatalf("expected second pipe to wait for the limit, got %v %v", started, err)
+	}
+	if err := unlockQueuedPipe(second[0]); err != nil {
+		t.Fatal(err)
+	}
+	if pipes, err := getPipesFromQueue(); err != nil || len(pipes) != 0 {
+		t.Fatalf("expected service at its limit to get no pipes, got %d %v", len(pipes), err)
+	}
+
+	if err := setQueuedPipeSynced(first[0]); err != nil {
+		t.Fatal(err)
+	}
+	pipes, err := getPipesFromQueue()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(pipes) != 1 || pipes[0].workspaceID != second[0].workspaceID {
+		t.Fatalf("expected requeued pipe after the run finished, got %d pipes", len(pipes))
+	}
+	if started, err := startQueuedPipe(pipes[0]); err != nil || !started {
+		t.Errorf("expected requeued pipe to start, got %v %v", started, err)
+	}
+	setQueuedPipeSynced(pipes[0])
+}
+
+func TestGetPipesFromQueue_SkipsStaleLocks(t *testing.T) {
+	db = connectDB(testDBConnString)
+	defer func(v string) { serviceConcurrency = v }(serviceConcurrency)
+	serviceConcurrency = TestServiceName + "=2"
+	queueTestPipes(t, projectsPipeID, 203)
+
+	pipes, err := getPipesFromQueue()
+	if err != nil || len(pipes) != 1 {
+		t.Fatalf("expected a pipe, got %d %v", len(pipes), err)
+	}
+	if started, err := startQueuedPipe(pipes[0]); err != nil || !started {
+		t.Fatalf("expected pipe to start, got %v %v", started, err)
+	}
+	// worker of the run crashed
+	_, err = db.Exec(`UPDATE queued_pipes
+		SET locked_at = locked_at - $3::float8 * interval '1 second',
+		started_at = started_at - $3::float8 * interval '1 second'
+		WHERE workspace_id = $1 AND key = $2 AND synced_at IS NULL`,
+		pipes[0].workspaceID, pipes[0].key, (queueStaleAfter + time.Minute).Seconds())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	queueTestPipes(t, usersPipeID, 203)
+	queueTestPipes(t, projectsPipeID, 204)
+	pipes, err = getPipesFromQueue()
+	if err != nil {
+		t.Fatal(err)
+	}
+	workspaces := map[int]bool{}
+	for _, pipe := range pipes {
+		workspaces[pipe.workspaceID] = true
+		if started, err := startQueuedPipe(pipe); err != nil || !started {
+			t.Errorf("expected pipe to start besides the stale run, got %v %v", started, err)
+		}
+		setQueuedPipeSynced(pipe)
+	}
+	if len(pipes) != 2 || !workspaces[203] || !workspaces[204] {
+		t.Errorf("expected stale lock to block neither workspace nor service, got %d pipes", len(pipes))
+	}
+}
+
+func TestRunQueuedPipes_RequeuesPipesAfterStop(t *testing.T) {
+	db = connectDB(testDBConnString)
+	queueTestPipes(t, projectsPipeID, 205)
+
+	pipes, err := getPipesFromQueue()
+	if err != nil || len(pipes) != 1 {
+		t.Fatalf("expected a pipe, got %d %v", len(pipes), err)
+	}
+	stop := make(chan struct{})
+	close(stop)
+	if runQueuedPipes(1, pipes, stop) {
+		t.Error("expected stopped worker to leave the batch")
+	}
+
+	pipes, err = getPipesFromQueue()
+	if err != nil || len(pipes) != 1 || pipes[0].workspaceID != 205 {
+		t.Fatalf("expected pipe not started to be requeued, got %d %v", len(pipes), err)
+	}
+	setQueuedPipeSynced(pipes[0])
+}
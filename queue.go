@@ -0,0 +1,212 @@
+package main
+
+import (
+	"database/sql"
+	"strings"
+	"time"
+)
+
+// QueueEntry is a row of queued_pipes, exposed by the admin API
+type QueueEntry struct {
+	ID          int64      `json:"id"`
+	WorkspaceID int        `json:"workspace_id"`
+	Key         string     `json:"key"`
+	Service     string     `json:"service"`
+	Pipe        string     `json:"pipe"`
+	State       string     `json:"state"`
+	Priority    int        `json:"priority"`
+	Manual      bool       `json:"manual"`
+	CreatedAt   time.Time  `json:"created_at"`
+	LockedAt    *time.Time `json:"locked_at,omitempty"`
+	SyncedAt    *time.Time `json:"synced_at,omitempty"`
+}
+
+// queueFilter selects entries listed by the admin API,
+// zero values match everything
+type queueFilter struct {
+	state       string
+	workspaceID int
+	service     string
+	olderThan   time.Duration // since the entry entered its current state
+	limit       int
+}
+
+const (
+	queueStateQueued = "queued"
+	queueStateLocked = "locked"
+	queueStateSynced = "synced"
+
+	defaultQueueListLimit = 100
+	maxQueueListLimit     = 1000
+
+	queueEntryColumns = `id, workspace_id, key, priority, manual, created_at, locked_at, synced_at`
+
+	selectQueueEntriesSQL = `SELECT ` + queueEntryColumns + `
+	FROM queued_pipes
+	WHERE ($1 = ''
+		OR ($1 = 'queued' AND locked_at IS NULL AND synced_at IS NULL)
+		OR ($1 = 'locked' AND locked_at IS NOT NULL AND synced_at IS NULL)
+		OR ($1 = 'synced' AND synced_at IS NOT NULL))
+	AND ($2 = 0 OR workspace_id = $2)
+	AND ($3 = '' OR split_part(key, ':', 1) = $3)
+	AND coalesce(synced_at, locked_at, created_at) <= now() - $4::float8 * interval '1 second'
+	ORDER BY created_at DESC
+	LIMIT $5`
+
+	singleQueueEntrySQL = `SELECT ` + queueEntryColumns + `
+	FROM queued_pipes
+	WHERE id = $1`
+
+	// pendingQueueEntrySQL selects the entry queue_pipe_as_first
+	// inserted or bumped, or the entry that is still running
+	pendingQueueEntrySQL = `SELECT ` + queueEntryColumns + `
+	FROM queued_pipes
+	WHERE workspace_id = $1
+	AND key = $2
+	AND synced_at IS NULL
+	ORDER BY locked_at DESC NULLS LAST
+	LIMIT 1`
+
+	cancelQueueEntrySQL = `DELETE FROM queued_pipes
+	WHERE id = $1
+	AND locked_at IS NULL
+	AND synced_at IS NULL`
+
+	// unlockQueueEntriesSQL puts locked entries back to queue, entries
+	// that are queued again already are deleted to keep the queue unique
+	unlockQueueEntriesSQL = `WITH stale AS (
+		SELECT id, workspace_id, key
+		FROM queued_pipes
+		WHERE locked_at IS NOT NULL
+		AND synced_at IS NULL
+		AND ($1 = 0 OR id = $1)
+		AND locked_at <= now() - $2::float8 * interval '1 second'
+		FOR UPDATE
+	),
+	duplicate AS (
+		DELETE FROM queued_pipes q
+		USING stale
+		WHERE q.id = stale.id
+		AND EXISTS (
+			SELECT 1 FROM queued_pipes p
+			WHERE p.workspace_id = stale.workspace_id
+			AND p.key = stale.key
+			AND p.locked_at IS NULL
+			AND p.synced_at IS NULL
+		)
+		RETURNING q.id
+	),
+	unlocked AS (
+		UPDATE queued_pipes
+		SET locked_at = NULL, started_at = NULL
+		FROM stale
+		WHERE queued_pipes.id = stale.id
+		AND stale.id NOT IN (SELECT id FROM duplicate)
+		RETURNING queued_pipes.id
+	)
+	SELECT id FROM duplicate
+	UNION ALL
+	SELECT id FROM unlocked`
+)
+
+type rowScanner interface {
+	Scan(dest ...interface{}) error
+}
+
+func scanQueueEntry(row rowScanner) (*QueueEntry, error) {
+	var entry QueueEntry
+	var lockedAt, syncedAt sql.NullTime
+	err := row.Scan(&entry.ID, &entry.WorkspaceID, &entry.Key, &entry.Priority,
+		&entry.Manual, &entry.CreatedAt, &lockedAt, &syncedAt)
+	if err != nil {
+		return nil, err
+	}
+	parts := strings.SplitN(entry.Key, ":", 2)
+	entry.Service = parts[0]
+	if len(parts) == 2 {
+		entry.Pipe = parts[1]
+	}
+	entry.State = queueStateQueued
+	if lockedAt.Valid {
+		entry.LockedAt = &lockedAt.Time
+		entry.State = queueStateLocked
+	}
+	if syncedAt.Valid {
+		entry.SyncedAt = &syncedAt.Time
+		entry.State = queueStateSynced
+	}
+	return &entry, nil
+}
+
+func listQueueEntries(filter queueFilter) ([]*QueueEntry, error) {
+	if filter.limit <= 0 {
+		filter.limit = defaultQueueListLimit
+	}
+	rows, err := db.Query(selectQueueEntriesSQL, filter.state, filter.workspaceID,
+		filter.service, filter.olderThan.Seconds(), filter.limit)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	entries := []*QueueEntry{}
+	for rows.Next() {
+		entry, err := scanQueueEntry(rows)
+		if err != nil {
+			return nil, err
+		}
+		entries = append(entries, entry)
+	}
+	return entries, rows.Err()
+}
+
+func loadQueueEntry(id int64) (*QueueEntry, error) {
+	entry, err := scanQueueEntry(db.QueryRow(singleQueueEntrySQL, id))
+	if err == sql.ErrNoRows {
+		return nil, nil
+	}
+	return entry, err
+}
+
+// requeueQueueEntry queues pipe of the entry as first, queued entries
+// get the highest priority and synced entries are queued again
+func requeueQueueEntry(entry *QueueEntry) (*QueueEntry, error) {
+	if _, err := db.Exec(queuePipeAsFirstSQL, entry.WorkspaceID, entry.Key); err != nil {
+		return nil, err
+	}
+	pending, err := scanQueueEntry(db.QueryRow(pendingQueueEntrySQL, entry.WorkspaceID, entry.Key))
+	if err == sql.ErrNoRows {
+		return nil, nil
+	}
+	return pending, err
+}
+
+// cancelQueueEntry removes entry that is not picked by a worker yet
+func cancelQueueEntry(id int64) (bool, error) {
+	res, err := db.Exec(cancelQueueEntrySQL, id)
+	if err != nil {
+		return false, err
+	}
+	n, err := res.RowsAffected()
+	return n > 0, err
+}
+
+// unlockQueueEntries puts entries locked for at least lockedFor back
+// to queue, id 0 unlocks all of them
+func unlockQueueEntries(id int64, lockedFor time.Duration) ([]int64, error) {
+	rows, err := db.Query(unlockQueueEntriesSQL, id, lockedFor.Seconds())
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	ids := []int64{}
+	for rows.Next() {
+		var id int64
+		if err := rows.Scan(&id); err != nil {
+			return nil, err
+		}
+		ids = append(ids, id)
+	}
+	return ids, rows.Err()
+}
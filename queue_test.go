@@ -0,0 +1,118 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+	"time"
+)
+
+func TestParseQueueFilter(t *testing.T) {
+	query, _ := url.ParseQuery("state=locked&workspace_id=7&service=asana&older_than=30m&limit=5")
+	filter, invalid := parseQueueFilter(query)
+	if invalid != nil {
+		t.Fatalf("unexpected validation error %v", invalid)
+	}
+	expected := queueFilter{state: queueStateLocked, workspaceID: 7, service: "asana", olderThan: 30 * time.Minute, limit: 5}
+	if filter != expected {
+		t.Errorf("expected %+v, got %+v", expected, filter)
+	}
+
+	for query, field := range map[string]string{
+		"state=running":   "state",
+		"workspace_id=x":  "workspace_id",
+		"service=../etc":  "service",
+		"older_than=soon": "older_than",
+		"limit=100000":    "limit",
+	} {
+		values, _ := url.ParseQuery(query)
+		_, invalid := parseQueueFilter(values)
+		if invalid == nil || invalid.Field != field {
+			t.Errorf("%s: expected invalid %s, got %v", query, field, invalid)
+		}
+	}
+}
+
+func TestAdminAuth(t *testing.T) {
+	defer func(token string) { adminToken = token }(adminToken)
+	handler := withAdminAuth(handleRequest(func(req Request) Response { return ok(nil) }))
+
+	get := func(authorization string) int {
+		r := httptest.NewRequest("GET", "/api/v1/admin/queue", nil)
+		if authorization != "" {
+			r.Header.Set("Authorization", authorization)
+		}
+		w := httptest.NewRecorder()
+		handler(w, r)
+		return w.Code
+	}
+
+	adminToken = ""
+	if code := get("Bearer "); code != http.StatusUnauthorized {
+		t.Errorf("expected admin API to be disabled without token, got %d", code)
+	}
+	adminToken = "secret"
+	for _, authorization := range []string{"", "Bearer wrong", "Basic c2VjcmV0OmFwaV90b2tlbg=="} {
+		if code := get(authorization); code != http.StatusUnauthorized {
+			t.Errorf("%q: expected 401, got %d", authorization, code)
+		}
+	}
+	if code := get("Bearer secret"); code != http.StatusOK {
+		t.Errorf("expected admin token to be accepted, got %d", code)
+	}
+}
+
+func TestAdminQueueOperations(t *testing.T) {
+	db = connectDB(testDBConnString)
+	wid := 201
+	pipe := NewPipe(wid, TestServiceName, projectsPipeID)
+	data, err := json.Marshal(pipe)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := db.Exec(insertPipesSQL, pipe.workspaceID, pipe.key, data); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := db.Exec(queuePipeAsFirstSQL, pipe.workspaceID, pipe.key); err != nil {
+		t.Fatal(err)
+	}
+
+	entries, err := listQueueEntries(queueFilter{workspaceID: wid, state: queueStateQueued})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(entries) != 1 || entries[0].Key != pipe.key || entries[0].Service != TestServiceName {
+		t.Fatalf("expected queued entry of the pipe, got %+v", entries)
+	}
+	entry := entries[0]
+
+	if _, err := db.Exec(`UPDATE queued_pipes SET locked_at = now() - interval '2 hours' WHERE id = $1`, entry.ID); err != nil {
+		t.Fatal(err)
+	}
+	if canceled, err := cancelQueueEntry(entry.ID); err != nil || canceled {
+		t.Errorf("expected locked entry not to be canceled, got %t %v", canceled, err)
+	}
+	ids, err := unlockQueueEntries(0, time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(ids) != 1 || ids[0] != entry.ID {
+		t.Errorf("expected stale entry to be unlocked, got %v", ids)
+	}
+
+	requeued, err := requeueQueueEntry(entry)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if requeued == nil || requeued.ID != entry.ID || !requeued.Manual || requeued.State != queueStateQueued {
+		t.Errorf("expected entry to be bumped, got %+v", requeued)
+	}
+	if canceled, err := cancelQueueEntry(entry.ID); err != nil || !canceled {
+		t.Errorf("expected queued entry to be canceled, got %t %v", canceled, err)
+	}
+	if entry, err := loadQueueEntry(entry.ID); err != nil || entry != nil {
+		t.Errorf("expected canceled entry to be removed, got %+v %v", entry, err)
+	}
+}
@@ -0,0 +1,378 @@
+package main
+
+import (
+	"context"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"go.opentelemetry.io/otel/api/trace"
+)
+
+const (
+	// maxRateLimitRetries is how many times a rate limited request is retried
+	maxRateLimitRetries = 5
+	// defaultRateLimitPause is used when provider does not say when to retry
+	defaultRateLimitPause = 30 * time.Second
+	// maxRateLimitPause caps how long a run is paused by a single response
+	maxRateLimitPause = time.Hour
+	// rateLimiterIdleTime is how long unused limiters are kept
+	rateLimiterIdleTime = 10 * time.Minute
+)
+
+type rateLimit struct {
+	rate  float64 // requests per second
+	burst int
+}
+
+var (
+	// authorizationRateLimits apply to each authorization (service and workspace),
+	// values follow limits documented by providers for a single token or account
+	authorizationRateLimits = map[string]rateLimit{
+		"asana":      {rate: 150.0 / 60, burst: 50},
+		"github":     {rate: 5000.0 / 3600, burst: 100},
+		"basecamp":   {rate: 500.0 / 10, burst: 100},
+		"teamweek":   {rate: 5, burst: 20},
+		"freshbooks": {rate: 2, burst: 10},
+	}
+	// serviceRateLimits are shared by all workspaces of the service,
+	// they keep our OAuth application within provider wide quotas
+	serviceRateLimits = map[string]rateLimit{
+		"asana":  {rate: 50, burst: 100},
+		"github": {rate: 20, burst: 100},
+	}
+)
+
+// TokenBucket allows rate requests per second with bursts up to burst,
+// reservations may take it below zero so that waiting callers queue up.
+type TokenBucket struct {
+	mu          sync.Mutex
+	rate        float64
+	burst       float64
+	tokens      float64
+	updatedAt   time.Time
+	pausedUntil time.Time
+}
+
+func NewTokenBucket(limit rateLimit) *TokenBucket {
+	return &TokenBucket{
+		rate:      limit.rate,
+		burst:     float64(limit.burst),
+		tokens:    float64(limit.burst),
+		updatedAt: time.Now(),
+	}
+}
+
+// reserve takes a token and returns how long to wait before using it
+func (b *TokenBucket) reserve(now time.Time) time.Duration {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	b.refill(now)
+	b.tokens--
+
+	var wait time.Duration
+	if b.tokens < 0 {
+		wait = time.Duration(-b.tokens / b.rate * float64(time.Second))
+	}
+	if paused := b.pausedUntil.Sub(now); paused > wait {
+		wait = paused
+	}
+	return wait
+}
+
+// allow takes a token if one is available, otherwise it returns
+// how long until the next token is available
+func (b *TokenBucket) allow(now time.Time) (bool, time.Duration) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	b.refill(now)
+	if b.tokens >= 1 {
+		b.tokens--
+		return true, 0
+	}
+	return false, time.Duration((1 - b.tokens) / b.rate * float64(time.Second))
+}
+
+// unreserve gives back token of reservation that was not used
+func (b *TokenBucket) unreserve() {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.tokens++
+	if b.tokens > b.burst {
+		b.tokens = b.burst
+	}
+}
+
+// full reports if the bucket has refilled, full buckets can be dropped
+func (b *TokenBucket) full(now time.Time) bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.refill(now)
+	return b.tokens >= b.burst && !b.pausedUntil.After(now)
+}
+
+func (b *TokenBucket) refill(now time.Time) {
+	b.tokens += now.Sub(b.updatedAt).Seconds() * b.rate
+	if b.tokens > b.burst {
+		b.tokens = b.burst
+	}
+	b.updatedAt = now
+}
+
+// pause blocks reservations until given time and drains the bucket
+func (b *TokenBucket) pause(until time.Time) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if until.After(b.pausedUntil) {
+		b.pausedUntil = until
+	}
+	if b.tokens > 0 {
+		b.tokens = 0
+	}
+}
+
+// RateLimiter throttles requests of a single authorization, it combines
+// the authorization bucket with bucket shared by the whole service.
+type RateLimiter struct {
+	authorization *TokenBucket
+	service       *TokenBucket
+
+	mu        sync.Mutex
+	throttled time.Duration
+	usedAt    time.Time
+}
+
+// wait blocks until a request may be sent, when ctx is done first
+// the reservation is given back and error of ctx is returned
+func (l *RateLimiter) wait(ctx context.Context) error {
+	now := time.Now()
+	l.use(now)
+	wait := l.authorization.reserve(now)
+	if l.service != nil {
+		if serviceWait := l.service.reserve(now); serviceWait > wait {
+			wait = serviceWait
+		}
+	}
+	if wait <= 0 {
+		return nil
+	}
+
+	timer := time.NewTimer(wait)
+	defer timer.Stop()
+	select {
+	case <-timer.C:
+	case <-ctx.Done():
+		l.authorization.unreserve()
+		if l.service != nil {
+			l.service.unreserve()
+		}
+		wait = time.Since(now)
+	}
+	l.mu.Lock()
+	l.throttled += wait
+	l.mu.Unlock()
+	return ctx.Err()
+}
+
+func (l *RateLimiter) use(now time.Time) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if now.After(l.usedAt) {
+		l.usedAt = now
+	}
+}
+
+// idle reports if the limiter was not used recently and has refilled,
+// idle limiters can be dropped as new ones behave the same
+func (l *RateLimiter) idle(now time.Time) bool {
+	l.mu.Lock()
+	usedAt := l.usedAt
+	l.mu.Unlock()
+	return now.Sub(usedAt) > rateLimiterIdleTime && l.authorization.full(now)
+}
+
+// throttledTime returns total time requests of this limiter waited
+func (l *RateLimiter) throttledTime() time.Duration {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.throttled
+}
+
+var rateLimiters = struct {
+	sync.Mutex
+	authorizations map[string]*RateLimiter
+	services       map[string]*TokenBucket
+	evictedAt      time.Time
+}{
+	authorizations: make(map[string]*RateLimiter),
+	services:       make(map[string]*TokenBucket),
+}
+
+func rateLimiterFor(serviceID string, workspaceID int) *RateLimiter {
+	rateLimiters.Lock()
+	defer rateLimiters.Unlock()
+
+	now := time.Now()
+	if now.Sub(rateLimiters.evictedAt) > rateLimiterIdleTime {
+		evictRateLimiters(now)
+	}
+
+	key := serviceID + ":" + strconv.Itoa(workspaceID)
+	if limiter, found := rateLimiters.authorizations[key]; found {
+		limiter.use(now)
+		return limiter
+	}
+
+	limit, found := authorizationRateLimits[serviceID]
+	if !found {
+		limit = rateLimit{rate: 10, burst: 10}
+	}
+	limiter := &RateLimiter{authorization: NewTokenBucket(limit), usedAt: now}
+	if limit, found := serviceRateLimits[serviceID]; found {
+		if _, exists := rateLimiters.services[serviceID]; !exists {
+			rateLimiters.services[serviceID] = NewTokenBucket(limit)
+		}
+		limiter.service = rateLimiters.services[serviceID]
+	}
+	rateLimiters.authorizations[key] = limiter
+	return limiter
+}
+
+// evictRateLimiters drops idle limiters of authorizations,
+// rateLimiters must be locked
+func evictRateLimiters(now time.Time) {
+	for key, limiter := range rateLimiters.authorizations {
+		if limiter.idle(now) {
+			delete(rateLimiters.authorizations, key)
+		}
+	}
+	rateLimiters.evictedAt = now
+}
+
+// rateLimitedClient returns HTTP client that throttles requests of the service
+func rateLimitedClient(s Service, next http.RoundTripper) *http.Client {
+	return rateLimitedClientContext(s.context(), s, next)
+}
+
+// rateLimitedClientContext returns rate limited client for calls of
+// parallelFetch, requests of client libraries without context support
+// are canceled with ctx
+func rateLimitedClientContext(ctx context.Context, s Service, next http.RoundTripper) *http.Client {
+	return &http.Client{
+		Transport: &rateLimitedTransport{
+			service: s.Name(),
+			limiter: rateLimiterFor(s.Name(), s.WorkspaceID()),
+			next:    tracedTransport(next),
+			parent:  ctx,
+		},
+	}
+}
+
+type rateLimitedTransport struct {
+	service string
+	limiter *RateLimiter
+	next    http.RoundTripper
+	parent  context.Context // context of the pipe run or fetch, client libraries don't pass it
+}
+
+// RoundTrip waits for the rate limiter and when provider responds that
+// limit is exceeded pauses the limiter and retries instead of failing.
+func (t *rateLimitedTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	if t.parent != nil && req.Context() == context.Background() {
+		req = req.WithContext(t.parent)
+	} else if t.parent != nil && !hasSpan(req.Context()) {
+		req = req.WithContext(trace.ContextWithSpan(req.Context(), trace.SpanFromContext(t.parent)))
+	}
+	for attempt := 0; ; attempt++ {
+		// provider requests are safe points to stop canceled runs
+		if err := checkCanceled(t.parent); err != nil {
+			return nil, err
+		}
+		if err := t.limiter.wait(req.Context()); err != nil {
+			return nil, err
+		}
+		start := time.Now()
+		resp, err := t.next.RoundTrip(req)
+		if err != nil {
+			providerRequestDuration.WithLabelValues(t.service, "0").Observe(time.Since(start).Seconds())
+			return nil, err
+		}
+		providerRequestDuration.WithLabelValues(t.service, strconv.Itoa(resp.StatusCode)).Observe(time.Since(start).Seconds())
+
+		retryAt, exhausted := rateLimitReset(resp, time.Now())
+		if exhausted {
+			t.limiter.authorization.pause(retryAt)
+		}
+		rateLimited := isRateLimited(resp)
+		if !rateLimited || attempt >= maxRateLimitRetries || (req.Body != nil && req.GetBody == nil) {
+			// turn failures into classified errors, so pipe statuses tell
+			// users whether to reconnect or to wait
+			if pipeErr := providerResponseError(t.service, resp, rateLimited); pipeErr != nil {
+				io.Copy(ioutil.Discard, resp.Body)
+				resp.Body.Close()
+				return nil, pipeErr
+			}
+			return resp, nil
+		}
+
+		io.Copy(ioutil.Discard, resp.Body)
+		resp.Body.Close()
+		if req.Body != nil {
+			body, err := req.GetBody()
+			if err != nil {
+				return nil, err
+			}
+			req = req.Clone(req.Context())
+			req.Body = body
+		}
+	}
+}
+
+func isRateLimited(resp *http.Response) bool {
+	if resp.StatusCode == http.StatusTooManyRequests {
+		return true
+	}
+	return resp.StatusCode == http.StatusForbidden && resp.Header.Get("X-RateLimit-Remaining") == "0"
+}
+
+// rateLimitReset returns time when requests can be made again,
+// if response says the rate limit is used up.
+func rateLimitReset(resp *http.Response, now time.Time) (time.Time, bool) {
+	retryAt, found := retryAfter(resp, now)
+	if !found && resp.Header.Get("X-RateLimit-Remaining") == "0" {
+		if reset, err := strconv.ParseInt(resp.Header.Get("X-RateLimit-Reset"), 10, 64); err == nil {
+			retryAt = time.Unix(reset, 0)
+		}
+	}
+
+	if retryAt.IsZero() {
+		if resp.StatusCode != http.StatusTooManyRequests {
+			return retryAt, false
+		}
+		retryAt = now.Add(defaultRateLimitPause)
+	}
+	if retryAt.Sub(now) > maxRateLimitPause {
+		retryAt = now.Add(maxRateLimitPause)
+	}
+	return retryAt, true
+}
+
+// retryAfter returns time of Retry-After header, in seconds or HTTP date
+func retryAfter(resp *http.Response, now time.Time) (time.Time, bool) {
+	value := resp.Header.Get("Retry-After")
+	if value == "" {
+		return time.Time{}, false
+	}
+	if seconds, err := strconv.Atoi(value); err == nil {
+		return now.Add(time.Duration(seconds) * time.Second), true
+	}
+	if date, err := http.ParseTime(value); err == nil {
+		return date, true
+	}
+	return time.Time{}, false
+}
@@ -0,0 +1,135 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"testing"
+	"time"
+)
+
+func TestTokenBucketReserve(t *testing.T) {
+	now := time.Now()
+	bucket := NewTokenBucket(rateLimit{rate: 10, burst: 2})
+	bucket.updatedAt = now
+
+	for i := 0; i < 2; i++ {
+		if wait := bucket.reserve(now); wait != 0 {
+			t.Fatalf("expected burst request %d not to wait, got %s", i, wait)
+		}
+	}
+	if wait := bucket.reserve(now); wait != 100*time.Millisecond {
+		t.Fatalf("expected to wait 100ms, got %s", wait)
+	}
+
+	bucket.pause(now.Add(time.Minute))
+	if wait := bucket.reserve(now.Add(time.Second)); wait != 59*time.Second {
+		t.Fatalf("expected paused bucket to wait 59s, got %s", wait)
+	}
+}
+
+func TestRateLimiterWaitCanceled(t *testing.T) {
+	limiter := &RateLimiter{authorization: NewTokenBucket(rateLimit{rate: 1, burst: 1})}
+	limiter.authorization.pause(time.Now().Add(time.Hour))
+
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+	defer cancel()
+	start := time.Now()
+	if err := limiter.wait(ctx); err != context.DeadlineExceeded {
+		t.Errorf("expected wait to end with its context, got %v", err)
+	}
+	if waited := time.Since(start); waited > time.Second {
+		t.Errorf("expected wait to stop when context is done, waited %s", waited)
+	}
+	if tokens := limiter.authorization.tokens; tokens < 0 {
+		t.Errorf("expected reservation to be given back, got %v tokens", tokens)
+	}
+}
+
+func TestEvictRateLimiters(t *testing.T) {
+	rateLimiters.Lock()
+	defer rateLimiters.Unlock()
+
+	now := time.Now()
+	newLimiter := func(usedAt time.Time) *RateLimiter {
+		bucket := NewTokenBucket(rateLimit{rate: 1, burst: 1})
+		bucket.updatedAt = now
+		return &RateLimiter{authorization: bucket, usedAt: usedAt}
+	}
+	idle, used, paused := newLimiter(now.Add(-time.Hour)), newLimiter(now), newLimiter(now.Add(-time.Hour))
+	paused.authorization.pause(now.Add(time.Minute))
+	rateLimiters.authorizations["test:1"] = idle
+	rateLimiters.authorizations["test:2"] = used
+	rateLimiters.authorizations["test:3"] = paused
+	defer func() {
+		delete(rateLimiters.authorizations, "test:2")
+		delete(rateLimiters.authorizations, "test:3")
+	}()
+
+	evictRateLimiters(now)
+	if _, found := rateLimiters.authorizations["test:1"]; found {
+		t.Error("expected idle limiter to be evicted")
+	}
+	if rateLimiters.authorizations["test:2"] != used || rateLimiters.authorizations["test:3"] != paused {
+		t.Error("expected used and paused limiters to be kept")
+	}
+}
+
+func TestRateLimitReset(t *testing.T) {
+	now := time.Unix(1500000000, 0)
+	cases := []struct {
+		status    int
+		header    http.Header
+		exhausted bool
+		retryAt   time.Time
+	}{
+		{http.StatusOK, http.Header{}, false, time.Time{}},
+		{http.StatusTooManyRequests, http.Header{}, true, now.Add(defaultRateLimitPause)},
+		{http.StatusTooManyRequests, http.Header{"Retry-After": {"20"}}, true, now.Add(20 * time.Second)},
+		{http.StatusTooManyRequests, http.Header{"Retry-After": {"86400"}}, true, now.Add(maxRateLimitPause)},
+		{http.StatusOK, http.Header{
+			"X-Ratelimit-Remaining": {"0"},
+			"X-Ratelimit-Reset":     {strconv.FormatInt(now.Unix()+60, 10)},
+		}, true, now.Add(time.Minute)},
+		{http.StatusOK, http.Header{
+			"X-Ratelimit-Remaining": {"10"},
+			"X-Ratelimit-Reset":     {strconv.FormatInt(now.Unix()+60, 10)},
+		}, false, time.Time{}},
+	}
+	for i, c := range cases {
+		retryAt, exhausted := rateLimitReset(&http.Response{StatusCode: c.status, Header: c.header}, now)
+		if exhausted != c.exhausted || !retryAt.Equal(c.retryAt) {
+			t.Errorf("case %d: expected %v %s, got %v %s", i, c.exhausted, c.retryAt, exhausted, retryAt)
+		}
+	}
+}
+
+func TestRateLimitedTransportRetries(t *testing.T) {
+	var requests int
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests++
+		if requests == 1 {
+			w.Header().Set("Retry-After", "0")
+			w.WriteHeader(http.StatusTooManyRequests)
+			return
+		}
+		w.WriteHeader(http.StatusOK)
+	}))
+	defer ts.Close()
+
+	limiter := &RateLimiter{authorization: NewTokenBucket(rateLimit{rate: 100, burst: 10})}
+	client := &http.Client{Transport: &rateLimitedTransport{limiter: limiter, next: http.DefaultTransport}}
+
+	resp, err := client.Get(ts.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("expected rate limited request to be retried, got status %d", resp.StatusCode)
+	}
+	if requests != 2 {
+		t.Fatalf("expected 2 requests, got %d", requests)
+	}
+}
@@ -0,0 +1,128 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"regexp"
+	"strings"
+)
+
+const redacted = "[REDACTED]"
+
+var (
+	// key=value and "key": "value" pairs of sensitive keys in free text
+	sensitivePairPattern = regexp.MustCompile(
+		`(?i)("?\b(?:[a-z_]*token|code|[a-z_]*secret|password|oauth_verifier|authorization)"?\s*[:=]\s*"?)([^"&\s,;}]+)`)
+	// credentials of Authorization header values
+	authSchemePattern = regexp.MustCompile(`(?i)\b(basic|bearer)\s+[a-z0-9+/=._~-]{8,}`)
+	emailPattern      = regexp.MustCompile(`[a-zA-Z0-9._%+-]+@[a-zA-Z0-9.-]+\.[a-zA-Z]{2,}`)
+)
+
+// isSensitiveKey reports if value of JSON key must not be logged
+func isSensitiveKey(key string) bool {
+	key = strings.ToLower(key)
+	switch key {
+	case "code", "token", "authorization", "oauth_verifier", "password":
+		return true
+	}
+	return strings.HasSuffix(key, "_token") ||
+		strings.Contains(key, "secret") ||
+		strings.Contains(key, "email")
+}
+
+// redact masks tokens, codes, secrets and emails in s,
+// JSON documents are redacted by their keys
+func redact(s string) string {
+	trimmed := strings.TrimSpace(s)
+	if strings.HasPrefix(trimmed, "{") || strings.HasPrefix(trimmed, "[") {
+		var document interface{}
+		decoder := json.NewDecoder(strings.NewReader(trimmed))
+		decoder.UseNumber()
+		if err := decoder.Decode(&document); err == nil && !decoder.More() {
+			var buf bytes.Buffer
+			encoder := json.NewEncoder(&buf)
+			encoder.SetEscapeHTML(false)
+			if err := encoder.Encode(redactJSON(document)); err == nil {
+				return strings.TrimSpace(buf.String())
+			}
+		}
+	}
+	return redactText(s)
+}
+
+func redactText(s string) string {
+	s = authSchemePattern.ReplaceAllString(s, "${1} "+redacted)
+	s = sensitivePairPattern.ReplaceAllString(s, "${1}"+redacted)
+	return emailPattern.ReplaceAllString(s, redacted)
+}
+
+func redactJSON(v interface{}) interface{} {
+	switch value := v.(type) {
+	case map[string]interface{}:
+		for k, item := range value {
+			if isSensitiveKey(k) {
+				value[k] = redacted
+			} else {
+				value[k] = redactJSON(item)
+			}
+		}
+		return value
+	case []interface{}:
+		for i, item := range value {
+			value[i] = redactJSON(item)
+		}
+		return value
+	case string:
+		return redactText(value)
+	default:
+		return v
+	}
+}
+
+// redactValue redacts log field values that may contain secrets
+func redactValue(v interface{}) interface{} {
+	switch value := v.(type) {
+	case nil:
+		return nil
+	case error:
+		return redact(value.Error())
+	case string:
+		return redact(value)
+	case []byte:
+		return redact(string(value))
+	case fmt.Stringer:
+		return redact(value.String())
+	default:
+		return v
+	}
+}
+
+// redactedError is err with redacted message,
+// errors.Is and errors.As still match the original error
+type redactedError struct {
+	err     error
+	message string
+}
+
+func (e *redactedError) Error() string { return e.message }
+
+func (e *redactedError) Unwrap() error { return e.err }
+
+// redactError masks sensitive data in message of err
+func redactError(err error) error {
+	message := redact(err.Error())
+	if message == err.Error() {
+		return err
+	}
+	return &redactedError{err: err, message: message}
+}
+
+// errorType returns type name of err reported to error trackers,
+// redacted errors keep the type of the original error
+func errorType(err error) string {
+	if e, ok := err.(*redactedError); ok {
+		err = e.err
+	}
+	return fmt.Sprintf("%T", err)
+}
@@ -1,17 +1,19 @@
 package main
 
 import (
+	"crypto/subtle"
 	"encoding/json"
 	"errors"
 	"fmt"
+	"io"
 	"io/ioutil"
-	"log"
 	"net/http"
 	"net/url"
+	"runtime/debug"
 	"strconv"
+	"strings"
 	"time"
 
-	"github.com/bugsnag/bugsnag-go"
 	"github.com/gorilla/context"
 	"github.com/gorilla/mux"
 )
@@ -41,6 +43,7 @@ const (
 	workspaceTokenKey key = 2
 	serviceIDKey      key = 3
 	pipeIDKey         key = 4
+	apiVersionKey     key = 5
 )
 
 func badRequest(explanation interface{}) Response {
@@ -50,6 +53,14 @@ func badRequest(explanation interface{}) Response {
 	return Response{http.StatusBadRequest, explanation.(error), "application/json"}
 }
 
+func notFound(explanation string) Response {
+	return Response{http.StatusNotFound, errors.New(explanation), "application/json"}
+}
+
+func conflict(explanation string) Response {
+	return Response{http.StatusConflict, errors.New(explanation), "application/json"}
+}
+
 func internalServerError(err string) Response {
 	return Response{http.StatusInternalServerError, err, "application/json"}
 }
@@ -78,6 +89,32 @@ func serviceUnavailable(reasons interface{}) Response {
 	return Response{http.StatusServiceUnavailable, reasons, "application/json"}
 }
 
+// errorResponse responds with classified err, v2 error body has
+// its code, user-facing message and retryable flag
+func errorResponse(err error) Response {
+	pipeErr := classifyError(err)
+	return Response{pipeErr.status(), pipeErr, "application/json"}
+}
+
+// classifiedError responds with classified err in API v2, v1 responds
+// with legacy response it had before errors were classified
+func (req Request) classifiedError(err error, legacy Response) Response {
+	if apiVersion(req.r) < 2 {
+		return legacy
+	}
+	return errorResponse(err)
+}
+
+// oAuthRefreshFailed responds to failed refresh of authorization
+func (req Request) oAuthRefreshFailed(err error) Response {
+	return req.classifiedError(err, badRequest("oAuth refresh failed!"))
+}
+
+// invalidServiceParams responds to service params of pipe that are not valid
+func (req Request) invalidServiceParams(err error) Response {
+	return req.classifiedError(asInvalidConfig(err), badRequest(err.Error()))
+}
+
 func (req Request) redirectWithError(err string) Response {
 	return found(urls.ReturnURL[environment] + "?err=" + url.QueryEscape(err))
 }
@@ -86,6 +123,51 @@ func uuid(r *http.Request) string {
 	return fmt.Sprintf("%v", context.Get(r, uuidKey))
 }
 
+// requestLogger returns logger with fields identifying the request,
+// workspace, service and pipe are set once the request is authenticated
+func requestLogger(r *http.Request) *Logger {
+	fields := Fields{
+		"request_id": uuid(r),
+		"method":     r.Method,
+		"path":       r.URL.Path,
+	}
+	if workspaceID := currentWorkspaceID(r); workspaceID != 0 {
+		fields["workspace_id"] = workspaceID
+	}
+	serviceID, pipeID := currentServicePipeID(r)
+	if serviceID == "" {
+		serviceID = mux.Vars(r)["service"]
+	}
+	if pipeID == "" {
+		pipeID = mux.Vars(r)["pipe"]
+	}
+	if serviceID != "" {
+		fields["service"] = serviceID
+	}
+	if pipeID != "" {
+		fields["pipe"] = pipeID
+	}
+	return logger.With(fields)
+}
+
+// requestErrorMetadata returns metadata of errors reported while handling request
+func requestErrorMetadata(r *http.Request) ErrorMetadata {
+	metadata := ErrorMetadata{
+		"request": {
+			"uuid":   uuid(r),
+			"method": r.Method,
+			"path":   r.URL.Path,
+		},
+	}
+	if workspaceID := currentWorkspaceID(r); workspaceID != 0 {
+		metadata["workspace"] = Fields{"id": workspaceID}
+	}
+	if serviceID, pipeID := currentServicePipeID(r); pipeID != "" {
+		metadata["pipe"] = Fields{"id": pipeID, "service": serviceID}
+	}
+	return metadata
+}
+
 func currentWorkspaceID(r *http.Request) int {
 	if v, ok := context.GetOk(r, workspaceIDKey); ok {
 		return v.(int)
@@ -122,12 +204,12 @@ func withService(handler http.HandlerFunc) http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
 		serviceID := mux.Vars(r)["service"]
 		if !serviceType.MatchString(serviceID) {
-			http.Error(w, "Missing or invalid service", http.StatusBadRequest)
+			writeError(w, r, http.StatusBadRequest, &ValidationError{Field: "service", Message: "Missing or invalid service"})
 			return
 		}
 		pipeID := mux.Vars(r)["pipe"]
 		if !pipeType.MatchString(pipeID) {
-			http.Error(w, "Missing or invalid pipe", http.StatusBadRequest)
+			writeError(w, r, http.StatusBadRequest, &ValidationError{Field: "pipe", Message: "Missing or invalid pipe"})
 			return
 		}
 		context.Set(r, serviceIDKey, serviceID)
@@ -140,23 +222,38 @@ func withAuth(handler http.HandlerFunc) http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
 		authData, err := parseToken(r)
 		if err != nil {
-			http.Error(w, err.Error(), http.StatusBadRequest)
+			writeError(w, r, http.StatusBadRequest, err)
 			return
 		}
 		if authData == nil {
-			http.Error(w, "Unauthorized", http.StatusUnauthorized)
+			writeError(w, r, http.StatusUnauthorized, errors.New("Unauthorized"))
 			return
 		}
 
 		var workspaceID int
-		workspaceID, err = getTogglWorkspaceID(authData.Username)
+		workspaceID, err = workspaceCache.workspaceID(r.Context(), authData.Username)
 		if err != nil {
-			http.Error(w, err.Error(), http.StatusBadRequest)
+			writeError(w, r, http.StatusBadRequest, err)
 			return
 		}
 
 		context.Set(r, workspaceIDKey, workspaceID)
 		context.Set(r, workspaceTokenKey, authData.Username)
+		if !allowWorkspaceRequest(w, r, workspaceID) {
+			return
+		}
+		handler(w, r)
+	}
+}
+
+// withAdminAuth lets through requests with the admin_token bearer token
+func withAdminAuth(handler http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		token := strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer ")
+		if adminToken == "" || subtle.ConstantTimeCompare([]byte(token), []byte(adminToken)) != 1 {
+			writeError(w, r, http.StatusUnauthorized, errors.New("Unauthorized"))
+			return
+		}
 		handler(w, r)
 	}
 }
@@ -164,66 +261,90 @@ func withAuth(handler http.HandlerFunc) http.HandlerFunc {
 // handleRequest wraps API request/response calls and writes the response out.
 func handleRequest(handler HandlerFunc) http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
+		requestStarted := time.Now()
+		requestLog := requestLogger(r)
+
 		// take care of panic
 		defer func() {
-			if recover() != nil {
-				log.Println("panic when handling", r.URL.Path)
-				bugsnag.Recover(bugsnag.StartSession(r.Context()))
+			if rec := recover(); rec != nil {
+				err := fmt.Errorf("panic when handling request: %v", rec)
+				requestLog.Error("panic when handling request", Fields{"error": err})
+				metadata := requestErrorMetadata(r)
+				metadata["request"]["stack"] = string(debug.Stack())
+				reportError(err, metadata)
 			}
 		}()
 
-		uuidToken := uuid(r)
-		requestStarted := time.Now()
-
 		// define resp so it can be used in log
 		var resp Response
 
 		// log request
-		log.Println(uuidToken, "Start", r.Method, r.URL, "for", parseRemoteAddr(r))
+		requestLog.Info("request started", Fields{"remote_addr": parseRemoteAddr(r)})
 		defer func() {
-			log.Println(uuidToken, r.Method, resp.status, r.URL, "-", time.Since(requestStarted))
+			requestLog.Info("request finished", Fields{
+				"status":      resp.status,
+				"duration_ms": time.Since(requestStarted).Milliseconds(),
+			})
 		}()
 
 		// Parse request body, if any
 		var body []byte
 		if r.Body != nil {
 			defer r.Body.Close()
-			b, err := ioutil.ReadAll(r.Body)
+			reader := io.Reader(r.Body)
+			maxSize := maxRequestBodySize(r)
+			if maxSize > 0 {
+				if r.ContentLength > maxSize {
+					resp = Response{http.StatusRequestEntityTooLarge, errBodyTooLarge, "application/json"}
+					writeError(w, r, resp.status, errBodyTooLarge)
+					return
+				}
+				reader = io.LimitReader(r.Body, maxSize+1)
+			}
+			b, err := ioutil.ReadAll(reader)
 			if err != nil {
-				log.Println(uuidToken, "Error:", err, r)
-				bugsnag.Notify(err, r)
-				http.Error(w, err.Error(), http.StatusInternalServerError)
+				requestLog.Error("failed to read request body", Fields{"error": err})
+				reportError(err, requestErrorMetadata(r))
+				writeError(w, r, http.StatusInternalServerError, err)
+				return
+			}
+			if maxSize > 0 && int64(len(b)) > maxSize {
+				resp = Response{http.StatusRequestEntityTooLarge, errBodyTooLarge, "application/json"}
+				writeError(w, r, resp.status, errBodyTooLarge)
 				return
 			}
 			body = b
 			if len(body) > 0 {
-				log.Println(uuidToken, "Input:", string(body))
+				requestLog.Info("request body", Fields{"body": body})
 			}
 		}
 
 		// run the actual handler
 		req := Request{w, r, body}
-		resp = handler(req)
+		if errs := apiSpec.validateRequestBody(r, body); len(errs) > 0 {
+			resp = Response{http.StatusBadRequest, errs, "application/json"}
+		} else {
+			resp = handler(req)
+		}
 
 		// Handle error
 		if err, isError := resp.content.(error); isError {
-			log.Println(uuidToken, "Error:", err, r)
+			requestLog.Error("request failed", Fields{"status": resp.status, "error": err})
 			if resp.status < 400 || resp.status >= 500 {
-				go bugsnag.Notify(err,
-					bugsnag.MetaData{
-						"request": {
-							"uuid": uuidToken,
-						},
-					})
+				go reportError(err, requestErrorMetadata(r))
 			}
-			http.Error(w, err.Error(), resp.status)
+			writeError(w, r, resp.status, err)
+			return
+		}
+		if resp.status >= 400 && apiVersion(r) >= 2 {
+			writeErrorEnvelope(w, resp.status, resp.content)
 			return
 		}
 
 		// Handle redirect
 		if resp.status == http.StatusFound {
 			location := resp.content.(string)
-			log.Println(uuidToken, "Redirect:", location)
+			requestLog.Info("redirect", Fields{"location": location})
 			http.Redirect(w, r, location, resp.status)
 			return
 		}
@@ -231,10 +352,14 @@ func handleRequest(handler HandlerFunc) http.HandlerFunc {
 		// Encode JSON response
 		var output []byte
 		if resp.contentType == "application/json" {
-			b, err := json.Marshal(resp.content)
+			content := resp.content
+			if apiVersion(r) >= 2 && resp.status != http.StatusNoContent {
+				content = dataEnvelope{content}
+			}
+			b, err := json.Marshal(content)
 			if err != nil {
-				log.Print(err.Error())
-				http.Error(w, err.Error(), http.StatusInternalServerError)
+				requestLog.Error("failed to encode response", Fields{"error": err})
+				writeError(w, r, http.StatusInternalServerError, err)
 				return
 			}
 			output = b
@@ -244,7 +369,7 @@ func handleRequest(handler HandlerFunc) http.HandlerFunc {
 
 		// Log output, except for GET results, which tend to be spammy.
 		if r.Method != "GET" {
-			log.Println(uuidToken, "Output", resp.contentType, string(output))
+			requestLog.Info("response body", Fields{"content_type": resp.contentType, "body": output})
 		}
 
 		// Write output
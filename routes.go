@@ -1,12 +1,14 @@
 package main
 
 import (
-	"log"
 	"net/http"
 
 	"github.com/gorilla/context"
 	"github.com/gorilla/mux"
 	gouuid "github.com/nu7hatch/gouuid"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+	"go.opentelemetry.io/otel/api/trace"
+	"go.opentelemetry.io/otel/instrumentation/othttp"
 )
 
 type Router struct {
@@ -15,29 +17,59 @@ type Router struct {
 
 var routes *Router
 
+// serveMux serves API and metrics, http.DefaultServeMux is not served
+// because packages such as expvar register debug pages on it
+var serveMux = http.NewServeMux()
+
 func init() {
 	routes = &Router{Routes: mux.NewRouter()}
 
 	v1 := routes.Routes.PathPrefix("/api/v1").Subrouter()
-	v1.HandleFunc("/status", handleRequest(getStatus)).Methods("GET")
-	v1.HandleFunc("/integrations", withAuth(handleRequest(getIntegrations))).Methods("GET")
+	v1.HandleFunc("/openapi.json", handleRequest(getOpenAPISpec)).Methods("GET")
+	registerAPIRoutes(v1)
+
+	v2 := routes.Routes.PathPrefix("/api/v2").Subrouter()
+	v2.Use(withAPIVersion(2))
+	registerAPIRoutes(v2)
+
+	serveMux.Handle("/metrics", promhttp.Handler())
+	serveMux.Handle("/", withFlusher(othttp.NewHandler(routes, "http.request")))
+}
+
+// registerAPIRoutes registers handlers shared by all API versions
+func registerAPIRoutes(api *mux.Router) {
+	api.Use(withIPRateLimit)
 
-	v1.HandleFunc("/integrations/{service}/pipes/{pipe}", withAuth(handleRequest(getIntegrationPipe))).Methods("GET")
-	v1.HandleFunc("/integrations/{service}/pipes/{pipe}/setup", withAuth(handleRequest(putPipeSetup))).Methods("PUT")
-	v1.HandleFunc("/integrations/{service}/pipes/{pipe}/setup", withAuth(handleRequest(postPipeSetup))).Methods("POST")
-	v1.HandleFunc("/integrations/{service}/pipes/{pipe}/setup", withAuth(handleRequest(deletePipeSetup))).Methods("DELETE")
-	v1.HandleFunc("/integrations/{service}/pipes/{pipe}/log", withService(withAuth(handleRequest(getServicePipeLog)))).Methods("GET")
-	v1.HandleFunc("/integrations/{service}/pipes/{pipe}/clear_connections", withService(withAuth(handleRequest(postServicePipeClearConnections)))).Methods("POST")
+	api.HandleFunc("/status", handleRequest(getStatus)).Methods("GET")
+	api.HandleFunc("/integrations", withAuth(handleRequest(getIntegrations))).Methods("GET")
 
-	v1.HandleFunc("/integrations/{service}/accounts", withAuth(handleRequest(getServiceAccounts))).Methods("GET")
-	v1.HandleFunc("/integrations/{service}/auth_url", withAuth(handleRequest(getAuthURL))).Methods("GET")
-	v1.HandleFunc("/integrations/{service}/authorizations", withAuth(handleRequest(postAuthorization))).Methods("POST")
-	v1.HandleFunc("/integrations/{service}/authorizations", withAuth(handleRequest(deleteAuthorization))).Methods("DELETE")
+	api.HandleFunc("/integrations/{service}/pipes/{pipe}", withAuth(handleRequest(getIntegrationPipe))).Methods("GET")
+	api.HandleFunc("/integrations/{service}/pipes/{pipe}/setup", withAuth(handleRequest(putPipeSetup))).Methods("PUT")
+	api.HandleFunc("/integrations/{service}/pipes/{pipe}/setup", withAuth(handleRequest(postPipeSetup))).Methods("POST")
+	api.HandleFunc("/integrations/{service}/pipes/{pipe}/setup", withAuth(handleRequest(deletePipeSetup))).Methods("DELETE")
+	api.HandleFunc("/integrations/{service}/pipes/{pipe}/log", withService(withAuth(handleRequest(getServicePipeLog)))).Methods("GET")
+	api.HandleFunc("/integrations/{service}/pipes/{pipe}/clear_connections", withService(withAuth(handleRequest(postServicePipeClearConnections)))).Methods("POST")
 
-	v1.HandleFunc("/integrations/{service}/pipes/{pipe}/users", withAuth(handleRequest(getServiceUsers))).Methods("GET")
-	v1.HandleFunc("/integrations/{service}/pipes/{pipe}/run", withService(withAuth(handleRequest(postPipeRun)))).Methods("POST")
+	api.HandleFunc("/integrations/{service}/accounts", withAuth(handleRequest(getServiceAccounts))).Methods("GET")
+	api.HandleFunc("/integrations/{service}/auth_url", withAuth(handleRequest(getAuthURL))).Methods("GET")
+	api.HandleFunc("/integrations/{service}/authorizations", withAuth(handleRequest(postAuthorization))).Methods("POST")
+	api.HandleFunc("/integrations/{service}/authorizations", withAuth(handleRequest(deleteAuthorization))).Methods("DELETE")
 
-	http.Handle("/", routes)
+	api.HandleFunc("/integrations/{service}/pipes/{pipe}/users", withAuth(handleRequest(getServiceUsers))).Methods("GET")
+	api.HandleFunc("/integrations/{service}/pipes/{pipe}/projects", withService(withAuth(handleRequest(getServiceProjects)))).Methods("GET")
+	api.HandleFunc("/integrations/{service}/pipes/{pipe}/projects", withService(withAuth(handleRequest(postServiceProjects)))).Methods("POST")
+	api.HandleFunc("/integrations/{service}/pipes/{pipe}/run", withService(withAuth(handleRequest(postPipeRun)))).Methods("POST")
+	api.HandleFunc("/integrations/{service}/pipes/{pipe}/events", withService(withAuth(getPipeEvents))).Methods("GET")
+	api.HandleFunc("/integrations/{service}/pipes/{pipe}/cancel", withService(withAuth(handleRequest(postPipeCancel)))).Methods("POST")
+
+	api.HandleFunc("/jobs/{id}", withAuth(handleRequest(getJob))).Methods("GET")
+
+	api.HandleFunc("/admin/queue", withAdminAuth(handleRequest(getAdminQueue))).Methods("GET")
+	api.HandleFunc("/admin/queue/unlock_stale", withAdminAuth(handleRequest(postAdminQueueUnlockStale))).Methods("POST")
+	api.HandleFunc("/admin/queue/{entry_id}", withAdminAuth(handleRequest(deleteAdminQueueEntry))).Methods("DELETE")
+	api.HandleFunc("/admin/queue/{entry_id}/requeue", withAdminAuth(handleRequest(postAdminQueueEntryRequeue))).Methods("POST")
+	api.HandleFunc("/admin/queue/{entry_id}/unlock", withAdminAuth(handleRequest(postAdminQueueEntryUnlock))).Methods("POST")
+	api.HandleFunc("/admin/workspaces/{workspace_id}/queue", withAdminAuth(handleRequest(getAdminWorkspaceQueue))).Methods("GET")
 }
 
 func (router *Router) ServeHTTP(w http.ResponseWriter, r *http.Request) {
@@ -45,12 +77,13 @@ func (router *Router) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 
 	u4, err := gouuid.NewV4()
 	if err != nil {
-		log.Print(err.Error())
+		logger.Error("failed to generate request id", Fields{"error": err})
 		http.Error(w, err.Error(), http.StatusInternalServerError)
 		return
 	}
 	uuidToken := u4.String()
 	context.Set(r, uuidKey, uuidToken)
+	traceRequest(router, r, uuidToken)
 
 	w.Header().Set("Cache-Control", "no-cache, private, no-store, must-revalidate, max-stale=0, post-check=0, pre-check=0")
 
@@ -69,3 +102,16 @@ func (router *Router) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 	}
 	router.Routes.ServeHTTP(w, r)
 }
+
+// traceRequest names the request span after the matched route
+// and tags it with the request UUID
+func traceRequest(router *Router, r *http.Request, uuidToken string) {
+	span := trace.SpanFromContext(r.Context())
+	span.SetAttribute("request.id", uuidToken)
+	var match mux.RouteMatch
+	if router.Routes.Match(r, &match) && match.Route != nil {
+		if template, err := match.Route.GetPathTemplate(); err == nil {
+			span.SetName(r.Method + " " + template)
+		}
+	}
+}
@@ -4,7 +4,6 @@ import (
 	"encoding/json"
 	"fmt"
 	"io/ioutil"
-	"log"
 	"math/rand"
 	"net/http"
 	"os"
@@ -15,7 +14,6 @@ import (
 	"time"
 
 	"code.google.com/p/goauth2/oauth"
-	"github.com/bugsnag/bugsnag-go"
 	"github.com/tambet/oauthplain"
 )
 
@@ -36,72 +34,69 @@ var (
 )
 
 func main() {
-	InitFlags()
+	args := InitFlags()
 	runtime.GOMAXPROCS(runtime.NumCPU())
 
-	bugsnag.Configure(bugsnag.Configuration{
-		APIKey:              bugsnagAPIKey,
-		ReleaseStage:        environment,
-		NotifyReleaseStages: []string{"production", "staging"},
-		// more configuration options
-	})
-
-	db = connectDB(dbConnString)
-	defer db.Close()
-
-	loadIntegrations()
-
-	b, err := ioutil.ReadFile(filepath.Join(workdir, "config", "urls.json"))
-	if err != nil {
-		log.Fatal(err)
+	if err := setLogLevel(logLevelName); err != nil {
+		logger.Fatal("invalid log level", Fields{"error": err})
 	}
-	if err := json.Unmarshal(b, &urls); err != nil {
-		log.Fatal(err)
+	if len(args) > 0 {
+		os.Exit(runCommand(args))
 	}
-	b, err = ioutil.ReadFile(filepath.Join(workdir, "config", "oauth2.json"))
-	if err != nil {
-		log.Fatal(err)
+	if _, err := serviceLimits(); err != nil {
+		logger.Fatal("invalid service concurrency limits", Fields{"error": err})
 	}
-	if err := json.Unmarshal(b, &oAuth2Configs); err != nil {
-		log.Fatal(err)
+	workspaceCache = NewWorkspaceCache(workspaceCacheSize, workspaceCacheTTL, workspaceCacheStaleTTL, lookupWorkspaceID)
+	if err := initRequestLimiters(); err != nil {
+		logger.Fatal("invalid trusted proxies", Fields{"error": err})
 	}
-	b, err = ioutil.ReadFile(filepath.Join(workdir, "config", "oauth1.json"))
+
+	reporter, err := newErrorReporter(errorReporterName)
 	if err != nil {
-		log.Fatal(err)
+		logger.Fatal("failed to initialize error reporter", Fields{"error": err})
 	}
-	if err := json.Unmarshal(b, &oAuth1Configs); err != nil {
-		log.Fatal(err)
+	errorReporter = reporter
+
+	stopTracing, err := initTracing()
+	if err != nil {
+		logger.Fatal("failed to initialize tracing", Fields{"error": err})
 	}
+	defer stopTracing()
 
-	for _, integration := range availableIntegrations {
-		availableAuthorizations[integration.ID] = integration.AuthType
+	db = connectDB(dbConnString)
+	defer db.Close()
+
+	if err := loadConfig(); err != nil {
+		logger.Fatal("failed to load config", Fields{"error": err})
 	}
 
 	rand.Seed(time.Now().Unix())
 
 	if environment == "production" {
-		go autoSyncRunner()
+		go autoSyncRunner(NewWorkerPool("Worker", pipeWorker), workersConfigSignals())
 	}
 	if environment == "staging" {
-		go autoSyncRunnerStub()
+		go autoSyncRunner(NewWorkerPool("WorkerStub", pipeWorkerStub), workersConfigSignals())
 	}
 	go autoSyncQueuer()
+	go removeFinishedJobs()
 
 	listenAddress := fmt.Sprintf(":%d", port)
-	log.Printf(
-		"pipes (PID: %d) is starting on %s\n=> Ctrl-C to shutdown server\n",
-		os.Getpid(),
-		listenAddress)
-	log.Fatal(http.ListenAndServe(listenAddress, http.DefaultServeMux))
+	logger.Info("pipes is starting", Fields{"pid": os.Getpid(), "address": listenAddress})
+	if err := http.ListenAndServe(listenAddress, serveMux); err != nil {
+		logger.Fatal("server stopped", Fields{"error": err})
+	}
 }
 
 func loadIntegrations() {
-	b, err := ioutil.ReadFile(filepath.Join(workdir, "config", "integrations.json"))
-	if err != nil {
-		log.Fatal(err)
+	if err := readIntegrations(); err != nil {
+		logger.Fatal("failed to load config", Fields{"error": err})
 	}
-	if err := json.Unmarshal(b, &availableIntegrations); err != nil {
-		log.Fatal(err)
+}
+
+func readIntegrations() error {
+	if err := readConfig("integrations.json", &availableIntegrations); err != nil {
+		return err
 	}
 	ids := make([]string, len(availableIntegrations))
 	for i := range availableIntegrations {
@@ -109,6 +104,38 @@ func loadIntegrations() {
 	}
 	serviceType = regexp.MustCompile(strings.Join(ids, "|"))
 	pipeType = regexp.MustCompile("users|projects|todolists|todos|tasks|timeentries")
+	return nil
+}
+
+// loadConfig reads integrations, URLs and OAuth configs from workdir
+func loadConfig() error {
+	if err := readIntegrations(); err != nil {
+		return err
+	}
+	if err := readConfig("urls.json", &urls); err != nil {
+		return err
+	}
+	if err := readConfig("oauth2.json", &oAuth2Configs); err != nil {
+		return err
+	}
+	if err := readConfig("oauth1.json", &oAuth1Configs); err != nil {
+		return err
+	}
+	for _, integration := range availableIntegrations {
+		availableAuthorizations[integration.ID] = integration.AuthType
+	}
+	return nil
+}
+
+func readConfig(name string, v interface{}) error {
+	b, err := ioutil.ReadFile(filepath.Join(workdir, "config", name))
+	if err != nil {
+		return fmt.Errorf("read %s: %w", name, err)
+	}
+	if err := json.Unmarshal(b, v); err != nil {
+		return fmt.Errorf("parse %s: %w", name, err)
+	}
+	return nil
 }
 
 func isWhiteListedCorsOrigin(r *http.Request) (string, bool) {
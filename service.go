@@ -1,6 +1,7 @@
 package main
 
 import (
+	"context"
 	"fmt"
 	"time"
 )
@@ -28,6 +29,13 @@ type (
 		// setAuthData adds the provided oauth token to Service struct
 		setAuthData([]byte) error
 
+		// setContext sets context of the pipe run using the service,
+		// requests made by the service are traced as part of the run
+		setContext(context.Context)
+
+		// context returns context set with setContext
+		context() context.Context
+
 		// keyFor should provide unique key for object type
 		// Example: asana:account:XXXX:projects
 		keyFor(string) string
@@ -56,31 +64,42 @@ type (
 		// https://github.com/toggl/pipes-api/blob/master/model.go#L38-45
 		TodoLists() ([]*Task, error)
 
+		// TimeEntries maps foreign time entries to TimeEntry models,
+		// foreign user, project and task ids must be set for mapping
+		// https://github.com/toggl/pipes-api/blob/master/model.go#L50-L65
+		TimeEntries() ([]*TimeEntry, error)
+
 		// Exports time entry model to foreign service
 		// should return foreign id of saved time entry
 		// https://github.com/toggl/pipes-api/blob/master/model.go#L47-L61
 		ExportTimeEntry(*TimeEntry) (int, error)
+
+		// Deletes previously exported time entry from foreign service
+		// using the foreign id set on the time entry model
+		DeleteTimeEntry(*TimeEntry) error
 	}
 
-	emptyService struct{}
+	emptyService struct {
+		ctx context.Context
+	}
 )
 
-func getService(serviceID string, workspaceID int) Service {
+func getService(serviceID string, workspaceID int) (Service, error) {
 	switch serviceID {
 	case "basecamp":
-		return Service(&BasecampService{workspaceID: workspaceID})
+		return Service(&BasecampService{workspaceID: workspaceID}), nil
 	case "freshbooks":
-		return Service(&FreshbooksService{workspaceID: workspaceID})
+		return Service(&FreshbooksService{workspaceID: workspaceID}), nil
 	case "teamweek":
-		return Service(&TeamweekService{workspaceID: workspaceID})
+		return Service(&TeamweekService{workspaceID: workspaceID}), nil
 	case "asana":
-		return Service(&AsanaService{workspaceID: workspaceID})
+		return Service(&AsanaService{workspaceID: workspaceID}), nil
 	case "github":
-		return Service(&GithubService{workspaceID: workspaceID})
+		return Service(&GithubService{workspaceID: workspaceID}), nil
 	case TestServiceName:
-		return Service(&TestService{workspaceID: workspaceID})
+		return Service(&TestService{workspaceID: workspaceID}), nil
 	default:
-		panic(fmt.Sprintf("getService: Unrecognized serviceID - %s", serviceID))
+		return nil, fmt.Errorf("getService: Unrecognized serviceID - %s", serviceID)
 	}
 }
 
@@ -90,6 +109,17 @@ func (s *emptyService) Users() ([]*User, error)                 { return nil, ni
 func (s *emptyService) Tasks() ([]*Task, error)                 { return nil, nil }
 func (s *emptyService) Clients() ([]*Client, error)             { return nil, fmt.Errorf("%w clients", ErrNotSupported) }
 func (s *emptyService) TodoLists() ([]*Task, error)             { return nil, nil }
+func (s *emptyService) TimeEntries() ([]*TimeEntry, error)      { return nil, nil }
 func (s *emptyService) Projects() ([]*Project, error)           { return nil, nil }
 func (s *emptyService) Accounts() ([]*Account, error)           { return nil, nil }
 func (s *emptyService) ExportTimeEntry(*TimeEntry) (int, error) { return 0, nil }
+func (s *emptyService) DeleteTimeEntry(*TimeEntry) error        { return nil }
+
+func (s *emptyService) setContext(ctx context.Context) { s.ctx = ctx }
+
+func (s *emptyService) context() context.Context {
+	if s.ctx == nil {
+		return context.Background()
+	}
+	return s.ctx
+}
@@ -55,7 +55,7 @@ func (s *TeamweekService) setAuthData(b []byte) error {
 
 func (s *TeamweekService) client() *teamweek.Client {
 	t := &oauth.Transport{Token: &s.token}
-	return teamweek.NewClient(t.Client())
+	return teamweek.NewClient(rateLimitedClient(s, t))
 }
 
 // Map Teamweek accounts to local accounts
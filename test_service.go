@@ -3,6 +3,8 @@ package main
 import (
 	"encoding/json"
 	"fmt"
+	"strconv"
+	"sync"
 
 	"code.google.com/p/goauth2/oauth"
 )
@@ -41,10 +43,87 @@ func (s *TestService) setAuthData(b []byte) error {
 
 func (s *TestService) Projects() ([]*Project, error) {
 	var ps []*Project
-	ps = append(ps, &Project{Name: p1Name})
-	ps = append(ps, &Project{Name: p2Name})
-	ps = append(ps, &Project{Name: p3Name})
-	ps = append(ps, &Project{Name: p4Name})
-	ps = append(ps, &Project{Name: p5Name})
+	ps = append(ps, &Project{Name: p1Name, ForeignID: "1"})
+	ps = append(ps, &Project{Name: p2Name, ForeignID: "2"})
+	ps = append(ps, &Project{Name: p3Name, ForeignID: "3"})
+	ps = append(ps, &Project{Name: p4Name, ForeignID: "4"})
+	ps = append(ps, &Project{Name: p5Name, ForeignID: "5"})
 	return ps, nil
 }
+
+// testTasks are returned by Tasks of the test service
+var testTasks []*Task
+
+func (s *TestService) Tasks() ([]*Task, error) {
+	return testTasks, nil
+}
+
+// testTimeEntries are time entries of the test service by foreign ID,
+// they are kept across instances of TestService
+var testTimeEntries = &testTimeEntryStore{entries: make(map[string]*TimeEntry)}
+
+type testTimeEntryStore struct {
+	sync.Mutex
+	lastID  int
+	entries map[string]*TimeEntry
+	// imported are returned by TimeEntries of the test service
+	imported []*TimeEntry
+	// exportErr, when set, is called before each export and its error is returned
+	exportErr func(*TimeEntry) error
+}
+
+// reset removes time entries and hooks of earlier tests
+func (s *testTimeEntryStore) reset() {
+	s.Lock()
+	defer s.Unlock()
+	s.entries = make(map[string]*TimeEntry)
+	s.imported = nil
+	s.exportErr = nil
+}
+
+func (s *testTimeEntryStore) get(foreignID string) *TimeEntry {
+	s.Lock()
+	defer s.Unlock()
+	return s.entries[foreignID]
+}
+
+func (s *testTimeEntryStore) count() int {
+	s.Lock()
+	defer s.Unlock()
+	return len(s.entries)
+}
+
+func (s *TestService) TimeEntries() ([]*TimeEntry, error) {
+	testTimeEntries.Lock()
+	defer testTimeEntries.Unlock()
+	timeEntries := make([]*TimeEntry, 0, len(testTimeEntries.imported))
+	for _, entry := range testTimeEntries.imported {
+		e := *entry
+		timeEntries = append(timeEntries, &e)
+	}
+	return timeEntries, nil
+}
+
+func (s *TestService) ExportTimeEntry(entry *TimeEntry) (int, error) {
+	testTimeEntries.Lock()
+	defer testTimeEntries.Unlock()
+	if testTimeEntries.exportErr != nil {
+		if err := testTimeEntries.exportErr(entry); err != nil {
+			return 0, err
+		}
+	}
+	if _, found := testTimeEntries.entries[entry.ForeignID]; !found {
+		testTimeEntries.lastID++
+		entry.ForeignID = strconv.Itoa(testTimeEntries.lastID)
+	}
+	e := *entry
+	testTimeEntries.entries[entry.ForeignID] = &e
+	return numberStrToInt(entry.ForeignID), nil
+}
+
+func (s *TestService) DeleteTimeEntry(entry *TimeEntry) error {
+	testTimeEntries.Lock()
+	defer testTimeEntries.Unlock()
+	delete(testTimeEntries.entries, entry.ForeignID)
+	return nil
+}
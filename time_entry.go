@@ -0,0 +1,16 @@
+package main
+
+type (
+	timeEntryRequest struct {
+		TimeEntries []*TimeEntry `json:"time_entries"`
+	}
+
+	TimeEntriesImport struct {
+		TimeEntries   []*TimeEntry `json:"time_entries"`
+		Notifications []string     `json:"notifications"`
+	}
+)
+
+func (p *TimeEntriesImport) Count() int {
+	return len(p.TimeEntries)
+}
@@ -2,32 +2,271 @@ package main
 
 import (
 	"bytes"
+	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"io/ioutil"
-	"log"
+	"net"
 	"net/http"
 	"strconv"
 	"strings"
 	"time"
+
+	gouuid "github.com/nu7hatch/gouuid"
+)
+
+const (
+	// togglAPITimeout limits a single GET request to Toggl API
+	togglAPITimeout = 60 * time.Second
+	// togglAPIPostTimeout limits a single POST request, imports of large
+	// payloads take long and failed POSTs are not retried once sent
+	togglAPIPostTimeout = 10 * time.Minute
+	// togglAPIMaxRetries is how many times failed request is retried
+	togglAPIMaxRetries = 3
+	// togglAPIRetryDelay is the delay before first retry, doubled on each next one
+	togglAPIRetryDelay = 500 * time.Millisecond
+	// togglAPIMaxRetryAfter is the longest Retry-After waited for,
+	// requests asked to wait longer fail as rate limited
+	togglAPIMaxRetryAfter = 30 * time.Second
+	// maxErrorBodyLength limits response body included in error messages
+	maxErrorBodyLength = 512
+	// togglAPIMaxIDsPerRequest limits IDs sent in query string of one
+	// request, so that URLs of large workspaces stay within server limits
+	togglAPIMaxIDsPerRequest = 200
 )
 
 var togglAPIPingClient = &http.Client{
 	Timeout: 3 * time.Second,
 }
 
+// TogglAPI is the part of Toggl API used by pipes,
+// implemented by TogglClient and replaced with a fake in tests.
+type TogglAPI interface {
+	// GetWorkspaceID returns ID of the workspace the token belongs to
+	GetWorkspaceID(ctx context.Context, APIToken string) (int, error)
+
+	// GetTimeEntries returns time entries of given users and projects
+	// that were changed since lastSync
+	GetTimeEntries(ctx context.Context, APIToken string, lastSync time.Time, userIDs, projectsIDs []int) ([]TimeEntry, error)
+
+	// GetTimeEntryChanges returns which of given time entries were
+	// deleted or moved to another project since lastSync
+	GetTimeEntryChanges(ctx context.Context, APIToken string, lastSync time.Time, entryIDs []int) (*timeEntryChanges, error)
+
+	// PostPipesAPI imports payload to the pipes endpoint of pipeID
+	// and returns the response body
+	PostPipesAPI(ctx context.Context, APIToken, pipeID string, payload interface{}) ([]byte, error)
+}
+
+var togglClient TogglAPI = NewTogglClient()
+
 func pingTogglAPI() error {
 	url := fmt.Sprintf("%s/api/v9/status", urls.TogglAPIHost[environment])
 	resp, err := togglAPIPingClient.Get(url)
 	if err != nil {
 		return fmt.Errorf("error checking toggl api: %s", err.Error())
 	}
+	defer resp.Body.Close()
 	if resp.StatusCode != http.StatusOK {
 		return fmt.Errorf("toggl api is not healthy, got status code: %d", resp.StatusCode)
 	}
 	return nil
 }
 
+// TogglClient is shared client for Toggl API, it reuses connections and
+// retries requests that failed because of network or server errors.
+type TogglClient struct {
+	client      *http.Client
+	host        string // overrides configured Toggl API host
+	maxRetries  int
+	retryDelay  time.Duration
+	timeout     time.Duration
+	postTimeout time.Duration
+}
+
+func NewTogglClient() *TogglClient {
+	return NewTogglClientWithHost("")
+}
+
+// NewTogglClientWithHost returns client that sends requests to given host
+// instead of the configured Toggl API host
+func NewTogglClientWithHost(host string) *TogglClient {
+	transport := &http.Transport{
+		Proxy: http.ProxyFromEnvironment,
+		DialContext: (&net.Dialer{
+			Timeout:   10 * time.Second,
+			KeepAlive: 30 * time.Second,
+		}).DialContext,
+		MaxIdleConns:          100,
+		MaxIdleConnsPerHost:   20,
+		IdleConnTimeout:       90 * time.Second,
+		TLSHandshakeTimeout:   10 * time.Second,
+		ExpectContinueTimeout: 1 * time.Second,
+	}
+	return &TogglClient{
+		client:      &http.Client{Transport: tracedTransport(transport)},
+		host:        host,
+		maxRetries:  togglAPIMaxRetries,
+		retryDelay:  togglAPIRetryDelay,
+		timeout:     togglAPITimeout,
+		postTimeout: togglAPIPostTimeout,
+	}
+}
+
+// TogglAPIError is returned when Toggl API responds with unexpected status code
+type TogglAPIError struct {
+	Method     string
+	URL        string
+	StatusCode int
+	RequestID  string
+	Body       []byte
+}
+
+func (e *TogglAPIError) Error() string {
+	body := strings.TrimSpace(string(e.Body))
+	if len(body) > maxErrorBodyLength {
+		body = body[:maxErrorBodyLength] + "..."
+	}
+	return fmt.Sprintf("%s %s failed with status code %d (request %s): %s",
+		e.Method, e.URL, e.StatusCode, e.RequestID, body)
+}
+
+func (c *TogglClient) url(path string) string {
+	if c.host != "" {
+		return c.host + path
+	}
+	return urls.TogglAPIHost[environment] + path
+}
+
+// do sends request to Toggl API and returns body of successful response.
+// Network errors, 5xx and 429 responses are retried with exponential
+// backoff, or after Retry-After of the response when it says so. POST
+// requests are retried only when they were not sent, Toggl API may have
+// imported them already and the idempotency key they carry is not
+// a guarantee against duplicates, so they get a longer deadline than
+// other requests. Waits between retries end with ctx.
+// Trace context of ctx is propagated to Toggl API in request headers.
+func (c *TogglClient) do(ctx context.Context, method, path, APIToken string, payload interface{}) ([]byte, error) {
+	var body []byte
+	if payload != nil {
+		var err error
+		if body, err = json.Marshal(payload); err != nil {
+			return nil, err
+		}
+	}
+	u4, err := gouuid.NewV4()
+	if err != nil {
+		return nil, err
+	}
+	requestID := u4.String()
+	url := c.url(path)
+
+	var delay time.Duration
+	for attempt := 0; ; attempt++ {
+		if attempt > 0 {
+			if err := sleepContext(ctx, delay); err != nil {
+				return nil, err
+			}
+		}
+		delay = c.retryDelay << uint(attempt)
+		timeout := c.timeout
+		if method == "POST" {
+			timeout = c.postTimeout
+		}
+		reqCtx, cancel := context.WithTimeout(ctx, timeout)
+		req, err := http.NewRequestWithContext(reqCtx, method, url, bytes.NewReader(body))
+		if err != nil {
+			cancel()
+			return nil, err
+		}
+		req.Header.Set("User-Agent", "toggl-pipes")
+		req.Header.Set("X-Request-ID", requestID)
+		if method == "POST" {
+			req.Header.Set("Content-Type", "application/json")
+			req.Header.Set("Idempotency-Key", requestID)
+		}
+		req.SetBasicAuth(APIToken, "api_token")
+
+		start := time.Now()
+		resp, err := c.client.Do(req)
+		c.observe(method, path, resp, start)
+		if err != nil {
+			cancel()
+			if attempt < c.maxRetries && (requestNotSent(err) || method != "POST" && classifyError(err).Retryable) {
+				logger.Warn("Toggl request failed, retrying", Fields{"method": method, "url": url, "toggl_request_id": requestID, "error": err})
+				continue
+			}
+			return nil, err
+		}
+		b, err := ioutil.ReadAll(resp.Body)
+		resp.Body.Close()
+		cancel()
+		if err != nil {
+			if attempt < c.maxRetries && method != "POST" {
+				continue
+			}
+			return nil, err
+		}
+		if resp.StatusCode == http.StatusUnauthorized || resp.StatusCode == http.StatusForbidden {
+			workspaceCache.invalidate(APIToken)
+		}
+		if resp.StatusCode != http.StatusOK {
+			apiErr := &TogglAPIError{
+				Method:     method,
+				URL:        url,
+				StatusCode: resp.StatusCode,
+				RequestID:  requestID,
+				Body:       b,
+			}
+			if retryAt, found := retryAfter(resp, time.Now()); found {
+				if wait := time.Until(retryAt); wait > togglAPIMaxRetryAfter {
+					return nil, apiErr
+				} else if wait > delay {
+					delay = wait
+				}
+			}
+			if attempt < c.maxRetries && method != "POST" && classifyError(apiErr).Retryable {
+				logger.Warn("Toggl request failed, retrying", Fields{"method": method, "url": url, "toggl_request_id": requestID, "status": resp.StatusCode})
+				continue
+			}
+			return nil, apiErr
+		}
+		logger.Debug("Toggl request", Fields{"method": method, "url": url, "toggl_request_id": requestID, "duration_ms": time.Since(start).Milliseconds()})
+		return b, nil
+	}
+}
+
+// sleepContext waits for d unless ctx is done first
+func sleepContext(ctx context.Context, d time.Duration) error {
+	timer := time.NewTimer(d)
+	defer timer.Stop()
+	select {
+	case <-timer.C:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// requestNotSent tells if request failed before it was sent,
+// e.g. when connection to Toggl API could not be made
+func requestNotSent(err error) bool {
+	var opErr *net.OpError
+	return errors.As(err, &opErr) && opErr.Op == "dial"
+}
+
+func (c *TogglClient) observe(method, path string, resp *http.Response, start time.Time) {
+	var code int
+	if resp != nil {
+		code = resp.StatusCode
+	}
+	if i := strings.Index(path, "?"); i >= 0 {
+		path = path[:i]
+	}
+	togglAPIRequestDuration.WithLabelValues(method, path, strconv.Itoa(code)).Observe(time.Since(start).Seconds())
+}
+
 type workspaceResponse struct {
 	Workspace *Workspace `json:"data"`
 }
@@ -40,30 +279,13 @@ func stringify(values []int) string {
 	return strings.Join(s, ",")
 }
 
-func getTogglTimeEntries(APIToken string, lastSync time.Time, userIDs, projectsIDs []int) ([]TimeEntry, error) {
-	url := fmt.Sprintf("%s/api/pipes/time_entries?since=%d&user_ids=%s&project_ids=%s",
-		urls.TogglAPIHost[environment], lastSync.Unix(), stringify(userIDs), stringify(projectsIDs))
-
-	req, err := http.NewRequest("GET", url, nil)
-	if err != nil {
-		return nil, err
-	}
-	req.Header.Set("User-Agent", "toggl-pipes")
-	req.SetBasicAuth(APIToken, "api_token")
-	client := &http.Client{}
-	resp, err := client.Do(req)
-	if err != nil {
-		return nil, err
-	}
-	var b []byte
-	defer resp.Body.Close()
-	b, err = ioutil.ReadAll(resp.Body)
+func (c *TogglClient) GetTimeEntries(ctx context.Context, APIToken string, lastSync time.Time, userIDs, projectsIDs []int) ([]TimeEntry, error) {
+	path := fmt.Sprintf("/api/pipes/time_entries?since=%d&user_ids=%s&project_ids=%s",
+		lastSync.Unix(), stringify(userIDs), stringify(projectsIDs))
+	b, err := c.do(ctx, "GET", path, APIToken, nil)
 	if err != nil {
 		return nil, err
 	}
-	if http.StatusOK != resp.StatusCode {
-		return nil, fmt.Errorf("GET time_entries failed %d", resp.StatusCode)
-	}
 	var timeEntries []TimeEntry
 	if err := json.Unmarshal(b, &timeEntries); err != nil {
 		return nil, err
@@ -71,65 +293,53 @@ func getTogglTimeEntries(APIToken string, lastSync time.Time, userIDs, projectsI
 	return timeEntries, nil
 }
 
-func getTogglWorkspaceID(APIToken string) (int, error) {
-	var workspaceID int
-	url := fmt.Sprintf("%s/api/pipes/workspace", urls.TogglAPIHost[environment])
-	req, err := http.NewRequest("GET", url, nil)
-	if err != nil {
-		return workspaceID, err
-	}
-	req.Header.Set("User-Agent", "toggl-pipes")
-	req.SetBasicAuth(APIToken, "api_token")
-	client := &http.Client{}
-	resp, err := client.Do(req)
-	if err != nil {
-		return workspaceID, err
+// timeEntryChanges lists previously exported time entries that were
+// deleted in Toggl or moved to another project since the last sync.
+type timeEntryChanges struct {
+	Deleted []int       `json:"deleted"`
+	Moved   []TimeEntry `json:"moved"`
+}
+
+// GetTimeEntryChanges asks for changes of at most togglAPIMaxIDsPerRequest
+// entries at a time, the changes of all requests are merged
+func (c *TogglClient) GetTimeEntryChanges(ctx context.Context, APIToken string, lastSync time.Time, entryIDs []int) (*timeEntryChanges, error) {
+	changes := &timeEntryChanges{Deleted: make([]int, 0), Moved: make([]TimeEntry, 0)}
+	for start := 0; start < len(entryIDs); start += togglAPIMaxIDsPerRequest {
+		end := start + togglAPIMaxIDsPerRequest
+		if end > len(entryIDs) {
+			end = len(entryIDs)
+		}
+		path := fmt.Sprintf("/api/pipes/time_entries/changes?since=%d&ids=%s",
+			lastSync.Unix(), stringify(entryIDs[start:end]))
+		b, err := c.do(ctx, "GET", path, APIToken, nil)
+		if err != nil {
+			return nil, err
+		}
+		var chunk timeEntryChanges
+		if err := json.Unmarshal(b, &chunk); err != nil {
+			return nil, err
+		}
+		changes.Deleted = append(changes.Deleted, chunk.Deleted...)
+		changes.Moved = append(changes.Moved, chunk.Moved...)
 	}
-	var b []byte
-	defer resp.Body.Close()
-	b, err = ioutil.ReadAll(resp.Body)
+	return changes, nil
+}
+
+func (c *TogglClient) GetWorkspaceID(ctx context.Context, APIToken string) (int, error) {
+	b, err := c.do(ctx, "GET", "/api/pipes/workspace", APIToken, nil)
 	if err != nil {
-		return workspaceID, err
-	}
-	if http.StatusOK != resp.StatusCode {
-		return workspaceID, fmt.Errorf("GET workspace failed %d", resp.StatusCode)
+		return 0, err
 	}
-
 	var response workspaceResponse
 	if err := json.Unmarshal(b, &response); err != nil {
-		return workspaceID, err
+		return 0, err
+	}
+	if response.Workspace == nil {
+		return 0, fmt.Errorf("GET workspace returned no workspace")
 	}
-
 	return response.Workspace.ID, nil
 }
 
-func postPipesAPI(APIToken, pipeID string, payload interface{}) ([]byte, error) {
-	start := time.Now()
-	url := fmt.Sprintf("%s/api/pipes/%s", urls.TogglAPIHost[environment], pipeID)
-	b, err := json.Marshal(payload)
-	if err != nil {
-		return nil, err
-	}
-	buf := bytes.NewBuffer(b)
-	req, err := http.NewRequest("POST", url, buf)
-	if err != nil {
-		return nil, err
-	}
-	req.Header.Set("User-Agent", "toggl-pipes")
-	req.SetBasicAuth(APIToken, "api_token")
-	client := &http.Client{}
-	resp, err := client.Do(req)
-	if err != nil {
-		return nil, err
-	}
-	defer resp.Body.Close()
-	b, err = ioutil.ReadAll(resp.Body)
-	if err != nil {
-		return nil, err
-	}
-	if 200 != resp.StatusCode {
-		return b, fmt.Errorf("%s failed with status code %d", url, resp.StatusCode)
-	}
-	log.Println("Toggl request", url, "time", time.Since(start))
-	return b, nil
+func (c *TogglClient) PostPipesAPI(ctx context.Context, APIToken, pipeID string, payload interface{}) ([]byte, error) {
+	return c.do(ctx, "POST", "/api/pipes/"+pipeID, APIToken, payload)
 }
@@ -0,0 +1,309 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func newTestTogglClient(handler http.HandlerFunc) (*TogglClient, *httptest.Server) {
+	ts := httptest.NewServer(handler)
+	c := NewTogglClientWithHost(ts.URL)
+	c.retryDelay = 0
+	return c, ts
+}
+
+func TestTogglClientRetriesServerErrors(t *testing.T) {
+	var requests int
+	requestIDs := make(map[string]bool)
+	c, ts := newTestTogglClient(func(w http.ResponseWriter, r *http.Request) {
+		requests++
+		requestIDs[r.Header.Get("X-Request-ID")] = true
+		if requests < 3 {
+			w.WriteHeader(http.StatusBadGateway)
+			return
+		}
+		w.Write([]byte(`{"data":{"id":5}}`))
+	})
+	defer ts.Close()
+
+	workspaceID, err := c.GetWorkspaceID(context.Background(), "token")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if workspaceID != 5 {
+		t.Fatalf("expected workspace 5, got %d", workspaceID)
+	}
+	if requests != 3 {
+		t.Fatalf("expected 3 requests, got %d", requests)
+	}
+	if len(requestIDs) != 1 || requestIDs[""] {
+		t.Fatalf("expected retries to reuse one request ID, got %v", requestIDs)
+	}
+}
+
+func TestTogglClientDoesNotRetrySentPosts(t *testing.T) {
+	var requests int
+	c, ts := newTestTogglClient(func(w http.ResponseWriter, r *http.Request) {
+		requests++
+		if r.Header.Get("Idempotency-Key") == "" {
+			t.Error("expected idempotency key")
+		}
+		w.WriteHeader(http.StatusBadGateway)
+	})
+	defer ts.Close()
+
+	if _, err := c.PostPipesAPI(context.Background(), "token", usersPipeID, usersRequest{}); err == nil {
+		t.Fatal("expected error")
+	}
+	if requests != 1 {
+		t.Fatalf("expected POST which may be imported not to be retried, got %d requests", requests)
+	}
+}
+
+func TestTogglClientRetriesUnsentPosts(t *testing.T) {
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	ts.Close()
+	c := NewTogglClientWithHost(ts.URL)
+	c.retryDelay = 0
+
+	_, err := c.PostPipesAPI(context.Background(), "token", usersPipeID, usersRequest{})
+	if err == nil {
+		t.Fatal("expected error")
+	}
+	if !requestNotSent(err) {
+		t.Errorf("expected refused connection to be a request that was not sent, got %v", err)
+	}
+	if requestNotSent(&net.OpError{Op: "read", Err: errors.New("connection reset by peer")}) {
+		t.Error("expected read error to be a request that may have been sent")
+	}
+}
+
+func TestTogglClientHonoursRetryAfter(t *testing.T) {
+	var requests []time.Time
+	retryAfter := "1"
+	c, ts := newTestTogglClient(func(w http.ResponseWriter, r *http.Request) {
+		requests = append(requests, time.Now())
+		if len(requests) == 1 {
+			w.Header().Set("Retry-After", retryAfter)
+			w.WriteHeader(http.StatusTooManyRequests)
+			return
+		}
+		w.Write([]byte(`{"data":{"id":5}}`))
+	})
+	defer ts.Close()
+
+	if _, err := c.GetWorkspaceID(context.Background(), "token"); err != nil {
+		t.Fatal(err)
+	}
+	if len(requests) != 2 || requests[1].Sub(requests[0]) < time.Second {
+		t.Fatalf("expected retry after a second, got %d requests", len(requests))
+	}
+
+	requests, retryAfter = nil, "3600"
+	if _, err := c.GetWorkspaceID(context.Background(), "token"); classifyError(err).Code != errorCodeRateLimited {
+		t.Fatalf("expected rate limited error, got %v", err)
+	}
+	if len(requests) != 1 {
+		t.Fatalf("expected no retry when asked to wait an hour, got %d requests", len(requests))
+	}
+}
+
+func TestTogglClientStopsRetryingWithContext(t *testing.T) {
+	c, ts := newTestTogglClient(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusServiceUnavailable)
+	})
+	defer ts.Close()
+	c.retryDelay = time.Minute
+
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	start := time.Now()
+	if _, err := c.GetWorkspaceID(ctx, "token"); err != context.DeadlineExceeded {
+		t.Errorf("expected retries to end with context, got %v", err)
+	}
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Errorf("expected backoff to stop when context is done, took %s", elapsed)
+	}
+}
+
+func TestTogglClientGivesPostsLongerDeadline(t *testing.T) {
+	c, ts := newTestTogglClient(func(w http.ResponseWriter, r *http.Request) {
+		time.Sleep(100 * time.Millisecond)
+		w.Write([]byte(`{}`))
+	})
+	defer ts.Close()
+	c.maxRetries = 0
+	c.timeout, c.postTimeout = 20*time.Millisecond, 5*time.Second
+
+	if _, err := c.GetWorkspaceID(context.Background(), "token"); !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("expected slow GET to time out, got %v", err)
+	}
+	// slow imports must not time out while Toggl still saves them
+	if _, err := c.PostPipesAPI(context.Background(), "token", "projects", projectRequest{}); err != nil {
+		t.Errorf("expected slow POST to finish, got %v", err)
+	}
+}
+
+func TestTogglClientReturnsAPIError(t *testing.T) {
+	var requests int
+	c, ts := newTestTogglClient(func(w http.ResponseWriter, r *http.Request) {
+		requests++
+		w.WriteHeader(http.StatusBadRequest)
+		w.Write([]byte(`invalid project`))
+	})
+	defer ts.Close()
+
+	_, err := c.PostPipesAPI(context.Background(), "token", projectsPipeID, nil)
+	var apiErr *TogglAPIError
+	if !errors.As(err, &apiErr) {
+		t.Fatalf("expected TogglAPIError, got %v", err)
+	}
+	if apiErr.StatusCode != http.StatusBadRequest || string(apiErr.Body) != "invalid project" {
+		t.Fatalf("unexpected error %v", apiErr)
+	}
+	if requests != 1 {
+		t.Fatalf("expected client errors not to be retried, got %d requests", requests)
+	}
+}
+
+func TestFakeTogglAPIMatchesProjectsByName(t *testing.T) {
+	api := newFakeTogglAPI(workspaceID)
+	defer api.Close()
+	defer api.use()()
+
+	existing := api.addProject("Website")
+
+	b, err := togglClient.PostPipesAPI(context.Background(), "token", projectsPipeID, projectRequest{Projects: []*Project{
+		{Name: " website ", ForeignID: "1"},
+		{Name: "Mobile app", ForeignID: "2"},
+		{Name: " ", ForeignID: "3"},
+	}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	var projectsImport ProjectsImport
+	if err := json.Unmarshal(b, &projectsImport); err != nil {
+		t.Fatal(err)
+	}
+	if projectsImport.Count() != 2 {
+		t.Fatalf("expected 2 imported projects, got %d", projectsImport.Count())
+	}
+	if projectsImport.Projects[0].ID != existing.ID {
+		t.Errorf("expected project to be matched by name to %d, got %d", existing.ID, projectsImport.Projects[0].ID)
+	}
+	if projectsImport.Projects[1].ID == existing.ID || projectsImport.Projects[1].ForeignID != "2" {
+		t.Errorf("expected new project to be created, got %+v", projectsImport.Projects[1])
+	}
+	if len(projectsImport.Notifications) != 1 {
+		t.Errorf("expected notification about blank project name, got %v", projectsImport.Notifications)
+	}
+}
+
+func TestFakeTogglAPIWorkspaceAndTimeEntries(t *testing.T) {
+	api := newFakeTogglAPI(workspaceID)
+	defer api.Close()
+	defer api.use()()
+
+	id, err := togglClient.GetWorkspaceID(context.Background(), "token")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if id != workspaceID {
+		t.Fatalf("expected workspace %d, got %d", workspaceID, id)
+	}
+
+	project := api.addProject("Website")
+	kept := api.addTimeEntry(TimeEntry{UserID: 10, ProjectID: project.ID})
+	removed := api.addTimeEntry(TimeEntry{UserID: 10, ProjectID: project.ID})
+	api.addTimeEntry(TimeEntry{UserID: 11, ProjectID: project.ID})
+	api.deleteTimeEntry(removed.ID)
+
+	timeEntries, err := togglClient.GetTimeEntries(context.Background(), "token", time.Now(), []int{10}, []int{project.ID})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(timeEntries) != 1 || timeEntries[0].ID != kept.ID {
+		t.Fatalf("expected only time entry %d, got %+v", kept.ID, timeEntries)
+	}
+
+	changes, err := togglClient.GetTimeEntryChanges(context.Background(), "token", time.Now(), []int{kept.ID, removed.ID})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(changes.Deleted) != 1 || changes.Deleted[0] != removed.ID {
+		t.Fatalf("expected time entry %d to be deleted, got %v", removed.ID, changes.Deleted)
+	}
+}
+
+func TestGetTimeEntryChangesInChunks(t *testing.T) {
+	api := newFakeTogglAPI(workspaceID)
+	defer api.Close()
+	defer api.use()()
+
+	var ids []int
+	for i := 0; i < 2*togglAPIMaxIDsPerRequest+50; i++ {
+		ids = append(ids, api.addTimeEntry(TimeEntry{UserID: 10}).ID)
+	}
+	// one deleted entry in each chunk
+	deleted := []int{ids[0], ids[togglAPIMaxIDsPerRequest], ids[len(ids)-1]}
+	for _, id := range deleted {
+		api.deleteTimeEntry(id)
+	}
+
+	changes, err := togglClient.GetTimeEntryChanges(context.Background(), "token", time.Now(), ids)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n := api.requestCount("/api/pipes/time_entries/changes"); n != 3 {
+		t.Errorf("expected 3 requests, got %d", n)
+	}
+	if len(changes.Deleted) != len(deleted) {
+		t.Errorf("expected changes of all requests, got %v", changes.Deleted)
+	}
+}
+
+func TestPostProjectsWithFakeTogglAPI(t *testing.T) {
+	db = connectDB(testDBConnString)
+	api := newFakeTogglAPI(workspaceID)
+	defer api.Close()
+	defer api.use()()
+
+	existing := api.addProject(strings.TrimSpace(p1Name))
+
+	p := NewPipe(workspaceID, TestServiceName, projectsPipeID)
+	p.authorization = &Authorization{WorkspaceToken: "token"}
+	if err := p.NewStatus(); err != nil {
+		t.Fatal(err)
+	}
+	if err := p.fetchObjects(false); err != nil {
+		t.Fatal(err)
+	}
+	if err := p.postObjects(false); err != nil {
+		t.Fatal(err)
+	}
+
+	s, err := p.Service()
+	if err != nil {
+		t.Fatal(err)
+	}
+	connection, err := loadConnection(s, projectsPipeID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(connection.Data) != 4 {
+		t.Fatalf("expected 4 connected projects, got %v", connection.Data)
+	}
+	if connection.Data["1"] != existing.ID {
+		t.Errorf("expected project to be connected to existing project %d, got %d", existing.ID, connection.Data["1"])
+	}
+	if api.requestCount("/api/pipes/projects") != 1 {
+		t.Errorf("expected one projects request, got %d", api.requestCount("/api/pipes/projects"))
+	}
+}
@@ -0,0 +1,109 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"os"
+
+	"go.opentelemetry.io/otel/api/global"
+	"go.opentelemetry.io/otel/api/kv"
+	"go.opentelemetry.io/otel/api/standard"
+	"go.opentelemetry.io/otel/api/trace"
+	"go.opentelemetry.io/otel/exporters/otlp"
+	"go.opentelemetry.io/otel/exporters/trace/stdout"
+	"go.opentelemetry.io/otel/instrumentation/othttp"
+	"go.opentelemetry.io/otel/sdk/resource"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"google.golang.org/grpc/codes"
+)
+
+const tracerName = "github.com/toggl/pipes-api"
+
+// initTracing configures trace exporter selected with trace_exporter flag,
+// returned function flushes and stops the exporter.
+func initTracing() (func(), error) {
+	var options []sdktrace.ProviderOption
+	stop := func() {}
+
+	switch traceExporter {
+	case "", "none":
+		return stop, nil
+	case "stdout", "file":
+		exporterOptions := stdout.Options{}
+		if traceExporter == "file" {
+			f, err := os.OpenFile(traceFile, os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0644)
+			if err != nil {
+				return nil, err
+			}
+			exporterOptions.Writer = f
+			stop = func() { f.Close() }
+		}
+		exporter, err := stdout.NewExporter(exporterOptions)
+		if err != nil {
+			return nil, err
+		}
+		options = append(options, sdktrace.WithSyncer(exporter))
+	case "otlp":
+		exporter, err := otlp.NewExporter(otlp.WithInsecure(), otlp.WithAddress(traceOTLPAddress))
+		if err != nil {
+			return nil, err
+		}
+		options = append(options, sdktrace.WithBatcher(exporter))
+		stop = func() { exporter.Stop() }
+	default:
+		return nil, fmt.Errorf("unknown trace exporter %q, expected none, stdout, file or otlp", traceExporter)
+	}
+
+	options = append(options,
+		sdktrace.WithConfig(sdktrace.Config{DefaultSampler: sdktrace.ProbabilitySampler(traceSampleRatio)}),
+		sdktrace.WithResource(resource.New(
+			standard.ServiceNameKey.String("pipes-api"),
+			kv.String("environment", environment),
+		)),
+	)
+	provider, err := sdktrace.NewProvider(options...)
+	if err != nil {
+		return nil, err
+	}
+	global.SetTraceProvider(provider)
+	return stop, nil
+}
+
+func startSpan(ctx context.Context, name string, attrs ...kv.KeyValue) (context.Context, trace.Span) {
+	return global.Tracer(tracerName).Start(ctx, name, trace.WithAttributes(attrs...))
+}
+
+// endSpan ends the span and marks it failed if err is set
+func endSpan(ctx context.Context, span trace.Span, err error) {
+	if err != nil {
+		span.RecordError(ctx, err, trace.WithErrorStatus(codes.Internal))
+	}
+	span.End()
+}
+
+// detachedContext keeps span of ctx but not its cancellation, used
+// for work that outlives the request which started it
+func detachedContext(ctx context.Context) context.Context {
+	return trace.ContextWithSpan(context.Background(), trace.SpanFromContext(ctx))
+}
+
+func hasSpan(ctx context.Context) bool {
+	return trace.SpanFromContext(ctx).SpanContext().IsValid()
+}
+
+// tracedTransport creates client spans for outgoing requests
+// and propagates trace context in request headers
+func tracedTransport(next http.RoundTripper) http.RoundTripper {
+	return othttp.NewTransport(next, othttp.WithSpanNameFormatter(func(_ string, r *http.Request) string {
+		return "HTTP " + r.Method + " " + r.URL.Host
+	}))
+}
+
+func pipeAttributes(p *Pipe) []kv.KeyValue {
+	return []kv.KeyValue{
+		kv.Int("workspace.id", p.workspaceID),
+		kv.String("service", p.serviceID),
+		kv.String("pipe", p.ID),
+	}
+}
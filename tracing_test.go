@@ -0,0 +1,93 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+
+	"go.opentelemetry.io/otel/api/global"
+	"go.opentelemetry.io/otel/api/trace"
+	export "go.opentelemetry.io/otel/sdk/export/trace"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+)
+
+type recordedSpans struct {
+	mu    sync.Mutex
+	spans []*export.SpanData
+}
+
+func (r *recordedSpans) ExportSpan(_ context.Context, span *export.SpanData) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.spans = append(r.spans, span)
+}
+
+// recordTraces installs trace provider recording all spans,
+// returned function restores the previous provider
+func recordTraces(t *testing.T) (*recordedSpans, func()) {
+	recorded := &recordedSpans{}
+	provider, err := sdktrace.NewProvider(
+		sdktrace.WithSyncer(recorded),
+		sdktrace.WithConfig(sdktrace.Config{DefaultSampler: sdktrace.AlwaysSample()}),
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+	previous := global.TraceProvider()
+	global.SetTraceProvider(provider)
+	return recorded, func() { global.SetTraceProvider(previous) }
+}
+
+func TestTogglClientPropagatesTraceContext(t *testing.T) {
+	_, restore := recordTraces(t)
+	defer restore()
+
+	var traceparent string
+	c, ts := newTestTogglClient(func(w http.ResponseWriter, r *http.Request) {
+		traceparent = r.Header.Get("traceparent")
+		w.Write([]byte(`{"data":{"id":1}}`))
+	})
+	defer ts.Close()
+
+	ctx, span := startSpan(context.Background(), "test")
+	if _, err := c.GetWorkspaceID(ctx, "token"); err != nil {
+		t.Fatal(err)
+	}
+	span.End()
+
+	traceID := span.SpanContext().TraceID.String()
+	if traceparent == "" || traceparent[3:35] != traceID {
+		t.Fatalf("expected traceparent of trace %s, got %q", traceID, traceparent)
+	}
+}
+
+func TestProviderRequestsAreTracedInPipeRun(t *testing.T) {
+	recorded, restore := recordTraces(t)
+	defer restore()
+
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	defer ts.Close()
+
+	ctx, span := startSpan(context.Background(), "pipe.run")
+	service := &TestService{workspaceID: workspaceID}
+	service.setContext(ctx)
+
+	resp, err := rateLimitedClient(service, http.DefaultTransport).Get(ts.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	span.End()
+
+	parentID := span.SpanContext().SpanID
+	recorded.mu.Lock()
+	defer recorded.mu.Unlock()
+	for _, s := range recorded.spans {
+		if s.ParentSpanID == parentID && s.SpanKind == trace.SpanKindClient {
+			return
+		}
+	}
+	t.Fatalf("expected provider request span with pipe run as parent, got %d spans", len(recorded.spans))
+}
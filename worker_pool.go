@@ -0,0 +1,101 @@
+package main
+
+import (
+	"fmt"
+	"runtime/debug"
+	"sync"
+	"time"
+)
+
+var workerRestartDelay = 5 * time.Second
+
+// WorkerFunc runs until stop is closed
+type WorkerFunc func(id int, stop <-chan struct{})
+
+// WorkerPool keeps the requested number of workers running,
+// a worker that panics is reported and restarted.
+type WorkerPool struct {
+	name string
+	work WorkerFunc
+
+	mu      sync.Mutex
+	workers []chan struct{}
+	nextID  int
+	wg      sync.WaitGroup
+}
+
+func NewWorkerPool(name string, work WorkerFunc) *WorkerPool {
+	return &WorkerPool{name: name, work: work}
+}
+
+// Resize starts or stops workers to match the given size,
+// stopped workers finish their current pipe and put the rest of
+// their batch back to queue before exiting
+func (wp *WorkerPool) Resize(size int) {
+	wp.mu.Lock()
+	defer wp.mu.Unlock()
+
+	for len(wp.workers) < size {
+		stop := make(chan struct{})
+		wp.workers = append(wp.workers, stop)
+		wp.wg.Add(1)
+		go wp.supervise(wp.nextID, stop)
+		wp.nextID++
+	}
+	for len(wp.workers) > size {
+		last := len(wp.workers) - 1
+		close(wp.workers[last])
+		wp.workers = wp.workers[:last]
+	}
+	logger.Info("worker pool resized", Fields{"pool": wp.name, "workers": len(wp.workers)})
+}
+
+func (wp *WorkerPool) Size() int {
+	wp.mu.Lock()
+	defer wp.mu.Unlock()
+	return len(wp.workers)
+}
+
+// Stop stops all workers and waits for them to exit
+func (wp *WorkerPool) Stop() {
+	wp.Resize(0)
+	wp.wg.Wait()
+}
+
+func (wp *WorkerPool) supervise(id int, stop <-chan struct{}) {
+	defer wp.wg.Done()
+	for wp.runWorker(id, stop) {
+		logger.Warn("worker died, restarting", Fields{"pool": wp.name, "worker": id, "restart_delay": workerRestartDelay.String()})
+		select {
+		case <-stop:
+			return
+		case <-time.After(workerRestartDelay):
+		}
+	}
+	logger.Info("worker stopped", Fields{"pool": wp.name, "worker": id})
+}
+
+// runWorker returns true if worker exited because of a panic
+func (wp *WorkerPool) runWorker(id int, stop <-chan struct{}) (panicked bool) {
+	defer func() {
+		if r := recover(); r != nil {
+			panicked = true
+			reportError(fmt.Errorf("%s %d panicked: %v", wp.name, id, r), workerErrorMetadata(wp.name, Fields{
+				"id":    id,
+				"stack": string(debug.Stack()),
+			}))
+		}
+	}()
+	wp.work(id, stop)
+	return false
+}
+
+// sleepOrStop sleeps for given duration, returns false if stopped meanwhile
+func sleepOrStop(duration time.Duration, stop <-chan struct{}) bool {
+	select {
+	case <-stop:
+		return false
+	case <-time.After(duration):
+		return true
+	}
+}
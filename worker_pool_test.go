@@ -0,0 +1,98 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sync/atomic"
+	"syscall"
+	"testing"
+	"time"
+)
+
+func TestWorkerPoolRestartsPanickedWorker(t *testing.T) {
+	defer func(d time.Duration) { workerRestartDelay = d }(workerRestartDelay)
+	workerRestartDelay = time.Millisecond
+
+	var runs int32
+	pool := NewWorkerPool("Test", func(id int, stop <-chan struct{}) {
+		if atomic.AddInt32(&runs, 1) == 1 {
+			panic("worker failure")
+		}
+		<-stop
+	})
+	pool.Resize(1)
+
+	deadline := time.Now().Add(time.Second)
+	for atomic.LoadInt32(&runs) < 2 && time.Now().Before(deadline) {
+		time.Sleep(time.Millisecond)
+	}
+	if atomic.LoadInt32(&runs) != 2 {
+		t.Fatalf("expected worker to be restarted once, got %d runs", runs)
+	}
+	pool.Stop()
+}
+
+func TestWorkerPoolResize(t *testing.T) {
+	var running int32
+	pool := NewWorkerPool("Test", func(id int, stop <-chan struct{}) {
+		atomic.AddInt32(&running, 1)
+		defer atomic.AddInt32(&running, -1)
+		<-stop
+	})
+
+	pool.Resize(3)
+	if pool.Size() != 3 {
+		t.Errorf("expected pool size 3, got %d", pool.Size())
+	}
+	pool.Resize(1)
+	if pool.Size() != 1 {
+		t.Errorf("expected pool size 1, got %d", pool.Size())
+	}
+	pool.Stop()
+	if atomic.LoadInt32(&running) != 0 {
+		t.Errorf("expected all workers to exit, %d still running", running)
+	}
+}
+
+func TestWorkersConfig(t *testing.T) {
+	dir, err := ioutil.TempDir("", "workers")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	defer func(dir string, count int) { workdir, workersCount = dir, count }(workdir, workersCount)
+	workdir, workersCount = dir, 4
+
+	if count := startWorkersCount(); count != 4 {
+		t.Errorf("expected workers_count flag without config, got %d", count)
+	}
+	if err := os.Mkdir(filepath.Join(dir, "config"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	config := filepath.Join(dir, "config", "workers.json")
+	if err := ioutil.WriteFile(config, []byte(`{"workers_count": 2}`), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if count := startWorkersCount(); count != 2 {
+		t.Errorf("expected pool to start with size of config, got %d", count)
+	}
+
+	pool := NewWorkerPool("Test", func(id int, stop <-chan struct{}) { <-stop })
+	defer pool.Stop()
+	signals := make(chan os.Signal)
+	go watchWorkersConfig(pool, signals)
+	if err := ioutil.WriteFile(config, []byte(`{"workers_count": 3}`), 0644); err != nil {
+		t.Fatal(err)
+	}
+	signals <- syscall.SIGHUP
+	close(signals)
+
+	deadline := time.Now().Add(time.Second)
+	for pool.Size() != 3 && time.Now().Before(deadline) {
+		time.Sleep(time.Millisecond)
+	}
+	if pool.Size() != 3 {
+		t.Errorf("expected pool to be resized on SIGHUP, got %d", pool.Size())
+	}
+}
@@ -0,0 +1,170 @@
+package main
+
+import (
+	"container/list"
+	"context"
+	"crypto/sha256"
+	"errors"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// cache metrics are registered with the other metrics of /metrics
+var (
+	workspaceCacheHits = prometheus.NewCounter(prometheus.CounterOpts{
+		Name: "pipes_workspace_cache_hits_total",
+		Help: "Workspace cache hits.",
+	})
+	workspaceCacheStaleHits = prometheus.NewCounter(prometheus.CounterOpts{
+		Name: "pipes_workspace_cache_stale_hits_total",
+		Help: "Workspace cache hits served while refreshed.",
+	})
+	workspaceCacheMisses = prometheus.NewCounter(prometheus.CounterOpts{
+		Name: "pipes_workspace_cache_misses_total",
+		Help: "Workspace cache misses.",
+	})
+	workspaceCacheEvictions = prometheus.NewCounter(prometheus.CounterOpts{
+		Name: "pipes_workspace_cache_evictions_total",
+		Help: "Workspace cache evictions.",
+	})
+)
+
+var workspaceCache = NewWorkspaceCache(10000, 5*time.Minute, 0, lookupWorkspaceID)
+
+func lookupWorkspaceID(ctx context.Context, APIToken string) (int, error) {
+	return togglClient.GetWorkspaceID(ctx, APIToken)
+}
+
+type workspaceLookupFunc func(ctx context.Context, APIToken string) (int, error)
+
+// WorkspaceCache caches workspace IDs of Toggl API tokens, so that
+// authenticated requests don't have to ask Toggl API every time.
+// Least recently used tokens are evicted when the cache is full.
+type WorkspaceCache struct {
+	mu         sync.Mutex
+	size       int
+	ttl        time.Duration
+	staleTTL   time.Duration // how long expired entries may be served while refreshed
+	lookup     workspaceLookupFunc
+	entries    map[[sha256.Size]byte]*list.Element
+	lru        *list.List
+	refreshing map[[sha256.Size]byte]bool
+}
+
+type workspaceCacheEntry struct {
+	key         [sha256.Size]byte
+	workspaceID int
+	expiresAt   time.Time
+}
+
+func NewWorkspaceCache(size int, ttl, staleTTL time.Duration, lookup workspaceLookupFunc) *WorkspaceCache {
+	return &WorkspaceCache{
+		size:       size,
+		ttl:        ttl,
+		staleTTL:   staleTTL,
+		lookup:     lookup,
+		entries:    make(map[[sha256.Size]byte]*list.Element),
+		lru:        list.New(),
+		refreshing: make(map[[sha256.Size]byte]bool),
+	}
+}
+
+// cacheKey hashes the token so that tokens are not kept in memory
+func cacheKey(APIToken string) [sha256.Size]byte {
+	return sha256.Sum256([]byte(APIToken))
+}
+
+// workspaceID returns workspace ID of the token from cache or Toggl API.
+// With stale TTL set, expired entry is returned while it is refreshed
+// in background.
+func (c *WorkspaceCache) workspaceID(ctx context.Context, APIToken string) (int, error) {
+	key := cacheKey(APIToken)
+	now := time.Now()
+
+	c.mu.Lock()
+	if element, found := c.entries[key]; found {
+		entry := element.Value.(*workspaceCacheEntry)
+		if now.Before(entry.expiresAt) {
+			c.lru.MoveToFront(element)
+			c.mu.Unlock()
+			workspaceCacheHits.Inc()
+			return entry.workspaceID, nil
+		}
+		if now.Before(entry.expiresAt.Add(c.staleTTL)) {
+			c.lru.MoveToFront(element)
+			if !c.refreshing[key] {
+				c.refreshing[key] = true
+				go c.refresh(APIToken, key)
+			}
+			c.mu.Unlock()
+			workspaceCacheStaleHits.Inc()
+			return entry.workspaceID, nil
+		}
+	}
+	c.mu.Unlock()
+
+	workspaceCacheMisses.Inc()
+	return c.load(ctx, APIToken, key)
+}
+
+func (c *WorkspaceCache) refresh(APIToken string, key [sha256.Size]byte) {
+	defer func() {
+		c.mu.Lock()
+		delete(c.refreshing, key)
+		c.mu.Unlock()
+	}()
+	c.load(context.Background(), APIToken, key)
+}
+
+func (c *WorkspaceCache) load(ctx context.Context, APIToken string, key [sha256.Size]byte) (int, error) {
+	workspaceID, err := c.lookup(ctx, APIToken)
+	if err != nil {
+		if isUnauthorized(err) {
+			c.invalidate(APIToken)
+		}
+		return 0, err
+	}
+	c.set(key, workspaceID)
+	return workspaceID, nil
+}
+
+func (c *WorkspaceCache) set(key [sha256.Size]byte, workspaceID int) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	entry := &workspaceCacheEntry{key: key, workspaceID: workspaceID, expiresAt: time.Now().Add(c.ttl)}
+	if element, found := c.entries[key]; found {
+		element.Value = entry
+		c.lru.MoveToFront(element)
+		return
+	}
+	c.entries[key] = c.lru.PushFront(entry)
+	for c.lru.Len() > c.size {
+		oldest := c.lru.Back()
+		c.lru.Remove(oldest)
+		delete(c.entries, oldest.Value.(*workspaceCacheEntry).key)
+		workspaceCacheEvictions.Inc()
+	}
+}
+
+// invalidate removes the token from cache, used when Toggl API rejects it
+func (c *WorkspaceCache) invalidate(APIToken string) {
+	key := cacheKey(APIToken)
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if element, found := c.entries[key]; found {
+		c.lru.Remove(element)
+		delete(c.entries, key)
+	}
+}
+
+func isUnauthorized(err error) bool {
+	var apiErr *TogglAPIError
+	if !errors.As(err, &apiErr) {
+		return false
+	}
+	return apiErr.StatusCode == http.StatusUnauthorized || apiErr.StatusCode == http.StatusForbidden
+}
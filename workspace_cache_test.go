@@ -0,0 +1,100 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+func countingLookup(calls *int32, err error) workspaceLookupFunc {
+	return func(ctx context.Context, APIToken string) (int, error) {
+		atomic.AddInt32(calls, 1)
+		if err != nil {
+			return 0, err
+		}
+		return len(APIToken), nil
+	}
+}
+
+func TestWorkspaceCacheHitAndExpiry(t *testing.T) {
+	var calls int32
+	c := NewWorkspaceCache(10, 20*time.Millisecond, 0, countingLookup(&calls, nil))
+
+	hits, misses := testutil.ToFloat64(workspaceCacheHits), testutil.ToFloat64(workspaceCacheMisses)
+	for i := 0; i < 3; i++ {
+		id, err := c.workspaceID(context.Background(), "token")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if id != 5 {
+			t.Fatalf("expected workspace 5, got %d", id)
+		}
+	}
+	if calls != 1 {
+		t.Fatalf("expected one lookup, got %d", calls)
+	}
+	if testutil.ToFloat64(workspaceCacheHits)-hits != 2 || testutil.ToFloat64(workspaceCacheMisses)-misses != 1 {
+		t.Fatalf("expected 2 hits and 1 miss")
+	}
+
+	time.Sleep(30 * time.Millisecond)
+	if _, err := c.workspaceID(context.Background(), "token"); err != nil {
+		t.Fatal(err)
+	}
+	if calls != 2 {
+		t.Fatalf("expected expired entry to be looked up again, got %d lookups", calls)
+	}
+}
+
+func TestWorkspaceCacheEvictsLeastRecentlyUsed(t *testing.T) {
+	var calls int32
+	c := NewWorkspaceCache(2, time.Minute, 0, countingLookup(&calls, nil))
+
+	c.workspaceID(context.Background(), "a")
+	c.workspaceID(context.Background(), "b")
+	c.workspaceID(context.Background(), "a")
+	c.workspaceID(context.Background(), "c")
+	if _, found := c.entries[cacheKey("b")]; found {
+		t.Fatal("expected least recently used token to be evicted")
+	}
+	c.workspaceID(context.Background(), "a")
+	if calls != 3 {
+		t.Fatalf("expected 3 lookups, got %d", calls)
+	}
+}
+
+func TestWorkspaceCacheStaleWhileRevalidate(t *testing.T) {
+	var calls int32
+	c := NewWorkspaceCache(10, time.Millisecond, time.Minute, countingLookup(&calls, nil))
+
+	c.workspaceID(context.Background(), "token")
+	time.Sleep(5 * time.Millisecond)
+	if id, err := c.workspaceID(context.Background(), "token"); err != nil || id != 5 {
+		t.Fatalf("expected stale workspace, got %d %v", id, err)
+	}
+
+	deadline := time.Now().Add(time.Second)
+	for atomic.LoadInt32(&calls) < 2 && time.Now().Before(deadline) {
+		time.Sleep(time.Millisecond)
+	}
+	if atomic.LoadInt32(&calls) != 2 {
+		t.Fatalf("expected stale entry to be refreshed in background")
+	}
+}
+
+func TestWorkspaceCacheInvalidatedOnUnauthorized(t *testing.T) {
+	var calls int32
+	c := NewWorkspaceCache(10, time.Millisecond, time.Minute, countingLookup(&calls, &TogglAPIError{StatusCode: http.StatusForbidden}))
+	c.set(cacheKey("token"), 1)
+
+	if _, err := c.load(context.Background(), "token", cacheKey("token")); !isUnauthorized(err) {
+		t.Fatalf("expected unauthorized error, got %v", err)
+	}
+	if _, found := c.entries[cacheKey("token")]; found {
+		t.Fatal("expected rejected token to be removed from cache")
+	}
+}
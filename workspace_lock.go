@@ -0,0 +1,52 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+)
+
+// workspaceLockNamespace is the first key of the advisory lock pair,
+// so workspace locks don't clash with other advisory locks in the DB
+const workspaceLockNamespace = 1
+
+const (
+	tryWorkspaceLockSQL = `SELECT pg_try_advisory_lock($1, $2)`
+	workspaceUnlockSQL  = `SELECT pg_advisory_unlock($1, $2)`
+)
+
+// ErrWorkspaceLocked is returned when a pipe is already running for the workspace
+var ErrWorkspaceLocked = errors.New("A pipe is already running for this workspace, please try again later")
+
+// WorkspaceLock is a session level Postgres advisory lock, it is held
+// on a dedicated connection so that it is visible to all API instances
+// and background workers until unlocked or the connection is dropped.
+type WorkspaceLock struct {
+	workspaceID int
+	conn        *sql.Conn
+}
+
+func tryLockWorkspace(workspaceID int) (*WorkspaceLock, error) {
+	ctx := context.Background()
+	conn, err := db.Conn(ctx)
+	if err != nil {
+		return nil, err
+	}
+	var locked bool
+	err = conn.QueryRowContext(ctx, tryWorkspaceLockSQL, workspaceLockNamespace, workspaceID).Scan(&locked)
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	if !locked {
+		conn.Close()
+		return nil, ErrWorkspaceLocked
+	}
+	return &WorkspaceLock{workspaceID: workspaceID, conn: conn}, nil
+}
+
+func (l *WorkspaceLock) unlock() error {
+	defer l.conn.Close()
+	_, err := l.conn.ExecContext(context.Background(), workspaceUnlockSQL, workspaceLockNamespace, l.workspaceID)
+	return err
+}
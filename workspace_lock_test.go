@@ -0,0 +1,33 @@
+package main
+
+import "testing"
+
+func TestTryLockWorkspace_RejectsConcurrentLock(t *testing.T) {
+	db = connectDB(testDBConnString)
+
+	lock, err := tryLockWorkspace(workspaceID)
+	if err != nil {
+		t.Fatalf("Unexpected error %v", err)
+	}
+
+	if _, err := tryLockWorkspace(workspaceID); err != ErrWorkspaceLocked {
+		t.Fatalf("second lock expected to get %v, but got %v", ErrWorkspaceLocked, err)
+	}
+
+	otherLock, err := tryLockWorkspace(workspaceID + 1)
+	if err != nil {
+		t.Fatalf("lock for other workspace got unexpected error %v", err)
+	}
+	if err := otherLock.unlock(); err != nil {
+		t.Fatalf("Unexpected error %v", err)
+	}
+
+	if err := lock.unlock(); err != nil {
+		t.Fatalf("Unexpected error %v", err)
+	}
+	lock, err = tryLockWorkspace(workspaceID)
+	if err != nil {
+		t.Fatalf("lock after unlock got unexpected error %v", err)
+	}
+	lock.unlock()
+}